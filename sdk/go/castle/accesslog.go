@@ -0,0 +1,171 @@
+package castle
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DefaultAccessLogFormat is the format of WithHTTPAccessLog without WithHTTPAccessLogFormat.
+const DefaultAccessLogFormat = `$client_ip [$time] "$method $path $proto" $status $bytes $duration`
+
+// accessLogBuffer is the number of the entries waiting to be logged,
+// the entries are dropped once it's full, so slow writers never block the requests.
+const accessLogBuffer = 1024
+
+// AccessLogEntry is a proxied http request, see WithHTTPAccessLog.
+type AccessLogEntry struct {
+	// Time is when the request is received.
+	Time   time.Time
+	Method string
+	// Path is the path and the query of the request as the user sent,
+	// before WithHTTPPathPrefix strips the prefix.
+	Path  string
+	Proto string
+	Host  string
+	// Status is the status code of the response, it's 0 if nothing is responded,
+	// e.g. the user goes away.
+	Status int
+	// Bytes is the size of the response body sent to the user.
+	Bytes int64
+	// Duration is until the whole response is sent, the streaming responses are logged once they end.
+	Duration  time.Duration
+	ClientIP  string
+	UserAgent string
+	// ConnectionID is the id of the connection assigned by the server, the same as Event.ConnectionID.
+	ConnectionID string
+}
+
+// accessLog logs the entries of the requests in a separate goroutine.
+type accessLog struct {
+	w       io.Writer
+	format  string
+	fn      func(AccessLogEntry)
+	entries chan AccessLogEntry
+}
+
+func newAccessLog(w io.Writer, format string, fn func(AccessLogEntry)) *accessLog {
+	if format == "" {
+		format = DefaultAccessLogFormat
+	}
+	return &accessLog{
+		w:       w,
+		format:  format,
+		fn:      fn,
+		entries: make(chan AccessLogEntry, accessLogBuffer),
+	}
+}
+
+// run logs the entries until the ctx is done, the buffered entries are logged before it returns.
+func (l *accessLog) run(ctx context.Context) {
+	for {
+		select {
+		case entry := <-l.entries:
+			l.log(entry)
+		case <-ctx.Done():
+			for {
+				select {
+				case entry := <-l.entries:
+					l.log(entry)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *accessLog) log(entry AccessLogEntry) {
+	if l.fn != nil {
+		l.fn(entry)
+	}
+	if l.w != nil {
+		io.WriteString(l.w, l.line(entry)+"\n")
+	}
+}
+
+// line expands the variables of the format, e.g. $method or ${method},
+// the unknown variables are expanded to "-".
+func (l *accessLog) line(entry AccessLogEntry) string {
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	return os.Expand(l.format, func(name string) string {
+		switch name {
+		case "time":
+			return entry.Time.Format(time.RFC3339)
+		case "method":
+			return entry.Method
+		case "path":
+			return entry.Path
+		case "proto":
+			return entry.Proto
+		case "host":
+			return orDash(entry.Host)
+		case "status":
+			return strconv.Itoa(entry.Status)
+		case "bytes":
+			return strconv.FormatInt(entry.Bytes, 10)
+		case "duration":
+			return entry.Duration.String()
+		case "duration_ms":
+			return strconv.FormatInt(entry.Duration.Milliseconds(), 10)
+		case "client_ip":
+			return orDash(entry.ClientIP)
+		case "user_agent":
+			return orDash(entry.UserAgent)
+		case "connection_id":
+			return orDash(entry.ConnectionID)
+		default:
+			return "-"
+		}
+	})
+}
+
+// middleware is the outermost one, so the requests rejected by the other middlewares are logged too.
+func (l *accessLog) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := AccessLogEntry{
+			Time:         start,
+			Method:       r.Method,
+			Path:         r.URL.RequestURI(),
+			Proto:        r.Proto,
+			Host:         r.Host,
+			UserAgent:    r.UserAgent(),
+			ClientIP:     clientIP(r),
+			ConnectionID: connectionID(r.Context()),
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		entry.Status = rec.status
+		entry.Bytes = rec.bytes
+		entry.Duration = time.Since(start)
+		select {
+		case l.entries <- entry:
+		default:
+		}
+	})
+}
+
+// clientIP is the address of the user told by the server, or the remote address of the request.
+func clientIP(r *http.Request) string {
+	if visitor, ok := r.Context().Value(visitorKey{}).(netip.Addr); ok {
+		return visitor.String()
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if _, err := netip.ParseAddr(host); err == nil {
+			return host
+		}
+	}
+	return ""
+}
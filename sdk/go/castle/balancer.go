@@ -0,0 +1,158 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// The strategies of WithTCPBalancer.
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceRandom           = "random"
+)
+
+// tcpUpstream is a local address which serves the connections of a tcp tunnel.
+type tcpUpstream struct {
+	addr string
+	// weight is of WithTCPWeightedUpstreams, 0 means no new connection.
+	weight  int
+	healthy atomic.Bool
+	active  atomic.Int64
+	total   atomic.Int64
+}
+
+// tcpBalancer balances the connections of a tcp tunnel across the upstreams.
+type tcpBalancer struct {
+	strategy  string
+	upstreams []*tcpUpstream
+	wrr       *weightedRoundRobin
+}
+
+func newTCPBalancer(addrs []string, weights []int, strategy string) (*tcpBalancer, error) {
+	switch strategy {
+	case "":
+		strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceRandom:
+	default:
+		return nil, fmt.Errorf("unsupported balancer strategy %q", strategy)
+	}
+	b := &tcpBalancer{strategy: strategy, wrr: newWeightedRoundRobin(weights)}
+	for i, addr := range addrs {
+		u := &tcpUpstream{addr: addr, weight: weights[i]}
+		u.healthy.Store(true)
+		b.upstreams = append(b.upstreams, u)
+	}
+	return b, nil
+}
+
+// order returns the upstreams in the order to try for a new connection, the first one is picked
+// by the strategy in proportion to the weights, and the drained ones are skipped.
+func (b *tcpBalancer) order() []*tcpUpstream {
+	n := len(b.upstreams)
+	start := -1
+	switch b.strategy {
+	case BalanceRoundRobin:
+		start = b.wrr.next(func(int) bool { return true })
+	case BalanceRandom:
+		total := 0
+		for _, u := range b.upstreams {
+			total += u.weight
+		}
+		if total > 0 {
+			r := rand.IntN(total)
+			for i, u := range b.upstreams {
+				if r < u.weight {
+					start = i
+					break
+				}
+				r -= u.weight
+			}
+		}
+	case BalanceLeastConnections:
+		// the fewest connections per weight.
+		for i, u := range b.upstreams {
+			if u.weight <= 0 {
+				continue
+			}
+			if start < 0 || u.active.Load()*int64(b.upstreams[start].weight) < b.upstreams[start].active.Load()*int64(u.weight) {
+				start = i
+			}
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+	order := make([]*tcpUpstream, 0, n)
+	for i := 0; i < n; i++ {
+		if u := b.upstreams[(start+i)%n]; u.weight > 0 {
+			order = append(order, u)
+		}
+	}
+	return order
+}
+
+// dial dials the upstreams one by one until one of them succeeds.
+func (b *tcpBalancer) dial(ctx context.Context, dialer *localDialer, onFail func(attempt int, err error)) (net.Conn, error) {
+	order := b.order()
+	if len(order) == 0 {
+		return nil, errors.New("all the upstreams are drained")
+	}
+	var errs []error
+	for _, u := range order {
+		conn, err := dialer.dial(ctx, "tcp", u.addr, onFail)
+		if err != nil {
+			u.healthy.Store(false)
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		u.healthy.Store(true)
+		u.active.Add(1)
+		u.total.Add(1)
+		return &upstreamConn{Conn: conn, upstream: u}, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (b *tcpBalancer) status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(b.upstreams))
+	for _, u := range b.upstreams {
+		status = append(status, UpstreamStatus{
+			Addr:        u.addr,
+			Healthy:     u.healthy.Load(),
+			Weight:      u.weight,
+			ActiveConns: int(u.active.Load()),
+			TotalConns:  int(u.total.Load()),
+		})
+	}
+	return status
+}
+
+// upstreamConn releases the slot of the upstream once it's closed.
+type upstreamConn struct {
+	net.Conn
+	upstream  *tcpUpstream
+	closeOnce sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.upstream.active.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+func (c *upstreamConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
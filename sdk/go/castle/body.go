@@ -0,0 +1,33 @@
+package castle
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+// maxRequestBody rejects the requests with the body larger than limit with 413,
+// rejected counts the rejected requests.
+//
+// The requests declaring a larger Content-Length are rejected before reaching the local server,
+// the other requests are cut off once the body exceeds limit while it's streamed,
+// the proxy responds 413 for them, see isBodyTooLarge.
+func maxRequestBody(limit int64, rejected *atomic.Int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				rejected.Add(1)
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isBodyTooLarge reports whether the request failed to be proxied because the body exceeds the limit.
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
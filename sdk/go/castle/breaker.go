@@ -0,0 +1,162 @@
+package castle
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultBreakerOpenDuration = 30 * time.Second
+
+// BreakerState is the state of the circuit breaker of WithHTTPCircuitBreaker.
+type BreakerState int
+
+const (
+	// BreakerClosed means the requests are proxied to the local server.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means the requests are rejected with 503 without reaching the local server.
+	BreakerOpen
+	// BreakerHalfOpen means a single request is proxied to probe whether the local server recovers.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker stops proxying the requests to the local server after the consecutive failures,
+// a failure is a 5xx response, including the 502 of the failed connections to the local server.
+type circuitBreaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	// probing is true while the probe request of the half-open state is in flight.
+	probing bool
+}
+
+func newCircuitBreaker(threshold int, openDuration time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+	}
+}
+
+func (b *circuitBreaker) current() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) handler(next http.Handler, emit func(Event)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ok, retryAfter := b.allow(emit)
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			proxyError(w, r, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		b.record(rec.status < http.StatusInternalServerError, emit)
+	})
+}
+
+// allow reports whether the request can be proxied, or how long to retry after if it can't.
+func (b *circuitBreaker) allow(emit func(Event)) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.openDuration - time.Since(b.openedAt); wait > 0 {
+			return false, wait
+		}
+		b.transit(BreakerHalfOpen, emit)
+		b.probing = true
+		return true, 0
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, time.Second
+		}
+		b.probing = true
+		return true, 0
+	default:
+		return true, 0
+	}
+}
+
+func (b *circuitBreaker) record(ok bool, emit func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probing = false
+		if ok {
+			b.failures = 0
+			b.transit(BreakerClosed, emit)
+		} else {
+			b.openedAt = time.Now()
+			b.transit(BreakerOpen, emit)
+		}
+	case BreakerClosed:
+		if ok {
+			b.failures = 0
+			return
+		}
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openedAt = time.Now()
+			b.transit(BreakerOpen, emit)
+		}
+	}
+}
+
+// transit must be called with the lock held, emit doesn't block.
+func (b *circuitBreaker) transit(state BreakerState, emit func(Event)) {
+	b.state = state
+	emit(Event{Type: EventBreakerState, Breaker: state})
+}
+
+// statusRecorder records the status code and the body size of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap makes http.ResponseController work with the underlying ResponseWriter.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,308 @@
+package castle
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheBypassHeader makes the http cache of WithHTTPCache skip the request if it's set to any value,
+// the request is sent to the local server, and the response is not cached.
+const CacheBypassHeader = "X-Castle-Cache-Bypass"
+
+// cacheStatusHeader tells whether the response is served from the cache, HIT or MISS.
+const cacheStatusHeader = "X-Castle-Cache"
+
+// httpCache caches the cacheable GET responses of the local server in memory,
+// the least recently used responses are evicted once the size exceeds maxSize.
+type httpCache struct {
+	maxSize    int64
+	defaultTTL time.Duration
+
+	mu   sync.Mutex
+	size int64
+	// entries are the cached responses by the url and the values of the vary headers.
+	entries map[string]*list.Element
+	// vary are the names of the vary headers by the url.
+	vary map[string][]string
+	// lru is the list of the entries, the most recently used one is at the front.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+func newHTTPCache(maxSize int64, defaultTTL time.Duration) *httpCache {
+	return &httpCache{
+		maxSize:    maxSize,
+		defaultTTL: defaultTTL,
+		entries:    make(map[string]*list.Element),
+		vary:       make(map[string][]string),
+		lru:        list.New(),
+	}
+}
+
+// purge drops all the cached responses.
+func (c *httpCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = 0
+	c.entries = make(map[string]*list.Element)
+	c.vary = make(map[string][]string)
+	c.lru.Init()
+}
+
+func (c *httpCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || isUpgradeRequest(r) || r.Header.Get(CacheBypassHeader) != "" ||
+			hasDirective(r.Header, "no-cache") || hasDirective(r.Header, "no-store") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		url := r.Host + r.URL.RequestURI()
+		if entry := c.get(url, r.Header); entry != nil {
+			c.serve(w, r, entry)
+			return
+		}
+
+		rec := &cacheRecorder{ResponseWriter: w, limit: c.maxSize}
+		rec.Header().Set(cacheStatusHeader, "MISS")
+		next.ServeHTTP(rec, r)
+		c.store(url, r.Header, rec)
+	})
+}
+
+func (c *httpCache) get(url string, reqHeader http.Header) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[varyKey(url, c.vary[url], reqHeader)]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return entry
+}
+
+func (c *httpCache) serve(w http.ResponseWriter, r *http.Request, entry *cacheEntry) {
+	h := w.Header()
+	for k, v := range entry.header {
+		h[k] = v
+	}
+	h.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	h.Set(cacheStatusHeader, "HIT")
+	if etag := entry.header.Get("ETag"); etag != "" && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+func (c *httpCache) store(url string, reqHeader http.Header, rec *cacheRecorder) {
+	ttl, ok := c.ttl(rec, reqHeader.Get("Authorization") != "")
+	if !ok {
+		return
+	}
+	var names []string
+	for _, value := range rec.Header().Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "*" {
+				return
+			} else if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+
+	header := rec.Header().Clone()
+	header.Del(cacheStatusHeader)
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     varyKey(url, names, reqHeader),
+		status:  rec.status,
+		header:  header,
+		body:    rec.body.Bytes(),
+		stored:  now,
+		expires: now.Add(ttl),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !equalNames(c.vary[url], names) {
+		// the variants of the url are keyed by the other headers now.
+		for key, elem := range c.entries {
+			if strings.HasPrefix(key, url+"\n") || key == url {
+				c.remove(elem)
+			}
+		}
+		c.vary[url] = names
+	}
+	if elem, ok := c.entries[entry.key]; ok {
+		c.remove(elem)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += int64(len(entry.body))
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// ttl returns how long the recorded response can be cached, false if it's not cacheable.
+// The response of an authorized request is only cached if it's public explicitly.
+func (c *httpCache) ttl(rec *cacheRecorder, authorized bool) (time.Duration, bool) {
+	if rec.status != http.StatusOK || rec.overflow {
+		return 0, false
+	}
+	h := rec.Header()
+	if authorized && !hasDirective(h, "public") && !hasDirective(h, "s-maxage") {
+		return 0, false
+	}
+	if h.Get("Set-Cookie") != "" {
+		return 0, false
+	}
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if hasDirective(h, directive) {
+			return 0, false
+		}
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := directiveValue(h, directive); ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return c.defaultTTL, c.defaultTTL > 0
+}
+
+// remove must be called with the lock held.
+func (c *httpCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// varyKey is the key of the variant of the url selected by the values of the vary headers.
+func varyKey(url string, names []string, header http.Header) string {
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range names {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDirective reports whether the Cache-Control header has the directive.
+func hasDirective(h http.Header, directive string) bool {
+	_, ok := directiveValue(h, directive)
+	return ok
+}
+
+// directiveValue returns the value of the directive of the Cache-Control header.
+func directiveValue(h http.Header, directive string) (string, bool) {
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if strings.EqualFold(name, directive) {
+				return strings.Trim(value, `"`), true
+			}
+		}
+	}
+	return "", false
+}
+
+// etagMatches reports whether the If-None-Match header matches the etag.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" ||
+			strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheRecorder tees the response to the user and the buffer until the body exceeds the limit.
+type cacheRecorder struct {
+	http.ResponseWriter
+	limit int64
+
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (w *cacheRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if int64(w.body.Len()+len(b)) > w.limit {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cacheRecorder) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap makes http.ResponseController work with the underlying ResponseWriter.
+func (w *cacheRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// PurgeCache drops all the cached responses of WithHTTPCache, it's a no-op without the cache.
+func (t *Tunnel) PurgeCache() {
+	if t.http != nil && t.http.cache != nil {
+		t.http.cache.purge()
+	}
+}
@@ -0,0 +1,333 @@
+// Package casttest provides an in-process castled server for testing the code which uses castle,
+// the tunnels are served over an in-memory transport, no port is bound.
+//
+// A test starts the server, creates the castle client by TestServer.NewClient, and connects to
+// the tunnels by TestServer.Dial or TestServer.HTTPClient as the users do:
+//
+//	server := casttest.NewTestServer()
+//	defer server.Close()
+//	client, _ := server.NewClient()
+//	client.StartTunnel(ctx, castle.NewHTTPTunnel("web", localAddr))
+//	resp, _ := server.HTTPClient("web").Get("http://web.casttest.local/")
+package casttest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/castle"
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Domain is the domain of the subdomains of the http tunnels.
+const Domain = "casttest.local"
+
+// bufSize is the buffer of the in-memory transport.
+const bufSize = 1024 * 1024
+
+// ErrNoTunnel is returned by TestServer.Dial if there is no registered tunnel of the name.
+var ErrNoTunnel = errors.New("casttest: no such tunnel")
+
+// ErrRefused is returned by TestServer.Dial if the client refuses the connection,
+// e.g. the local server is down or the connection is rejected by WithAllowCIDR.
+var ErrRefused = errors.New("casttest: connection refused by the client")
+
+// TestServer is an in-process castled server, it's safe for concurrent use.
+type TestServer struct {
+	proto.UnimplementedTunnelServiceServer
+
+	listener *bufconn.Listener
+	server   *grpc.Server
+
+	mu      sync.Mutex
+	tunnels map[string]*tunnel
+	pending map[string]chan *Conn
+	// failures are the errors of the next registrations, see FailRegistrations.
+	failures []error
+	nextPort int
+	nextID   atomic.Int64
+}
+
+// tunnel is a registered tunnel.
+type tunnel struct {
+	name   string
+	config *proto.Tunnel
+	// sendMu serializes sending the commands to the control stream.
+	sendMu sync.Mutex
+	stream proto.TunnelService_RegisterServer
+	// drop ends the control stream with the error.
+	drop chan error
+}
+
+// NewTestServer starts the server, it should be closed by Close.
+func NewTestServer() *TestServer {
+	s := &TestServer{
+		listener: bufconn.Listen(bufSize),
+		server:   grpc.NewServer(),
+		tunnels:  make(map[string]*tunnel),
+		pending:  make(map[string]chan *Conn),
+		nextPort: 20000,
+	}
+	proto.RegisterTunnelServiceServer(s.server, s)
+	go s.server.Serve(s.listener)
+	return s
+}
+
+// Close stops the server, the tunnels quit or reconnect.
+func (s *TestServer) Close() {
+	s.server.Stop()
+	s.listener.Close()
+}
+
+// NewClient creates a castle client connecting to the server over the in-memory transport.
+func (s *TestServer) NewClient(options ...castle.Option) (*castle.Client, error) {
+	dialer := castle.WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		return s.listener.DialContext(ctx)
+	})
+	return castle.NewClient("casttest", append([]castle.Option{dialer}, options...)...)
+}
+
+// Tunnels returns the names of the registered tunnels.
+func (s *TestServer) Tunnels() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.tunnels))
+	for name := range s.tunnels {
+		names = append(names, name)
+	}
+	return names
+}
+
+// WaitTunnel waits until the tunnel of the name is registered, e.g. after DropTunnels,
+// it returns the error of the ctx if the tunnel is not registered before the ctx is done.
+func (s *TestServer) WaitTunnel(ctx context.Context, name string) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		_, ok := s.tunnels[name]
+		s.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// FailRegistrations makes the next n registrations fail with err,
+// err defaults to an Unavailable status, which the clients retry.
+func (s *TestServer) FailRegistrations(n int, err error) {
+	if err == nil {
+		err = status.Error(codes.Unavailable, "casttest: injected failure")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.failures = append(s.failures, err)
+	}
+}
+
+// DropTunnels breaks the control streams of all the registered tunnels,
+// like the server restarts, the tunnels reconnect if WithReconnect is set.
+func (s *TestServer) DropTunnels() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, t := range s.tunnels {
+		select {
+		case t.drop <- status.Error(codes.Unavailable, "casttest: tunnel dropped"):
+		default:
+		}
+		delete(s.tunnels, name)
+	}
+}
+
+// Dial connects to the tunnel of the name as a user, the traffic is proxied to the local server
+// of the tunnel by the client. It fails with ErrNoTunnel if the tunnel is not registered,
+// or ErrRefused if the client refuses the connection.
+func (s *TestServer) Dial(ctx context.Context, name string) (*Conn, error) {
+	s.mu.Lock()
+	t, ok := s.tunnels[name]
+	connectionID := "casttest-" + strconv.FormatInt(s.nextID.Add(1), 10)
+	accepted := make(chan *Conn, 1)
+	if ok {
+		s.pending[connectionID] = accepted
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoTunnel, name)
+	}
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, connectionID)
+		s.mu.Unlock()
+	}()
+
+	t.sendMu.Lock()
+	err := t.stream.Send(&proto.ControlCommand{
+		Payload: &proto.ControlCommand_Work{
+			Work: &proto.WorkPayload{ConnectionId: connectionID},
+		},
+	})
+	t.sendMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("casttest: failed to send the work to tunnel %q: %w", name, err)
+	}
+
+	select {
+	case conn := <-accepted:
+		if conn == nil {
+			return nil, ErrRefused
+		}
+		return conn, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// HTTPClient returns a http client whose requests are sent to the tunnel of the name,
+// whatever the host of the url is.
+func (s *TestServer) HTTPClient(name string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := s.Dial(ctx, name)
+				if err != nil {
+					return nil, err
+				}
+				return conn, nil
+			},
+			// like castled, each connection carries one request.
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// Register implements proto.TunnelServiceServer.
+func (s *TestServer) Register(req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+	// the same as castled, it's used by Client.Ping.
+	if req.Tunnel == nil {
+		return status.Error(codes.InvalidArgument, "tunnel is required")
+	}
+	s.mu.Lock()
+	if len(s.failures) > 0 {
+		err := s.failures[0]
+		s.failures = s.failures[1:]
+		s.mu.Unlock()
+		return err
+	}
+	name := req.Tunnel.Name
+	if _, ok := s.tunnels[name]; ok {
+		s.mu.Unlock()
+		return status.Errorf(codes.AlreadyExists, "tunnel %q is already registered", name)
+	}
+	t := &tunnel{name: name, config: req.Tunnel, stream: stream, drop: make(chan error, 1)}
+	s.tunnels[name] = t
+	entrypoint := s.entrypoint(req.Tunnel)
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		if s.tunnels[name] == t {
+			delete(s.tunnels, name)
+		}
+		s.mu.Unlock()
+	}()
+
+	t.sendMu.Lock()
+	err := stream.Send(&proto.ControlCommand{
+		Payload: &proto.ControlCommand_Init{
+			Init: &proto.InitPayload{
+				TunnelId:           name,
+				AssignedEntrypoint: []string{entrypoint},
+			},
+		},
+	})
+	t.sendMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err := <-t.drop:
+		return err
+	case <-stream.Context().Done():
+		return nil
+	}
+}
+
+// entrypoint returns the entrypoint of the tunnel, the ports are allocated in turn
+// if the tunnel doesn't request one, it's called with s.mu held.
+func (s *TestServer) entrypoint(config *proto.Tunnel) string {
+	port := func(requested int32) int {
+		if requested != 0 {
+			return int(requested)
+		}
+		s.nextPort++
+		return s.nextPort
+	}
+	switch {
+	case config.GetUdp() != nil:
+		return fmt.Sprintf("udp://127.0.0.1:%d", port(config.GetUdp().RemotePort))
+	case config.GetHttp() != nil:
+		http := config.GetHttp()
+		switch {
+		case http.Domain != "":
+			return "http://" + http.Domain
+		case http.Subdomain != "":
+			return "http://" + http.Subdomain + "." + Domain
+		case http.RandomSubdomain:
+			return "http://" + config.Name + "-" + strconv.FormatInt(s.nextID.Add(1), 10) + "." + Domain
+		default:
+			return fmt.Sprintf("http://127.0.0.1:%d", port(http.RemotePort))
+		}
+	default:
+		return fmt.Sprintf("tcp://127.0.0.1:%d", port(config.GetTcp().GetRemotePort()))
+	}
+}
+
+// Data implements proto.TunnelServiceServer.
+func (s *TestServer) Data(stream proto.TunnelService_DataServer) error {
+	// like castled, the header is sent right away, it doesn't tell the address of the user.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	start, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	accepted, ok := s.pending[start.ConnectionId]
+	s.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.NotFound, "unknown connection %s", start.ConnectionId)
+	}
+	if start.Action != proto.TrafficToServer_Start {
+		accepted <- nil
+		return nil
+	}
+
+	conn := newConn(stream, start.ConnectionId)
+	accepted <- conn
+	// end the stream once the user closes the conn.
+	select {
+	case <-conn.done:
+	case <-stream.Context().Done():
+	}
+	return nil
+}
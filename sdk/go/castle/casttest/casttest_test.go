@@ -0,0 +1,116 @@
+package casttest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/castle"
+	"github.com/openosaka/castled/sdk/go/castle/casttest"
+)
+
+func TestHTTPTunnel(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+r.URL.Path+" "+r.Header.Get("X-Env"))
+	}))
+	defer local.Close()
+
+	server := casttest.NewTestServer()
+	defer server.Close()
+	client, err := server.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := castle.NewHTTPTunnel("web", strings.TrimPrefix(local.URL, "http://"),
+		castle.WithHTTPSubDomain("web"),
+		castle.WithHTTPRequestHeaders(map[string]string{"X-Env": "test"}, nil))
+	entrypoints, _, err := client.StartTunnel(ctx, tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entrypoints) != 1 || entrypoints[0].URL != "http://web."+casttest.Domain {
+		t.Fatalf("unexpected entrypoints: %v", entrypoints)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp, err := server.HTTPClient("web").Get("http://web.casttest.local/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "web.casttest.local/hello test" {
+			t.Fatalf("unexpected body: %q", body)
+		}
+	}
+
+	if _, err := server.Dial(ctx, "unknown"); !errors.Is(err, casttest.ErrNoTunnel) {
+		t.Fatalf("expected ErrNoTunnel, got %v", err)
+	}
+}
+
+func TestTCPTunnelReconnect(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := casttest.NewTestServer()
+	defer server.Close()
+	client, err := server.NewClient(castle.WithReconnect(5, 10*time.Millisecond, 50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, castle.NewTCPTunnel("echo", lis.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+
+	echo := func() {
+		t.Helper()
+		conn, err := server.Dial(ctx, "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "ping")
+		conn.CloseWrite()
+		if got, _ := io.ReadAll(conn); string(got) != "ping" {
+			t.Fatalf("unexpected echo: %q", got)
+		}
+	}
+	echo()
+
+	// the first re-registration fails, the second one succeeds.
+	server.FailRegistrations(1, nil)
+	server.DropTunnels()
+	if err := server.WaitTunnel(ctx, "echo"); err != nil {
+		t.Fatal(err)
+	}
+	echo()
+	if n := client.Tunnels()[0].Status.Reconnects; n != 1 {
+		t.Fatalf("expected 1 reconnect, got %d", n)
+	}
+}
@@ -0,0 +1,114 @@
+package casttest
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+)
+
+// Conn is a user connection to a tunnel of the TestServer.
+//
+// Reading from the conn receives the traffic from the local server, it returns io.EOF
+// once the client finishes sending, writing to the conn sends the traffic to the local server.
+// The deadlines are not supported.
+type Conn struct {
+	stream       proto.TunnelService_DataServer
+	connectionID string
+
+	readMu   sync.Mutex
+	pending  []byte
+	finished bool
+
+	writeMu  sync.Mutex
+	closedWr bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newConn(stream proto.TunnelService_DataServer, connectionID string) *Conn {
+	return &Conn{
+		stream:       stream,
+		connectionID: connectionID,
+		done:         make(chan struct{}),
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		if c.finished {
+			return 0, io.EOF
+		}
+		traffic, err := c.stream.Recv()
+		if err != nil {
+			c.finished = true
+			return 0, io.EOF
+		}
+		switch traffic.Action {
+		case proto.TrafficToServer_Sending:
+			c.pending = traffic.Data
+		case proto.TrafficToServer_Finished, proto.TrafficToServer_Close:
+			c.finished = true
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closedWr {
+		return 0, net.ErrClosed
+	}
+	if len(b) == 0 {
+		// the empty data means the end of the traffic.
+		return 0, nil
+	}
+	if err := c.stream.Send(&proto.TrafficToClient{Data: b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// CloseWrite tells the client there is no more traffic from the user.
+func (c *Conn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closedWr {
+		return nil
+	}
+	c.closedWr = true
+	return c.stream.Send(&proto.TrafficToClient{})
+}
+
+// Close ends the connection.
+func (c *Conn) Close() error {
+	err := c.CloseWrite()
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return connAddr(c.connectionID) }
+func (c *Conn) RemoteAddr() net.Addr { return connAddr(c.connectionID) }
+
+func (c *Conn) SetDeadline(t time.Time) error      { return nil }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return nil }
+
+// connAddr is the address of a user connection, which is identified by the connection id.
+type connAddr string
+
+func (a connAddr) Network() string { return "casttest" }
+func (a connAddr) String() string  { return string(a) }
@@ -2,46 +2,294 @@ package castle
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/openosaka/castled/sdk/go/proto"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
 const DEFAULT_BUFFER_SIZE = 8 * 1024
 
+// streamLinger is how long to wait for the server to end a data stream after the connection is closed.
+const streamLinger = time.Second
+
+// maxDatagramSize is the max size of an udp datagram.
+const maxDatagramSize = 64 * 1024
+
+// maxBufferSize is the max of WithBufferSize, each chunk of the buffer is sent in one message,
+// which should be far below the max message size of the server.
+const maxBufferSize = 1024 * 1024
+
+// minKeepAliveInterval is the min interval of the keepalive pings of grpc, the shorter ones are raised to it.
+const minKeepAliveInterval = 10 * time.Second
+
+// minWindowSize is the min flow control window of grpc, the smaller windows are ignored by grpc.
+const minWindowSize = 64 * 1024
+
 type Client struct {
 	controlServerAddr string
 	grpcClient        proto.TunnelServiceClient
-	logger            Logger
+	conn              *grpc.ClientConn
+	logger            *slog.Logger
+	reconnect         *reconnectOptions
+	// sleep waits the delays of the reconnects and the register retries, see WithReconnectSleep.
+	sleep          SleepFunc
+	onReconnect    ReconnectHandler
+	onConfigUpdate func(ConfigUpdate) error
+	events         *eventDispatcher
+	keepalive      *keepalive.ClientParameters
+	dialer         Dialer
+	authToken      AuthTokenFunc
+	registerRetry  *RetryPolicy
+	serverTLS      *tls.Config
+	// bufferSize is the size of the copy buffers of each connection, see WithBufferSize,
+	// 0 means DEFAULT_BUFFER_SIZE with the dynamic flow control windows.
+	bufferSize int
+	// creds is the tls credentials of the control channel, nil if it's plaintext.
+	creds *serverCredentials
+	// proxy is of WithHTTPConnectProxy, it may be nil.
+	proxy *connectProxy
+	// created is when the client was created, for Metrics.
+	created time.Time
+	// health is the server of WithHealthServer, it may be nil.
+	health *healthServer
+
+	mu      sync.Mutex
+	tunnels []*Tunnel
+	// shutdown is set once Shutdown is called.
+	shutdown bool
 }
 
 type options struct {
-	logger Logger
+	logger        *slog.Logger
+	reconnect     *reconnectOptions
+	jitter        float64
+	random        func() float64
+	sleep         SleepFunc
+	onReconnect   ReconnectHandler
+	onEvent       EventHandler
+	keepalive     *keepalive.ClientParameters
+	dialer        Dialer
+	authToken     AuthTokenFunc
+	registerRetry *RetryPolicy
+	serverTLS     *tls.Config
+	clientCerts   []tls.Certificate
+	bufferSize    int
+	healthAddr    string
+	// onConfigUpdate is of WithConfigUpdateHandler.
+	onConfigUpdate func(ConfigUpdate) error
+	// connectProxy is the url of WithHTTPConnectProxy, nil without the option.
+	connectProxy *string
 }
 
 func newOptions() *options {
-	slog.SetLogLoggerLevel(slog.LevelDebug)
 	return &options{
-		logger: slog.Default(),
+		logger: slog.New(discardHandler{}),
 	}
 }
 
 type Option func(*options)
 
-func WithLogger(logger Logger) func(*options) {
+// WithLogger sets the logger of the client, e.g. the reconnects, the registrations
+// and the errors of the connections, the records have the attributes "tunnel" and "connection_id"
+// if they are about a tunnel or a connection.
+// Without the option, the client doesn't log anything.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *options) {
+		if logger != nil {
+			c.logger = logger
+		}
+	}
+}
+
+// WithReconnect makes the client register the tunnel again when the control stream is broken,
+// e.g. the network is down or the server restarts.
+//
+// The delay between attempts starts from baseDelay and doubles after each failed attempt,
+// up to maxDelay. After maxRetries failed attempts, the quit channel receives the last error.
+func WithReconnect(maxRetries int, baseDelay, maxDelay time.Duration) Option {
+	return func(c *options) {
+		c.reconnect = &reconnectOptions{
+			maxRetries: maxRetries,
+			baseDelay:  baseDelay,
+			maxDelay:   maxDelay,
+		}
+	}
+}
+
+// WithReconnectJitter randomizes the delays of WithReconnect, each delay is reduced by a random
+// duration up to the fraction of it, so the clients dropped by a server restart together don't
+// reconnect in lockstep. The fraction is between 0 and 1, 1 is the full jitter, i.e. the delay is
+// anywhere between zero and the backoff, NewClient fails otherwise. It defaults to no jitter,
+// see WithReconnectRand and WithReconnectSleep to make the delays deterministic.
+func WithReconnectJitter(fraction float64) Option {
+	return func(c *options) {
+		c.jitter = fraction
+	}
+}
+
+// WithReconnectRand sets the source of the jitter of WithReconnectJitter, it returns a number
+// in [0, 1), e.g. a seeded rand.Rand.Float64 to make the delays deterministic.
+// It defaults to the Float64 of math/rand/v2.
+func WithReconnectRand(random func() float64) Option {
 	return func(c *options) {
-		c.logger = logger
+		c.random = random
 	}
 }
 
+// SleepFunc waits for the duration d, it returns the error of ctx if ctx is done before.
+type SleepFunc func(ctx context.Context, d time.Duration) error
+
+// WithReconnectSleep sets how the client waits the delays between the attempts of WithReconnect
+// and WithRegisterRetry, e.g. a fake clock in tests which records the delays and returns right away.
+// It defaults to a timer.
+func WithReconnectSleep(sleep SleepFunc) Option {
+	return func(c *options) {
+		c.sleep = sleep
+	}
+}
+
+// WithReconnectHandler sets the handler which is called after each reconnect attempt.
+func WithReconnectHandler(handler ReconnectHandler) Option {
+	return func(c *options) {
+		c.onReconnect = handler
+	}
+}
+
+// WithKeepAlive makes the client ping the server every interval when the connection is idle,
+// if the server doesn't respond within the timeout, the connection is considered broken,
+// the tunnels quit or reconnect if WithReconnect is set.
+//
+// Without the option, the client relies on the keepalive of the operating system,
+// which may take hours to notice a dead connection.
+// NAT devices and firewalls usually drop idle mappings after 30 seconds to a few minutes,
+// an interval of 20-30 seconds with a timeout of 10 seconds keeps the mappings alive.
+// The interval and the timeout must be positive, NewClient fails otherwise. The intervals below
+// 10 seconds are raised to 10 seconds, which is the min of grpc, and the server must permit pings that often.
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(c *options) {
+		c.keepalive = &keepalive.ClientParameters{
+			Time:                interval,
+			Timeout:             timeout,
+			PermitWithoutStream: true,
+		}
+	}
+}
+
+// WithBufferSize bounds the memory buffered for each connection of the tunnels to about 2 * bytes,
+// e.g. to keep the memory steady with many connections to a slow local server.
+//
+// The traffic is copied between the server and the local server in chunks of the bytes,
+// and the flow control window of each data stream is set to the bytes, at least 64KB,
+// so the server stops sending once the window of unread traffic is full, until the local server
+// drains it. The bytes are at most 1MB, NewClient fails otherwise.
+//
+// Without the option, the chunks are 8KB, and the windows grow with the bandwidth of the connection to server,
+// which gives the best throughput over the long distances, but a connection may buffer up to 16MB.
+//
+// The copies always go through the buffers, there is no zero-copy path like splice(2) on linux,
+// since the traffic of the server is carried by the grpc messages instead of a socket.
+func WithBufferSize(bytes int) Option {
+	return func(c *options) {
+		c.bufferSize = bytes
+	}
+}
+
+// Dialer connects to the server at addr, addr is the server address passed to NewClient.
+type Dialer func(ctx context.Context, addr string) (net.Conn, error)
+
+// WithDialer makes the client connect to the server with the dialer instead of net.Dial,
+// e.g. through a SOCKS5 proxy, or an in-memory pipe in tests.
+//
+// The server address is not resolved by the client then, it's passed to the dialer as is.
+// With WithHTTPConnectProxy, the dialer connects to the proxy instead.
+func WithDialer(dialer Dialer) Option {
+	return func(c *options) {
+		c.dialer = dialer
+	}
+}
+
+// AuthTokenFunc returns the token to authenticate the client to the server.
+type AuthTokenFunc func(ctx context.Context) (string, error)
+
+// WithAuthToken authenticates the client to the server with the token,
+// the token is sent as a bearer token when registering each tunnel.
+//
+// If the server rejects the token, StartTunnel returns an *AuthError,
+// and the tunnels don't retry reconnecting.
+func WithAuthToken(token string) Option {
+	return WithAuthTokenFunc(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+// WithAuthTokenFunc is like WithAuthToken, but gets the token from fn before each registration,
+// including the re-registrations, so a short-lived token can be refreshed.
+func WithAuthTokenFunc(fn AuthTokenFunc) Option {
+	return func(c *options) {
+		c.authToken = fn
+	}
+}
+
+// WithRegisterRetry makes StartTunnel retry the registration on the transient errors,
+// e.g. the server is unavailable, with the policy, until the ctx is done.
+// The permanent errors, e.g. AuthError, are returned immediately.
+func WithRegisterRetry(policy RetryPolicy) Option {
+	return func(c *options) {
+		c.registerRetry = &policy
+	}
+}
+
+// WithServerTLS connects to the server over tls with the config,
+// the server certificate is verified against config.RootCAs, or the system roots if it's nil.
+//
+// The control channel also uses tls with the default config
+// if the server address has a tls scheme, e.g. "castles://", see NewClient.
+func WithServerTLS(config *tls.Config) Option {
+	return func(c *options) {
+		if config == nil {
+			config = &tls.Config{}
+		}
+		c.serverTLS = config.Clone()
+	}
+}
+
+// WithServerTLSInsecureSkipVerify connects to the server over tls without verifying
+// the server certificate, it should only be used for testing.
+func WithServerTLSInsecureSkipVerify() Option {
+	return func(c *options) {
+		c.serverTLS = &tls.Config{InsecureSkipVerify: true}
+	}
+}
+
+// WithClientCertificate presents the certificate to the server in the tls handshake,
+// so that the server can authenticate the client by the certificate (mTLS).
+// It implies the control channel uses tls, see WithServerTLS for verifying the server.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(c *options) {
+		c.clientCerts = append(c.clientCerts, cert)
+	}
+}
+
+// NewClient creates a client of the castled server at serverAddr.
+//
+// The serverAddr is either a bare host:port, which connects in plaintext,
+// or a url with the scheme of the transport: "castle://host:port" and "grpc://host:port"
+// connect in plaintext, "castles://host:port" and "grpcs://host:port" connect over tls,
+// so do "tls://" and "https://". The other schemes are not supported.
 func NewClient(serverAddr string, options ...Option) (*Client, error) {
 	opts := newOptions()
 	for _, o := range options {
@@ -51,214 +299,1011 @@ func NewClient(serverAddr string, options ...Option) (*Client, error) {
 	client := &Client{
 		logger:            opts.logger,
 		controlServerAddr: serverAddr,
+		reconnect:         opts.reconnect,
+		sleep:             opts.sleep,
+		onReconnect:       opts.onReconnect,
+		onConfigUpdate:    opts.onConfigUpdate,
+		events:            newEventDispatcher(opts.onEvent),
+		keepalive:         opts.keepalive,
+		dialer:            opts.dialer,
+		authToken:         opts.authToken,
+		registerRetry:     opts.registerRetry,
+		serverTLS:         opts.serverTLS,
+		bufferSize:        opts.bufferSize,
+		created:           time.Now(),
+	}
+	if !(opts.jitter >= 0 && opts.jitter <= 1) {
+		return nil, fmt.Errorf("invalid reconnect jitter %v, it should be between 0 and 1", opts.jitter)
+	}
+	if client.reconnect != nil {
+		client.reconnect.jitter = opts.jitter
+		client.reconnect.random = opts.random
+	}
+	if client.sleep == nil {
+		client.sleep = sleepContext
+	}
+	if ka := opts.keepalive; ka != nil {
+		if ka.Time <= 0 || ka.Timeout <= 0 {
+			return nil, fmt.Errorf("invalid keepalive interval %v and timeout %v, they should be positive", ka.Time, ka.Timeout)
+		}
+		params := *ka
+		params.Time = max(params.Time, minKeepAliveInterval)
+		client.keepalive = &params
+	}
+	if opts.bufferSize < 0 || opts.bufferSize > maxBufferSize {
+		return nil, fmt.Errorf("invalid buffer size %d, it should be at most %d", opts.bufferSize, maxBufferSize)
+	}
+	addr, useTLS, err := parseServerAddr(serverAddr)
+	if err != nil {
+		return nil, err
+	}
+	client.controlServerAddr = addr
+	if opts.connectProxy != nil {
+		if client.proxy, err = newConnectProxy(*opts.connectProxy, opts.dialer); err != nil {
+			return nil, err
+		}
+	}
+	if useTLS && client.serverTLS == nil {
+		client.serverTLS = &tls.Config{}
+	}
+	if len(opts.clientCerts) > 0 {
+		if client.serverTLS == nil {
+			client.serverTLS = &tls.Config{}
+		}
+		client.serverTLS.Certificates = append(client.serverTLS.Certificates, opts.clientCerts...)
 	}
 	grpcClient, err := client.newGrpcClient()
 	if err != nil {
 		return nil, err
 	}
 	client.grpcClient = grpcClient
+	if opts.healthAddr != "" {
+		if err := client.startHealthServer(opts.healthAddr); err != nil {
+			client.conn.Close()
+			return nil, err
+		}
+	}
 
 	return client, nil
 }
 
 func (c *Client) newGrpcClient() (proto.TunnelServiceClient, error) {
-	conn, err := grpc.NewClient(c.controlServerAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if c.serverTLS != nil {
+		c.creds = newServerCredentials(c.serverTLS)
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(c.creds)}
+	}
+	if c.keepalive != nil {
+		dialOpts = append(dialOpts, grpc.WithKeepaliveParams(*c.keepalive))
+	}
+	if c.bufferSize > 0 {
+		// a fixed window disables the dynamic window of grpc.
+		dialOpts = append(dialOpts, grpc.WithInitialWindowSize(int32(max(c.bufferSize, minWindowSize))))
+	}
+	target := c.controlServerAddr
+	if c.proxy != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(c.proxy.dial))
+		target = "passthrough:///" + target
+	} else if c.dialer != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(c.dialer))
+		// pass the address to the dialer without resolving it.
+		target = "passthrough:///" + target
+	}
+	conn, err := grpc.NewClient(target, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
+	c.conn = conn
 	return proto.NewTunnelServiceClient(conn), nil
 }
 
-func (c *Client) StartTunnel(ctx context.Context, tunnel *Tunnel) ([]string, <-chan error, error) {
+// StartTunnel registers the tunnel and serves its connections until the ctx is done,
+// it returns the entrypoints assigned by the server, and the quit channel receives
+// the error once the tunnel quits.
+func (c *Client) StartTunnel(ctx context.Context, tunnel *Tunnel) ([]Entrypoint, <-chan error, error) {
+	if err := tunnel.Validate(); err != nil {
+		c.emit(tunnel, Event{Type: EventClosed, Err: err})
+		return nil, nil, err
+	}
+	if err := c.checkTLSKey(tunnel); err != nil {
+		c.emit(tunnel, Event{Type: EventClosed, Err: err})
+		return nil, nil, err
+	}
+	if err := c.track(tunnel); err != nil {
+		c.emit(tunnel, Event{Type: EventClosed, Err: err})
+		return nil, nil, err
+	}
 	quit := make(chan error, 1)
 
-	stream, err := c.grpcClient.Register(ctx, &proto.RegisterReq{
-		Tunnel: &tunnel.Tunnel,
-	})
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to register tunnel: %w", err)
-	}
+	s, controlCtx, dataCtx := newSession(ctx)
+	s.client = c
+	tunnel.mu.Lock()
+	tunnel.session = s
+	tunnel.mu.Unlock()
 
-	command, err := stream.Recv()
+	stream, entrypoint, err := c.registerWithRetry(controlCtx, tunnel)
+	if err == nil {
+		err = tunnel.verifyEntrypoint(entrypoint)
+	}
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to init the registration: %w", err)
+		s.stopControl()
+		s.stopData()
+		close(s.done)
+		tunnel.status.setQuitReason(QuitFatalError)
+		tunnel.status.setState(StateClosed, err)
+		c.emit(tunnel, Event{Type: EventClosed, Err: err})
+		return nil, nil, err
+	}
+	tunnel.status.setState(StateConnected, nil)
+	tunnel.status.setEntrypoints(entrypoint)
+	entrypoints := newEntrypoints(entrypoint, &tunnel.Tunnel, tunnel.status.registeredRegion())
+	c.emit(tunnel, Event{Type: EventRegistered, Entrypoints: entrypoints})
+	logger := c.tunnelLogger(tunnel)
+	for _, warning := range append(slices.Clip(tunnel.warnings), tunnel.status.unconfirmedWarnings()...) {
+		logger.Warn("option doesn't take effect", slog.Any("error", warning))
+		c.emit(tunnel, Event{Type: EventWarning, Err: warning})
+	}
+	if tunnel.http != nil {
+		tunnel.http.setEntrypoints(entrypoints)
+		tunnel.http.start(tunnel.localAddr, logger, func(event Event) {
+			c.emit(tunnel, event)
+		})
 	}
 
-	payload, ok := command.Payload.(*proto.ControlCommand_Init)
-	if !ok {
-		return nil, nil, fmt.Errorf("first command should be init")
+	var ttl *time.Timer
+	if tunnel.ttl > 0 {
+		ttl = time.AfterFunc(tunnel.ttl, func() {
+			// the ttl doesn't wait for the connections.
+			expired, cancel := context.WithCancel(context.Background())
+			cancel()
+			tunnel.expire(expired, logger)
+		})
 	}
 
 	go func() {
-		defer c.logger.Debug("tunnel closed")
+		defer logger.Debug("tunnel closed")
+		defer close(s.done)
+		if ttl != nil {
+			defer ttl.Stop()
+		}
+		defer s.stopControl()
+		if tunnel.http != nil {
+			defer func() {
+				// closing gracefully drains the connections before closing the http proxy.
+				if !s.closing.Load() {
+					tunnel.http.close()
+				}
+			}()
+		}
 
 		var err error
 		defer func() {
+			reason := quitReason(err)
 			select {
 			case <-ctx.Done():
 				// only treat the self cancel as a normal quit
 				err = nil
+				reason = QuitContextCanceled
 			default:
 			}
+			if s.expired.Load() {
+				err = nil
+				reason = QuitExpired
+			} else if s.closing.Load() {
+				err = nil
+				reason = QuitNormal
+			}
+			tunnel.status.setQuitReason(reason)
+			tunnel.status.setState(StateClosed, err)
+			if c.events != nil {
+				go func(err error) {
+					tunnel.status.conns.wait(context.Background())
+					c.emit(tunnel, Event{Type: EventClosed, Err: err})
+				}(err)
+			}
 			quit <- err
 		}()
 
-		for {
-			select {
-			case <-ctx.Done():
-				stream.CloseSend()
-				return
-			default:
-			}
+		err = c.serve(controlCtx, dataCtx, tunnel, stream)
+		if err == nil || controlCtx.Err() != nil {
+			return
+		}
+		c.broken(controlCtx, tunnel, err)
+		if c.reconnect == nil {
+			return
+		}
 
-			var command *proto.ControlCommand
-			command, err = stream.Recv()
-			if gerr, ok := status.FromError(err); ok && gerr.Code() == codes.Unavailable {
-				err = fmt.Errorf("control server is unavailable: %w", err)
-				return
-			}
+		// register the same entrypoint again, instead of getting a new random one.
+		pinned := pinTunnel(&tunnel.Tunnel, entrypoint)
+		for err != nil {
+			stream, err = c.reRegister(controlCtx, tunnel, pinned, err)
 			if err != nil {
-				// err = fmt.Errorf("failed to receive control message: %w", err)
 				return
 			}
-			c.logger.Debug("received control message", slog.Any("command", command))
+			err = c.serve(controlCtx, dataCtx, tunnel, stream)
+			if err != nil && controlCtx.Err() == nil {
+				c.broken(controlCtx, tunnel, err)
+			}
+		}
+	}()
 
-			_, ok := command.Payload.(*proto.ControlCommand_Init)
-			if ok {
-				err = errors.New("unexpected init command")
-				return
+	return entrypoints, quit, nil
+}
+
+// StartTunnels starts multiple tunnels, all of them share the same connection of the client.
+//
+// entrypoints[i] is the entrypoint of tunnels[i], it's nil if the tunnel failed to register,
+// the other tunnels keep running in this case, and the returned error joins
+// the registration error of each failed tunnel as a *TunnelError.
+//
+// The quit channel receives the error of each tunnel which quits unexpectedly as a *TunnelError,
+// and it's closed after all the started tunnels quit.
+// See StartTunnelsResults to tell the result of each tunnel apart.
+func (c *Client) StartTunnels(ctx context.Context, tunnels ...*Tunnel) ([][]Entrypoint, <-chan error, error) {
+	entrypoints, quits, errs := c.startTunnels(ctx, tunnels)
+	for i, err := range errs {
+		if err != nil {
+			errs[i] = &TunnelError{Name: tunnels[i].Name, Err: err}
+		}
+	}
+
+	quit := make(chan error, len(tunnels))
+	var quitWg sync.WaitGroup
+	for i, q := range quits {
+		if q == nil {
+			continue
+		}
+		quitWg.Add(1)
+		go func() {
+			defer quitWg.Done()
+			if err := <-q; err != nil {
+				quit <- &TunnelError{Name: tunnels[i].Name, Err: err}
 			}
+		}()
+	}
+	go func() {
+		quitWg.Wait()
+		close(quit)
+	}()
 
-			work, ok := command.Payload.(*proto.ControlCommand_Work)
-			if !ok {
-				err = errors.New("unexpected command, expected work command")
-				return
+	return entrypoints, quit, errors.Join(errs...)
+}
+
+// TunnelResult is the result of starting one of the tunnels of StartTunnelsResults.
+type TunnelResult struct {
+	Name string
+	// Entrypoint is the first entrypoint assigned by the server, it's zero if Err isn't nil.
+	Entrypoint Entrypoint
+	// Err is the error of StartTunnel, the tunnel isn't running if it's not nil.
+	Err error
+	// Tunnel is the tunnel itself, e.g. to start it again after it fails.
+	Tunnel *Tunnel
+}
+
+// StartTunnelsResults starts multiple tunnels like StartTunnels, but reports each tunnel on its own,
+// so a supervisor can restart only the tunnels that fail.
+//
+// results[i] is the result of tunnels[i]. A failed tunnel never affects the others, there is no error
+// which is fatal to all the tunnels, e.g. after the client is shut down each result has ErrClientClosed.
+// quits has a quit channel by the name of each started tunnel, like the one of StartTunnel,
+// it receives nil if the tunnel is closed or the ctx is done, and the error if it quits unexpectedly.
+// The failed tunnels have no quit channel.
+func (c *Client) StartTunnelsResults(ctx context.Context, tunnels ...*Tunnel) (results []TunnelResult, quits map[string]<-chan error) {
+	entrypoints, quitChans, errs := c.startTunnels(ctx, tunnels)
+	results = make([]TunnelResult, len(tunnels))
+	quits = make(map[string]<-chan error, len(tunnels))
+	for i, tunnel := range tunnels {
+		results[i] = TunnelResult{Name: tunnel.Name, Err: errs[i], Tunnel: tunnel}
+		if errs[i] != nil {
+			continue
+		}
+		if len(entrypoints[i]) > 0 {
+			results[i].Entrypoint = entrypoints[i][0]
+		}
+		// the running tunnels have distinct names, see ErrDuplicateName.
+		quits[tunnel.Name] = quitChans[i]
+	}
+	return results, quits
+}
+
+// startTunnels starts the tunnels concurrently, the entrypoints, quit channel and error
+// of each tunnel are returned by the index.
+func (c *Client) startTunnels(ctx context.Context, tunnels []*Tunnel) ([][]Entrypoint, []<-chan error, []error) {
+	entrypoints := make([][]Entrypoint, len(tunnels))
+	quits := make([]<-chan error, len(tunnels))
+	errs := make([]error, len(tunnels))
+
+	var wg sync.WaitGroup
+	for i, tunnel := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entrypoints[i], quits[i], errs[i] = c.StartTunnel(ctx, tunnel)
+		}()
+	}
+	wg.Wait()
+	return entrypoints, quits, errs
+}
+
+// AddTunnel starts the tunnel on the running client, it shares the connection to the server
+// with the other tunnels, and returns the first entrypoint assigned by the server,
+// see TunnelInfo.Entrypoints of Tunnels for all of them.
+//
+// Unlike StartTunnel, the ctx only bounds the registration, the tunnel keeps running until
+// RemoveTunnel, Tunnel.Close or Shutdown is called, or it quits for an error,
+// which is reported by EventClosed of WithEventHandler and TunnelInfo.Status.
+// It's safe to call concurrently with the other methods of the client.
+func (c *Client) AddTunnel(ctx context.Context, tunnel *Tunnel) (Entrypoint, error) {
+	tunnelCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, cancel)
+	entrypoints, quit, err := c.StartTunnel(tunnelCtx, tunnel)
+	if !stop() || err != nil {
+		// the ctx is done during the registration.
+		cancel()
+		if err == nil {
+			<-quit
+			err = ctx.Err()
+		}
+		return Entrypoint{}, err
+	}
+	go func() {
+		<-quit
+		cancel()
+	}()
+	if len(entrypoints) == 0 {
+		return Entrypoint{}, nil
+	}
+	return entrypoints[0], nil
+}
+
+// RemoveTunnel closes the running tunnel of the name which is started by AddTunnel, StartTunnel
+// or StartTunnels, it returns ErrTunnelNotFound if there is no such tunnel.
+// The in-flight connections of the tunnel are closed at once, use Tunnel.Close of TunnelInfo.Tunnel
+// to drain them instead. It's safe to call concurrently with the other methods of the client.
+func (c *Client) RemoveTunnel(name string) error {
+	var tunnel *Tunnel
+	c.mu.Lock()
+	for _, t := range c.tunnels {
+		if state := t.Status().State; t.Name == name && state != StateIdle && state != StateClosed {
+			tunnel = t
+			break
+		}
+	}
+	c.mu.Unlock()
+	if tunnel == nil {
+		return fmt.Errorf("%w: no running tunnel named %q", ErrTunnelNotFound, name)
+	}
+
+	closed, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := tunnel.Close(closed); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
+
+// register registers the tunnel with the config, the config may differ from the tunnel's
+// when reconnecting.
+func (c *Client) register(ctx context.Context, tunnel *Tunnel, config *proto.Tunnel) (proto.TunnelService_RegisterClient, []string, error) {
+	stream, entrypoint, err := c.doRegister(ctx, tunnel, config)
+	if err != nil {
+		tunnel.status.registerErrors.Add(1)
+	}
+	return stream, entrypoint, err
+}
+
+func (c *Client) doRegister(ctx context.Context, tunnel *Tunnel, config *proto.Tunnel) (proto.TunnelService_RegisterClient, []string, error) {
+	md := tunnel.registerMetadata()
+	ctx = withTunnelMetadata(ctx, md)
+	ctx = metadata.AppendToOutgoingContext(ctx, metadataConfigUpdates, "true")
+	if c.authToken != nil {
+		token, err := c.authToken(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get auth token: %w", err)
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, metadataAuthorization, "Bearer "+token)
+	}
+
+	stream, err := c.grpcClient.Register(ctx, &proto.RegisterReq{
+		Tunnel: config,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to register tunnel: %w", c.registerError(err, config))
+	}
+
+	command, err := stream.Recv()
+	if err != nil {
+		if bindErr := asBindAddrError(err, tunnel.bindAddr, stream.Trailer()); bindErr != err {
+			return nil, nil, fmt.Errorf("failed to init the registration: %w", bindErr)
+		}
+		return nil, nil, fmt.Errorf("failed to init the registration: %w", c.registerError(err, config))
+	}
+
+	payload, ok := command.Payload.(*proto.ControlCommand_Init)
+	if !ok {
+		return nil, nil, fmt.Errorf("first command should be init")
+	}
+	if header, err := stream.Header(); err == nil {
+		if values := header.Get(metadataRegion); len(values) > 0 {
+			tunnel.status.setRegion(values[0])
+		}
+		tunnel.status.setTags(decodeTags(header))
+		tunnel.status.setDataCompression(negotiateDataCompression(md, header))
+		tunnel.status.setTLSUpdates(slices.Contains(header.Get(metadataTLSUpdates), "true"))
+		tunnel.status.setUnconfirmed(unconfirmedMetadata(md, header))
+	}
+	tunnel.status.setTunnelID(payload.Init.TunnelId)
+	return stream, payload.Init.AssignedEntrypoint, nil
+}
+
+// registerError converts err of the registration of config to AuthError or TLSError
+// if it's caused by the credentials, ConflictError if the entrypoint is taken,
+// or ServerError if the server can't be reached.
+func (c *Client) registerError(err error, config *proto.Tunnel) error {
+	if status.Code(err) == codes.Unavailable && c.proxy != nil {
+		if proxyErr := c.proxy.proxyErr(); proxyErr != nil {
+			return asServerError(proxyErr, c.controlServerAddr, config.GetName())
+		}
+	}
+	if status.Code(err) == codes.Unavailable && c.creds != nil {
+		if handshakeErr := c.creds.handshakeErr(); handshakeErr != nil {
+			err = newTLSError(handshakeErr)
+		}
+	}
+	return asServerError(asConflictError(asAuthError(err), config), c.controlServerAddr, config.GetName())
+}
+
+// registerWithRetry registers the tunnel for the first time, it retries with the register retry policy.
+func (c *Client) registerWithRetry(ctx context.Context, tunnel *Tunnel) (proto.TunnelService_RegisterClient, []string, error) {
+	stream, entrypoint, err := c.registerTunnel(ctx, tunnel)
+	policy := c.registerRetry
+	if policy == nil {
+		return stream, entrypoint, err
+	}
+	for attempt := 1; err != nil && isTransient(err); attempt++ {
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			return nil, nil, fmt.Errorf("failed to register after %d attempts: %w", attempt, err)
+		}
+		delay := policy.delay(attempt)
+		c.tunnelLogger(tunnel).Warn("failed to register tunnel, retrying",
+			slog.Int("attempt", attempt), slog.Duration("delay", delay), slog.Any("error", err))
+		if sleepErr := c.sleep(ctx, delay); sleepErr != nil {
+			return nil, nil, errors.Join(sleepErr, err)
+		}
+		stream, entrypoint, err = c.registerTunnel(ctx, tunnel)
+	}
+	return stream, entrypoint, err
+}
+
+// reRegister registers the tunnel again after the control stream is broken by cause,
+// it gives up after the max retries of the reconnect options.
+func (c *Client) reRegister(ctx context.Context, tunnel *Tunnel, pinned *proto.Tunnel, cause error) (proto.TunnelService_RegisterClient, error) {
+	err := cause
+	tunnel.status.setState(StateReconnecting, err)
+	logger := c.tunnelLogger(tunnel)
+	for attempt := 1; attempt <= c.reconnect.maxRetries; attempt++ {
+		delay := c.reconnect.delay(attempt)
+		logger.Warn("control stream is broken, reconnecting",
+			slog.Int("attempt", attempt), slog.Duration("delay", delay), slog.Any("error", err))
+
+		if err := c.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+
+		var stream proto.TunnelService_RegisterClient
+		stream, _, err = c.register(ctx, tunnel, pinned)
+		if err != nil {
+			tunnel.status.setState(StateReconnecting, err)
+		} else {
+			tunnel.status.setState(StateConnected, nil)
+			tunnel.status.reconnects.Add(1)
+		}
+		if c.onReconnect != nil {
+			c.onReconnect(attempt, err)
+		}
+		c.emit(tunnel, Event{Type: EventReconnect, Attempt: attempt, Err: err})
+		if err == nil {
+			logger.Info("tunnel reconnected", slog.Int("attempt", attempt))
+			return stream, nil
+		}
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			// the credentials won't become valid by retrying.
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("failed to reconnect after %d attempts: %w", c.reconnect.maxRetries, err)
+}
+
+// serve handles the commands from the control stream until the stream is broken,
+// it returns nil if the ctx is done, the connections are served with the dataCtx.
+func (c *Client) serve(ctx, dataCtx context.Context, tunnel *Tunnel, stream proto.TunnelService_RegisterClient) error {
+	logger := c.tunnelLogger(tunnel)
+	for {
+		select {
+		case <-ctx.Done():
+			stream.CloseSend()
+			return nil
+		default:
+		}
+
+		command, err := stream.Recv()
+		if err != nil {
+			err = asGoingAway(stream, err)
+			if errors.Is(err, io.EOF) || status.Code(err) == codes.Unavailable {
+				return &ServerError{Addr: c.controlServerAddr, Tunnel: tunnel.Name, Err: fmt.Errorf("%w: %w", ErrServerClosed, err)}
 			}
+			return err
+		}
+		logger.Debug("received control message", slog.Any("command", command))
+
+		_, ok := command.Payload.(*proto.ControlCommand_Init)
+		if ok {
+			return errors.New("unexpected init command")
+		}
+
+		work, ok := command.Payload.(*proto.ControlCommand_Work)
+		if !ok {
+			return errors.New("unexpected command, expected work command")
+		}
 
-			//TODO(sword): traffic control
+		if isConfigUpdate(work.Work.ConnectionId) {
 			go func() {
-				if err := c.work(ctx, tunnel, work); err != nil {
-					c.logger.Error("failed to process work command", slog.Any("error", err))
+				if err := c.updateConfig(dataCtx, tunnel, work.Work.ConnectionId); err != nil {
+					logger.Error("failed to update config", slog.Any("error", err))
 				}
 			}()
+			continue
 		}
-	}()
 
-	return payload.Init.AssignedEntrypoint, quit, nil
+		//TODO(sword): traffic control
+		go func() {
+			if err := c.work(dataCtx, tunnel, work); err != nil {
+				tunnel.status.connErrors.Add(1)
+				logger.Error("failed to process work command",
+					slog.String("connection_id", work.Work.ConnectionId), slog.Any("error", err))
+				c.emit(tunnel, Event{Type: EventError, ConnectionID: work.Work.ConnectionId, Err: err})
+			}
+		}()
+	}
 }
 
 func (c *Client) work(ctx context.Context, tunnel *Tunnel, work *proto.ControlCommand_Work) error {
 	connectionID := work.Work.ConnectionId
+	logger := c.tunnelLogger(tunnel).With(slog.String("connection_id", connectionID))
 
 	bidiStream, err := c.grpcClient.Data(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to create data stream: %w", err)
 	}
 
-	localAddr := tunnel.LocalAddr
+	if tunnel.filter != nil {
+		addr, ok := remoteAddr(bidiStream)
+		if !ok && len(tunnel.filter.allow) > 0 {
+			// the allow list can't be checked without the address, so it fails closed.
+			logger.Info("connection is rejected, the server doesn't tell the address of the user")
+			return c.reject(tunnel, bidiStream, connectionID, errors.New("address of the user is unknown"))
+		}
+		if ok && !tunnel.filter.allowed(addr) {
+			logger.Info("connection is rejected", slog.String("remote_addr", addr.String()))
+			return c.reject(tunnel, bidiStream, connectionID, fmt.Errorf("address %s is not allowed", addr))
+		}
+	}
+
+	connLimit, maxConns := tunnel.connLimits()
+	if connLimit != nil && tunnel.http == nil {
+		if _, ok := connLimit.allow(); !ok {
+			logger.Warn("too many new connections, the connection is dropped")
+			return c.reject(tunnel, bidiStream, connectionID, errors.New("exceeded the connection rate limit"))
+		}
+	}
+
+	localAddr := tunnel.localAddr()
+	if tunnel.resolver != nil && tunnel.http == nil {
+		visitor, _ := remoteAddrPort(bidiStream)
+		addr, err := tunnel.resolver.resolve(ctx, ConnMeta{ConnectionID: connectionID, RemoteAddr: visitor, LocalAddr: localAddr})
+		if err != nil {
+			logger.Info("connection is rejected", slog.Any("error", err))
+			return c.reject(tunnel, bidiStream, connectionID, err)
+		}
+		localAddr = addr
+	}
+
+	if maxConns > 0 {
+		if !tunnel.status.conns.tryAdd(maxConns) {
+			logger.Warn("too many connections, the connection is dropped", slog.Int("max_connections", maxConns))
+			return c.reject(tunnel, bidiStream, connectionID, fmt.Errorf("reached the max connections %d", maxConns))
+		}
+	} else {
+		tunnel.status.conns.add()
+	}
+	if accepted, last := tunnel.takeRequest(); !accepted {
+		tunnel.status.conns.done()
+		return c.reject(tunnel, bidiStream, connectionID, fmt.Errorf("reached the max requests %d", tunnel.maxRequests))
+	} else if last {
+		// the last connection is added already, so closing waits for it.
+		tunnel.expire(context.Background(), logger)
+	}
+
+	if tunnel.http != nil {
+		if err := bidiStream.Send(&proto.TrafficToServer{
+			ConnectionId: connectionID,
+			Action:       proto.TrafficToServer_Start,
+		}); err != nil {
+			return fmt.Errorf("failed to send start action: %w", err)
+		}
+
+		conn := tunnel.newConn(bidiStream, connectionID)
+		if visitor, ok := remoteAddrPort(bidiStream); ok {
+			conn.setVisitor(visitor)
+		}
+		c.openConn(tunnel, conn)
+		conn.onClose = func() {
+			go c.closeConn(tunnel, conn)
+		}
+		tunnel.http.serve(conn)
+		return nil
+	}
+
 	isUdp := tunnel.GetUdp() != nil
-	var localConn net.Conn
+	network := "tcp"
 	if isUdp {
-		localConn, err = net.Dial("udp", localAddr)
-	} else {
-		localConn, err = net.Dial("tcp", localAddr)
+		network = "udp"
 	}
-	if err != nil {
-		err2 := bidiStream.Send(&proto.TrafficToServer{
+	onDialFail := func(attempt int, err error) {
+		logger.Warn("failed to dial local address", slog.Int("attempt", attempt), slog.Any("error", err))
+		c.emit(tunnel, Event{Type: EventLocalDialFailed, ConnectionID: connectionID, Attempt: attempt, Err: err})
+	}
+	// conn is created before dialing if the tunnel is routed by the server name,
+	// the user sends the ClientHello only after the connection starts.
+	var conn *streamConn
+	var serverName string
+	routed := false
+	if tunnel.sni != nil {
+		if err := bidiStream.Send(&proto.TrafficToServer{
+			ConnectionId: connectionID,
+			Action:       proto.TrafficToServer_Start,
+		}); err != nil {
+			tunnel.status.conns.done()
+			return fmt.Errorf("failed to send start action: %w", err)
+		}
+		conn = tunnel.newConn(bidiStream, connectionID)
+		serverName = conn.peekServerName(sniPeekTimeout)
+		if addr, ok := tunnel.sni.route(serverName); ok {
+			localAddr, routed = addr, true
+		}
+		logger = logger.With(slog.String("server_name", serverName))
+	}
+	// closeStream ends the connection which fails before forwarding.
+	closeStream := func() {
+		if conn != nil {
+			conn.Close()
+			return
+		}
+		if err := bidiStream.Send(&proto.TrafficToServer{
 			ConnectionId: connectionID,
 			Action:       proto.TrafficToServer_Close,
-		})
-		if err2 != nil {
-			c.logger.Error("failed to send close action to control server, the server maybe crashed", slog.Any("error", err2))
+		}); err != nil {
+			logger.Error("failed to send close action to control server, the server maybe crashed", slog.Any("error", err))
 		}
+	}
 
+	var localConn net.Conn
+	if isUdp && len(tunnel.fanout) > 0 {
+		localConn, err = tunnel.dialFanout(ctx, onDialFail)
+	} else if tunnel.balancer != nil && !routed {
+		localConn, err = tunnel.balancer.dial(ctx, tunnel.dialer, onDialFail)
+	} else {
+		localConn, err = tunnel.dialer.dial(ctx, network, localAddr, onDialFail)
+	}
+	if err != nil {
+		tunnel.status.conns.done()
+		closeStream()
 		return fmt.Errorf("failed to dial to local address: %w", err)
 	}
+	if tunnel.proxyProtocol != 0 {
+		src, _ := remoteAddrPort(bidiStream)
+		if err := writeProxyHeader(localConn, tunnel.proxyProtocol, src, serverName); err != nil {
+			tunnel.status.conns.done()
+			localConn.Close()
+			closeStream()
+			return fmt.Errorf("failed to write proxy protocol header: %w", err)
+		}
+	}
 
-	if err := bidiStream.Send(&proto.TrafficToServer{
-		ConnectionId: connectionID,
-		Action:       proto.TrafficToServer_Start,
-	}); err != nil {
-		return fmt.Errorf("failed to send start action: %w", err)
+	if conn == nil {
+		if err := bidiStream.Send(&proto.TrafficToServer{
+			ConnectionId: connectionID,
+			Action:       proto.TrafficToServer_Start,
+		}); err != nil {
+			return fmt.Errorf("failed to send start action: %w", err)
+		}
+		conn = tunnel.newConn(bidiStream, connectionID)
 	}
+	go func() {
+		// the header may come with the first traffic, don't wait for it.
+		if visitor, ok := remoteAddrPort(bidiStream); ok {
+			conn.setVisitor(visitor)
+		}
+	}()
+	c.openConn(tunnel, conn)
+	// the local connection may never end, close it forcibly when the ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		localConn.Close()
+	})
+	var idle *idleTimer
+	if tunnel.idleTimeout > 0 {
+		idle = newIdleTimer(tunnel.idleTimeout, func() {
+			logger.Info("connection is idle, closing")
+			localConn.Close()
+			conn.Close()
+		})
+	}
+	// each direction is half-closed once it ends, e.g. the user shuts down writing but keeps reading,
+	// and the connection is closed once both have ended, or either of them fails.
+	// There is no zero-copy path: the other end is always the data stream, which carries the bytes
+	// in the grpc messages, and splice(2) needs both ends to be sockets or pipes, so the copies stay in user space.
+	abort := func() {
+		localConn.Close()
+		conn.Close()
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		wg.Wait()
+		stop()
+		idle.stop()
+		localConn.Close()
+		conn.Close()
+		c.closeConn(tunnel, conn)
+	}()
 
 	go func() {
 		// read from the stream
+		defer wg.Done()
 		defer func() {
-			c.logger.Debug("quit reading")
-			if tcpConn, ok := localConn.(*net.TCPConn); ok {
-				tcpConn.CloseWrite()
-			}
+			logger.Debug("quit reading")
 		}()
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			dataToClient, err := bidiStream.Recv()
-			if err == io.EOF || (dataToClient != nil && len(dataToClient.Data) == 0) {
-				c.logger.Debug("server closed the stream, most of times are because the server finished the work")
-				return
-			}
-			if err != nil {
-				c.logger.Error("failed to receive data", slog.Any("error", err))
-				return
-			}
-
-			n, err := localConn.Write(dataToClient.Data)
-			if err != nil {
-				c.logger.Error("failed to write data to local connection", slog.Any("error", err))
-				return
-			}
-			c.logger.Debug("wrote data to local connection", slog.Int("n", n))
+		var err error
+		if isUdp {
+			// keep each datagram in one write
+			err = copyDatagrams(localConn, &idleReader{Reader: conn, timer: idle}, tunnel.udpDatagramSize(), conn.discardPending, func(n int) {
+				c.dropDatagram(tunnel, connectionID, n, true)
+			})
+		} else {
+			_, err = io.CopyBuffer(localConn, &idleReader{Reader: conn, timer: idle}, make([]byte, c.copyBufferSize()))
+		}
+		if err != nil {
+			logger.Error("failed to write data to local connection", slog.Any("error", err))
+			abort()
+			return
+		}
+		logger.Debug("server closed the stream, most of times are because the server finished the work")
+		if cw, ok := localConn.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
 		}
 	}()
 
 	go func() {
 		// write to the stream
+		defer wg.Done()
 		defer func() {
-			c.logger.Debug("quit writing")
+			logger.Debug("quit writing")
 		}()
 
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			buf := make([]byte, DEFAULT_BUFFER_SIZE)
-			n, err := localConn.Read(buf)
-			if err == io.EOF {
-				c.logger.Debug("no more data to read from local connection")
-				break
-			}
-			if err != nil {
-				c.logger.Error("failed to read data from local connection", slog.Any("error", err))
-				return
-			}
-			c.logger.Debug("read data from local connection", slog.Int("n", n))
-
-			if err := bidiStream.Send(&proto.TrafficToServer{
-				ConnectionId: connectionID,
-				Action:       proto.TrafficToServer_Sending,
-				Data:         buf[:n],
-			}); err != nil {
-				c.logger.Error("failed to send data to control server", slog.Any("error", err))
-				break
-			}
+		var err error
+		if isUdp {
+			// the datagrams bigger than the buffer would be truncated by the socket.
+			err = copyDatagrams(conn, &idleReader{Reader: localConn, timer: idle}, tunnel.udpDatagramSize(), nil, func(n int) {
+				c.dropDatagram(tunnel, connectionID, n, false)
+			})
+		} else {
+			_, err = io.CopyBuffer(conn, &idleReader{Reader: localConn, timer: idle}, make([]byte, c.copyBufferSize()))
 		}
+		if err != nil {
+			logger.Error("failed to send data to control server", slog.Any("error", err))
+			abort()
+			return
+		}
+		logger.Debug("no more data to read from local connection")
 
-		if err := bidiStream.Send(&proto.TrafficToServer{
-			ConnectionId: connectionID,
-			Action:       proto.TrafficToServer_Finished,
-		}); err != nil {
-			c.logger.Error("failed to send close action to control server", slog.Any("error", err))
+		if err := conn.CloseWrite(); err != nil {
+			logger.Error("failed to send close action to control server", slog.Any("error", err))
 		}
 	}()
 
 	return nil
 }
+
+func (c *Client) copyBufferSize() int {
+	if c.bufferSize > 0 {
+		return c.bufferSize
+	}
+	return DEFAULT_BUFFER_SIZE
+}
+
+// TunnelInfo describes a tunnel started by the client at the moment of calling Client.Tunnels.
+type TunnelInfo struct {
+	Name string
+	// Protocol is "tcp", "udp", "http" or "grpc".
+	Protocol string
+	// LocalAddr is where the new connections are dialed to, see Tunnel.UpdateLocalAddr.
+	LocalAddr string
+	// Entrypoints are the entrypoints returned by the server when the tunnel was registered,
+	// it's empty if the tunnel has never been registered.
+	Entrypoints []Entrypoint
+	// Region is the region of the edge which terminates the traffic of the tunnel,
+	// it's empty if the server doesn't tell, see WithRegion.
+	Region string
+	// Metadata is the metadata of WithMetadata accepted by the server,
+	// it's nil if the server doesn't tell.
+	Metadata map[string]string
+	Status   TunnelStatus
+	// Tunnel is the tunnel itself, e.g. to close it by Tunnel.Close.
+	Tunnel *Tunnel
+}
+
+// Tunnels returns the tunnels which have been started by the client, including the closed ones,
+// the returned slice is a snapshot, it's safe to range over while the tunnels change.
+func (c *Client) Tunnels() []TunnelInfo {
+	c.mu.Lock()
+	tunnels := append([]*Tunnel(nil), c.tunnels...)
+	c.mu.Unlock()
+
+	infos := make([]TunnelInfo, 0, len(tunnels))
+	for _, tunnel := range tunnels {
+		region := tunnel.status.registeredRegion()
+		infos = append(infos, TunnelInfo{
+			Name:        tunnel.Name,
+			Protocol:    tunnel.protocol(),
+			LocalAddr:   tunnel.localAddr(),
+			Entrypoints: newEntrypoints(tunnel.status.registeredEntrypoints(), &tunnel.Tunnel, region),
+			Region:      region,
+			Metadata:    tunnel.status.acceptedTags(),
+			Status:      tunnel.Status(),
+			Tunnel:      tunnel,
+		})
+	}
+	return infos
+}
+
+// RecentRequests returns the requests retained by WithHTTPInspect of the tunnel, the oldest first.
+// It returns nil if there is no such tunnel or the tunnel doesn't inspect the requests.
+// If a closed tunnel has the same name as a later one, the later one is used.
+func (c *Client) RecentRequests(tunnelName string) []InspectedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := len(c.tunnels) - 1; i >= 0; i-- {
+		tunnel := c.tunnels[i]
+		if tunnel.Name != tunnelName {
+			continue
+		}
+		if tunnel.http == nil || tunnel.http.inspector == nil {
+			return nil
+		}
+		return tunnel.http.inspector.recent()
+	}
+	return nil
+}
+
+// track adds the tunnel to the client,
+// it fails if the tunnel conflicts with another running tunnel.
+func (c *Client) track(tunnel *Tunnel) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.shutdown {
+		return ErrClientClosed
+	}
+	tracked := false
+	for _, t := range c.tunnels {
+		if t == tunnel {
+			tracked = true
+			continue
+		}
+		if state := t.Status().State; state == StateIdle || state == StateClosed {
+			continue
+		}
+		if t.Name == tunnel.Name {
+			return fmt.Errorf("%w: tunnel %q is already running", ErrDuplicateName, tunnel.Name)
+		}
+		if routeConflicts(t, tunnel) {
+			return fmt.Errorf("the route of path prefix %q and predicates %v conflicts with tunnel %q", tunnel.pathPrefix, tunnel.matches, t.Name)
+		}
+	}
+	if !tracked {
+		c.tunnels = append(c.tunnels, tunnel)
+	}
+	// mark the tunnel as running while holding the lock, so the concurrent starts see it.
+	tunnel.status.setState(StateConnecting, nil)
+	return nil
+}
+
+// ForEachConn calls fn with the stats of each connection which is being proxied by the tunnels
+// of the client, the stats are taken right before calling fn, it's safe to call concurrently.
+func (c *Client) ForEachConn(fn func(ConnStats)) {
+	for _, info := range c.Tunnels() {
+		for _, stats := range info.Tunnel.status.activeConns(info.Name) {
+			fn(stats)
+		}
+	}
+}
+
+// Shutdown closes all the tunnels of the client gracefully, like http.Server.Shutdown.
+//
+// The tunnels stop accepting new connections, and the in-flight connections are drained
+// until the ctx is done, then the remaining connections are closed forcibly,
+// and ctx.Err() is returned in this case.
+// StartTunnel returns ErrClientClosed after Shutdown is called, and the server of
+// WithHealthServer is closed after the tunnels.
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.shutdown = true
+	tunnels := append([]*Tunnel(nil), c.tunnels...)
+	c.mu.Unlock()
+
+	errs := make([]error, len(tunnels))
+	var wg sync.WaitGroup
+	for i, tunnel := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = tunnel.Close(ctx)
+		}()
+	}
+	wg.Wait()
+	healthErr := c.health.shutdown(ctx)
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return healthErr
+}
+
+// openConn reports the connection which is going to be proxied, it must be tracked already.
+func (c *Client) openConn(tunnel *Tunnel, conn *streamConn) {
+	tunnel.status.addActive(conn)
+	tunnel.status.totalConns.Add(1)
+	c.emit(tunnel, Event{Type: EventConnOpened, ConnectionID: conn.connectionID})
+}
+
+// closeConn untracks the connection after it's closed.
+func (c *Client) closeConn(tunnel *Tunnel, conn *streamConn) {
+	conn.linger(streamLinger)
+	tunnel.status.removeActive(conn)
+	c.emit(tunnel, Event{
+		Type:         EventConnClosed,
+		ConnectionID: conn.connectionID,
+		BytesIn:      conn.bytesIn.Load(),
+		BytesOut:     conn.bytesOut.Load(),
+	})
+	tunnel.status.conns.done()
+}
+
+// reject refuses the connection for the reason.
+func (c *Client) reject(tunnel *Tunnel, stream proto.TunnelService_DataClient, connectionID string, reason error) error {
+	tunnel.status.rejectedConns.Add(1)
+	c.emit(tunnel, Event{Type: EventConnRejected, ConnectionID: connectionID, Err: reason})
+	if err := stream.Send(&proto.TrafficToServer{
+		ConnectionId: connectionID,
+		Action:       proto.TrafficToServer_Close,
+	}); err != nil {
+		return fmt.Errorf("failed to send close action: %w", err)
+	}
+	return nil
+}
+
+// dropDatagram reports the datagram of n bytes exceeding WithUdpMaxDatagramSize.
+func (c *Client) dropDatagram(tunnel *Tunnel, connectionID string, n int, fromUser bool) {
+	tunnel.status.droppedDatagrams.Add(1)
+	err := &DatagramSizeError{Size: n, MaxSize: tunnel.udpDatagramSize(), FromUser: fromUser}
+	c.tunnelLogger(tunnel).Warn("datagram is dropped", slog.String("connection_id", connectionID), slog.Any("error", err))
+	c.emit(tunnel, Event{Type: EventDatagramDropped, ConnectionID: connectionID, Err: err})
+}
+
+func (c *Client) emit(tunnel *Tunnel, event Event) {
+	event.Tunnel = tunnel.Name
+	c.events.emit(event)
+}
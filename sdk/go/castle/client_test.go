@@ -1 +1,3353 @@
 package castle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeServer is a minimal control server for testing the client.
+type fakeServer struct {
+	proto.UnimplementedTunnelServiceServer
+
+	addr string
+	// remoteAddr is the address of the users told to the client.
+	remoteAddr string
+
+	mu         sync.Mutex
+	registered []*proto.Tunnel
+	md         []metadata.MD
+	streams    []proto.TunnelService_RegisterServer
+	visitors   map[string]chan *fakeVisitor
+	// halfClose keeps the data stream after the client finishes sending until the user finishes too,
+	// unlike castled.
+	halfClose bool
+	// certs are the certificates pushed by Tunnel.UpdateTLS.
+	certs []string
+	// acks are the acknowledgements of the config updates by the connection id.
+	acks map[string]chan *proto.TrafficToServer
+	// onRegister handles the nth(starts from 0) registration,
+	// the default handler sends the init command and blocks until the stream is closed.
+	onRegister func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error
+}
+
+func newFakeServer(t testing.TB, opts ...grpc.ServerOption) *fakeServer {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		addr:     lis.Addr().String(),
+		visitors: make(map[string]chan *fakeVisitor),
+		acks:     make(map[string]chan *proto.TrafficToServer),
+	}
+	server := grpc.NewServer(opts...)
+	proto.RegisterTunnelServiceServer(server, s)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return s
+}
+
+func (s *fakeServer) Register(req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+	// the same as castled, it's used by Client.Ping.
+	if req.Tunnel == nil {
+		return status.Error(codes.InvalidArgument, "tunnel is required")
+	}
+	s.mu.Lock()
+	n := len(s.registered)
+	s.registered = append(s.registered, req.Tunnel)
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	s.md = append(s.md, md)
+	s.streams = append(s.streams, stream)
+	onRegister := s.onRegister
+	s.mu.Unlock()
+
+	if onRegister != nil {
+		return onRegister(n, req, stream)
+	}
+	if err := sendInit(stream, fmt.Sprintf("tcp://127.0.0.1:%d", 20000+n)); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func (s *fakeServer) registrations() []*proto.Tunnel {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*proto.Tunnel(nil), s.registered...)
+}
+
+func (s *fakeServer) Data(stream proto.TunnelService_DataServer) error {
+	// like castled, the header is sent right away, with or without the address of the user.
+	header := metadata.MD{}
+	if s.remoteAddr != "" {
+		header.Set(metadataRemoteAddr, s.remoteAddr)
+	}
+	if err := stream.SendHeader(header); err != nil {
+		return err
+	}
+	start, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	visitor, ok := s.visitors[start.ConnectionId]
+	ack, isAck := s.acks[start.ConnectionId]
+	s.mu.Unlock()
+	if isAck {
+		ack <- start
+		return nil
+	}
+	if strings.HasPrefix(start.ConnectionId, tlsUpdatePrefix) {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		s.mu.Lock()
+		s.certs = append(s.certs, md.Get(metadataTLSCert)...)
+		s.mu.Unlock()
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("unknown connection %s", start.ConnectionId)
+	}
+	if start.Action != proto.TrafficToServer_Start {
+		close(visitor)
+		return nil
+	}
+
+	// like castled, end the stream once the client finishes sending.
+	done := make(chan struct{})
+	sent := make(chan struct{})
+	visitor <- &fakeVisitor{stream: stream, done: done, sent: sent}
+	select {
+	case <-done:
+	case <-stream.Context().Done():
+	}
+	if s.halfClose {
+		select {
+		case <-sent:
+		case <-stream.Context().Done():
+		}
+	}
+	return nil
+}
+
+// fakeVisitor is a user connection to the nth registered tunnel of the fake server.
+type fakeVisitor struct {
+	t      testing.TB
+	stream proto.TunnelService_DataServer
+
+	pending  []byte
+	finished bool
+	// done is closed once the client finishes sending.
+	done chan struct{}
+	// sent is closed once the user finishes sending.
+	sent chan struct{}
+	// codec is set if the traffic is compressed, see WithDataCompression.
+	codec *dataCodec
+}
+
+// visit creates a user connection to the nth registered tunnel,
+// it returns nil if the client refuses the connection.
+func (s *fakeServer) visit(t testing.TB, n int) *fakeVisitor {
+	t.Helper()
+
+	connectionID := fmt.Sprintf("conn-%d", time.Now().UnixNano())
+	visitor := make(chan *fakeVisitor, 1)
+	s.mu.Lock()
+	s.visitors[connectionID] = visitor
+	stream := s.streams[n]
+	s.mu.Unlock()
+
+	if err := stream.Send(&proto.ControlCommand{
+		Payload: &proto.ControlCommand_Work{
+			Work: &proto.WorkPayload{ConnectionId: connectionID},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case v, ok := <-visitor:
+		if !ok {
+			return nil
+		}
+		v.t = t
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client didn't start the data stream")
+		return nil
+	}
+}
+
+// pushConfig sends the config update of the settings to the nth registered tunnel,
+// it returns the acknowledgement of the client.
+func (s *fakeServer) pushConfig(t testing.TB, n int, settings string) *proto.TrafficToServer {
+	t.Helper()
+
+	connectionID := fmt.Sprintf("%s%d?%s", configUpdatePrefix, time.Now().UnixNano(), settings)
+	ack := make(chan *proto.TrafficToServer, 1)
+	s.mu.Lock()
+	s.acks[connectionID] = ack
+	stream := s.streams[n]
+	s.mu.Unlock()
+
+	if err := stream.Send(&proto.ControlCommand{
+		Payload: &proto.ControlCommand_Work{
+			Work: &proto.WorkPayload{ConnectionId: connectionID},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case traffic := <-ack:
+		return traffic
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client didn't acknowledge the config update")
+		return nil
+	}
+}
+
+func (v *fakeVisitor) send(data []byte) {
+	v.t.Helper()
+	if v.codec != nil && len(data) > 0 {
+		data = v.codec.encode(data)
+	}
+	if err := v.stream.Send(&proto.TrafficToClient{Data: data}); err != nil {
+		v.t.Fatal(err)
+	}
+}
+
+// finish sends the empty data to tell the client there is no more traffic.
+func (v *fakeVisitor) finish() {
+	v.send(nil)
+	select {
+	case <-v.sent:
+	default:
+		close(v.sent)
+	}
+}
+
+// Read reads the traffic from the client, it returns io.EOF once the client finishes sending.
+func (v *fakeVisitor) Read(b []byte) (int, error) {
+	for len(v.pending) == 0 {
+		if v.finished {
+			return 0, io.EOF
+		}
+		traffic, err := v.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		switch traffic.Action {
+		case proto.TrafficToServer_Sending:
+			v.pending = traffic.Data
+			if v.codec != nil {
+				if v.pending, err = v.codec.decode(traffic.Data); err != nil {
+					return 0, err
+				}
+			}
+		case proto.TrafficToServer_Finished, proto.TrafficToServer_Close:
+			v.finished = true
+			close(v.done)
+		}
+	}
+	n := copy(b, v.pending)
+	v.pending = v.pending[n:]
+	return n, nil
+}
+
+// readAll reads the traffic from the client until it finishes sending.
+func (v *fakeVisitor) readAll() []byte {
+	v.t.Helper()
+	buf, err := io.ReadAll(v)
+	if err != nil {
+		v.t.Fatal(err)
+	}
+	return buf
+}
+
+func sendInit(stream proto.TunnelService_RegisterServer, entrypoints ...string) error {
+	return stream.Send(&proto.ControlCommand{
+		Payload: &proto.ControlCommand_Init{
+			Init: &proto.InitPayload{
+				TunnelId:           "test",
+				AssignedEntrypoint: entrypoints,
+			},
+		},
+	})
+}
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseDelay time.Duration
+		maxDelay  time.Duration
+		want      []time.Duration
+	}{
+		{"doubling", 100 * time.Millisecond, time.Second, []time.Duration{
+			100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second,
+		}},
+		{"zero base", 0, time.Second, []time.Duration{0, 0, 0, 0}},
+		{"base over max", 2 * time.Second, time.Second, []time.Duration{time.Second, time.Second}},
+		{"overflow", time.Hour, time.Duration(math.MaxInt64), []time.Duration{
+			time.Hour, 2 * time.Hour, 4 * time.Hour,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &reconnectOptions{baseDelay: tt.baseDelay, maxDelay: tt.maxDelay}
+			for i, w := range tt.want {
+				if got := r.delay(i + 1); got != w {
+					t.Errorf("delay(%d) = %v, want %v", i+1, got, w)
+				}
+			}
+			// the delays never overflow past the max.
+			if got := r.delay(100); got < 0 || got > tt.maxDelay {
+				t.Errorf("delay(100) = %v, want at most %v", got, tt.maxDelay)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   []time.Duration
+	}{
+		{"defaults", RetryPolicy{MaxAttempts: 10}, []time.Duration{
+			time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second,
+		}},
+		{"custom", RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 25 * time.Millisecond}, []time.Duration{
+			10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, w := range tt.want {
+				if got := tt.policy.delay(i + 1); got != w {
+					t.Errorf("delay(%d) = %v, want %v", i+1, got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestReconnectJitter(t *testing.T) {
+	randoms := []float64{0, 0.5, 0.99, 0.25}
+	r := &reconnectOptions{baseDelay: 100 * time.Millisecond, maxDelay: time.Second, jitter: 0.5}
+	r.random = func() float64 {
+		v := randoms[0]
+		randoms = randoms[1:]
+		return v
+	}
+	// the backoffs are 100ms, 200ms, 400ms and 800ms, reduced by up to a half of them.
+	want := []time.Duration{
+		100 * time.Millisecond,
+		150 * time.Millisecond,
+		202 * time.Millisecond,
+		700 * time.Millisecond,
+	}
+	for i, w := range want {
+		if got := r.delay(i + 1); got != w {
+			t.Errorf("delay(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+
+	// the full jitter spreads the delays between zero and the backoff.
+	full := &reconnectOptions{baseDelay: time.Second, maxDelay: time.Second, jitter: 1}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := full.delay(1)
+		if d < 0 || d > time.Second {
+			t.Fatalf("delay %v is out of the range", d)
+		}
+		seen[d] = true
+	}
+	if len(seen) < 50 {
+		t.Fatalf("expected the delays to be spread, got %d distinct delays", len(seen))
+	}
+
+	for _, fraction := range []float64{-0.1, 1.5, math.NaN()} {
+		if _, err := NewClient("127.0.0.1:1", WithReconnectJitter(fraction)); err == nil {
+			t.Errorf("expected the jitter %v to fail", fraction)
+		}
+	}
+	client, err := NewClient("127.0.0.1:1", WithReconnectJitter(0.3), WithReconnect(3, time.Second, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.reconnect.jitter != 0.3 {
+		t.Fatalf("unexpected jitter: %v", client.reconnect.jitter)
+	}
+}
+
+func TestReconnectSleep(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		switch n {
+		case 0:
+			// drop the first control stream
+			return sendInit(stream, "tcp://127.0.0.1:20001")
+		case 1:
+			return status.Error(codes.Unavailable, "restarting")
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+
+	var mu sync.Mutex
+	var delays []time.Duration
+	reconnected := make(chan struct{})
+	client, err := NewClient(server.addr,
+		WithReconnect(3, time.Second, time.Minute),
+		WithReconnectJitter(0.5),
+		WithReconnectRand(func() float64 { return 0.5 }),
+		WithReconnectSleep(func(ctx context.Context, d time.Duration) error {
+			mu.Lock()
+			defer mu.Unlock()
+			delays = append(delays, d)
+			return ctx.Err()
+		}),
+		WithReconnectHandler(func(attempt int, err error) {
+			if err == nil {
+				close(reconnected)
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// the backoffs are 1s and 2s, reduced by a quarter of them, and nothing really waits.
+	want := []time.Duration{750 * time.Millisecond, 1500 * time.Millisecond}
+	if !slices.Equal(delays, want) {
+		t.Fatalf("unexpected delays %v, want %v", delays, want)
+	}
+}
+
+func TestStartTunnelReconnect(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		if n == 0 {
+			// drop the first control stream
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+
+	attempts := make(chan error, 10)
+	client, err := NewClient(server.addr,
+		WithReconnect(3, 10*time.Millisecond, 50*time.Millisecond),
+		WithReconnectHandler(func(attempt int, err error) {
+			attempts <- err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", "127.0.0.1:0")
+	entrypoint, quit, err := client.StartTunnel(ctx, tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entrypoint) != 1 || entrypoint[0].URL != "tcp://127.0.0.1:20001" {
+		t.Fatalf("unexpected entrypoint: %v", entrypoint)
+	}
+
+	select {
+	case err := <-attempts:
+		if err != nil {
+			t.Fatalf("reconnect failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reconnect attempt")
+	}
+
+	registrations := server.registrations()
+	if len(registrations) != 2 {
+		t.Fatalf("expected 2 registrations, got %d", len(registrations))
+	}
+	if port := registrations[1].GetTcp().GetRemotePort(); port != 20001 {
+		t.Fatalf("expected the same port to be requested after reconnecting, got %d", port)
+	}
+	if status := tunnel.Status(); status.State != StateConnected || status.LastError == nil || status.Reconnects != 1 {
+		t.Fatalf("unexpected status after reconnecting: %+v", status)
+	}
+
+	cancel()
+	if err := <-quit; err != nil {
+		t.Fatalf("unexpected quit error: %v", err)
+	}
+	if state := tunnel.Status().State; state != StateClosed {
+		t.Fatalf("expected closed state, got %v", state)
+	}
+}
+
+func TestStartTunnelsPartialFailure(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if req.Tunnel.Name == "bad" {
+			return status.Error(codes.AlreadyExists, "port already in use")
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	entrypoints, quit, err := client.StartTunnels(ctx,
+		NewTCPTunnel("good", "127.0.0.1:0"),
+		NewTCPTunnel("bad", "127.0.0.1:0"),
+	)
+	var tunnelErr *TunnelError
+	if !errors.As(err, &tunnelErr) || tunnelErr.Name != "bad" {
+		t.Fatalf("expected the error of the bad tunnel, got %v", err)
+	}
+	if len(entrypoints[0]) != 1 || entrypoints[1] != nil {
+		t.Fatalf("unexpected entrypoints: %v", entrypoints)
+	}
+
+	cancel()
+	for err := range quit {
+		t.Fatalf("unexpected quit error: %v", err)
+	}
+}
+
+func TestStartTunnelsResults(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if req.Tunnel.Name == "bad" {
+			return status.Error(codes.AlreadyExists, "port already in use")
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		if req.Tunnel.Name == "dropped" {
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results, quits := client.StartTunnelsResults(ctx,
+		NewTCPTunnel("good", "127.0.0.1:0"),
+		NewTCPTunnel("bad", "127.0.0.1:0"),
+		NewTCPTunnel("dropped", "127.0.0.1:0"),
+	)
+	if results[0].Name != "good" || results[0].Err != nil || results[0].Entrypoint.Port != 20000 {
+		t.Fatalf("unexpected result of the good tunnel: %+v", results[0])
+	}
+	var conflictErr *ConflictError
+	if results[1].Name != "bad" || !errors.As(results[1].Err, &conflictErr) || results[1].Entrypoint.URL != "" {
+		t.Fatalf("unexpected result of the bad tunnel: %+v", results[1])
+	}
+	if len(quits) != 2 || quits["bad"] != nil {
+		t.Fatalf("expected the quit channels of the started tunnels, got %v", quits)
+	}
+
+	// a tunnel which quits doesn't affect the others.
+	if err := <-quits["dropped"]; !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	if state := results[0].Tunnel.Status().State; state != StateConnected {
+		t.Fatalf("expected the good tunnel to keep running, got %v", state)
+	}
+	cancel()
+	if err := <-quits["good"]; err != nil {
+		t.Fatalf("expected nil after the ctx is done, got %v", err)
+	}
+}
+
+func TestAddRemoveTunnel(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Shutdown(context.Background())
+
+	// the ctx of AddTunnel only bounds the registration.
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entrypoint, err := client.AddTunnel(ctx, NewTCPTunnel(fmt.Sprintf("tunnel-%d", i), "127.0.0.1:0"))
+			if err == nil && entrypoint.URL == "" {
+				err = errors.New("no entrypoint")
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	cancel()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = client.RemoveTunnel(fmt.Sprintf("tunnel-%d", i))
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range client.Tunnels() {
+		if info.Status.State != StateClosed || info.Status.QuitReason != QuitNormal {
+			t.Fatalf("expected %s to be closed normally, got %v %v", info.Name, info.Status.State, info.Status.QuitReason)
+		}
+	}
+
+	if err := client.RemoveTunnel("tunnel-0"); !errors.Is(err, ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound for the removed tunnel, got %v", err)
+	}
+	if err := client.RemoveTunnel("missing"); !errors.Is(err, ErrTunnelNotFound) {
+		t.Fatalf("expected ErrTunnelNotFound, got %v", err)
+	}
+	// the name can be added again after it's removed.
+	if _, err := client.AddTunnel(context.Background(), NewTCPTunnel("tunnel-0", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPTunnelProxy(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String())
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	visitor.finish()
+	if got := string(visitor.readAll()); got != "ping" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+	if status := tunnel.Status(); status.BytesIn != 4 || status.BytesOut != 4 {
+		t.Fatalf("unexpected bytes: in=%d out=%d", status.BytesIn, status.BytesOut)
+	}
+	tunnels := client.Tunnels()
+	if len(tunnels) != 1 || tunnels[0].Tunnel != tunnel {
+		t.Fatalf("unexpected tunnels: %v", tunnels)
+	}
+	if info := tunnels[0]; info.Name != "test" || info.Protocol != "tcp" || len(info.Entrypoints) != 1 ||
+		info.Status.State != StateConnected {
+		t.Fatalf("unexpected tunnel info: %+v", info)
+	}
+}
+
+func TestTunnelAddrFilter(t *testing.T) {
+	client, err := NewClient("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(context.Background(), NewTCPTunnel("test", "127.0.0.1:0", WithAllowCIDR("10.0.0.0"))); err == nil {
+		t.Fatal("expected the invalid cidr to fail")
+	}
+
+	server := newFakeServer(t)
+	server.remoteAddr = "10.1.2.3:5555"
+	client, err = NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", "127.0.0.1:0", WithAllowCIDR("10.0.0.0/8"), WithDenyCIDR("10.1.0.0/16"))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if md := server.md[0]; len(md.Get(metadataAllowCIDR)) != 1 || len(md.Get(metadataDenyCIDR)) != 1 {
+		t.Fatalf("expected the cidrs to be sent to the server, got %v", md)
+	}
+
+	if visitor := server.visit(t, 0); visitor != nil {
+		t.Fatal("expected the connection to be rejected")
+	}
+	if rejected := tunnel.Status().RejectedConns; rejected != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", rejected)
+	}
+
+	// the allow list fails closed if the server doesn't tell the address of the user.
+	server = newFakeServer(t)
+	client, err = NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel = NewTCPTunnel("test", "127.0.0.1:0", WithAllowCIDR("10.0.0.0/8"))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if visitor := server.visit(t, 0); visitor != nil {
+		t.Fatal("expected the connection of the unknown address to be rejected")
+	}
+	if rejected := tunnel.Status().RejectedConns; rejected != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", rejected)
+	}
+}
+
+func TestTunnelClose(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewTCPTunnel("test", local.Addr().String())
+	_, quit, err := client.StartTunnel(context.Background(), tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connection never finishes, so closing times out.
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(visitor, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := tunnel.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the draining to time out, got %v", err)
+	}
+	if err := <-quit; err != nil {
+		t.Fatalf("expected nil after closing, got %v", err)
+	}
+	if err := tunnel.Close(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected closing twice to be a no-op, got %v", err)
+	}
+	if status := tunnel.Status(); status.State != StateClosed {
+		t.Fatalf("expected closed state, got %v", status.State)
+	}
+}
+
+func TestTCPTunnelIdleTimeout(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	localClosed := make(chan struct{})
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// the connection is reaped by the client.
+		io.Copy(io.Discard, conn)
+		close(localClosed)
+	}()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithTCPIdleTimeout(100*time.Millisecond))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	start := time.Now()
+	if got := visitor.readAll(); len(got) != 0 {
+		t.Fatalf("unexpected data: %q", got)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("the connection is closed too early: %v", elapsed)
+	}
+	select {
+	case <-localClosed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the local connection is not closed")
+	}
+}
+
+func TestUDPTunnelSessions(t *testing.T) {
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewUDPTunnel("test", local.LocalAddr().String(),
+		WithUdpSessionTimeout(100*time.Millisecond),
+		WithUdpMaxSessions(1),
+	)
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	md := server.md[0]
+	if got := md.Get(metadataUDPSessionTimeout); len(got) != 1 || got[0] != "100ms" {
+		t.Fatalf("unexpected session timeout metadata: %v", got)
+	}
+	if got := md.Get(metadataUDPMaxSessions); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("unexpected max sessions metadata: %v", got)
+	}
+
+	visitor := server.visit(t, 0)
+	if dropped := server.visit(t, 0); dropped != nil {
+		t.Fatal("expected the second session to be dropped")
+	}
+	if rejected := tunnel.Status().RejectedConns; rejected != 1 {
+		t.Fatalf("expected 1 rejected session, got %d", rejected)
+	}
+
+	// the session expires without any datagram.
+	visitor.readAll()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Status().ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the session is not expired")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if visitor := server.visit(t, 0); visitor == nil {
+		t.Fatal("expected a new session after the old one expired")
+	}
+}
+
+func TestWithDialer(t *testing.T) {
+	server := newFakeServer(t)
+	dialed := make(chan string, 10)
+	client, err := NewClient("castled.test:6100", WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+		dialed <- addr
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", server.addr)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-dialed; addr != "castled.test:6100" {
+		t.Fatalf("unexpected dialed address: %s", addr)
+	}
+}
+
+// stallConn drops the writes once stalled, like a connection whose NAT mapping is gone.
+type stallConn struct {
+	net.Conn
+	stalled *atomic.Bool
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	if c.stalled.Load() {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestWithKeepAlive(t *testing.T) {
+	for _, opt := range []Option{WithKeepAlive(0, time.Second), WithKeepAlive(time.Minute, -time.Second)} {
+		if _, err := NewClient("127.0.0.1:6100", opt); err == nil {
+			t.Fatal("expected the non-positive keepalive to fail")
+		}
+	}
+	client, err := NewClient("127.0.0.1:6100", WithKeepAlive(time.Second, 2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ka := client.keepalive; ka.Time != minKeepAliveInterval || ka.Timeout != 2*time.Second || !ka.PermitWithoutStream {
+		t.Fatalf("expected the interval to be raised to the min of grpc, got %+v", ka)
+	}
+
+	if testing.Short() {
+		t.Skip("the pings are at least 10 seconds apart")
+	}
+	// the connection stalls silently, only the unanswered pings tell it's broken.
+	server := newFakeServer(t)
+	var conns []*atomic.Bool
+	var mu sync.Mutex
+	reconnected := make(chan struct{}, 1)
+	client, err = NewClient(server.addr,
+		WithKeepAlive(minKeepAliveInterval, 500*time.Millisecond),
+		WithReconnect(3, 10*time.Millisecond, 50*time.Millisecond),
+		WithReconnectHandler(func(attempt int, err error) {
+			if err == nil {
+				reconnected <- struct{}{}
+			}
+		}),
+		WithDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			stalled := new(atomic.Bool)
+			mu.Lock()
+			conns = append(conns, stalled)
+			mu.Unlock()
+			return &stallConn{Conn: conn, stalled: stalled}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	for _, stalled := range conns {
+		stalled.Store(true)
+	}
+	mu.Unlock()
+
+	select {
+	case <-reconnected:
+	case <-time.After(3 * minKeepAliveInterval):
+		t.Fatal("expected the stalled connection to be noticed by the keepalive")
+	}
+	if n := len(server.registrations()); n != 2 {
+		t.Fatalf("expected 2 registrations, got %d", n)
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if auth := md.Get(metadataAuthorization); len(auth) != 1 || auth[0] != "Bearer good" {
+			return status.Error(codes.Unauthenticated, "invalid token")
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := NewClient(server.addr, WithAuthToken("bad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0"))
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected an AuthError, got %v", err)
+	}
+	if !errors.Is(err, ErrAuth) {
+		t.Fatalf("expected the AuthError to match ErrAuth, got %v", err)
+	}
+
+	var calls int
+	client, err = NewClient(server.addr, WithAuthTokenFunc(func(ctx context.Context) (string, error) {
+		calls++
+		return "good", nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the token func to be called once, got %d", calls)
+	}
+}
+
+func TestClientShutdown(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, quit, err := client.StartTunnels(context.Background(),
+		NewTCPTunnel("a", local.Addr().String()),
+		NewTCPTunnel("b", local.Addr().String()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the in-flight connection is drained before closing.
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(context.Background())
+	}()
+	visitor.finish()
+	if got := string(visitor.readAll()); got != "ping" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("unexpected shutdown error: %v", err)
+	}
+	for err := range quit {
+		t.Fatalf("unexpected quit error: %v", err)
+	}
+
+	if _, _, err := client.StartTunnel(context.Background(), NewTCPTunnel("c", local.Addr().String())); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed, got %v", err)
+	}
+}
+
+func TestRegisterRetry(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		switch {
+		case req.Tunnel.Name == "denied":
+			return status.Error(codes.PermissionDenied, "denied")
+		case n < 3:
+			return status.Error(codes.Unavailable, "not ready")
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := NewClient(server.addr, WithRegisterRetry(RetryPolicy{MaxAttempts: 2, Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0")); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected unavailable after 2 attempts, got %v", err)
+	}
+
+	client, err = NewClient(server.addr, WithRegisterRetry(RetryPolicy{Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewTCPTunnel("test2", "127.0.0.1:0")
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if n := tunnel.Status().RegisterErrors; n != 1 {
+		t.Fatalf("expected 1 register error, got %d", n)
+	}
+
+	denied := NewTCPTunnel("denied", "127.0.0.1:0")
+	_, _, err = client.StartTunnel(ctx, denied)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected an AuthError, got %v", err)
+	}
+	if n := denied.Status().RegisterErrors; n != 1 {
+		t.Fatalf("expected no retry on a permanent error, got %d attempts", n)
+	}
+}
+
+func TestLocalDialRetries(t *testing.T) {
+	// reserve a port which is not listened yet.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := lis.Addr().String()
+	lis.Close()
+
+	failed := make(chan Event, 100)
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventLocalDialFailed {
+			failed <- event
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", localAddr, WithLocalDialRetries(50, 20*time.Millisecond), WithLocalDialTimeout(time.Second))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		// the local server comes up after the first failed dial.
+		<-failed
+		local, err := net.Listen("tcp", localAddr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Cleanup(func() { local.Close() })
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	visitor := server.visit(t, 0)
+	if visitor == nil {
+		t.Fatal("expected the connection to be forwarded after retrying")
+	}
+	visitor.send([]byte("hello"))
+	visitor.finish()
+	if got := string(visitor.readAll()); got != "hello" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+}
+
+func TestLocalDNSCache(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(lis.Addr().String())
+
+	tunnel := NewTCPTunnel("test", net.JoinHostPort("backend.test", port),
+		WithLocalDNSCache(time.Hour), WithLocalDNSRefresh(), WithLocalDialRetries(1, 0))
+	if err := tunnel.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	var lookups []string
+	// the backend moves from 127.0.0.2, which refuses the connections, to 127.0.0.1.
+	addrs := []string{"127.0.0.2", "127.0.0.1"}
+	tunnel.dnsCache.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups = append(lookups, host)
+		if len(lookups) > len(addrs) {
+			return nil, nil
+		}
+		return addrs[len(lookups)-1 : len(lookups)], nil
+	}
+	dial := func() error {
+		conn, err := tunnel.dialer.dial(context.Background(), "tcp", tunnel.LocalAddr, nil)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	// the retry resolves again once the cached address refuses.
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(lookups, []string{"backend.test", "backend.test"}) {
+		t.Fatalf("expected the address to be cached after the refresh, got the lookups %v", lookups)
+	}
+
+	tunnel.RefreshLocalDNS()
+	if err := dial(); err == nil || !strings.Contains(err.Error(), "resolves to no addresses") {
+		t.Fatalf("expected the empty resolution to fail, got %v", err)
+	}
+
+	if err := NewTCPTunnel("test", "127.0.0.1:8080", WithLocalDNSCache(-time.Second)).Validate(); err == nil {
+		t.Fatal("expected the negative ttl to be rejected")
+	}
+}
+
+func TestLocalDialSourceAddr(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr()
+		conn.Close()
+	}()
+
+	tunnel := NewTCPTunnel("test", lis.Addr().String(), WithLocalDialSourceAddr("127.0.0.1"))
+	if err := tunnel.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tunnel.dialer.dial(context.Background(), "tcp", tunnel.LocalAddr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := conn.LocalAddr().(*net.TCPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected the conn to be bound to the source address, got %s", addr)
+	}
+	if addr := (<-remote).(*net.TCPAddr); !addr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("expected the local server to see the source address, got %s", addr)
+	}
+
+	// 192.0.2.0/24 is reserved for the documentation, it's never assigned.
+	for _, source := range []string{"192.0.2.1", "not-an-ip"} {
+		if err := NewTCPTunnel("test", "127.0.0.1:8080", WithLocalDialSourceAddr(source)).Validate(); err == nil {
+			t.Fatalf("expected the source address %q to be rejected", source)
+		}
+	}
+}
+
+func TestTunnelValidate(t *testing.T) {
+	if err := NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPDomain("example.com")).Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, tunnel := range map[string]*Tunnel{
+		"conflicting entrypoints": NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPDomain("example.com"), WithHTTPSubDomain("foo")),
+		"invalid cidr":            NewTCPTunnel("test", "127.0.0.1:8080", WithAllowCIDR("10.0.0.0")),
+		"invalid local address":   NewUDPTunnel("test", "127.0.0.1"),
+		"empty name":              NewTCPTunnel("", "127.0.0.1:8080"),
+		"invalid name":            NewTCPTunnel("go http", "127.0.0.1:8080"),
+		"long name":               NewTCPTunnel(strings.Repeat("a", maxNameLength+1), "127.0.0.1:8080"),
+	} {
+		if err := tunnel.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	client, err := NewClient("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPPort(8080), WithHTTPRandomSubdomain())
+	if _, _, err := client.StartTunnel(context.Background(), tunnel); err == nil || err.Error() != tunnel.Validate().Error() {
+		t.Fatalf("expected StartTunnel to fail with the validation error, got %v", err)
+	}
+}
+
+func TestRegisterConflict(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if req.Tunnel.GetHttp().GetSubdomain() == "taken" {
+			return status.Error(codes.AlreadyExists, "subdomain already registered")
+		}
+		if err := sendInit(stream, "http://random.example.com"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.StartTunnel(ctx, NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPSubDomain("taken")))
+	if !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("expected ErrAddressInUse, got %v", err)
+	}
+	var conflict *ConflictError
+	if !errors.As(err, &conflict) || conflict.Subdomain != "taken" {
+		t.Fatalf("expected a ConflictError of the subdomain, got %v", err)
+	}
+
+	// fall back to a random subdomain.
+	if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPRandomSubdomain())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTCPBindAddr(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		if addrs := md.Get(metadataTCPBindAddr); len(addrs) != 1 || addrs[0] != "10.0.0.1" {
+			stream.SetTrailer(metadata.Pairs(metadataAllowedBindAddrs, "10.0.0.1,192.168.1.1"))
+			return status.Error(codes.PermissionDenied, "bind address is not allowed")
+		}
+		if req.Tunnel.Name == "confirmed" {
+			if err := stream.SendHeader(metadata.Pairs(metadataAccepted, metadataTCPBindAddr)); err != nil {
+				return err
+			}
+		}
+		if err := sendInit(stream, "tcp://10.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan Event, 10)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventWarning {
+			events <- event
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.StartTunnel(ctx, NewTCPTunnel("denied", "127.0.0.1:8080", WithTCPBindAddr("203.0.113.1")))
+	var bindErr *BindAddrError
+	if !errors.As(err, &bindErr) || bindErr.Addr != "203.0.113.1" || !slices.Equal(bindErr.Allowed, []string{"10.0.0.1", "192.168.1.1"}) {
+		t.Fatalf("expected a BindAddrError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "10.0.0.1, 192.168.1.1") {
+		t.Fatalf("expected the allowed addresses in the error, got %v", err)
+	}
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		t.Fatalf("unexpected AuthError: %v", err)
+	}
+
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("invalid", "127.0.0.1:8080", WithTCPBindAddr("10.0.0.1:80"))); err == nil {
+		t.Fatal("expected the invalid bind address to fail")
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("confirmed", "127.0.0.1:8080", WithTCPBindAddr("10.0.0.1"))); err != nil {
+		t.Fatal(err)
+	}
+	// the server which doesn't confirm the bind addr ignores it.
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("allowed", "127.0.0.1:8080", WithTCPBindAddr("10.0.0.1"))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-events:
+		if event.Tunnel != "allowed" || !strings.Contains(event.Err.Error(), "bind addr") {
+			t.Fatalf("unexpected warning: %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no warning of the unconfirmed bind addr")
+	}
+}
+
+// udpEcho serves a udp backend which replies each datagram with the prefix after the delay.
+func udpEcho(t *testing.T, prefix string, delay time.Duration) string {
+	t.Helper()
+
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(delay)
+			backend.WriteTo(append([]byte(prefix), buf[:n]...), addr)
+		}
+	}()
+	return backend.LocalAddr().String()
+}
+
+func TestUDPTunnelFanout(t *testing.T) {
+	if err := NewUDPTunnel("test", "127.0.0.1:8080", WithUdpFanout(make([]string, maxUDPFanout)...)).Validate(); err == nil {
+		t.Fatal("expected too many fanout backends to fail")
+	}
+
+	local := udpEcho(t, "a:", 0)
+	fanout := []string{udpEcho(t, "b:", 50*time.Millisecond), udpEcho(t, "c:", 50*time.Millisecond)}
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for i, options := range [][]UDPOption{
+		{WithUdpFanout(fanout...)},
+		{WithUdpFanout(fanout...), WithUdpFanoutAllReplies()},
+	} {
+		options = append(options, WithUdpSessionTimeout(300*time.Millisecond))
+		if _, _, err := client.StartTunnel(ctx, NewUDPTunnel(fmt.Sprintf("test-%d", i), local, options...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("x"))
+	if got := string(visitor.readAll()); got != "a:x" {
+		t.Fatalf("expected only the reply of the first responder, got %q", got)
+	}
+
+	visitor = server.visit(t, 1)
+	visitor.send([]byte("x"))
+	got := string(visitor.readAll())
+	for _, want := range []string{"a:x", "b:x", "c:x"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected the reply %q, got %q", want, got)
+		}
+	}
+}
+
+func TestUDPMaxDatagramSize(t *testing.T) {
+	if err := NewUDPTunnel("test", "127.0.0.1:8080", WithUdpMaxDatagramSize(maxUDPDatagramSize+1)).Validate(); err == nil {
+		t.Fatal("expected the max datagram size exceeding udp to fail")
+	}
+
+	// the local server replies 3000 bytes to "big", and echoes the others.
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := local.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) == "big" {
+				local.WriteTo(make([]byte, 3000), addr)
+				continue
+			}
+			local.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	dropped := make(chan Event, 10)
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventDatagramDropped {
+			dropped <- event
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewUDPTunnel("default", local.LocalAddr().String())); err != nil {
+		t.Fatal(err)
+	}
+	limited := NewUDPTunnel("limited", local.LocalAddr().String(), WithUdpMaxDatagramSize(1000))
+	if _, _, err := client.StartTunnel(ctx, limited); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[1].Get(metadataUDPMaxDatagramSize); len(got) != 1 || got[0] != "1000" {
+		t.Fatalf("unexpected max datagram size metadata: %v", got)
+	}
+
+	// the datagrams bigger than the copy buffer are kept whole by default.
+	visitor := server.visit(t, 0)
+	large := bytes.Repeat([]byte("x"), 3*DEFAULT_BUFFER_SIZE)
+	visitor.send(large)
+	got := make([]byte, len(large))
+	if _, err := io.ReadFull(visitor, got); err != nil || !bytes.Equal(got, large) {
+		t.Fatalf("expected the large datagram to be echoed whole, got %d bytes, %v", len(got), err)
+	}
+
+	visitor = server.visit(t, 1)
+	visitor.send(make([]byte, 2000))
+	visitor.send([]byte("big"))
+	visitor.send([]byte("ok"))
+	buf := make([]byte, 10)
+	if n, err := visitor.Read(buf); err != nil || string(buf[:n]) != "ok" {
+		t.Fatalf("expected only the datagram within the size to be echoed, got %q, %v", buf[:n], err)
+	}
+	for _, want := range []DatagramSizeError{{Size: 2000, MaxSize: 1000, FromUser: true}, {Size: 1001, MaxSize: 1000}} {
+		select {
+		case event := <-dropped:
+			var sizeErr *DatagramSizeError
+			if !errors.As(event.Err, &sizeErr) || *sizeErr != want {
+				t.Fatalf("expected the dropped datagram %+v, got %v", want, event.Err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected an EventDatagramDropped")
+		}
+	}
+	if n := limited.Status().DroppedDatagrams; n != 2 {
+		t.Fatalf("expected 2 dropped datagrams, got %d", n)
+	}
+}
+
+func TestHealthServer(t *testing.T) {
+	if _, err := NewClient("127.0.0.1:1", WithHealthServer("127.0.0.1:-1")); err == nil {
+		t.Fatal("expected the invalid health address to fail")
+	}
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithHealthServer("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := "http://" + client.health.lis.Addr().String()
+	probe := func(path string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if code, body := probe("/readyz"); code != http.StatusServiceUnavailable || !strings.Contains(body, "no tunnel") {
+		t.Fatalf("expected not ready before any tunnel, got %d %q", code, body)
+	}
+	// the probe connects the lazy connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body := probe("/healthz")
+		if code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connection to be up, got %d %q", code, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closeStream := make(chan struct{})
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-closeStream
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:8080")); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := probe("/readyz"); code != http.StatusOK {
+		t.Fatalf("expected ready, got %d %q", code, body)
+	}
+	close(closeStream)
+	for {
+		code, body := probe("/readyz")
+		if code == http.StatusServiceUnavailable && strings.Contains(body, "tunnel test is") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected not ready after the server is gone, got %d %q", code, body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := client.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(base + "/healthz"); err == nil {
+		t.Fatal("expected the health server to be closed")
+	}
+}
+
+func TestPing(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtt, err := client.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 {
+		t.Fatalf("unexpected rtt: %v", rtt)
+	}
+	if len(server.registered) != 0 {
+		t.Fatal("ping shouldn't register a tunnel")
+	}
+
+	// the server accepts the connection but never responds.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	client, err = NewClient(lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.Ping(ctx)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) {
+		t.Fatalf("expected a TimeoutError, got %v", err)
+	}
+}
+
+func TestTunnelMaxConnections(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	rejected := make(chan Event, 10)
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventConnRejected {
+			rejected <- event
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithMaxConnections(1))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataMaxConnections); len(got) != 1 || got[0] != "1" {
+		t.Fatalf("unexpected max connections metadata: %v", got)
+	}
+
+	visitor := server.visit(t, 0)
+	if dropped := server.visit(t, 0); dropped != nil {
+		t.Fatal("expected the second connection to be refused")
+	}
+	select {
+	case <-rejected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an EventConnRejected")
+	}
+	if n := tunnel.Status().RejectedConns; n != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", n)
+	}
+
+	// the slot is released after the connection closes.
+	visitor.finish()
+	visitor.readAll()
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Status().ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if visitor := server.visit(t, 0); visitor == nil {
+		t.Fatal("expected a new connection after the old one closed")
+	}
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	if err := NewTCPTunnel("test", "127.0.0.1:8080", WithConnectionRateLimit(-1, 0)).Validate(); err == nil {
+		t.Fatal("expected the negative rate to fail")
+	}
+
+	local := tcpNamed(t, "a")
+	rejected := make(chan Event, 10)
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventConnRejected {
+			rejected <- event
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a token every 10 minutes, only the burst is available in the test.
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithConnectionRateLimit(1, 2))
+	tunnel.connLimit.rate = 1.0 / 600
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataConnectionRate); len(got) != 1 || got[0] != "1,2" {
+		t.Fatalf("unexpected connection rate metadata: %v", got)
+	}
+
+	for i := 0; i < 2; i++ {
+		if visitor := server.visit(t, 0); visitor == nil {
+			t.Fatal("expected the connection in the burst to be accepted")
+		}
+	}
+	if dropped := server.visit(t, 0); dropped != nil {
+		t.Fatal("expected the connection exceeding the rate to be refused")
+	}
+	select {
+	case <-rejected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an EventConnRejected")
+	}
+	if status := tunnel.Status(); status.TotalConns != 2 || status.RejectedConns != 1 {
+		t.Fatalf("expected 2 accepted and 1 rejected connections, got %d and %d", status.TotalConns, status.RejectedConns)
+	}
+}
+
+func TestIngressRateLimitLargeMessages(t *testing.T) {
+	const (
+		size  = 512 * 1024
+		rate  = 1024 * 1024
+		burst = 64 * 1024
+	)
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	received := make(chan time.Time, 1)
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.CopyN(io.Discard, conn, size)
+		received <- time.Now()
+	}()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithIngressRateLimit(rate), WithRateLimitBurst(burst))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is much larger than the buffer the client reads it with.
+	visitor := server.visit(t, 0)
+	start := time.Now()
+	visitor.send(make([]byte, size))
+	select {
+	case at := <-received:
+		if want := time.Duration(float64(size-burst) / rate * float64(time.Second)); at.Sub(start) < want*9/10 {
+			t.Fatalf("expected %d bytes at %d B/s to take about %v, took %v", size, rate, want, at.Sub(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the traffic")
+	}
+}
+
+func TestTunnelExpiry(t *testing.T) {
+	for _, tunnel := range []*Tunnel{
+		NewTCPTunnel("test", "127.0.0.1:8080", WithTTL(-time.Second)),
+		NewTCPTunnel("test", "127.0.0.1:8080", WithMaxRequests(-1)),
+	} {
+		if err := tunnel.Validate(); err == nil {
+			t.Fatal("expected the negative limit to fail")
+		}
+	}
+
+	local := tcpNamed(t, "a")
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("max requests", func(t *testing.T) {
+		tunnel := NewTCPTunnel("requests", local.Addr().String(), WithMaxRequests(2))
+		_, quit, err := client.StartTunnel(ctx, tunnel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := len(server.registrations()) - 1
+		first := server.visit(t, n)
+		if first == nil {
+			t.Fatal("expected the first connection to be accepted")
+		}
+		last := server.visit(t, n)
+		if last == nil {
+			t.Fatal("expected the last connection to be accepted")
+		}
+		// the last connection keeps going until it ends.
+		last.send([]byte("ping"))
+		last.finish()
+		if got := last.readAll(); string(got) != "aping" {
+			t.Fatalf("unexpected response of the last connection: %q", got)
+		}
+		first.finish()
+		select {
+		case err := <-quit:
+			if err != nil {
+				t.Fatalf("expected the tunnel to expire without an error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the tunnel to expire after the max requests")
+		}
+		if reason := tunnel.Status().QuitReason; reason != QuitExpired {
+			t.Fatalf("expected QuitExpired, got %s", reason)
+		}
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		tunnel := NewTCPTunnel("ttl", local.Addr().String(), WithTTL(100*time.Millisecond))
+		_, quit, err := client.StartTunnel(ctx, tunnel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.mu.Lock()
+		md := server.md[len(server.md)-1]
+		server.mu.Unlock()
+		if got := md.Get(metadataTTL); len(got) != 1 || got[0] != "100ms" {
+			t.Fatalf("unexpected ttl metadata: %v", got)
+		}
+		select {
+		case err := <-quit:
+			if err != nil {
+				t.Fatalf("expected the tunnel to expire without an error, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the tunnel to expire after the ttl")
+		}
+		if reason := tunnel.Status().QuitReason; reason != QuitExpired {
+			t.Fatalf("expected QuitExpired, got %s", reason)
+		}
+	})
+}
+
+func TestConfigUpdate(t *testing.T) {
+	local := tcpNamed(t, "a")
+	server := newFakeServer(t)
+	updates := make(chan ConfigUpdate, 10)
+	client, err := NewClient(server.addr, WithConfigUpdateHandler(func(update ConfigUpdate) error {
+		updates <- update
+		if update.EgressRateLimit != nil {
+			return errors.New("egress is managed locally")
+		}
+		return nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithIngressRateLimit(1<<20))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataConfigUpdates); len(got) != 1 || got[0] != "true" {
+		t.Fatalf("unexpected config updates metadata: %v", got)
+	}
+
+	ack := server.pushConfig(t, 0, "max-connections=1&ingress-rate-limit=2048")
+	if ack.Action != proto.TrafficToServer_Finished {
+		t.Fatalf("expected the update to be applied, got %v: %s", ack.Action, ack.Data)
+	}
+	update := <-updates
+	if update.Tunnel != "test" || *update.MaxConnections != 1 || *update.IngressRateLimit != 2048 || update.RateLimitBurst != nil {
+		t.Fatalf("unexpected update: %+v", update)
+	}
+	if tunnel.ingress.rate != 2048 {
+		t.Fatalf("expected the ingress limit to be updated, got %v", tunnel.ingress.rate)
+	}
+	if visitor := server.visit(t, 0); visitor == nil {
+		t.Fatal("expected the first connection to be accepted")
+	}
+	if dropped := server.visit(t, 0); dropped != nil {
+		t.Fatal("expected the connection above the new limit to be refused")
+	}
+
+	// the refused updates change nothing.
+	ack = server.pushConfig(t, 0, "egress-rate-limit=1024")
+	if ack.Action != proto.TrafficToServer_Close || !strings.Contains(string(ack.Data), "egress is managed locally") {
+		t.Fatalf("expected the update to be refused by the handler, got %v: %s", ack.Action, ack.Data)
+	}
+	if tunnel.egress != nil {
+		t.Fatal("expected the egress to stay unlimited")
+	}
+	ack = server.pushConfig(t, 0, "max-connections=5&unknown=1")
+	if ack.Action != proto.TrafficToServer_Close || !strings.Contains(string(ack.Data), "unknown") {
+		t.Fatalf("expected the unknown setting to be refused, got %v: %s", ack.Action, ack.Data)
+	}
+	if _, maxConns := tunnel.connLimits(); maxConns != 1 {
+		t.Fatalf("expected the max connections to stay 1, got %d", maxConns)
+	}
+}
+
+func TestClientForEachConn(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	server := newFakeServer(t)
+	server.remoteAddr = "10.1.2.3:5555"
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String())
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(visitor, buf); err != nil {
+		t.Fatal(err)
+	}
+	var stats []ConnStats
+	client.ForEachConn(func(s ConnStats) {
+		stats = append(stats, s)
+	})
+	if len(stats) != 1 {
+		t.Fatalf("expected 1 active connection, got %d", len(stats))
+	}
+	s := stats[0]
+	if s.Tunnel != "test" || s.RemoteAddr.String() != "10.1.2.3:5555" || s.BytesIn != 5 || s.BytesOut != 5 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if s.Opened.IsZero() || s.Duration <= 0 {
+		t.Fatalf("unexpected open time: %+v", s)
+	}
+
+	visitor.finish()
+	visitor.readAll()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var n int
+		client.ForEachConn(func(ConnStats) { n++ })
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the closed connection is still reported")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParseServerAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr   string
+		want   string
+		useTLS bool
+	}{
+		{"127.0.0.1:6610", "127.0.0.1:6610", false},
+		{"localhost:6610", "localhost:6610", false},
+		{"castle://castled.test:6610", "castled.test:6610", false},
+		{"grpc://castled.test:6610", "castled.test:6610", false},
+		{"castles://castled.test:6610", "castled.test:6610", true},
+		{"GRPCS://castled.test:6610", "castled.test:6610", true},
+	} {
+		got, useTLS, err := parseServerAddr(tc.addr)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.addr, err)
+		}
+		if got != tc.want || useTLS != tc.useTLS {
+			t.Fatalf("%s: got %s, tls %v", tc.addr, got, useTLS)
+		}
+	}
+
+	for _, addr := range []string{"udp://castled.test:6610", "castle://", "castle://castled.test:6610/path"} {
+		if _, err := NewClient(addr); err == nil {
+			t.Fatalf("%s: expected an error", addr)
+		}
+	}
+}
+
+// tcpNamed serves a tcp backend which sends its name to each connection then echoes.
+func tcpNamed(t *testing.T, name string) net.Listener {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return lis
+}
+
+func TestTCPHalfClose(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// like a server which speaks first, shut down writing and keep reading.
+		conn.Write([]byte("banner"))
+		conn.(*net.TCPConn).CloseWrite()
+		b, _ := io.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	server := newFakeServer(t)
+	server.halfClose = true
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", lis.Addr().String())
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := server.visit(t, 0)
+	if got := string(visitor.readAll()); got != "banner" {
+		t.Fatalf("unexpected banner: %q", got)
+	}
+	// the local server finished sending, the user can still send.
+	visitor.send([]byte("hello"))
+	visitor.finish()
+	select {
+	case got := <-received:
+		if got != "hello" {
+			t.Fatalf("unexpected traffic after the half-close: %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the half-close of the user isn't propagated to the local server")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Status().ActiveConns != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not closed after both directions ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTCPTunnelUpstreams(t *testing.T) {
+	if err := NewTCPTunnel("test", "127.0.0.1:8080", WithTCPBalancer("fastest")).Validate(); err == nil {
+		t.Fatal("expected the unknown strategy to fail")
+	}
+
+	a, b, c := tcpNamed(t, "a"), tcpNamed(t, "b"), tcpNamed(t, "c")
+	down := tcpNamed(t, "d")
+	down.Close()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	roundRobin := NewTCPTunnel("round-robin", a.Addr().String(),
+		WithTCPUpstreams(down.Addr().String(), b.Addr().String(), c.Addr().String()))
+	leastConns := NewTCPTunnel("least-connections", a.Addr().String(),
+		WithTCPUpstreams(b.Addr().String()), WithTCPBalancer(BalanceLeastConnections))
+	for _, tunnel := range []*Tunnel{roundRobin, leastConns} {
+		if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name := func(v *fakeVisitor) string {
+		t.Helper()
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(v, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	// the upstream which is down falls through to the next one.
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, name(server.visit(t, 0)))
+	}
+	if strings.Join(got, "") != "abbc" {
+		t.Fatalf("unexpected round-robin order: %v", got)
+	}
+	upstreams := roundRobin.Status().Upstreams
+	if len(upstreams) != 4 || upstreams[1].Healthy || upstreams[1].TotalConns != 0 || upstreams[2].TotalConns != 2 {
+		t.Fatalf("unexpected upstream status: %+v", upstreams)
+	}
+
+	// a is busy with the first connection.
+	if got := name(server.visit(t, 1)); got != "a" {
+		t.Fatalf("expected a, got %s", got)
+	}
+	if got := name(server.visit(t, 1)); got != "b" {
+		t.Fatalf("expected the least busy upstream b, got %s", got)
+	}
+	if upstreams := leastConns.Status().Upstreams; upstreams[0].ActiveConns != 1 || upstreams[1].ActiveConns != 1 {
+		t.Fatalf("unexpected active connections: %+v", upstreams)
+	}
+}
+
+func TestTCPWeightedUpstreams(t *testing.T) {
+	if err := NewTCPTunnel("test", "127.0.0.1:8080", WithTCPWeightedUpstreams(map[string]int{"127.0.0.1:8081": -1})).Validate(); err == nil {
+		t.Fatal("expected the negative weight to fail")
+	}
+
+	a, b, c := tcpNamed(t, "a"), tcpNamed(t, "b"), tcpNamed(t, "c")
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// c is drained.
+	tunnel := NewTCPTunnel("test", a.Addr().String(), WithTCPWeightedUpstreams(map[string]int{
+		a.Addr().String(): 3,
+		b.Addr().String(): 1,
+	}), WithTCPWeightedUpstreams(map[string]int{c.Addr().String(): 0}))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []byte
+	for i := 0; i < 8; i++ {
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(server.visit(t, 0), buf); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf...)
+	}
+	if string(got) != "aabaaaba" {
+		t.Fatalf("unexpected weighted order: %s", got)
+	}
+	upstreams := tunnel.Status().Upstreams
+	if len(upstreams) != 3 {
+		t.Fatalf("unexpected upstream status: %+v", upstreams)
+	}
+	// the upstreams other than the local addr are sorted by the addr.
+	expected := map[string][2]int{a.Addr().String(): {3, 6}, b.Addr().String(): {1, 2}, c.Addr().String(): {0, 0}}
+	for _, upstream := range upstreams {
+		if want := expected[upstream.Addr]; upstream.Weight != want[0] || upstream.TotalConns != want[1] {
+			t.Fatalf("unexpected upstream status: %+v", upstreams)
+		}
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWithLogger(t *testing.T) {
+	// reserve a port which is not listened.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := lis.Addr().String()
+	lis.Close()
+
+	var logs syncBuffer
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", localAddr)); err != nil {
+		t.Fatal(err)
+	}
+	if visitor := server.visit(t, 0); visitor != nil {
+		t.Fatal("expected the connection to fail")
+	}
+
+	var record struct {
+		Msg          string `json:"msg"`
+		Tunnel       string `json:"tunnel"`
+		ConnectionID string `json:"connection_id"`
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Msg == "failed to dial local address" {
+			break
+		}
+	}
+	if record.Msg != "failed to dial local address" || record.Tunnel != "test" || !strings.HasPrefix(record.ConnectionID, "conn-") {
+		t.Fatalf("unexpected record: %+v\n%s", record, logs.String())
+	}
+}
+
+func TestGoingAway(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		if n == 0 {
+			stream.SetTrailer(metadata.Pairs(metadataGoingAway, "200ms"))
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+
+	events := make(chan Event, 10)
+	client, err := NewClient(server.addr,
+		WithReconnect(3, 10*time.Millisecond, 50*time.Millisecond),
+		WithEventHandler(func(event Event) {
+			if event.Type == EventGoingAway || event.Type == EventReconnect {
+				events <- event
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	goingAway := <-events
+	var goingAwayErr *GoingAwayError
+	if goingAway.Type != EventGoingAway || goingAway.Grace != 200*time.Millisecond || !errors.As(goingAway.Err, &goingAwayErr) {
+		t.Fatalf("unexpected event: %+v", goingAway)
+	}
+	reconnect := <-events
+	if reconnect.Type != EventReconnect || reconnect.Err != nil {
+		t.Fatalf("unexpected event: %+v", reconnect)
+	}
+	if elapsed := reconnect.Time.Sub(goingAway.Time); elapsed < 200*time.Millisecond {
+		t.Fatalf("reconnected %s after going away, before the grace period", elapsed)
+	}
+}
+
+func TestWithRegion(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		// eu-west is unavailable, the server falls back to us-east.
+		if err := stream.SendHeader(metadata.Pairs(metadataRegion, "us-east")); err != nil {
+			return err
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0", WithRegion("eu-west"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := server.md[0].Get(metadataRegion); len(got) != 1 || got[0] != "eu-west" {
+		t.Fatalf("unexpected region metadata: %v", got)
+	}
+	if region := client.Tunnels()[0].Region; region != "us-east" {
+		t.Fatalf("unexpected region: %q", region)
+	}
+}
+
+func TestUnconfirmedMetadata(t *testing.T) {
+	md := metadata.Pairs(metadataRegion, "eu-west", metadataTCPBindAddr, "10.0.0.1", metadataTTL, "1h0m0s",
+		metadataTCPPortRange, "20000-20100", metadataTCPKeepAlive, "30s,10s,5",
+		metadataHTTPProtocols, "h2,http/1.1", metadataTCPNoDelay, "true",
+		metadataUDPSessionTimeout, "30s", metadataUDPMaxSessions, "10")
+	tests := []struct {
+		name   string
+		header metadata.MD
+		want   int
+	}{
+		{"castled", metadata.MD{}, 9},
+		{"accepted", metadata.Pairs(metadataAccepted, metadataTCPBindAddr, metadataAccepted, metadataRegion), 7},
+		// the server tells the region actually chosen.
+		{"region told", metadata.Pairs(metadataRegion, "us-east"), 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unconfirmedMetadata(md, tt.header); len(got) != tt.want {
+				t.Fatalf("got %d warnings %v, want %d", len(got), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithMetadata(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		// the server drops the commit.
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		var accepted []string
+		for _, tag := range md.Get(metadataTag) {
+			if !strings.HasPrefix(tag, "commit=") {
+				accepted = append(accepted, metadataTag, tag)
+			}
+		}
+		if err := stream.SendHeader(metadata.Pairs(accepted...)); err != nil {
+			return err
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", "127.0.0.1:0",
+		WithMetadata(map[string]string{"team": "infra", "env": "staging"}),
+		WithMetadata(map[string]string{"commit": "abc123"}))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := server.md[0].Get(metadataTag); !slices.Equal(got, []string{"commit=abc123", "env=staging", "team=infra"}) {
+		t.Fatalf("unexpected metadata: %v", got)
+	}
+	if got := client.Tunnels()[0].Metadata; len(got) != 2 || got["team"] != "infra" || got["env"] != "staging" {
+		t.Fatalf("unexpected accepted metadata: %v", got)
+	}
+
+	for name, tags := range map[string]map[string]string{
+		"long value":  {"team": strings.Repeat("x", maxTagValueLen+1)},
+		"invalid key": {"team name": "infra"},
+		"non-ascii":   {"team": "ïnfra"},
+	} {
+		if err := NewTCPTunnel("test", "127.0.0.1:0", WithMetadata(tags)).Validate(); err == nil {
+			t.Errorf("%s: expected the metadata to be rejected", name)
+		}
+	}
+	tooMany := make(map[string]string)
+	for i := 0; i <= maxTags; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "value"
+	}
+	if err := NewTCPTunnel("test", "127.0.0.1:0", WithMetadata(tooMany)).Validate(); err == nil {
+		t.Error("expected too many keys to be rejected")
+	}
+}
+
+func TestNewEntrypoint(t *testing.T) {
+	for _, tt := range []struct {
+		raw    string
+		config *proto.Tunnel
+		want   Entrypoint
+	}{
+		{
+			raw:    "tcp://127.0.0.1:20001",
+			config: &NewTCPTunnel("test", "127.0.0.1:0").Tunnel,
+			want:   Entrypoint{Scheme: "tcp", Host: "127.0.0.1", Port: 20001},
+		},
+		{
+			raw:    "https://example.com",
+			config: &NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPDomain("example.com")).Tunnel,
+			want:   Entrypoint{Scheme: "https", Host: "example.com", Port: 443, Domain: "example.com"},
+		},
+		{
+			raw:    "http://abc.castle.example.com:8080",
+			config: &NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPRandomSubdomain()).Tunnel,
+			want:   Entrypoint{Scheme: "http", Host: "abc.castle.example.com", Port: 8080, Domain: "castle.example.com", Subdomain: "abc"},
+		},
+		{
+			raw:    "not a url",
+			config: &NewTCPTunnel("test", "127.0.0.1:0").Tunnel,
+		},
+	} {
+		tt.want.URL = tt.raw
+		tt.want.Region = "eu-west"
+		if got := newEntrypoint(tt.raw, tt.config, "eu-west"); got != tt.want {
+			t.Errorf("newEntrypoint(%q) = %+v, want %+v", tt.raw, got, tt.want)
+		}
+		if got := newEntrypoint(tt.raw, tt.config, "").String(); got != tt.raw {
+			t.Errorf("unexpected string: %q", got)
+		}
+	}
+}
+
+func TestTCPPortRange(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		port := req.Tunnel.GetTcp().RemotePort
+		if port < 20002 {
+			return status.Error(codes.AlreadyExists, "port is in use")
+		}
+		if err := sendInit(stream, fmt.Sprintf("tcp://127.0.0.1:%d", port)); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	entrypoint, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "127.0.0.1:0", WithTCPPortRange(20000, 20005)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entrypoint) != 1 || entrypoint[0].Port != 20002 {
+		t.Fatalf("unexpected entrypoint: %v", entrypoint)
+	}
+	if got := server.md[0].Get(metadataTCPPortRange); len(got) != 1 || got[0] != "20000-20005" {
+		t.Fatalf("unexpected port range metadata: %v", got)
+	}
+
+	_, _, err = client.StartTunnel(ctx, NewTCPTunnel("full", "127.0.0.1:0", WithTCPPortRange(20000, 20001)))
+	if !errors.Is(err, ErrNoPortAvailable) {
+		t.Fatalf("expected ErrNoPortAvailable, got %v", err)
+	}
+
+	for _, tunnel := range []*Tunnel{
+		NewTCPTunnel("test", "127.0.0.1:0", WithTCPPortRange(20005, 20000)),
+		NewTCPTunnel("test", "127.0.0.1:0", WithTCPPortRange(20000, 20005), WithTCPPort(20000)),
+	} {
+		if err := tunnel.Validate(); err == nil {
+			t.Fatal("expected the port range to be invalid")
+		}
+	}
+}
+
+func TestDuplicateTunnelName(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := NewTCPTunnel("go-http", "127.0.0.1:0")
+	if _, _, err := client.StartTunnel(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("go-http", "127.0.0.1:0")); !errors.Is(err, ErrDuplicateName) {
+		t.Fatalf("expected ErrDuplicateName, got %v", err)
+	}
+
+	// the name is free again once the tunnel is closed.
+	if err := first.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("go-http", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		if n == 0 {
+			// drop the first control stream, the tunnel quits without reconnecting.
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan [][]Entrypoint, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, server.addr, []*Tunnel{NewTCPTunnel("test", "127.0.0.1:0")},
+			WithServeLogger(slog.New(discardHandler{})),
+			WithServeRestart(10*time.Millisecond),
+			WithServeReady(func(entrypoints [][]Entrypoint) { ready <- entrypoints }),
+		)
+	}()
+
+	select {
+	case entrypoints := <-ready:
+		if len(entrypoints) != 1 || len(entrypoints[0]) != 1 || entrypoints[0][0].Port != 20001 {
+			t.Fatalf("unexpected entrypoints: %v", entrypoints)
+		}
+	case err := <-done:
+		t.Fatalf("serve quit before ready: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.registrations()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the tunnel isn't restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected serve error: %v", err)
+	}
+
+	if err := Serve(context.Background(), server.addr, []*Tunnel{NewTCPTunnel("", "127.0.0.1:0")}); err == nil {
+		t.Fatal("expected the invalid tunnel to fail")
+	}
+}
+
+func TestTCPTunnelUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	failed := make(chan error, 1)
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventLocalDialFailed {
+			failed <- event.Err
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", "unix://"+path)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the socket doesn't exist yet.
+	if visitor := server.visit(t, 0); visitor != nil {
+		t.Fatal("expected the connection to fail")
+	}
+	if err := <-failed; !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the missing socket error, got %v", err)
+	}
+
+	local, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	visitor.finish()
+	if got := string(visitor.readAll()); got != "ping" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := lis.Addr().String()
+	lis.Close()
+
+	for _, tc := range []struct {
+		addr string
+		kind error
+	}{
+		{addr: refused, kind: ErrConnRefused},
+		{addr: "castle.invalid:6100", kind: ErrDNS},
+	} {
+		client, err := NewClient(tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = client.StartTunnel(context.Background(), NewTCPTunnel("test", "127.0.0.1:0"))
+		if !errors.Is(err, tc.kind) {
+			t.Fatalf("%s: expected %v, got %v", tc.addr, tc.kind, err)
+		}
+		var serverErr *ServerError
+		if !errors.As(err, &serverErr) || serverErr.Addr != tc.addr || serverErr.Tunnel != "test" {
+			t.Fatalf("%s: expected the ServerError of the tunnel, got %v", tc.addr, err)
+		}
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("%s: expected the status of the cause to be kept, got %v", tc.addr, err)
+		}
+	}
+}
+
+// fakeConnectProxy is a HTTP CONNECT proxy which requires the Basic credentials if auth is set,
+// the host "castle.test" is connected to 127.0.0.1.
+func fakeConnectProxy(t *testing.T, auth string) (addr string, connects *atomic.Int64) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	connects = new(atomic.Int64)
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				if auth != "" && req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)) {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"corp\"\r\n\r\n")
+					return
+				}
+				addr := req.Host
+				if host, port, _ := net.SplitHostPort(addr); host == "castle.test" {
+					addr = net.JoinHostPort("127.0.0.1", port)
+				}
+				backend, err := net.Dial("tcp", addr)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer backend.Close()
+				connects.Add(1)
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(backend, reader)
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+	return lis.Addr().String(), connects
+}
+
+func TestHTTPConnectProxy(t *testing.T) {
+	if _, err := NewClient("127.0.0.1:1", WithHTTPConnectProxy("socks5://127.0.0.1:1080")); err == nil {
+		t.Fatal("expected the proxy of other schemes to fail")
+	}
+
+	server := newFakeServer(t)
+	_, port, _ := net.SplitHostPort(server.addr)
+	proxy, connects := fakeConnectProxy(t, "alice:secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client, err := NewClient("castle.test:"+port, WithHTTPConnectProxy("http://alice:secret@"+proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("proxied", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+	if n := connects.Load(); n != 1 {
+		t.Fatalf("expected the client to connect through the proxy, got %d connects", n)
+	}
+
+	client, err = NewClient("castle.test:"+port, WithHTTPConnectProxy("http://alice:wrong@"+proxy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.StartTunnel(ctx, NewTCPTunnel("refused", "127.0.0.1:0"))
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) || proxyErr.StatusCode != http.StatusProxyAuthRequired || proxyErr.Challenge != `Basic realm="corp"` {
+		t.Fatalf("expected the ProxyError of 407, got %v", err)
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Tunnel != "refused" {
+		t.Fatalf("expected the ServerError of the tunnel, got %v", err)
+	}
+
+	// the environment is the fallback of the empty url.
+	t.Setenv("HTTPS_PROXY", "http://alice:secret@"+proxy)
+	t.Setenv("NO_PROXY", "")
+	client, err = NewClient("castle.test:"+port, WithHTTPConnectProxy(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("environment", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+	if n := connects.Load(); n != 2 {
+		t.Fatalf("expected the client to connect through the proxy of the environment, got %d connects", n)
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		if req.Tunnel.Name == "dropped" {
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel := NewTCPTunnel("test", "127.0.0.1:0")
+	expired, cancelExpired := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancelExpired()
+	if err := tunnel.WaitReady(expired); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the unstarted tunnel to wait until the ctx is done, got %v", err)
+	}
+
+	// it waits for the tunnel which isn't started yet.
+	ready := make(chan error, 1)
+	go func() {
+		ready <- tunnel.WaitReady(ctx)
+	}()
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ready:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected WaitReady to return once the tunnel is registered")
+	}
+	if err := tunnel.WaitReady(expired); err != nil {
+		t.Fatalf("expected the connected tunnel to be ready at once, got %v", err)
+	}
+
+	dropped := NewTCPTunnel("dropped", "127.0.0.1:0")
+	_, quit, err := client.StartTunnel(ctx, dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-quit
+	if err := dropped.WaitReady(ctx); !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected the error of the closed tunnel, got %v", err)
+	}
+}
+
+func TestQuitReason(t *testing.T) {
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "tcp://127.0.0.1:20001"); err != nil {
+			return err
+		}
+		if req.Tunnel.Name == "dropped" {
+			return nil
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dropped := NewTCPTunnel("dropped", "127.0.0.1:0")
+	_, quit, err := client.StartTunnel(context.Background(), dropped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-quit
+	if !errors.Is(err, ErrServerClosed) {
+		t.Fatalf("expected ErrServerClosed, got %v", err)
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.Addr != server.addr || serverErr.Tunnel != "dropped" {
+		t.Fatalf("expected the ServerError of the tunnel, got %v", err)
+	}
+	if reason := dropped.Status().QuitReason; reason != QuitServerClosed {
+		t.Fatalf("unexpected reason: %s", reason)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := NewTCPTunnel("canceled", "127.0.0.1:0")
+	if _, quit, err = client.StartTunnel(ctx, canceled); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-quit; err != nil {
+		t.Fatalf("unexpected quit error: %v", err)
+	}
+	if reason := canceled.Status().QuitReason; reason != QuitContextCanceled {
+		t.Fatalf("unexpected reason: %s", reason)
+	}
+
+	closed := NewTCPTunnel("closed", "127.0.0.1:0")
+	if _, quit, err = client.StartTunnel(context.Background(), closed); err != nil {
+		t.Fatal(err)
+	}
+	closed.Close(context.Background())
+	if err := <-quit; err != nil || closed.Status().QuitReason != QuitNormal {
+		t.Fatalf("unexpected quit: %v %s", err, closed.Status().QuitReason)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// reserve a port which is not listened.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := lis.Addr().String()
+	lis.Close()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("echo", local.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("down", unreachable)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		visitor := server.visit(t, 0)
+		visitor.send([]byte("ping"))
+		visitor.finish()
+		visitor.readAll()
+	}
+	// the connection is refused since the local server is down.
+	server.visit(t, 1)
+
+	var metrics Metrics
+	deadline := time.Now().Add(time.Second)
+	for {
+		metrics = client.Metrics()
+		if metrics.Totals.Errors == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(metrics.Tunnels) != 2 {
+		t.Fatalf("unexpected tunnels: %+v", metrics.Tunnels)
+	}
+	echo, down := metrics.Tunnels[0], metrics.Tunnels[1]
+	if echo.Name != "echo" || echo.Protocol != "tcp" || echo.TotalConns != 2 || echo.BytesIn != 8 || echo.BytesOut != 8 ||
+		echo.Errors != 0 || echo.State != StateConnected || echo.Uptime <= 0 {
+		t.Fatalf("unexpected metrics of echo: %+v", echo)
+	}
+	if down.Errors != 1 || down.TotalConns != 0 {
+		t.Fatalf("unexpected metrics of down: %+v", down)
+	}
+	if totals := metrics.Totals; totals.TotalConns != 2 || totals.BytesIn != 8 || totals.Errors != 1 || metrics.Uptime <= 0 {
+		t.Fatalf("unexpected totals: %+v", totals)
+	}
+}
+
+func TestUpdateLocalAddr(t *testing.T) {
+	old, updated := tcpNamed(t, "old"), tcpNamed(t, "new")
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", old.Addr().String())
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	inflight := server.visit(t, 0)
+	inflight.send([]byte("ping"))
+	if err := tunnel.UpdateLocalAddr(updated.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	inflight.finish()
+	if got := string(inflight.readAll()); got != "oldping" {
+		t.Fatalf("expected the in-flight connection to finish with the old address, got %q", got)
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.finish()
+	if got := string(visitor.readAll()); got != "new" {
+		t.Fatalf("expected the new connection to go to the new address, got %q", got)
+	}
+	if info := client.Tunnels()[0]; info.LocalAddr != updated.Addr().String() || len(server.registrations()) != 1 {
+		t.Fatalf("unexpected tunnel info: %+v", info)
+	}
+
+	if err := tunnel.UpdateLocalAddr("localhost"); err == nil {
+		t.Fatal("expected the invalid address to be rejected")
+	}
+	balanced := NewTCPTunnel("balanced", old.Addr().String(), WithTCPUpstreams(updated.Addr().String()))
+	if err := balanced.UpdateLocalAddr(updated.Addr().String()); err == nil {
+		t.Fatal("expected the tunnel with upstreams to be rejected")
+	}
+}
+
+func TestLocalResolver(t *testing.T) {
+	a, b := tcpNamed(t, "a"), tcpNamed(t, "b")
+	server := newFakeServer(t)
+	server.remoteAddr = "10.1.2.3:5555"
+	metas := make(chan ConnMeta, 10)
+	var calls atomic.Int32
+	resolver := WithLocalResolver(func(ctx context.Context, meta ConnMeta) (string, error) {
+		metas <- meta
+		switch calls.Add(1) {
+		case 1:
+			return meta.LocalAddr, nil
+		case 2:
+			return b.Addr().String(), nil
+		default:
+			return "", errors.New("no backend")
+		}
+	})
+	rejected := make(chan Event, 10)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventConnRejected {
+			rejected <- event
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", a.Addr().String(), resolver)
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"a", "b"} {
+		visitor := server.visit(t, 0)
+		visitor.finish()
+		if got := string(visitor.readAll()); got != want {
+			t.Fatalf("expected %q, got %q", want, got)
+		}
+	}
+	meta := <-metas
+	if meta.RemoteAddr.String() != "10.1.2.3:5555" || meta.LocalAddr != a.Addr().String() || meta.ConnectionID == "" {
+		t.Fatalf("unexpected conn meta: %+v", meta)
+	}
+
+	if dropped := server.visit(t, 0); dropped != nil {
+		t.Fatal("expected the connection to be refused")
+	}
+	select {
+	case event := <-rejected:
+		if !strings.Contains(event.Err.Error(), "no backend") {
+			t.Fatalf("unexpected error: %v", event.Err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected an EventConnRejected")
+	}
+	if n := tunnel.Status().RejectedConns; n != 1 {
+		t.Fatalf("expected 1 rejected connection, got %d", n)
+	}
+
+	if err := NewTCPTunnel("balanced", a.Addr().String(), resolver, WithTCPUpstreams(b.Addr().String())).Validate(); err == nil {
+		t.Fatal("expected the resolver with upstreams to fail")
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	if _, err := NewClient("127.0.0.1:1", WithBufferSize(2*maxBufferSize)); err == nil {
+		t.Fatal("expected the oversized buffer to fail")
+	}
+
+	local := tcpNamed(t, "local")
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithBufferSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", local.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+	visitor := server.visit(t, 0)
+	large := strings.Repeat("x", 1000)
+	visitor.send([]byte(large))
+	visitor.finish()
+	if got := string(visitor.readAll()); got != "local"+large {
+		t.Fatalf("unexpected traffic of %d bytes", len(got))
+	}
+}
+
+// BenchmarkSlowLocalServer pushes the traffic of the connections to a local server which drains slowly,
+// the peak of the live heap per connection stays about the same however many connections are active.
+func BenchmarkSlowLocalServer(b *testing.B) {
+	const (
+		perConn = 1024 * 1024
+		chunk   = 32 * 1024
+	)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, chunk)
+				for {
+					if _, err := conn.Read(buf); err != nil {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+	}()
+
+	for _, conns := range []int{16, 64} {
+		b.Run(fmt.Sprintf("conns-%d", conns), func(b *testing.B) {
+			server := newFakeServer(b)
+			client, err := NewClient(server.addr, WithBufferSize(chunk))
+			if err != nil {
+				b.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("bench", lis.Addr().String())); err != nil {
+				b.Fatal(err)
+			}
+
+			liveHeap := func() uint64 {
+				var stats runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				return stats.HeapAlloc
+			}
+			base := liveHeap()
+			var peak atomic.Uint64
+			sampling, stopSampling := context.WithCancel(context.Background())
+			defer stopSampling()
+			go func() {
+				for sampling.Err() == nil {
+					if live := liveHeap(); live > peak.Load() {
+						peak.Store(live)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}()
+
+			data := make([]byte, chunk)
+			b.SetBytes(int64(conns) * perConn)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < conns; j++ {
+					visitor := server.visit(b, 0)
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for sent := 0; sent < perConn; sent += chunk {
+							if err := visitor.stream.Send(&proto.TrafficToClient{Data: data}); err != nil {
+								b.Error(err)
+								return
+							}
+						}
+						visitor.stream.Send(&proto.TrafficToClient{})
+						io.Copy(io.Discard, visitor)
+					}()
+				}
+				wg.Wait()
+			}
+			b.StopTimer()
+			stopSampling()
+			if peak := peak.Load(); peak > base {
+				b.ReportMetric(float64(peak-base)/float64(conns), "peak-heap-B/conn")
+			}
+		})
+	}
+}
+
+// BenchmarkTCPTunnelThroughput measures the copies between the data stream and a local tcp server,
+// in both directions. Both of them go through the grpc messages in user space, there is no zero-copy
+// path to compare with, see Client.work.
+func BenchmarkTCPTunnelThroughput(b *testing.B) {
+	const (
+		perConn = 8 * 1024 * 1024
+		chunk   = 32 * 1024
+	)
+	data := make([]byte, chunk)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// the first byte tells the direction.
+				dir := make([]byte, 1)
+				if _, err := io.ReadFull(conn, dir); err != nil {
+					return
+				}
+				if dir[0] == 'r' {
+					io.Copy(io.Discard, conn)
+					return
+				}
+				for sent := 0; sent < perConn; sent += chunk {
+					if _, err := conn.Write(data); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	server := newFakeServer(b)
+	client, err := NewClient(server.addr, WithBufferSize(chunk))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("bench", lis.Addr().String())); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("to-local", func(b *testing.B) {
+		b.SetBytes(perConn)
+		for i := 0; i < b.N; i++ {
+			visitor := server.visit(b, 0)
+			visitor.send([]byte("r"))
+			for sent := 0; sent < perConn; sent += chunk {
+				visitor.send(data)
+			}
+			visitor.finish()
+			visitor.readAll()
+		}
+	})
+	b.Run("from-local", func(b *testing.B) {
+		b.SetBytes(perConn)
+		for i := 0; i < b.N; i++ {
+			visitor := server.visit(b, 0)
+			visitor.send([]byte("w"))
+			visitor.finish()
+			if n := len(visitor.readAll()); n != perConn {
+				b.Fatalf("got %d bytes, want %d", n, perConn)
+			}
+		}
+	})
+}
@@ -0,0 +1,160 @@
+package castle
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultCompressionMinSize is the min size of the responses to compress.
+const defaultCompressionMinSize = 1024
+
+// compressors are the supported content encodings.
+var compressors = map[string]func(io.Writer) compressor{
+	"gzip": func(w io.Writer) compressor { return gzip.NewWriter(w) },
+	// deflate is the zlib format, see RFC 9110.
+	"deflate": func(w io.Writer) compressor { return zlib.NewWriter(w) },
+	// br is at the default quality of the brotli cli for the dynamic content, the higher ones are much slower.
+	"br": func(w io.Writer) compressor { return brotli.NewWriterLevel(w, brotli.DefaultCompression) },
+}
+
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+func validateCompression(algos []string) error {
+	for _, algo := range algos {
+		if _, ok := compressors[algo]; !ok {
+			return fmt.Errorf("unsupported compression %q", algo)
+		}
+	}
+	return nil
+}
+
+// incompressibleTypes are the content types which are compressed already, or streamed.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/zstd", "text/event-stream",
+}
+
+// compress compresses the responses with the first algorithm accepted by the user.
+func compress(algos []string, minSize int) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead || isUpgradeRequest(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			algo := negotiateEncoding(r.Header.Get("Accept-Encoding"), algos)
+			if algo == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, algo: algo, minSize: minSize}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiateEncoding returns the first algorithm accepted by the Accept-Encoding header.
+func negotiateEncoding(acceptEncoding string, algos []string) string {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		accepted[strings.ToLower(strings.TrimSpace(coding))] = q > 0
+	}
+	for _, algo := range algos {
+		if ok, found := accepted[algo]; ok || (!found && accepted["*"]) {
+			return algo
+		}
+	}
+	return ""
+}
+
+// compressWriter decides whether to compress the response once the header is written.
+type compressWriter struct {
+	http.ResponseWriter
+	algo    string
+	minSize int
+
+	wroteHeader bool
+	c           compressor
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader || code < http.StatusOK {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.wroteHeader = true
+
+	h := w.Header()
+	if w.eligible(code, h) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.algo)
+		w.c = compressors[w.algo](w.ResponseWriter)
+	}
+	h.Add("Vary", "Accept-Encoding")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) eligible(code int, h http.Header) bool {
+	if code == http.StatusNoContent || code == http.StatusNotModified || h.Get("Content-Encoding") != "" {
+		return false
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < w.minSize {
+		return false
+	}
+	contentType := strings.ToLower(h.Get("Content-Type"))
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.c != nil {
+		return w.c.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *compressWriter) Flush() {
+	if w.c != nil {
+		w.c.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *compressWriter) close() {
+	if w.c != nil {
+		w.c.Close()
+	}
+}
+
+// Unwrap makes http.ResponseController work with the underlying ResponseWriter.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
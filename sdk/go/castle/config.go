@@ -0,0 +1,610 @@
+package castle
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// TunnelConfig defines a tunnel as plain data, e.g. decoded from a JSON or YAML file,
+// TunnelFromConfig builds the tunnel of it, and LoadTunnelsFromFile the tunnels of a file.
+// Each field maps to an option of the same name,
+// the zero values mean the defaults of the options.
+//
+// Only the section of the Protocol may be set, the options taking functions, writers or
+// tls.Config are only available to the option constructors.
+type TunnelConfig struct {
+	// Protocol is "tcp", "udp", "http" or "grpc".
+	Protocol  string `json:"protocol" yaml:"protocol"`
+	Name      string `json:"name" yaml:"name"`
+	LocalAddr string `json:"local_addr" yaml:"local_addr"`
+
+	RateLimit        int64    `json:"rate_limit,omitempty" yaml:"rate_limit,omitempty"`
+	IngressRateLimit int64    `json:"ingress_rate_limit,omitempty" yaml:"ingress_rate_limit,omitempty"`
+	EgressRateLimit  int64    `json:"egress_rate_limit,omitempty" yaml:"egress_rate_limit,omitempty"`
+	RateLimitBurst   int64    `json:"rate_limit_burst,omitempty" yaml:"rate_limit_burst,omitempty"`
+	AllowCIDR        []string `json:"allow_cidr,omitempty" yaml:"allow_cidr,omitempty"`
+	DenyCIDR         []string `json:"deny_cidr,omitempty" yaml:"deny_cidr,omitempty"`
+	MaxConnections   int      `json:"max_connections,omitempty" yaml:"max_connections,omitempty"`
+	// ConnectionRateLimit and ConnectionBurst are of WithConnectionRateLimit.
+	ConnectionRateLimit int               `json:"connection_rate_limit,omitempty" yaml:"connection_rate_limit,omitempty"`
+	ConnectionBurst     int               `json:"connection_burst,omitempty" yaml:"connection_burst,omitempty"`
+	TTL                 Duration          `json:"ttl,omitempty" yaml:"ttl,omitempty"`
+	MaxRequests         int               `json:"max_requests,omitempty" yaml:"max_requests,omitempty"`
+	Region              string            `json:"region,omitempty" yaml:"region,omitempty"`
+	Metadata            map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	LocalDialTimeout    Duration          `json:"local_dial_timeout,omitempty" yaml:"local_dial_timeout,omitempty"`
+	// LocalDialRetries and LocalDialRetryDelay are of WithLocalDialRetries.
+	LocalDialRetries    int      `json:"local_dial_retries,omitempty" yaml:"local_dial_retries,omitempty"`
+	LocalDialRetryDelay Duration `json:"local_dial_retry_delay,omitempty" yaml:"local_dial_retry_delay,omitempty"`
+	LocalDialSourceAddr string   `json:"local_dial_source_addr,omitempty" yaml:"local_dial_source_addr,omitempty"`
+	LocalDNSCache       Duration `json:"local_dns_cache,omitempty" yaml:"local_dns_cache,omitempty"`
+	LocalDNSRefresh     bool     `json:"local_dns_refresh,omitempty" yaml:"local_dns_refresh,omitempty"`
+
+	TCP  *TCPTunnelConfig  `json:"tcp,omitempty" yaml:"tcp,omitempty"`
+	UDP  *UDPTunnelConfig  `json:"udp,omitempty" yaml:"udp,omitempty"`
+	HTTP *HTTPTunnelConfig `json:"http,omitempty" yaml:"http,omitempty"`
+	GRPC *GRPCTunnelConfig `json:"grpc,omitempty" yaml:"grpc,omitempty"`
+}
+
+// TCPTunnelConfig is the section of the tcp tunnels of TunnelConfig.
+type TCPTunnelConfig struct {
+	Port uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+	// PortRangeMin and PortRangeMax are of WithTCPPortRange.
+	PortRangeMin  uint16         `json:"port_range_min,omitempty" yaml:"port_range_min,omitempty"`
+	PortRangeMax  uint16         `json:"port_range_max,omitempty" yaml:"port_range_max,omitempty"`
+	ProxyProtocol int            `json:"proxy_protocol,omitempty" yaml:"proxy_protocol,omitempty"`
+	IdleTimeout   Duration       `json:"idle_timeout,omitempty" yaml:"idle_timeout,omitempty"`
+	Upstreams     []string       `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+	Weights       map[string]int `json:"weights,omitempty" yaml:"weights,omitempty"`
+	Balancer      string         `json:"balancer,omitempty" yaml:"balancer,omitempty"`
+	BindAddr      string         `json:"bind_addr,omitempty" yaml:"bind_addr,omitempty"`
+	SNIRouting    bool           `json:"sni_routing,omitempty" yaml:"sni_routing,omitempty"`
+	// SNIRoutes maps the server names to the addrs of WithTCPSNIRoute.
+	SNIRoutes       map[string]string   `json:"sni_routes,omitempty" yaml:"sni_routes,omitempty"`
+	KeepAlive       *TCPKeepAliveConfig `json:"keepalive,omitempty" yaml:"keepalive,omitempty"`
+	NoDelay         *bool               `json:"nodelay,omitempty" yaml:"nodelay,omitempty"`
+	DataCompression string              `json:"data_compression,omitempty" yaml:"data_compression,omitempty"`
+}
+
+// TCPKeepAliveConfig is the config of WithTCPKeepAlive.
+type TCPKeepAliveConfig struct {
+	Enabled  bool     `json:"enabled" yaml:"enabled"`
+	Idle     Duration `json:"idle,omitempty" yaml:"idle,omitempty"`
+	Interval Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Count    int      `json:"count,omitempty" yaml:"count,omitempty"`
+}
+
+// UDPTunnelConfig is the section of the udp tunnels of TunnelConfig.
+type UDPTunnelConfig struct {
+	Port             uint16   `json:"port,omitempty" yaml:"port,omitempty"`
+	SessionTimeout   Duration `json:"session_timeout,omitempty" yaml:"session_timeout,omitempty"`
+	MaxSessions      int      `json:"max_sessions,omitempty" yaml:"max_sessions,omitempty"`
+	Fanout           []string `json:"fanout,omitempty" yaml:"fanout,omitempty"`
+	FanoutAllReplies bool     `json:"fanout_all_replies,omitempty" yaml:"fanout_all_replies,omitempty"`
+	MaxDatagramSize  int      `json:"max_datagram_size,omitempty" yaml:"max_datagram_size,omitempty"`
+}
+
+// HTTPTunnelConfig is the section of the http tunnels of TunnelConfig.
+type HTTPTunnelConfig struct {
+	// Port, Domain, Subdomain and RandomSubdomain are the entrypoint, only one of them may be set.
+	// A Domain like *.example.com is of WithHTTPWildcardDomain.
+	Port            uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+	Domain          string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Subdomain       string `json:"subdomain,omitempty" yaml:"subdomain,omitempty"`
+	RandomSubdomain bool   `json:"random_subdomain,omitempty" yaml:"random_subdomain,omitempty"`
+
+	PathPrefix  string            `json:"path_prefix,omitempty" yaml:"path_prefix,omitempty"`
+	StripPrefix bool              `json:"strip_prefix,omitempty" yaml:"strip_prefix,omitempty"`
+	MatchHeader map[string]string `json:"match_header,omitempty" yaml:"match_header,omitempty"`
+	MatchQuery  map[string]string `json:"match_query,omitempty" yaml:"match_query,omitempty"`
+
+	RewriteRedirects bool `json:"rewrite_redirects,omitempty" yaml:"rewrite_redirects,omitempty"`
+	// RewriteCookieDomain maps the domains of WithHTTPRewriteCookieDomain.
+	RewriteCookieDomain map[string]string `json:"rewrite_cookie_domain,omitempty" yaml:"rewrite_cookie_domain,omitempty"`
+	// BasicAuth maps the usernames to the passwords of WithHTTPBasicAuth.
+	BasicAuth map[string]string `json:"basic_auth,omitempty" yaml:"basic_auth,omitempty"`
+
+	// TLSCert and TLSKey are the PEM of WithHTTPTLS, TLSCertFile and TLSKeyFile are
+	// of WithHTTPTLSFromFiles, only one pair of them may be set.
+	TLSCert     string `json:"tls_cert,omitempty" yaml:"tls_cert,omitempty"`
+	TLSKey      string `json:"tls_key,omitempty" yaml:"tls_key,omitempty"`
+	TLSCertFile string `json:"tls_cert_file,omitempty" yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile  string `json:"tls_key_file,omitempty" yaml:"tls_key_file,omitempty"`
+
+	Upstreams     []string           `json:"upstreams,omitempty" yaml:"upstreams,omitempty"`
+	Weights       map[string]int     `json:"weights,omitempty" yaml:"weights,omitempty"`
+	StickySession string             `json:"sticky_session,omitempty" yaml:"sticky_session,omitempty"`
+	HealthCheck   *HealthCheckConfig `json:"health_check,omitempty" yaml:"health_check,omitempty"`
+
+	RequestHeaders       *HeaderRewriteConfig `json:"request_headers,omitempty" yaml:"request_headers,omitempty"`
+	ResponseHeaders      *HeaderRewriteConfig `json:"response_headers,omitempty" yaml:"response_headers,omitempty"`
+	PreserveTraceHeaders *bool                `json:"preserve_trace_headers,omitempty" yaml:"preserve_trace_headers,omitempty"`
+	ConnIDHeader         string               `json:"conn_id_header,omitempty" yaml:"conn_id_header,omitempty"`
+	ForwardedFor         bool                 `json:"forwarded_for,omitempty" yaml:"forwarded_for,omitempty"`
+	TrustedProxies       []string             `json:"trusted_proxies,omitempty" yaml:"trusted_proxies,omitempty"`
+	ForwardedPort        bool                 `json:"forwarded_port,omitempty" yaml:"forwarded_port,omitempty"`
+	ForceHTTPS           bool                 `json:"force_https,omitempty" yaml:"force_https,omitempty"`
+	ForceHTTPSExcept     []string             `json:"force_https_except,omitempty" yaml:"force_https_except,omitempty"`
+
+	Compression        []string     `json:"compression,omitempty" yaml:"compression,omitempty"`
+	CompressionMinSize int          `json:"compression_min_size,omitempty" yaml:"compression_min_size,omitempty"`
+	Cache              *CacheConfig `json:"cache,omitempty" yaml:"cache,omitempty"`
+	MaxRequestBody     int64        `json:"max_request_body,omitempty" yaml:"max_request_body,omitempty"`
+	AllowedMethods     []string     `json:"allowed_methods,omitempty" yaml:"allowed_methods,omitempty"`
+	HostHeader         string       `json:"host_header,omitempty" yaml:"host_header,omitempty"`
+
+	Mirror *MirrorConfig `json:"mirror,omitempty" yaml:"mirror,omitempty"`
+	// Static serves the files of a directory by NewStaticTunnel, the LocalAddr is empty with it.
+	Static *StaticConfig `json:"static,omitempty" yaml:"static,omitempty"`
+
+	CircuitBreaker      *CircuitBreakerConfig `json:"circuit_breaker,omitempty" yaml:"circuit_breaker,omitempty"`
+	UpgradeTimeout      Duration              `json:"upgrade_timeout,omitempty" yaml:"upgrade_timeout,omitempty"`
+	RequestTimeout      Duration              `json:"request_timeout,omitempty" yaml:"request_timeout,omitempty"`
+	ResponseIdleTimeout Duration              `json:"response_idle_timeout,omitempty" yaml:"response_idle_timeout,omitempty"`
+	// WebSocketKeepAlive is the interval of WithHTTPWebSocketKeepAlive.
+	WebSocketKeepAlive Duration `json:"websocket_keepalive,omitempty" yaml:"websocket_keepalive,omitempty"`
+	Protocols          []string `json:"protocols,omitempty" yaml:"protocols,omitempty"`
+	LocalScheme        string   `json:"local_scheme,omitempty" yaml:"local_scheme,omitempty"`
+	FlushInterval      Duration `json:"flush_interval,omitempty" yaml:"flush_interval,omitempty"`
+}
+
+// HealthCheckConfig is the config of WithHTTPHealthCheck.
+type HealthCheckConfig struct {
+	Path               string   `json:"path" yaml:"path"`
+	Interval           Duration `json:"interval,omitempty" yaml:"interval,omitempty"`
+	Timeout            Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	HealthyThreshold   int      `json:"healthy_threshold,omitempty" yaml:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int      `json:"unhealthy_threshold,omitempty" yaml:"unhealthy_threshold,omitempty"`
+}
+
+// HeaderRewriteConfig is the config of WithHTTPRequestHeaders and WithHTTPResponseHeaders.
+type HeaderRewriteConfig struct {
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty" yaml:"remove,omitempty"`
+}
+
+// CacheConfig is the config of WithHTTPCache.
+type CacheConfig struct {
+	MaxSize    int64    `json:"max_size" yaml:"max_size"`
+	DefaultTTL Duration `json:"default_ttl,omitempty" yaml:"default_ttl,omitempty"`
+}
+
+// CircuitBreakerConfig is the config of WithHTTPCircuitBreaker.
+type CircuitBreakerConfig struct {
+	FailureThreshold int      `json:"failure_threshold" yaml:"failure_threshold"`
+	OpenDuration     Duration `json:"open_duration,omitempty" yaml:"open_duration,omitempty"`
+}
+
+// MirrorConfig is the config of WithHTTPMirror, Seed is of WithHTTPMirrorSeed if it's set.
+type MirrorConfig struct {
+	Addr      string  `json:"addr" yaml:"addr"`
+	Fraction  float64 `json:"fraction" yaml:"fraction"`
+	SampleKey string  `json:"sample_key,omitempty" yaml:"sample_key,omitempty"`
+	Seed      *uint64 `json:"seed,omitempty" yaml:"seed,omitempty"`
+	MaxBody   int64   `json:"max_body,omitempty" yaml:"max_body,omitempty"`
+}
+
+// StaticConfig is the config of NewStaticTunnel, IndexFiles is of WithStaticIndexFiles if it's set.
+type StaticConfig struct {
+	Root             string   `json:"root" yaml:"root"`
+	DirectoryListing bool     `json:"directory_listing,omitempty" yaml:"directory_listing,omitempty"`
+	IndexFiles       []string `json:"index_files,omitempty" yaml:"index_files,omitempty"`
+	SPAFallback      string   `json:"spa_fallback,omitempty" yaml:"spa_fallback,omitempty"`
+}
+
+// GRPCTunnelConfig is the section of the gRPC tunnels of TunnelConfig,
+// the entrypoint and the TLS are like HTTPTunnelConfig.
+type GRPCTunnelConfig struct {
+	Port            uint16 `json:"port,omitempty" yaml:"port,omitempty"`
+	Domain          string `json:"domain,omitempty" yaml:"domain,omitempty"`
+	Subdomain       string `json:"subdomain,omitempty" yaml:"subdomain,omitempty"`
+	RandomSubdomain bool   `json:"random_subdomain,omitempty" yaml:"random_subdomain,omitempty"`
+	TLSCert         string `json:"tls_cert,omitempty" yaml:"tls_cert,omitempty"`
+	TLSKey          string `json:"tls_key,omitempty" yaml:"tls_key,omitempty"`
+	Reflection      bool   `json:"reflection,omitempty" yaml:"reflection,omitempty"`
+}
+
+// Duration is a time.Duration encoded as text like "30s" in the config files.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// TunnelFromConfig builds the tunnel of the config, the errors are the same as Tunnel.Validate
+// of the tunnel built by the option constructors, plus the fields inconsistent with the protocol.
+func TunnelFromConfig(config TunnelConfig) (*Tunnel, error) {
+	sections := map[string]bool{
+		"tcp":  config.TCP != nil,
+		"udp":  config.UDP != nil,
+		"http": config.HTTP != nil,
+		"grpc": config.GRPC != nil,
+	}
+	if _, ok := sections[config.Protocol]; !ok {
+		return nil, fmt.Errorf("unknown protocol %q of tunnel %q, it should be tcp, udp, http or grpc", config.Protocol, config.Name)
+	}
+	var err error
+	for protocol, set := range sections {
+		if set && protocol != config.Protocol {
+			err = errors.Join(err, fmt.Errorf("the %s config can't be used with the %s tunnel %q", protocol, config.Protocol, config.Name))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var tunnel *Tunnel
+	common := config.tunnelOptions()
+	switch config.Protocol {
+	case "tcp":
+		var options []TCPOption
+		for _, option := range common {
+			options = append(options, option)
+		}
+		if config.TCP != nil {
+			options = append(options, config.TCP.options()...)
+		}
+		tunnel = NewTCPTunnel(config.Name, config.LocalAddr, options...)
+	case "udp":
+		var options []UDPOption
+		for _, option := range common {
+			options = append(options, option)
+		}
+		if config.UDP != nil {
+			options = append(options, config.UDP.options()...)
+		}
+		tunnel = NewUDPTunnel(config.Name, config.LocalAddr, options...)
+	case "http":
+		var options []HTTPOption
+		for _, option := range common {
+			options = append(options, option)
+		}
+		if config.HTTP != nil {
+			httpOptions, err := config.HTTP.options()
+			if err != nil {
+				return nil, fmt.Errorf("invalid http config of tunnel %q: %w", config.Name, err)
+			}
+			options = append(options, httpOptions...)
+		}
+		if config.HTTP != nil && config.HTTP.Static != nil {
+			if config.LocalAddr != "" {
+				return nil, fmt.Errorf("the local addr can't be used with the static http tunnel %q", config.Name)
+			}
+			tunnel = NewStaticTunnel(config.Name, config.HTTP.Static.Root, options...)
+			break
+		}
+		tunnel = NewHTTPTunnel(config.Name, config.LocalAddr, options...)
+	case "grpc":
+		var options []GRPCOption
+		for _, option := range common {
+			options = append(options, option)
+		}
+		if config.GRPC != nil {
+			options = append(options, config.GRPC.options()...)
+		}
+		tunnel = NewGRPCTunnel(config.Name, config.LocalAddr, options...)
+	}
+	if err := tunnel.Validate(); err != nil {
+		return nil, err
+	}
+	return tunnel, nil
+}
+
+func (config *TunnelConfig) tunnelOptions() []TunnelOption {
+	var options []TunnelOption
+	if config.RateLimit != 0 {
+		options = append(options, WithRateLimit(config.RateLimit))
+	}
+	if config.IngressRateLimit != 0 {
+		options = append(options, WithIngressRateLimit(config.IngressRateLimit))
+	}
+	if config.EgressRateLimit != 0 {
+		options = append(options, WithEgressRateLimit(config.EgressRateLimit))
+	}
+	if config.RateLimitBurst != 0 {
+		options = append(options, WithRateLimitBurst(config.RateLimitBurst))
+	}
+	if len(config.AllowCIDR) > 0 {
+		options = append(options, WithAllowCIDR(config.AllowCIDR...))
+	}
+	if len(config.DenyCIDR) > 0 {
+		options = append(options, WithDenyCIDR(config.DenyCIDR...))
+	}
+	if config.MaxConnections != 0 {
+		options = append(options, WithMaxConnections(config.MaxConnections))
+	}
+	if config.ConnectionRateLimit != 0 || config.ConnectionBurst != 0 {
+		options = append(options, WithConnectionRateLimit(config.ConnectionRateLimit, config.ConnectionBurst))
+	}
+	if config.TTL != 0 {
+		options = append(options, WithTTL(time.Duration(config.TTL)))
+	}
+	if config.MaxRequests != 0 {
+		options = append(options, WithMaxRequests(config.MaxRequests))
+	}
+	if config.Region != "" {
+		options = append(options, WithRegion(config.Region))
+	}
+	if len(config.Metadata) > 0 {
+		options = append(options, WithMetadata(config.Metadata))
+	}
+	if config.LocalDialTimeout != 0 {
+		options = append(options, WithLocalDialTimeout(time.Duration(config.LocalDialTimeout)))
+	}
+	if config.LocalDialRetries != 0 || config.LocalDialRetryDelay != 0 {
+		options = append(options, WithLocalDialRetries(config.LocalDialRetries, time.Duration(config.LocalDialRetryDelay)))
+	}
+	if config.LocalDialSourceAddr != "" {
+		options = append(options, WithLocalDialSourceAddr(config.LocalDialSourceAddr))
+	}
+	if config.LocalDNSCache != 0 {
+		options = append(options, WithLocalDNSCache(time.Duration(config.LocalDNSCache)))
+	}
+	if config.LocalDNSRefresh {
+		options = append(options, WithLocalDNSRefresh())
+	}
+	return options
+}
+
+func (config *TCPTunnelConfig) options() []TCPOption {
+	var options []TCPOption
+	if config.Port != 0 {
+		options = append(options, WithTCPPort(config.Port))
+	}
+	if config.PortRangeMin != 0 || config.PortRangeMax != 0 {
+		options = append(options, WithTCPPortRange(config.PortRangeMin, config.PortRangeMax))
+	}
+	if config.ProxyProtocol != 0 {
+		options = append(options, WithTCPProxyProtocol(config.ProxyProtocol))
+	}
+	if config.IdleTimeout != 0 {
+		options = append(options, WithTCPIdleTimeout(time.Duration(config.IdleTimeout)))
+	}
+	if len(config.Upstreams) > 0 {
+		options = append(options, WithTCPUpstreams(config.Upstreams...))
+	}
+	if len(config.Weights) > 0 {
+		options = append(options, WithTCPWeightedUpstreams(config.Weights))
+	}
+	if config.Balancer != "" {
+		options = append(options, WithTCPBalancer(config.Balancer))
+	}
+	if config.BindAddr != "" {
+		options = append(options, WithTCPBindAddr(config.BindAddr))
+	}
+	if config.SNIRouting {
+		options = append(options, WithTCPSNIRouting())
+	}
+	for serverName, addr := range config.SNIRoutes {
+		options = append(options, WithTCPSNIRoute(serverName, addr))
+	}
+	if k := config.KeepAlive; k != nil {
+		options = append(options, WithTCPKeepAlive(k.Enabled, time.Duration(k.Idle), time.Duration(k.Interval), k.Count))
+	}
+	if config.NoDelay != nil {
+		options = append(options, WithTCPNoDelay(*config.NoDelay))
+	}
+	if config.DataCompression != "" {
+		options = append(options, WithDataCompression(config.DataCompression))
+	}
+	return options
+}
+
+func (config *UDPTunnelConfig) options() []UDPOption {
+	var options []UDPOption
+	if config.Port != 0 {
+		options = append(options, WithUdpPort(config.Port))
+	}
+	if config.SessionTimeout != 0 {
+		options = append(options, WithUdpSessionTimeout(time.Duration(config.SessionTimeout)))
+	}
+	if config.MaxSessions != 0 {
+		options = append(options, WithUdpMaxSessions(config.MaxSessions))
+	}
+	if len(config.Fanout) > 0 {
+		options = append(options, WithUdpFanout(config.Fanout...))
+	}
+	if config.FanoutAllReplies {
+		options = append(options, WithUdpFanoutAllReplies())
+	}
+	if config.MaxDatagramSize != 0 {
+		options = append(options, WithUdpMaxDatagramSize(config.MaxDatagramSize))
+	}
+	return options
+}
+
+func (config *HTTPTunnelConfig) options() ([]HTTPOption, error) {
+	var options []HTTPOption
+	if config.Port != 0 {
+		options = append(options, WithHTTPPort(config.Port))
+	}
+	if config.Domain != "" {
+		if validateWildcardDomain(config.Domain) == nil {
+			options = append(options, WithHTTPWildcardDomain(config.Domain))
+		} else {
+			options = append(options, WithHTTPDomain(config.Domain))
+		}
+	}
+	if config.Subdomain != "" {
+		options = append(options, WithHTTPSubDomain(config.Subdomain))
+	}
+	if config.RandomSubdomain {
+		options = append(options, WithHTTPRandomSubdomain())
+	}
+
+	if config.PathPrefix != "" {
+		options = append(options, WithHTTPPathPrefix(config.PathPrefix))
+	}
+	if config.StripPrefix {
+		options = append(options, WithHTTPStripPrefix(true))
+	}
+	for name, value := range config.MatchHeader {
+		options = append(options, WithHTTPMatchHeader(name, value))
+	}
+	for key, value := range config.MatchQuery {
+		options = append(options, WithHTTPMatchQuery(key, value))
+	}
+	if config.RewriteRedirects {
+		options = append(options, WithHTTPRewriteRedirects())
+	}
+	for from, to := range config.RewriteCookieDomain {
+		options = append(options, WithHTTPRewriteCookieDomain(from, to))
+	}
+	for username, password := range config.BasicAuth {
+		options = append(options, WithHTTPBasicAuth(username, password))
+	}
+
+	pem := config.TLSCert != "" || config.TLSKey != ""
+	files := config.TLSCertFile != "" || config.TLSKeyFile != ""
+	switch {
+	case pem && files:
+		return nil, errors.New("only one of tls cert and tls cert file is allowed")
+	case pem:
+		options = append(options, WithHTTPTLS([]byte(config.TLSCert), []byte(config.TLSKey)))
+	case files:
+		options = append(options, WithHTTPTLSFromFiles(config.TLSCertFile, config.TLSKeyFile))
+	}
+
+	if len(config.Upstreams) > 0 {
+		options = append(options, WithHTTPUpstreams(config.Upstreams...))
+	}
+	if len(config.Weights) > 0 {
+		options = append(options, WithHTTPWeightedUpstreams(config.Weights))
+	}
+	if config.StickySession != "" {
+		options = append(options, WithHTTPStickySession(config.StickySession))
+	}
+	if h := config.HealthCheck; h != nil {
+		options = append(options, WithHTTPHealthCheck(h.Path, time.Duration(h.Interval), time.Duration(h.Timeout),
+			h.HealthyThreshold, h.UnhealthyThreshold))
+	}
+
+	if h := config.RequestHeaders; h != nil {
+		options = append(options, WithHTTPRequestHeaders(h.Set, h.Remove))
+	}
+	if h := config.ResponseHeaders; h != nil {
+		options = append(options, WithHTTPResponseHeaders(h.Set, h.Remove))
+	}
+	if config.PreserveTraceHeaders != nil {
+		options = append(options, WithHTTPPreserveTraceHeaders(*config.PreserveTraceHeaders))
+	}
+	if config.ConnIDHeader != "" {
+		options = append(options, WithHTTPConnIDHeader(config.ConnIDHeader))
+	}
+	if config.ForwardedFor {
+		options = append(options, WithHTTPForwardedFor())
+	}
+	if len(config.TrustedProxies) > 0 {
+		options = append(options, WithHTTPTrustedProxies(config.TrustedProxies...))
+	}
+	if config.ForwardedPort {
+		options = append(options, WithHTTPForwardedPort(true))
+	}
+	if config.ForceHTTPS {
+		options = append(options, WithHTTPForceHTTPS())
+	}
+	if len(config.ForceHTTPSExcept) > 0 {
+		options = append(options, WithHTTPForceHTTPSExcept(config.ForceHTTPSExcept...))
+	}
+
+	if len(config.Compression) > 0 {
+		options = append(options, WithHTTPCompression(config.Compression...))
+	}
+	if config.CompressionMinSize != 0 {
+		options = append(options, WithHTTPCompressionMinSize(config.CompressionMinSize))
+	}
+	if c := config.Cache; c != nil {
+		options = append(options, WithHTTPCache(c.MaxSize, time.Duration(c.DefaultTTL)))
+	}
+	if config.MaxRequestBody != 0 {
+		options = append(options, WithHTTPMaxRequestBody(config.MaxRequestBody))
+	}
+	if len(config.AllowedMethods) > 0 {
+		options = append(options, WithHTTPAllowedMethods(config.AllowedMethods...))
+	}
+	if config.HostHeader != "" {
+		options = append(options, WithHTTPHostHeader(config.HostHeader))
+	}
+
+	if m := config.Mirror; m != nil {
+		options = append(options, WithHTTPMirror(m.Addr, m.Fraction))
+		if m.SampleKey != "" {
+			options = append(options, WithHTTPMirrorSampleKey(m.SampleKey))
+		}
+		if m.Seed != nil {
+			options = append(options, WithHTTPMirrorSeed(*m.Seed))
+		}
+		if m.MaxBody != 0 {
+			options = append(options, WithHTTPMirrorMaxBody(m.MaxBody))
+		}
+	}
+	if static := config.Static; static != nil {
+		if static.DirectoryListing {
+			options = append(options, WithStaticDirectoryListing(true))
+		}
+		if static.IndexFiles != nil {
+			options = append(options, WithStaticIndexFiles(static.IndexFiles...))
+		}
+		if static.SPAFallback != "" {
+			options = append(options, WithStaticSPAFallback(static.SPAFallback))
+		}
+	}
+	if b := config.CircuitBreaker; b != nil {
+		options = append(options, WithHTTPCircuitBreaker(b.FailureThreshold, time.Duration(b.OpenDuration)))
+	}
+	if config.UpgradeTimeout != 0 {
+		options = append(options, WithHTTPUpgradeTimeout(time.Duration(config.UpgradeTimeout)))
+	}
+	if config.RequestTimeout != 0 {
+		options = append(options, WithHTTPRequestTimeout(time.Duration(config.RequestTimeout)))
+	}
+	if config.ResponseIdleTimeout != 0 {
+		options = append(options, WithHTTPResponseIdleTimeout(time.Duration(config.ResponseIdleTimeout)))
+	}
+	if config.WebSocketKeepAlive != 0 {
+		options = append(options, WithHTTPWebSocketKeepAlive(time.Duration(config.WebSocketKeepAlive)))
+	}
+	if len(config.Protocols) > 0 {
+		options = append(options, WithHTTPProtocols(config.Protocols...))
+	}
+	if config.LocalScheme != "" {
+		options = append(options, WithHTTPLocalScheme(config.LocalScheme))
+	}
+	if config.FlushInterval != 0 {
+		options = append(options, WithHTTPFlushInterval(time.Duration(config.FlushInterval)))
+	}
+	return options, nil
+}
+
+func (config *GRPCTunnelConfig) options() []GRPCOption {
+	var options []GRPCOption
+	if config.Port != 0 {
+		options = append(options, WithGRPCPort(config.Port))
+	}
+	if config.Domain != "" {
+		options = append(options, WithGRPCDomain(config.Domain))
+	}
+	if config.Subdomain != "" {
+		options = append(options, WithGRPCSubdomain(config.Subdomain))
+	}
+	if config.RandomSubdomain {
+		options = append(options, WithGRPCRandomSubdomain())
+	}
+	if config.TLSCert != "" || config.TLSKey != "" {
+		options = append(options, WithGRPCTLS([]byte(config.TLSCert), []byte(config.TLSKey)))
+	}
+	if config.Reflection {
+		options = append(options, WithGRPCReflection(true))
+	}
+	return options
+}
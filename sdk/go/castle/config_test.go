@@ -0,0 +1,168 @@
+package castle
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelFromConfig(t *testing.T) {
+	raw := `[
+		{
+			"protocol": "tcp", "name": "db", "local_addr": "127.0.0.1:5432",
+			"region": "eu-west", "max_connections": 10, "local_dial_timeout": "3s",
+			"tcp": {"port": 15432, "idle_timeout": "5m", "proxy_protocol": 2, "upstreams": ["127.0.0.1:5433"]}
+		},
+		{
+			"protocol": "udp", "name": "dns", "local_addr": "127.0.0.1:53",
+			"udp": {"session_timeout": "30s", "max_sessions": 100}
+		},
+		{
+			"protocol": "http", "name": "web", "local_addr": "127.0.0.1:8080",
+			"http": {"domain": "*.example.com", "path_prefix": "/api", "strip_prefix": true,
+				"match_header": {"x-tenant": "acme"}, "max_request_body": 1024}
+		},
+		{"protocol": "grpc", "name": "rpc", "local_addr": "127.0.0.1:9090", "grpc": {"subdomain": "rpc", "reflection": true}}
+	]`
+	var configs []TunnelConfig
+	if err := json.Unmarshal([]byte(raw), &configs); err != nil {
+		t.Fatal(err)
+	}
+	var tunnels []*Tunnel
+	for _, config := range configs {
+		tunnel, err := TunnelFromConfig(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+
+	db, dns, web, rpc := tunnels[0], tunnels[1], tunnels[2], tunnels[3]
+	if db.GetTcp().RemotePort != 15432 || db.idleTimeout != 5*time.Minute || db.proxyProtocol != 2 ||
+		db.balancer == nil || db.maxConns != 10 || db.dialer.timeout != 3*time.Second || db.md.Get(metadataRegion)[0] != "eu-west" {
+		t.Fatalf("unexpected tcp tunnel: %+v", db)
+	}
+	if dns.GetUdp() == nil || dns.md.Get(metadataUDPSessionTimeout)[0] != "30s" || dns.md.Get(metadataUDPMaxSessions)[0] != "100" {
+		t.Fatalf("unexpected udp tunnel: %+v", dns)
+	}
+	if web.GetHttp().Domain != "*.example.com" || web.pathPrefix != "/api" || len(web.matches) != 1 || web.http == nil {
+		t.Fatalf("unexpected http tunnel: %+v", web)
+	}
+	if rpc.GetHttp().Subdomain != "rpc" || rpc.http == nil || !rpc.http.grpc {
+		t.Fatalf("unexpected grpc tunnel: %+v", rpc)
+	}
+
+	// the config is exported as is.
+	exported, err := json.Marshal(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var imported []TunnelConfig
+	if err := json.Unmarshal(exported, &imported); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(imported, configs) {
+		t.Fatalf("unexpected round trip: %s", exported)
+	}
+}
+
+func TestTunnelFromConfigErrors(t *testing.T) {
+	for name, config := range map[string]TunnelConfig{
+		"unknown protocol": {Protocol: "quic", Name: "test", LocalAddr: "127.0.0.1:8080"},
+		"other section":    {Protocol: "tcp", Name: "test", LocalAddr: "127.0.0.1:8080", HTTP: &HTTPTunnelConfig{}},
+		"invalid name":     {Protocol: "tcp", Name: "", LocalAddr: "127.0.0.1:8080"},
+		"invalid local":    {Protocol: "udp", Name: "test", LocalAddr: "8080"},
+		"two entrypoints": {Protocol: "http", Name: "test", LocalAddr: "127.0.0.1:8080",
+			HTTP: &HTTPTunnelConfig{Port: 8080, Subdomain: "test"}},
+		"two certificates": {Protocol: "http", Name: "test", LocalAddr: "127.0.0.1:8080",
+			HTTP: &HTTPTunnelConfig{TLSCert: "cert", TLSCertFile: "cert.pem"}},
+		"port and range": {Protocol: "tcp", Name: "test", LocalAddr: "127.0.0.1:8080",
+			TCP: &TCPTunnelConfig{Port: 20000, PortRangeMin: 20000, PortRangeMax: 20100}},
+		"negative connection rate": {Protocol: "grpc", Name: "test", LocalAddr: "127.0.0.1:8080", ConnectionRateLimit: -1},
+	} {
+		if _, err := TunnelFromConfig(config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	var d Duration
+	if err := json.Unmarshal([]byte(`"5 minutes"`), &d); err == nil {
+		t.Fatal("expected the invalid duration to fail")
+	}
+}
+
+func TestLoadTunnelsFromFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	t.Setenv("CASTLE_DB_PORT", "15432")
+
+	tunnels, err := LoadTunnelsFromFile(write("tunnels.yaml", `
+tunnels:
+  - protocol: tcp
+    name: db
+    local_addr: 127.0.0.1:5432
+    tcp:
+      port: ${CASTLE_DB_PORT}
+      idle_timeout: 5m
+  - protocol: http
+    name: web
+    local_addr: 127.0.0.1:8080
+    http:
+      subdomain: ${CASTLE_SUBDOMAIN:-web}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tunnels) != 2 || tunnels[0].GetTcp().RemotePort != 15432 || tunnels[0].idleTimeout != 5*time.Minute ||
+		tunnels[1].GetHttp().GetSubdomain() != "web" {
+		t.Fatalf("unexpected tunnels: %v", tunnels)
+	}
+
+	if got, err := expandEnv([]byte("price: $$5, port: $${CASTLE_DB_PORT}")); err != nil || string(got) != "price: $5, port: ${CASTLE_DB_PORT}" {
+		t.Fatalf("unexpected escaped dollars: %q, %v", got, err)
+	}
+
+	tunnels, err = LoadTunnelsFromFile(write("tunnels.json", `{"tunnels": [{"protocol": "udp", "name": "dns", "local_addr": "127.0.0.1:53"}]}`))
+	if err != nil || len(tunnels) != 1 || tunnels[0].GetUdp() == nil {
+		t.Fatalf("unexpected tunnels: %v, %v", tunnels, err)
+	}
+
+	_, err = LoadTunnelsFromFile(write("invalid.yml", `
+tunnels:
+  - protocol: tcp
+    name: db
+    local_addr: 127.0.0.1:5432
+  - protocol: quic
+    name: bad
+    local_addr: 127.0.0.1:8080
+  - protocol: tcp
+    name: db
+    local_addr: 127.0.0.1:5433
+`))
+	// the errors of all the entries are joined.
+	for _, expected := range []string{`invalid.yml:6: tunnels[1] "bad": unknown protocol`, `invalid.yml:9: tunnels[2] "db": duplicate name`} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected the error of %q, got %v", expected, err)
+		}
+	}
+
+	for name, content := range map[string]string{
+		"unset.yaml":   "tunnels:\n  - protocol: tcp\n    name: ${CASTLE_UNSET}\n",
+		"unknown.json": `{"tunnels": [{"protocol": "tcp", "name": "db", "local": "127.0.0.1:5432"}]}`,
+		"tunnels.toml": "",
+	} {
+		if _, err := LoadTunnelsFromFile(write(name, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
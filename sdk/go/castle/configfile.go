@@ -0,0 +1,138 @@
+package castle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// tunnelsFile is the content of the files of LoadTunnelsFromFile.
+type tunnelsFile struct {
+	Tunnels []TunnelConfig `json:"tunnels" yaml:"tunnels"`
+}
+
+// envPattern matches ${NAME} and ${NAME:-default} in the files of LoadTunnelsFromFile.
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// LoadTunnelsFromFile builds the tunnels of the YAML or JSON file at path, told by the extension of
+// .yaml, .yml or .json. The file has the list of TunnelConfig under "tunnels", e.g.
+//
+//	tunnels:
+//	  - protocol: http
+//	    name: web
+//	    local_addr: 127.0.0.1:8080
+//	    http:
+//	      subdomain: ${SUBDOMAIN:-web}
+//
+// ${NAME} is replaced by the environment variable NAME before the file is decoded, it's an error if NAME
+// isn't set, and ${NAME:-default} falls back to the default. "$$" is a literal "$".
+//
+// The unknown fields are errors, and so are the duplicate names. The errors of all the tunnels are joined,
+// each of them tells the index and the name of the tunnel, and the line of it in the YAML files.
+func LoadTunnelsFromFile(path string) ([]*Tunnel, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tunnels file: %w", err)
+	}
+	content, err = expandEnv(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var file tunnelsFile
+	// lines are the lines of the tunnels in the YAML files, they're unknown for JSON.
+	var lines []int
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&file); err == nil || errors.Is(err, io.EOF) {
+			err = nil
+			lines = tunnelLines(content)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported extension %q of tunnels file, expected .yaml, .yml or .json", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid tunnels file: %w", path, err)
+	}
+
+	tunnels := make([]*Tunnel, 0, len(file.Tunnels))
+	var errs []error
+	names := make(map[string]int, len(file.Tunnels))
+	for i, config := range file.Tunnels {
+		entry := fmt.Sprintf("%s: tunnels[%d] %q", path, i, config.Name)
+		if i < len(lines) {
+			entry = fmt.Sprintf("%s:%d: tunnels[%d] %q", path, lines[i], i, config.Name)
+		}
+		if first, ok := names[config.Name]; ok {
+			errs = append(errs, fmt.Errorf("%s: duplicate name of tunnels[%d]", entry, first))
+			continue
+		}
+		names[config.Name] = i
+		tunnel, err := TunnelFromConfig(config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", entry, err))
+			continue
+		}
+		tunnels = append(tunnels, tunnel)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// expandEnv replaces the environment variables of envPattern in content.
+func expandEnv(content []byte) ([]byte, error) {
+	var errs []error
+	var result bytes.Buffer
+	for i, line := range bytes.SplitAfter(content, []byte("\n")) {
+		// "$$" is kept as "$" and never starts a variable.
+		parts := bytes.Split(line, []byte("$$"))
+		for j, part := range parts {
+			if j > 0 {
+				result.WriteByte('$')
+			}
+			result.Write(envPattern.ReplaceAllFunc(part, func(match []byte) []byte {
+				groups := envPattern.FindSubmatch(match)
+				if value, ok := os.LookupEnv(string(groups[1])); ok {
+					return []byte(value)
+				}
+				if groups[2] != nil {
+					return groups[3]
+				}
+				errs = append(errs, fmt.Errorf("line %d: environment variable %s is not set", i+1, groups[1]))
+				return nil
+			}))
+		}
+	}
+	return result.Bytes(), errors.Join(errs...)
+}
+
+// tunnelLines returns the line of each tunnel of the YAML content, it's nil if the content can't be parsed.
+func tunnelLines(content []byte) []int {
+	var file struct {
+		Tunnels []yaml.Node `yaml:"tunnels"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil
+	}
+	lines := make([]int, len(file.Tunnels))
+	for i, node := range file.Tunnels {
+		lines[i] = node.Line
+	}
+	return lines
+}
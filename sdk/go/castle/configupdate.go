@@ -0,0 +1,188 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+)
+
+// configUpdatePrefix marks a work command as a config update pushed by the server instead of
+// a user connection, the control protocol has no message for it. The connection id is
+// "castle-config-update/<id>?<settings>", e.g. "castle-config-update/7?max-connections=10",
+// the settings are ingress-rate-limit, egress-rate-limit, rate-limit-burst, max-connections,
+// connection-rate-limit and connection-burst.
+//
+// The client acknowledges the update on a data stream of the connection id, with the Finished
+// action if it's applied, or the Close action with the reason as the data if it isn't.
+// The client tells the server it understands the updates by metadataConfigUpdates.
+const configUpdatePrefix = "castle-config-update/"
+
+// ConfigUpdate is the new limits of a running tunnel pushed by the server, e.g. by a central policy
+// of a fleet of clients. The nil fields are unchanged, and 0 removes the limit.
+type ConfigUpdate struct {
+	Tunnel string
+	// IngressRateLimit, EgressRateLimit and RateLimitBurst are of WithIngressRateLimit,
+	// WithEgressRateLimit and WithRateLimitBurst, they apply to the existing connections too,
+	// except the connections which were started without a limit.
+	IngressRateLimit *int64
+	EgressRateLimit  *int64
+	RateLimitBurst   *int64
+	// MaxConnections is of WithMaxConnections, the connections above the new limit are kept,
+	// the new connections are refused until they end.
+	MaxConnections *int
+	// ConnectionRateLimit and ConnectionBurst are of WithConnectionRateLimit, the http tunnels
+	// started without the limit refuse them.
+	ConnectionRateLimit *int
+	ConnectionBurst     *int
+}
+
+// WithConfigUpdateHandler calls handler with each ConfigUpdate pushed by the server before applying it,
+// e.g. to log the changes, the update is refused if the handler returns an error, and the server is told
+// the error. Without the option, the updates are applied as they come.
+func WithConfigUpdateHandler(handler func(ConfigUpdate) error) Option {
+	return func(c *options) {
+		c.onConfigUpdate = handler
+	}
+}
+
+// limitConfig are the limits of a tunnel which the server may update.
+type limitConfig struct {
+	ingressRate, egressRate, rateBurst int64
+	maxConns, connRate, connBurst      int
+}
+
+// isConfigUpdate reports whether the work command is a config update.
+func isConfigUpdate(connectionID string) bool {
+	return strings.HasPrefix(connectionID, configUpdatePrefix)
+}
+
+func parseConfigUpdate(tunnel, connectionID string) (ConfigUpdate, error) {
+	update := ConfigUpdate{Tunnel: tunnel}
+	_, query, _ := strings.Cut(connectionID, "?")
+	settings, err := url.ParseQuery(query)
+	if err != nil {
+		return update, fmt.Errorf("invalid config update %q: %w", connectionID, err)
+	}
+	for key, values := range settings {
+		value := values[len(values)-1]
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			return update, fmt.Errorf("invalid %s %q of the config update", key, value)
+		}
+		i := int(n)
+		switch key {
+		case "ingress-rate-limit":
+			update.IngressRateLimit = &n
+		case "egress-rate-limit":
+			update.EgressRateLimit = &n
+		case "rate-limit-burst":
+			update.RateLimitBurst = &n
+		case "max-connections":
+			update.MaxConnections = &i
+		case "connection-rate-limit":
+			update.ConnectionRateLimit = &i
+		case "connection-burst":
+			update.ConnectionBurst = &i
+		default:
+			return update, fmt.Errorf("unknown setting %q of the config update", key)
+		}
+	}
+	return update, nil
+}
+
+// connLimits returns the limits of the new connections.
+func (t *Tunnel) connLimits() (*rateLimiter, int) {
+	t.limitsMu.RLock()
+	defer t.limitsMu.RUnlock()
+	return t.connLimit, t.maxConns
+}
+
+// updateLimits applies the update, it changes nothing if the update can't be applied.
+func (t *Tunnel) updateLimits(update ConfigUpdate) error {
+	t.limitsMu.Lock()
+	defer t.limitsMu.Unlock()
+
+	limits := t.limits
+	set := func(dst *int64, src *int64) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	setInt := func(dst *int, src *int) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&limits.ingressRate, update.IngressRateLimit)
+	set(&limits.egressRate, update.EgressRateLimit)
+	set(&limits.rateBurst, update.RateLimitBurst)
+	setInt(&limits.maxConns, update.MaxConnections)
+	setInt(&limits.connRate, update.ConnectionRateLimit)
+	setInt(&limits.connBurst, update.ConnectionBurst)
+	connLimitChanged := limits.connRate != t.limits.connRate || limits.connBurst != t.limits.connBurst
+	if t.http != nil && t.connLimit == nil && connLimitChanged {
+		return errors.New("the http tunnel can't enable the connection rate limit while it's running")
+	}
+
+	updateLimiter(&t.ingress, limits.ingressRate, limits.rateBurst)
+	updateLimiter(&t.egress, limits.egressRate, limits.rateBurst)
+	if connLimitChanged {
+		updateLimiter(&t.connLimit, int64(limits.connRate), int64(limits.connBurst))
+	}
+	t.maxConns = limits.maxConns
+	t.limits = limits
+	return nil
+}
+
+// updateLimiter changes the limiter in place, so the connections sharing it follow the new limit.
+func updateLimiter(limiter **rateLimiter, rate, burst int64) {
+	if *limiter != nil {
+		(*limiter).set(rate, burst)
+		return
+	}
+	*limiter = newRateLimiter(rate, burst)
+}
+
+// updateConfig applies the config update of the work command and acknowledges the server,
+// it only fails if the acknowledgement can't be sent.
+func (c *Client) updateConfig(ctx context.Context, tunnel *Tunnel, connectionID string) error {
+	logger := c.tunnelLogger(tunnel)
+	update, err := parseConfigUpdate(tunnel.Name, connectionID)
+	if err == nil && c.onConfigUpdate != nil {
+		if err = c.onConfigUpdate(update); err != nil {
+			err = fmt.Errorf("the config update is refused: %w", err)
+		}
+	}
+	if err == nil {
+		err = tunnel.updateLimits(update)
+	}
+
+	ack := &proto.TrafficToServer{
+		ConnectionId: connectionID,
+		Action:       proto.TrafficToServer_Finished,
+	}
+	if err != nil {
+		logger.Warn("config update is not applied", slog.Any("error", err))
+		ack.Action = proto.TrafficToServer_Close
+		ack.Data = []byte(err.Error())
+	} else {
+		logger.Info("config update is applied", slog.String("update", connectionID))
+	}
+	c.emit(tunnel, Event{Type: EventConfigUpdate, Err: err})
+
+	stream, err := c.grpcClient.Data(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create data stream: %w", err)
+	}
+	defer stream.CloseSend()
+	if err := stream.Send(ack); err != nil {
+		return fmt.Errorf("failed to acknowledge the config update: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,339 @@
+package castle
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+)
+
+// streamConn wraps the data stream of a user connection as a net.Conn.
+//
+// Reading from the conn receives the traffic from the server,
+// writing to the conn sends the traffic to the server.
+type streamConn struct {
+	stream       proto.TunnelService_DataClient
+	connectionID string
+
+	// holdEOF makes Read block after the server finished sending,
+	// instead of returning io.EOF, until the conn is closed or the read deadline exceeds.
+	// the http server treats io.EOF as the user went away, but the server of castled
+	// finishes sending once the request is sent.
+	holdEOF atomic.Bool
+
+	// visitor is the address of the user, it's nil if the server doesn't tell.
+	visitor atomic.Pointer[netip.AddrPort]
+	// opened is the time when the conn was created.
+	opened time.Time
+
+	// ingress limits reading, egress limits writing.
+	ingress *rateLimiter
+	egress  *rateLimiter
+	// bytesIn is the bytes read, bytesOut is the bytes written.
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	// status accumulates the bytes of all the connections of the tunnel, it may be nil.
+	status *tunnelStatus
+	// codec compresses the traffic if WithDataCompression is negotiated, it may be nil.
+	codec *dataCodec
+
+	readMu  sync.Mutex
+	data    chan []byte
+	recvErr error
+	// recvDone is closed once the server ends the stream.
+	recvDone     chan struct{}
+	pending      []byte
+	readDeadline *deadline
+
+	writeMu  sync.Mutex
+	finished bool
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	onClose   func()
+}
+
+func newStreamConn(stream proto.TunnelService_DataClient, connectionID string) *streamConn {
+	c := &streamConn{
+		stream:       stream,
+		connectionID: connectionID,
+		opened:       time.Now(),
+		data:         make(chan []byte),
+		recvDone:     make(chan struct{}),
+		readDeadline: newDeadline(),
+		closing:      make(chan struct{}),
+	}
+	return c
+}
+
+func (c *streamConn) setVisitor(addr netip.AddrPort) {
+	c.visitor.Store(&addr)
+}
+
+// visitorAddr returns the address of the user, it's invalid if the server doesn't tell.
+func (c *streamConn) visitorAddr() netip.AddrPort {
+	if addr := c.visitor.Load(); addr != nil {
+		return *addr
+	}
+	return netip.AddrPort{}
+}
+
+func (c *streamConn) recv() {
+	defer close(c.recvDone)
+	for {
+		dataToClient, err := c.stream.Recv()
+		if err != nil {
+			c.recvErr = err
+			close(c.data)
+			break
+		}
+		if len(dataToClient.Data) == 0 {
+			// the server sends an empty data to indicate the end of the traffic.
+			c.recvErr = io.EOF
+			close(c.data)
+			break
+		}
+		data := dataToClient.Data
+		if c.status != nil {
+			c.status.wireBytesIn.Add(int64(len(data)))
+		}
+		if c.codec != nil {
+			if data, err = c.codec.decode(data); err != nil {
+				c.recvErr = err
+				close(c.data)
+				break
+			}
+		}
+
+		select {
+		case c.data <- data:
+		case <-c.closing:
+			close(c.data)
+			c.discard()
+			return
+		}
+	}
+	c.discard()
+}
+
+// discard drains the stream until the server ends it.
+func (c *streamConn) discard() {
+	for {
+		if _, err := c.stream.Recv(); err != nil {
+			return
+		}
+	}
+}
+
+// linger waits for the server to end the stream after the conn is closed, up to the timeout,
+// cancelling the stream before that may drop the traffic which hasn't been flushed.
+func (c *streamConn) linger(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-c.recvDone:
+	case <-timer.C:
+	}
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		// the rest of a message is charged as it's read, like the first part.
+		if err := c.ingress.wait(c.stream.Context(), n); err != nil {
+			return n, err
+		}
+		return n, nil
+	}
+
+	data := c.data
+	for {
+		select {
+		case <-c.closing:
+			return 0, net.ErrClosed
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case buf, ok := <-data:
+			if !ok {
+				if c.recvErr == io.EOF && c.holdEOF.Load() {
+					data = nil
+					continue
+				}
+				return 0, c.recvErr
+			}
+			n := copy(b, buf)
+			c.pending = buf[n:]
+			c.bytesIn.Add(int64(len(buf)))
+			if c.status != nil {
+				c.status.bytesIn.Add(int64(len(buf)))
+			}
+			if err := c.ingress.wait(c.stream.Context(), n); err != nil {
+				return n, err
+			}
+			return n, nil
+		}
+	}
+}
+
+// discardPending drops the rest of the message which exceeds the buffer of the last Read,
+// it returns the number of the dropped bytes.
+func (c *streamConn) discardPending() int {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	n := len(c.pending)
+	c.pending = nil
+	return n
+}
+
+func (c *streamConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.finished {
+		return 0, net.ErrClosed
+	}
+	if err := c.egress.wait(c.stream.Context(), len(b)); err != nil {
+		return 0, err
+	}
+	data := b
+	if c.codec != nil {
+		data = c.codec.encode(b)
+	}
+	if err := c.stream.Send(&proto.TrafficToServer{
+		ConnectionId: c.connectionID,
+		Action:       proto.TrafficToServer_Sending,
+		Data:         data,
+	}); err != nil {
+		return 0, err
+	}
+	c.bytesOut.Add(int64(len(b)))
+	if c.status != nil {
+		c.status.bytesOut.Add(int64(len(b)))
+		c.status.wireBytesOut.Add(int64(len(data)))
+	}
+	return len(b), nil
+}
+
+// CloseWrite tells the server there is no more traffic from the client.
+func (c *streamConn) CloseWrite() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.finished {
+		return nil
+	}
+	c.finished = true
+	return c.stream.Send(&proto.TrafficToServer{
+		ConnectionId: c.connectionID,
+		Action:       proto.TrafficToServer_Finished,
+	})
+}
+
+func (c *streamConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.CloseWrite()
+		close(c.closing)
+		c.stream.CloseSend()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr {
+	return streamAddr(c.connectionID)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return streamAddr(c.connectionID)
+}
+
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline is a no-op, writing to the stream is not cancellable.
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// streamAddr is the address of a user connection, which is identified by the connection id.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "castle" }
+func (a streamAddr) String() string  { return string(a) }
+
+// deadline is a cancellable deadline, the channel returned by wait is closed when the deadline exceeds.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // wait for the timer callback to finish and close cancel
+	}
+	d.timer = nil
+
+	closed := isClosedChan(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
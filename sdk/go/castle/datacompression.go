@@ -0,0 +1,145 @@
+package castle
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DataCompressionDeflate compresses the traffic of the data streams by deflate, see WithDataCompression.
+const DataCompressionDeflate = "deflate"
+
+const (
+	// the first byte of each data message of a compressed data stream.
+	frameRaw     byte = 0
+	frameDeflate byte = 1
+
+	// minCompressSize is the min size to compress, the smaller writes are sent as is.
+	minCompressSize = 128
+	// maxIncompressible is the number of the writes in a row which don't shrink by 1/8,
+	// they stop the compression of the direction of the connection, e.g. the already compressed
+	// or the encrypted traffic.
+	maxIncompressible = 4
+	// maxDecompressedFrame limits the size of a decompressed message,
+	// the messages are never bigger unless the server misbehaves.
+	maxDecompressedFrame = 4 << 20
+)
+
+// compressedMagics are the prefixes of the traffic which is already compressed or encrypted,
+// the connections starting with them are never compressed.
+var compressedMagics = [][]byte{
+	// a TLS handshake record.
+	{0x16, 0x03},
+	// gzip, zstd and zip.
+	{0x1f, 0x8b},
+	{0x28, 0xb5, 0x2f, 0xfd},
+	{'P', 'K', 0x03, 0x04},
+	// png and jpeg.
+	{0x89, 'P', 'N', 'G'},
+	{0xff, 0xd8, 0xff},
+	// ssh.
+	[]byte("SSH-"),
+}
+
+// negotiateDataCompression returns the compression offered by the tunnel metadata and accepted by
+// the header of the control stream, it's empty if the server doesn't accept it.
+func negotiateDataCompression(offered, header metadata.MD) string {
+	algo := offered.Get(metadataDataCompression)
+	accepted := header.Get(metadataDataCompression)
+	if len(algo) == 0 || len(accepted) == 0 || accepted[0] != algo[0] {
+		return ""
+	}
+	return algo[0]
+}
+
+func validateDataCompression(algo string) error {
+	switch algo {
+	case "", DataCompressionDeflate:
+		return nil
+	}
+	return fmt.Errorf("unsupported data compression %q, expected %q", algo, DataCompressionDeflate)
+}
+
+// dataCodec frames the traffic of a data stream of which the compression is negotiated,
+// each message is prefixed by frameRaw or frameDeflate, and the deflate ones are compressed independently,
+// so a message which doesn't shrink is sent as is.
+//
+// encode is called by the writer of the conn, and decode by the receiver, they never run concurrently
+// with themselves.
+type dataCodec struct {
+	writer *flate.Writer
+	buf    bytes.Buffer
+	// written is true once the first message is encoded.
+	written        bool
+	incompressible int
+	passthrough    bool
+
+	reader io.ReadCloser
+}
+
+func newDataCodec() *dataCodec {
+	writer, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return &dataCodec{writer: writer}
+}
+
+func (c *dataCodec) encode(b []byte) []byte {
+	if !c.written {
+		c.written = true
+		for _, magic := range compressedMagics {
+			if bytes.HasPrefix(b, magic) {
+				c.passthrough = true
+				break
+			}
+		}
+	}
+	if c.passthrough || len(b) < minCompressSize {
+		return append([]byte{frameRaw}, b...)
+	}
+
+	c.buf.Reset()
+	c.buf.WriteByte(frameDeflate)
+	c.writer.Reset(&c.buf)
+	c.writer.Write(b)
+	c.writer.Close()
+	if c.buf.Len() > len(b)-len(b)/8 {
+		c.incompressible++
+		if c.incompressible >= maxIncompressible {
+			c.passthrough = true
+		}
+		if c.buf.Len() > len(b) {
+			return append([]byte{frameRaw}, b...)
+		}
+	} else {
+		c.incompressible = 0
+	}
+	return bytes.Clone(c.buf.Bytes())
+}
+
+func (c *dataCodec) decode(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("empty frame of the compressed data stream")
+	}
+	switch b[0] {
+	case frameRaw:
+		return b[1:], nil
+	case frameDeflate:
+		if c.reader == nil {
+			c.reader = flate.NewReader(bytes.NewReader(b[1:]))
+		} else {
+			c.reader.(flate.Resetter).Reset(bytes.NewReader(b[1:]), nil)
+		}
+		data, err := io.ReadAll(io.LimitReader(c.reader, maxDecompressedFrame+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress the data stream: %w", err)
+		}
+		if len(data) > maxDecompressedFrame {
+			return nil, errors.New("the decompressed frame exceeds the limit")
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown frame %d of the compressed data stream", b[0])
+}
@@ -0,0 +1,128 @@
+package castle
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestDataCodec(t *testing.T) {
+	text := []byte(strings.Repeat("HELO castle.example.com\r\n", 100))
+	random := make([]byte, 4096)
+	rand.Read(random)
+
+	encoder, decoder := newDataCodec(), newDataCodec()
+	frame := encoder.encode(text)
+	if frame[0] != frameDeflate || len(frame) >= len(text)/4 {
+		t.Fatalf("expected the text to be compressed, got %d bytes of %d", len(frame), len(text))
+	}
+	if got, err := decoder.decode(frame); err != nil || !bytes.Equal(got, text) {
+		t.Fatalf("unexpected decoded text: %v", err)
+	}
+	for i := 0; i < maxIncompressible; i++ {
+		if frame := encoder.encode(random); frame[0] != frameRaw {
+			t.Fatal("expected the random bytes to be sent as is")
+		}
+	}
+	// the direction gives up after the incompressible writes in a row.
+	if frame := encoder.encode(text); frame[0] != frameRaw {
+		t.Fatal("expected the compression to stop")
+	}
+	if got, err := decoder.decode(encoder.encode(text)); err != nil || !bytes.Equal(got, text) {
+		t.Fatalf("unexpected decoded raw frame: %v", err)
+	}
+
+	// a TLS connection is never compressed.
+	tls := newDataCodec()
+	if frame := tls.encode(append([]byte{0x16, 0x03, 0x01}, text...)); frame[0] != frameRaw {
+		t.Fatal("expected the TLS traffic to be sent as is")
+	}
+
+	if _, err := decoder.decode([]byte{7, 1, 2}); err == nil {
+		t.Fatal("expected the unknown frame to fail")
+	}
+	if err := NewTCPTunnel("test", "127.0.0.1:8080", WithDataCompression("brotli")).Validate(); err == nil {
+		t.Fatal("expected the unsupported compression to fail")
+	}
+}
+
+func TestDataCompression(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		md, _ := metadata.FromIncomingContext(stream.Context())
+		// the second tunnel is registered by a server which doesn't compress.
+		if n == 0 {
+			if err := stream.SendHeader(metadata.Pairs(metadataDataCompression, md.Get(metadataDataCompression)[0])); err != nil {
+				return err
+			}
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	compressed := NewTCPTunnel("compressed", lis.Addr().String(), WithDataCompression(DataCompressionDeflate))
+	if _, _, err := client.StartTunnel(ctx, compressed); err != nil {
+		t.Fatal(err)
+	}
+	plain := NewTCPTunnel("plain", lis.Addr().String(), WithDataCompression(DataCompressionDeflate))
+	if _, _, err := client.StartTunnel(ctx, plain); err != nil {
+		t.Fatal(err)
+	}
+
+	text := []byte(strings.Repeat("HELO castle.example.com\r\n", 100))
+	visitor := server.visit(t, 0)
+	visitor.codec = newDataCodec()
+	visitor.send(text)
+	visitor.finish()
+	if got := visitor.readAll(); !bytes.Equal(got, text) {
+		t.Fatalf("unexpected echo of %d bytes", len(got))
+	}
+	status := compressed.Status()
+	if status.DataCompression != DataCompressionDeflate || status.BytesIn != int64(len(text)) || status.BytesOut != int64(len(text)) ||
+		status.WireBytesIn >= status.BytesIn/4 || status.WireBytesOut >= status.BytesOut/4 {
+		t.Fatalf("unexpected status of the compressed tunnel: %+v", status)
+	}
+
+	visitor = server.visit(t, 1)
+	visitor.send(text)
+	visitor.finish()
+	if got := visitor.readAll(); !bytes.Equal(got, text) {
+		t.Fatalf("unexpected echo of %d bytes", len(got))
+	}
+	if status := plain.Status(); status.DataCompression != "" || status.WireBytesIn != status.BytesIn || status.WireBytesOut != status.BytesOut {
+		t.Fatalf("unexpected status of the plain tunnel: %+v", status)
+	}
+}
@@ -0,0 +1,63 @@
+package castle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxUDPDatagramSize is the max of WithUdpMaxDatagramSize, the max payload of an udp datagram.
+const maxUDPDatagramSize = maxDatagramSize - 1
+
+// DatagramSizeError is the error of EventDatagramDropped, the datagram exceeds WithUdpMaxDatagramSize.
+type DatagramSizeError struct {
+	// Size is the size of the datagram, it's at least MaxSize+1 for the datagrams from the local address,
+	// of which the exceeding bytes are discarded by the socket.
+	Size    int
+	MaxSize int
+	// FromUser is true if the datagram is from the user, otherwise it's from the local address.
+	FromUser bool
+}
+
+func (e *DatagramSizeError) Error() string {
+	from := "local address"
+	if e.FromUser {
+		from = "user"
+	}
+	return fmt.Sprintf("datagram of %d bytes from the %s exceeds the max size %d", e.Size, from, e.MaxSize)
+}
+
+// udpDatagramSize returns the max size of the datagrams of the tunnel.
+func (t *Tunnel) udpDatagramSize() int {
+	if t.maxDatagramSize > 0 {
+		return t.maxDatagramSize
+	}
+	return maxUDPDatagramSize
+}
+
+// copyDatagrams copies each datagram from src to dst in one write, a datagram exceeding size is dropped
+// rather than truncated, and it's reported to drop. discard drains the rest of the datagram which exceeds
+// the buffer, it returns the number of the discarded bytes.
+func copyDatagrams(dst io.Writer, src io.Reader, size int, discard func() int, drop func(n int)) error {
+	// the extra byte tells the datagram exceeds the size.
+	buf := make([]byte, size+1)
+	for {
+		n, err := src.Read(buf)
+		if n > size {
+			if discard != nil {
+				n += discard()
+			}
+			drop(n)
+		} else if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// localDialer dials the local address of a tunnel for the forwarded connections.
+type localDialer struct {
+	// timeout is the timeout of each dial, zero means no timeout but the OS's.
+	timeout time.Duration
+	// retries is the max number of retries after the first dial fails.
+	retries int
+	// delay is the delay between the retries.
+	delay time.Duration
+	// keepAlive overrides the keepalive of the tcp connections if it's set.
+	keepAlive *tcpKeepAlive
+	// noDelay overrides TCP_NODELAY of the tcp connections if it's set, see WithTCPNoDelay.
+	noDelay *bool
+	// dnsCache resolves the hostnames of the addresses if it's set, see WithLocalDNSCache.
+	dnsCache *dnsCache
+	// source is the local address of the connections if it's valid, see WithLocalDialSourceAddr.
+	source netip.Addr
+}
+
+// dial dials addr until it succeeds, the retries run out or the ctx is done,
+// onFail is called on each failed dial, the attempt starts from 1.
+//
+// The addr may be a unix domain socket like "unix:///run/app.sock", which is dialed
+// in the same kind of the network, the missing socket fails the attempt.
+func (d *localDialer) dial(ctx context.Context, network, addr string, onFail func(attempt int, err error)) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: d.timeout}
+	if d.keepAlive != nil {
+		// the keepalive is set after the conn is established.
+		dialer.KeepAlive = -1
+	}
+	path, isUnix := unixSocketPath(addr)
+	if d.source.IsValid() && !isUnix {
+		if strings.HasPrefix(network, "udp") {
+			dialer.LocalAddr = net.UDPAddrFromAddrPort(netip.AddrPortFrom(d.source, 0))
+		} else {
+			dialer.LocalAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(d.source, 0))
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		dialNetwork, dialAddr, err := network, addr, error(nil)
+		if isUnix {
+			dialNetwork, dialAddr, err = unixNetwork(network, path)
+		}
+		var conn net.Conn
+		if err == nil {
+			if d.dnsCache != nil && !isUnix {
+				conn, err = d.dnsCache.dial(ctx, &dialer, dialNetwork, dialAddr)
+			} else {
+				conn, err = dialer.DialContext(ctx, dialNetwork, dialAddr)
+			}
+		}
+		if err == nil && d.keepAlive != nil {
+			if err = d.keepAlive.apply(conn); err != nil {
+				conn.Close()
+			}
+		}
+		if err == nil && d.noDelay != nil {
+			if tc, ok := conn.(*net.TCPConn); ok {
+				if err = tc.SetNoDelay(*d.noDelay); err != nil {
+					conn.Close()
+				}
+			}
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if onFail != nil {
+			onFail(attempt, err)
+		}
+		if attempt > d.retries {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(d.delay):
+		}
+	}
+}
+
+// validateSourceAddr checks the source address of WithLocalDialSourceAddr is assigned to an interface.
+func validateSourceAddr(source netip.Addr) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("failed to list the interface addresses: %w", err)
+	}
+	for _, addr := range addrs {
+		if prefix, err := netip.ParsePrefix(addr.String()); err == nil && prefix.Addr().Unmap() == source {
+			return nil
+		}
+	}
+	return fmt.Errorf("local dial source address %s is not assigned to any interface", source)
+}
+
+// localDialError is the error of dialing the local server of a http tunnel,
+// it tells the failed connections apart from the errors of the local server, see WithHTTPFallback.
+type localDialError struct {
+	err error
+}
+
+func (e *localDialError) Error() string { return e.err.Error() }
+
+func (e *localDialError) Unwrap() error { return e.err }
+
+// isLocalDialError reports whether err is of dialing the local server.
+func isLocalDialError(err error) bool {
+	var dialErr *localDialError
+	return errors.As(err, &dialErr)
+}
+
+type connectionIDKey struct{}
+
+// connectionID returns the id of the connection which the request of the ctx comes from.
+func connectionID(ctx context.Context) string {
+	id, _ := ctx.Value(connectionIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,89 @@
+package castle
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache caches the addresses of the hostnames of the local addresses for the ttl of WithLocalDNSCache.
+type dnsCache struct {
+	ttl time.Duration
+	// refresh forgets the addresses of a host once the dial to them fails, see WithLocalDNSRefresh.
+	refresh bool
+	// lookupHost resolves the host, it's replaced in tests.
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:        ttl,
+		lookupHost: net.DefaultResolver.LookupHost,
+		entries:    make(map[string]dnsEntry),
+	}
+}
+
+// lookup returns the addresses of the host, they're resolved again once the ttl passes.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.lookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve local host %q: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("local host %q resolves to no addresses", host)
+	}
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// forget drops the addresses of the host, or all the hosts if host is empty.
+func (c *dnsCache) forget(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if host == "" {
+		clear(c.entries)
+		return
+	}
+	delete(c.entries, host)
+}
+
+// dial dials the addrs of the host resolved by the cache in order, until one of them succeeds.
+func (c *dnsCache) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	if c.refresh {
+		c.forget(host)
+	}
+	return nil, err
+}
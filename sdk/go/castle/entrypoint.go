@@ -0,0 +1,73 @@
+package castle
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+)
+
+// Entrypoint is where the users connect to a tunnel, assigned by the server.
+type Entrypoint struct {
+	// URL is the entrypoint as the server returns, e.g. "tcp://example.com:20001".
+	URL string
+	// Scheme is "tcp", "udp", "http" or "https".
+	Scheme string
+	// Host is the hostname or the IP of the entrypoint, without the port.
+	Host string
+	// Port is the port of the entrypoint, it's the default port of the scheme
+	// if the URL doesn't have one.
+	Port uint16
+	// Domain and Subdomain are only set for the http tunnels routed by the host,
+	// Domain is the whole host of WithHTTPDomain, or the base domain of the subdomain.
+	Domain    string
+	Subdomain string
+	// Region is the region of the edge which terminates the traffic, see WithRegion.
+	Region string
+}
+
+// String returns the URL, so logging the entrypoint prints the same as before.
+func (e Entrypoint) String() string {
+	return e.URL
+}
+
+// newEntrypoints parses the entrypoints assigned by the server for the tunnel config,
+// the entrypoints which are not URLs only have the URL set.
+func newEntrypoints(raw []string, config *proto.Tunnel, region string) []Entrypoint {
+	if raw == nil {
+		return nil
+	}
+	entrypoints := make([]Entrypoint, 0, len(raw))
+	for _, s := range raw {
+		entrypoints = append(entrypoints, newEntrypoint(s, config, region))
+	}
+	return entrypoints
+}
+
+func newEntrypoint(raw string, config *proto.Tunnel, region string) Entrypoint {
+	e := Entrypoint{URL: raw, Region: region}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return e
+	}
+	e.Scheme = u.Scheme
+	e.Host = u.Hostname()
+	if port, err := strconv.ParseUint(u.Port(), 10, 16); err == nil {
+		e.Port = uint16(port)
+	} else if u.Scheme == "http" {
+		e.Port = 80
+	} else if u.Scheme == "https" {
+		e.Port = 443
+	}
+
+	if http := config.GetHttp(); http != nil {
+		switch {
+		case http.Domain != "":
+			e.Domain = e.Host
+		case http.Subdomain != "" || http.RandomSubdomain:
+			e.Subdomain, e.Domain, _ = strings.Cut(e.Host, ".")
+		}
+	}
+	return e
+}
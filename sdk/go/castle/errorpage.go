@@ -0,0 +1,58 @@
+package castle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// errorPage is the content responded for the errors generated by the tunnel, see WithHTTPErrorPage.
+type errorPage struct {
+	contentType string
+	body        []byte
+}
+
+// errorPages are the error pages by the status code, 0 is the catch-all one.
+type errorPages map[int]errorPage
+
+type errorPagesKey struct{}
+
+func validateErrorPage(code int) error {
+	if code != 0 && (code < 500 || code > 599) {
+		return fmt.Errorf("invalid error page status %d, expected 0 or 5xx", code)
+	}
+	return nil
+}
+
+// middleware makes the error pages available to proxyError.
+func (pages errorPages) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), errorPagesKey{}, pages)))
+	})
+}
+
+// proxyError responds the error generated by the tunnel rather than the local server,
+// with the error page of the code if any, or the text otherwise.
+func proxyError(w http.ResponseWriter, r *http.Request, code int, text string) {
+	if pages, ok := r.Context().Value(errorPagesKey{}).(errorPages); ok {
+		page, ok := pages[code]
+		if !ok {
+			page, ok = pages[0]
+		}
+		if ok {
+			h := w.Header()
+			h.Del("Content-Encoding")
+			h.Set("Content-Type", page.contentType)
+			h.Set("Content-Length", strconv.Itoa(len(page.body)))
+			w.WriteHeader(code)
+			w.Write(page.body)
+			return
+		}
+	}
+	if text == "" {
+		w.WriteHeader(code)
+		return
+	}
+	http.Error(w, text, code)
+}
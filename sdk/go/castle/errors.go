@@ -0,0 +1,260 @@
+package castle
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// ErrClientClosed is returned by StartTunnel after the client is shut down.
+var ErrClientClosed = errors.New("castle: client closed")
+
+// ErrServerClosed is matched by the error of the quit channel with errors.Is
+// if the server ends the control stream or the connection to the server is lost, the error is a ServerError.
+var ErrServerClosed = errors.New("castle: server closed the control stream")
+
+// ErrDuplicateName is returned by StartTunnel if another running tunnel of the client has the same name.
+var ErrDuplicateName = errors.New("castle: duplicate tunnel name")
+
+// ErrTunnelNotFound is returned by Client.RemoveTunnel if no running tunnel of the client has the name.
+var ErrTunnelNotFound = errors.New("castle: tunnel not found")
+
+// ErrAddressInUse is matched by the ConflictError with errors.Is.
+var ErrAddressInUse = errors.New("castle: address in use")
+
+// ErrDNS is matched by the ServerError with errors.Is if the address of the server can't be resolved.
+var ErrDNS = errors.New("castle: failed to resolve the server address")
+
+// ErrConnRefused is matched by the ServerError with errors.Is if the server refuses the connection.
+var ErrConnRefused = errors.New("castle: server refused the connection")
+
+// ErrTLS is matched by the TLSError with errors.Is.
+var ErrTLS = errors.New("castle: tls handshake failed")
+
+// ErrAuth is matched by the AuthError with errors.Is.
+var ErrAuth = errors.New("castle: authentication failed")
+
+// ServerError is returned when the client can't reach the server, or the server ends the control stream
+// of a running tunnel. It matches ErrDNS, ErrConnRefused or ErrServerClosed with errors.Is by the cause,
+// and Err is the TLSError if the tls handshake fails, or the ProxyError if the proxy refuses to connect.
+//
+// StartTunnels and Serve wrap it in the TunnelError of the tunnel like the other errors.
+type ServerError struct {
+	// Addr is the address of the server given to NewClient.
+	Addr string
+	// Tunnel is the name of the tunnel being registered or served, it's empty for Client.Ping.
+	Tunnel string
+	Err    error
+	// kind is one of the sentinel errors, nil if the cause is unknown.
+	kind error
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("server %s: %v", e.Addr, e.Err)
+}
+
+func (e *ServerError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ServerError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+// asServerError returns a ServerError if err of the tunnel is caused by the connection to the server at addr.
+func asServerError(err error, addr, tunnel string) error {
+	var tlsErr *TLSError
+	var proxyErr *ProxyError
+	if status.Code(err) != codes.Unavailable && !errors.As(err, &tlsErr) && !errors.As(err, &proxyErr) {
+		return err
+	}
+	return &ServerError{Addr: addr, Tunnel: tunnel, Err: err, kind: dialErrorKind(err)}
+}
+
+// dialErrorKind returns ErrDNS or ErrConnRefused by the error of dialing the server.
+// gRPC only keeps the message of the dial error, so it's told by the message of the net package,
+// or the name resolver of gRPC.
+func dialErrorKind(err error) error {
+	var dnsErr *net.DNSError
+	msg := err.Error()
+	switch {
+	case errors.As(err, &dnsErr), strings.Contains(msg, "name resolver error"), strings.Contains(msg, "no such host"):
+		return ErrDNS
+	case errors.Is(err, syscall.ECONNREFUSED), strings.Contains(msg, "connection refused"):
+		return ErrConnRefused
+	}
+	return nil
+}
+
+// TunnelError is the error which belongs to a specific tunnel.
+type TunnelError struct {
+	Name string
+	Err  error
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("tunnel %q: %v", e.Name, e.Err)
+}
+
+func (e *TunnelError) Unwrap() error {
+	return e.Err
+}
+
+// AuthError is returned when the server rejects the credentials of the client,
+// e.g. the auth token is missing, invalid or expired.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed: %v", e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AuthError) Is(target error) bool {
+	return target == ErrAuth
+}
+
+// TLSError is returned when the tls handshake with the server fails,
+// e.g. the server certificate can't be verified, or the server rejects the client certificate.
+type TLSError struct {
+	// ClientCert reports whether the server rejects the client certificate,
+	// otherwise the server certificate is bad or the handshake fails for other reasons.
+	ClientCert bool
+	Err        error
+}
+
+func (e *TLSError) Error() string {
+	if e.ClientCert {
+		return fmt.Sprintf("tls handshake failed, the client certificate is rejected: %v", e.Err)
+	}
+	return fmt.Sprintf("tls handshake failed: %v", e.Err)
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TLSError) Is(target error) bool {
+	return target == ErrTLS
+}
+
+// TimeoutError is returned when the server doesn't respond before the deadline of the ctx.
+type TimeoutError struct {
+	Op  string
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out: %v", e.Op, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports the error is a timeout, like net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// ConflictError is returned when the requested entrypoint is taken by another tunnel,
+// only the requested one of Port, Domain and Subdomain is set.
+// Callers may fall back to another entrypoint, e.g. a random subdomain.
+type ConflictError struct {
+	Port      uint16
+	Domain    string
+	Subdomain string
+	Err       error
+}
+
+func (e *ConflictError) Error() string {
+	switch {
+	case e.Domain != "":
+		return fmt.Sprintf("domain %s is already in use: %v", e.Domain, e.Err)
+	case e.Subdomain != "":
+		return fmt.Sprintf("subdomain %s is already in use: %v", e.Subdomain, e.Err)
+	default:
+		return fmt.Sprintf("port %d is already in use: %v", e.Port, e.Err)
+	}
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrAddressInUse
+}
+
+// BindAddrError is returned when the server refuses the bind address of WithTCPBindAddr.
+type BindAddrError struct {
+	Addr string
+	// Allowed is the bind addresses allowed by the server.
+	Allowed []string
+	Err     error
+}
+
+func (e *BindAddrError) Error() string {
+	return fmt.Sprintf("bind address %s is not allowed, the allowed addresses are %s: %v",
+		e.Addr, strings.Join(e.Allowed, ", "), e.Err)
+}
+
+func (e *BindAddrError) Unwrap() error {
+	return e.Err
+}
+
+// asBindAddrError returns a BindAddrError if the server refuses the bind address with err,
+// the server tells it by the allowed addresses in the trailer.
+func asBindAddrError(err error, addr string, trailer metadata.MD) error {
+	var allowed []string
+	for _, value := range trailer.Get(metadataAllowedBindAddrs) {
+		for _, a := range strings.Split(value, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				allowed = append(allowed, a)
+			}
+		}
+	}
+	if addr == "" || len(allowed) == 0 {
+		return err
+	}
+	return &BindAddrError{Addr: addr, Allowed: allowed, Err: err}
+}
+
+// asConflictError returns a ConflictError if the server refuses the entrypoint of config with err.
+func asConflictError(err error, config *proto.Tunnel) error {
+	if status.Code(err) != codes.AlreadyExists {
+		return err
+	}
+	conflict := &ConflictError{Err: err}
+	switch {
+	case config.GetTcp() != nil:
+		conflict.Port = uint16(config.GetTcp().RemotePort)
+	case config.GetUdp() != nil:
+		conflict.Port = uint16(config.GetUdp().RemotePort)
+	case config.GetHttp() != nil:
+		http := config.GetHttp()
+		conflict.Domain = http.Domain
+		conflict.Subdomain = http.Subdomain
+		conflict.Port = uint16(http.RemotePort)
+	}
+	return conflict
+}
+
+// asAuthError returns an AuthError if the server rejects the credentials with err.
+func asAuthError(err error) error {
+	if code := status.Code(err); code == codes.Unauthenticated || code == codes.PermissionDenied {
+		return &AuthError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+package castle
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventType is the type of an Event.
+type EventType int
+
+const (
+	// EventRegistered is emitted when the tunnel is registered, Entrypoints is set.
+	EventRegistered EventType = iota
+	// EventReconnect is emitted after each re-registration attempt, Attempt is set,
+	// Err is nil if the attempt succeeded.
+	EventReconnect
+	// EventConnOpened is emitted when a user connection is opened, ConnectionID is set.
+	EventConnOpened
+	// EventConnClosed is emitted when a user connection is closed,
+	// ConnectionID, BytesIn and BytesOut are set.
+	EventConnClosed
+	// EventConnRejected is emitted when the client refuses a user connection,
+	// e.g. the address is denied or there are too many sessions, ConnectionID and Err are set.
+	EventConnRejected
+	// EventUpstreamHealth is emitted when an upstream of a http tunnel becomes healthy or unhealthy,
+	// Upstream and Healthy are set.
+	EventUpstreamHealth
+	// EventWarning is emitted after registering for each option which doesn't take effect, Err is set.
+	EventWarning
+	// EventLocalDialFailed is emitted on each failed dial to the local address,
+	// ConnectionID, Attempt and Err are set, see WithLocalDialRetries.
+	EventLocalDialFailed
+	// EventBreakerState is emitted when the circuit breaker of a http tunnel changes the state,
+	// Breaker is set, see WithHTTPCircuitBreaker.
+	EventBreakerState
+	// EventGoingAway is emitted when the server is going to shut down, Grace and Err are set,
+	// the server keeps serving the existing connections for Grace, then the tunnel re-registers
+	// if WithReconnect is used, or it quits with a GoingAwayError.
+	EventGoingAway
+	// EventConfigUpdate is emitted for each config update pushed by the server, Err is set if it's not applied,
+	// see ConfigUpdate.
+	EventConfigUpdate
+	// EventDatagramDropped is emitted for each datagram of an udp tunnel which exceeds WithUdpMaxDatagramSize,
+	// ConnectionID is set, and Err is a *DatagramSizeError.
+	EventDatagramDropped
+	// EventError is emitted when the tunnel fails to serve a connection or the control stream is broken.
+	EventError
+	// EventClosed is emitted when the tunnel quits, Err is the reason if it quits unexpectedly.
+	EventClosed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRegistered:
+		return "registered"
+	case EventReconnect:
+		return "reconnect"
+	case EventConnOpened:
+		return "conn_opened"
+	case EventConnClosed:
+		return "conn_closed"
+	case EventConnRejected:
+		return "conn_rejected"
+	case EventUpstreamHealth:
+		return "upstream_health"
+	case EventWarning:
+		return "warning"
+	case EventLocalDialFailed:
+		return "local_dial_failed"
+	case EventBreakerState:
+		return "breaker_state"
+	case EventGoingAway:
+		return "going_away"
+	case EventConfigUpdate:
+		return "config_update"
+	case EventDatagramDropped:
+		return "datagram_dropped"
+	case EventError:
+		return "error"
+	case EventClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes what happened to a tunnel, only the fields documented by the type are set.
+type Event struct {
+	Type EventType
+	// Tunnel is the name of the tunnel.
+	Tunnel string
+	Time   time.Time
+
+	Entrypoints []Entrypoint
+	Attempt     int
+
+	// ConnectionID is the id of the user connection assigned by the server, it's the connection_id
+	// of the logs, see WithHTTPConnIDHeader to pass it to the local server.
+	ConnectionID string
+	// BytesIn is the bytes from the user, BytesOut is the bytes to the user.
+	BytesIn  int64
+	BytesOut int64
+
+	Upstream string
+	Healthy  bool
+
+	Breaker BreakerState
+	// Grace is how long the server keeps serving before it goes away.
+	Grace time.Duration
+
+	Err error
+
+	// Dropped is the number of the events dropped right before this one,
+	// since the handler fell behind by more than 4096 events, see EventHandler.
+	Dropped int
+}
+
+// maxPendingEvents is the max number of the events waiting for the handler,
+// the oldest events of the connections are dropped beyond it, see droppable.
+const maxPendingEvents = 4096
+
+// droppable reports whether the event may be dropped once too many are pending, only the events
+// of the connections are, which are emitted as many as the traffic, the others are never dropped.
+func (t EventType) droppable() bool {
+	switch t {
+	case EventConnOpened, EventConnClosed, EventConnRejected, EventLocalDialFailed, EventDatagramDropped:
+		return true
+	default:
+		return false
+	}
+}
+
+// EventHandler handles the events of the tunnels of a client.
+//
+// The events are delivered one by one from a dedicated goroutine, in the order they are emitted,
+// so a slow handler delays the following events but never blocks the tunnels.
+// The handler must not block, since an event is emitted for each connection: once 4096 events
+// are pending, the oldest events of the connections are dropped, i.e. EventConnOpened, EventConnClosed,
+// EventConnRejected, EventLocalDialFailed and EventDatagramDropped, and Event.Dropped of the next
+// delivered event counts them. The others, including EventRegistered and EventClosed, are never dropped.
+// The order below holds for the delivered events.
+// For each tunnel, EventRegistered is the first event, EventConnOpened of a connection precedes
+// its EventConnClosed, and EventClosed is the last event, it's emitted after the tunnel quits
+// and all its connections are closed.
+// A tunnel which fails to register only emits EventClosed.
+type EventHandler func(Event)
+
+// WithEventHandler sets the handler which receives the lifecycle events of all the tunnels,
+// the handler must not block, or the events are dropped once too many are pending, see EventHandler.
+func WithEventHandler(handler EventHandler) Option {
+	return func(c *options) {
+		c.onEvent = handler
+	}
+}
+
+// eventDispatcher delivers the events to the handler in order,
+// the delivering goroutine only runs when there are pending events.
+type eventDispatcher struct {
+	handler EventHandler
+	// max is the max number of the pending events, it's maxPendingEvents except in tests.
+	max int
+
+	mu      sync.Mutex
+	queue   []Event
+	running bool
+}
+
+func newEventDispatcher(handler EventHandler) *eventDispatcher {
+	if handler == nil {
+		return nil
+	}
+	return &eventDispatcher{handler: handler, max: maxPendingEvents}
+}
+
+// emit queues the event, it never blocks, the oldest droppable event is dropped if there are too many pending,
+// it's a no-op on a nil dispatcher.
+func (d *eventDispatcher) emit(event Event) {
+	if d == nil {
+		return
+	}
+	event.Time = time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queue = append(d.queue, event)
+	if len(d.queue) > d.max {
+		// drop the oldest droppable one, and pass its count on to the next one. The queue grows
+		// if only the newest one is droppable, it's bounded by the events which are never dropped.
+		i := slices.IndexFunc(d.queue, func(e Event) bool { return e.Type.droppable() })
+		if i >= 0 && i < len(d.queue)-1 {
+			d.queue[i+1].Dropped += d.queue[i].Dropped + 1
+			if i == 0 {
+				d.queue[0] = Event{}
+				d.queue = d.queue[1:]
+			} else {
+				d.queue = slices.Delete(d.queue, i, i+1)
+			}
+		}
+	}
+	if !d.running {
+		d.running = true
+		go d.run()
+	}
+}
+
+func (d *eventDispatcher) run() {
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			d.mu.Unlock()
+			return
+		}
+		event := d.queue[0]
+		d.queue[0] = Event{}
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+
+		d.handler(event)
+	}
+}
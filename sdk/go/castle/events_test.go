@@ -0,0 +1,167 @@
+package castle
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEventHandler(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	events := make(chan Event, 10)
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		events <- event
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewTCPTunnel("test", local.Addr().String())
+	_, quit, err := client.StartTunnel(ctx, tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	visitor.finish()
+	visitor.readAll()
+	cancel()
+	<-quit
+
+	want := []EventType{EventRegistered, EventConnOpened, EventConnClosed, EventClosed}
+	for _, w := range want {
+		select {
+		case event := <-events:
+			if event.Type != w || event.Tunnel != "test" {
+				t.Fatalf("unexpected event %v of tunnel %s, want %v", event.Type, event.Tunnel, w)
+			}
+			if event.Type == EventConnClosed && (event.BytesIn != 4 || event.BytesOut != 4) {
+				t.Fatalf("unexpected bytes: in=%d out=%d", event.BytesIn, event.BytesOut)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %v event", w)
+		}
+	}
+
+	// a tunnel failed to register only emits closed.
+	if _, _, err := client.StartTunnel(context.Background(), NewTCPTunnel("bad", "127.0.0.1:0", WithAllowCIDR("invalid"))); err == nil {
+		t.Fatal("expected the invalid cidr to fail")
+	}
+	select {
+	case event := <-events:
+		if event.Type != EventClosed || event.Tunnel != "bad" || event.Err == nil {
+			t.Fatalf("unexpected event %v of tunnel %s", event.Type, event.Tunnel)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no closed event")
+	}
+}
+
+func TestEventHandlerKeepsLifecycle(t *testing.T) {
+	blocked, release := make(chan struct{}), make(chan struct{})
+	delivered := make(chan Event, 100)
+	d := newEventDispatcher(func(event Event) {
+		if event.Type == EventRegistered {
+			close(blocked)
+			<-release
+		}
+		delivered <- event
+	})
+	d.max = 8
+
+	d.emit(Event{Type: EventRegistered})
+	<-blocked
+	// the queue is full of the connections when the tunnel closes.
+	d.emit(Event{Type: EventWarning})
+	for i := 0; i < 20; i++ {
+		d.emit(Event{Type: EventConnOpened, ConnectionID: strconv.Itoa(i)})
+	}
+	d.emit(Event{Type: EventClosed})
+	close(release)
+
+	if event := <-delivered; event.Type != EventRegistered {
+		t.Fatalf("unexpected first event: %+v", event)
+	}
+	if event := <-delivered; event.Type != EventWarning || event.Dropped != 0 {
+		t.Fatalf("expected the warning to be kept, got %+v", event)
+	}
+	for i := 14; i < 20; i++ {
+		event := <-delivered
+		if event.ConnectionID != strconv.Itoa(i) {
+			t.Fatalf("expected the oldest connections to be dropped, got %q", event.ConnectionID)
+		}
+		want := 0
+		if i == 14 {
+			want = 14
+		}
+		if event.Dropped != want {
+			t.Fatalf("expected %d dropped events before %d, got %d", want, i, event.Dropped)
+		}
+	}
+	if event := <-delivered; event.Type != EventClosed || event.Dropped != 0 {
+		t.Fatalf("expected the closed event to be delivered last, got %+v", event)
+	}
+}
+
+func TestEventHandlerBlocked(t *testing.T) {
+	blocked, release := make(chan struct{}), make(chan struct{})
+	delivered := make(chan Event, 100)
+	d := newEventDispatcher(func(event Event) {
+		if event.Type == EventRegistered {
+			close(blocked)
+			<-release
+		}
+		delivered <- event
+	})
+	d.max = 8
+
+	d.emit(Event{Type: EventRegistered})
+	<-blocked
+	// the handler is blocked, the pending events are bounded.
+	for i := 0; i < 20; i++ {
+		d.emit(Event{Type: EventConnOpened, ConnectionID: strconv.Itoa(i)})
+	}
+	d.mu.Lock()
+	pending := len(d.queue)
+	d.mu.Unlock()
+	if pending != 8 {
+		t.Fatalf("expected 8 pending events, got %d", pending)
+	}
+	close(release)
+
+	if event := <-delivered; event.Type != EventRegistered || event.Dropped != 0 {
+		t.Fatalf("unexpected first event: %+v", event)
+	}
+	for i := 12; i < 20; i++ {
+		event := <-delivered
+		if event.ConnectionID != strconv.Itoa(i) {
+			t.Fatalf("expected the oldest events to be dropped, got %q", event.ConnectionID)
+		}
+		want := 0
+		if i == 12 {
+			want = 12
+		}
+		if event.Dropped != want {
+			t.Fatalf("expected %d dropped events before %d, got %d", want, i, event.Dropped)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxUDPFanout is the max number of local backends a udp datagram is mirrored to.
+const maxUDPFanout = 16
+
+// fanoutConn mirrors each written datagram to all the backends of a udp session,
+// and reads the replies from either the first responder or all of them.
+type fanoutConn struct {
+	backends   []net.Conn
+	allReplies bool
+
+	replies chan reply
+	// closed is closed once the conn is closed.
+	closed    chan struct{}
+	closeOnce sync.Once
+	// readers is the number of the backends which are still readable.
+	readers sync.WaitGroup
+
+	mu sync.Mutex
+	// responder is the backend replied first, nil before any reply.
+	responder net.Conn
+}
+
+type reply struct {
+	from net.Conn
+	data []byte
+}
+
+func newFanoutConn(backends []net.Conn, allReplies bool) *fanoutConn {
+	c := &fanoutConn{
+		backends:   backends,
+		allReplies: allReplies,
+		replies:    make(chan reply),
+		closed:     make(chan struct{}),
+	}
+	c.readers.Add(len(backends))
+	for _, backend := range backends {
+		go c.read(backend)
+	}
+	go func() {
+		c.readers.Wait()
+		close(c.replies)
+	}()
+	return c
+}
+
+func (c *fanoutConn) read(backend net.Conn) {
+	defer c.readers.Done()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := backend.Read(buf)
+		if err != nil {
+			// a backend which is down doesn't affect the others.
+			return
+		}
+		select {
+		case c.replies <- reply{from: backend, data: append([]byte(nil), buf[:n]...)}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// Read reads a reply datagram, the replies of the other backends are dropped
+// after the first reply unless allReplies.
+func (c *fanoutConn) Read(b []byte) (int, error) {
+	for r := range c.replies {
+		if !c.allReplies {
+			c.mu.Lock()
+			if c.responder == nil {
+				c.responder = r.from
+			}
+			first := c.responder == r.from
+			c.mu.Unlock()
+			if !first {
+				continue
+			}
+		}
+		return copy(b, r.data), nil
+	}
+	return 0, io.EOF
+}
+
+// Write mirrors the datagram to all the backends, it fails only if all the backends fail.
+func (c *fanoutConn) Write(b []byte) (int, error) {
+	var errs []error
+	for _, backend := range c.backends {
+		if _, err := backend.Write(b); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == len(c.backends) {
+		return 0, errors.Join(errs...)
+	}
+	return len(b), nil
+}
+
+func (c *fanoutConn) Close() error {
+	var errs []error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		for _, backend := range c.backends {
+			errs = append(errs, backend.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (c *fanoutConn) LocalAddr() net.Addr  { return c.backends[0].LocalAddr() }
+func (c *fanoutConn) RemoteAddr() net.Addr { return c.backends[0].RemoteAddr() }
+
+func (c *fanoutConn) SetDeadline(t time.Time) error {
+	return c.each(func(backend net.Conn) error { return backend.SetDeadline(t) })
+}
+
+func (c *fanoutConn) SetReadDeadline(t time.Time) error {
+	return c.each(func(backend net.Conn) error { return backend.SetReadDeadline(t) })
+}
+
+func (c *fanoutConn) SetWriteDeadline(t time.Time) error {
+	return c.each(func(backend net.Conn) error { return backend.SetWriteDeadline(t) })
+}
+
+func (c *fanoutConn) each(fn func(net.Conn) error) error {
+	var errs []error
+	for _, backend := range c.backends {
+		errs = append(errs, fn(backend))
+	}
+	return errors.Join(errs...)
+}
+
+// dialFanout dials the local address and the fanout backends of the udp tunnel,
+// it fails only if none of them can be dialed.
+func (t *Tunnel) dialFanout(ctx context.Context, onFail func(attempt int, err error)) (net.Conn, error) {
+	var backends []net.Conn
+	var errs []error
+	for _, addr := range append([]string{t.localAddr()}, t.fanout...) {
+		backend, err := t.dialer.dial(ctx, "udp", addr, onFail)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		backends = append(backends, backend)
+	}
+	if len(backends) == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return newFanoutConn(backends, t.fanoutAllReplies), nil
+}
@@ -0,0 +1,59 @@
+package castle
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// addrFilter decides whether an address is allowed to connect to the tunnel,
+// the deny list takes precedence over the allow list,
+// and all the addresses are allowed if the allow list is empty.
+type addrFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newAddrFilter(allow, deny []string) (*addrFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	f := &addrFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q: %w", cidr, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func (f *addrFilter) allowed(addr netip.Addr) bool {
+	for _, prefix := range f.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, prefix := range f.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package castle
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAddrFilter(t *testing.T) {
+	f, err := newAddrFilter([]string{"192.168.0.0/16", "2001:db8::/32"}, []string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"192.168.0.1": true,
+		"192.168.1.1": false,
+		"10.0.0.1":    false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	}
+	for addr, want := range cases {
+		if got := f.allowed(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("allowed(%s) = %v, want %v", addr, got, want)
+		}
+	}
+
+	f, err = newAddrFilter(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.allowed(netip.MustParseAddr("192.168.0.1")) {
+		t.Error("expected the address to be allowed without the allow list")
+	}
+}
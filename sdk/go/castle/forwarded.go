@@ -0,0 +1,196 @@
+package castle
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+type visitorKey struct{}
+
+// visitorContext attaches the address of the user and the connection id of the conn
+// to the ctx of its requests, it's used as the ConnContext of the http server.
+func visitorContext(ctx context.Context, conn net.Conn) context.Context {
+	sc, ok := conn.(*streamConn)
+	if !ok {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, connectionIDKey{}, sc.connectionID)
+	if visitor := sc.visitorAddr(); visitor.IsValid() {
+		ctx = context.WithValue(ctx, visitorKey{}, visitor.Addr())
+	}
+	return ctx
+}
+
+// connIDHeader sets the header of WithHTTPConnIDHeader to the connection id of the request.
+func connIDHeader(name string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id := connectionID(r.Context()); id != "" {
+				r.Header.Set(name, id)
+			} else {
+				r.Header.Del(name)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedFor sets X-Forwarded-For, X-Forwarded-Proto and X-Real-IP of the requests.
+//
+// The address of the user told by the server is appended to X-Forwarded-For,
+// the real ip is the rightmost address of the chain which is not a trusted proxy.
+// Nothing is set if the server doesn't tell the address, except X-Real-IP is removed.
+func forwardedFor(trusted []netip.Prefix) middleware {
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var chain []string
+			for _, value := range r.Header.Values("X-Forwarded-For") {
+				for _, addr := range strings.Split(value, ",") {
+					if addr = strings.TrimSpace(addr); addr != "" {
+						chain = append(chain, addr)
+					}
+				}
+			}
+			visitor, ok := r.Context().Value(visitorKey{}).(netip.Addr)
+			if !ok {
+				// without the direct peer, the chain is all told by the user,
+				// so the real ip is unknown, and the X-Real-IP sent by the user is dropped.
+				r.Header.Del("X-Real-IP")
+				next.ServeHTTP(w, r)
+				return
+			}
+			chain = append(chain, visitor.String())
+
+			realIP := chain[0]
+			for i := len(chain) - 1; i >= 0; i-- {
+				addr, err := netip.ParseAddr(chain[i])
+				if err != nil || !isTrusted(addr.Unmap()) {
+					realIP = chain[i]
+					break
+				}
+			}
+
+			r.Header.Set("X-Forwarded-For", strings.Join(chain, ", "))
+			r.Header.Set("X-Real-IP", realIP)
+			if r.Header.Get("X-Forwarded-Proto") == "" {
+				r.Header.Set("X-Forwarded-Proto", "http")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// forwardedPort sets X-Forwarded-Port and X-Forwarded-Proto of the requests, see WithHTTPForwardedPort.
+type forwardedPort struct {
+	// entrypoints are set once the tunnel is registered.
+	entrypoints atomic.Pointer[[]Entrypoint]
+}
+
+func (f *forwardedPort) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, port, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host, port = r.Host, ""
+		}
+		// the X-Forwarded-Proto of the user is replaced, it can't be trusted.
+		proto := f.scheme(host, port)
+		if port == "" {
+			// the users omit the default port of the scheme.
+			port = strconv.Itoa(int(defaultPort(proto)))
+		}
+		r.Header.Set("X-Forwarded-Proto", proto)
+		r.Header.Set("X-Forwarded-Port", port)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// scheme returns the scheme of the entrypoint which the host and port of the request point to,
+// or of the first entrypoint of the host, or of the first entrypoint, it's http without the entrypoints.
+func (f *forwardedPort) scheme(host, port string) string {
+	entrypoints := f.entrypoints.Load()
+	if entrypoints == nil {
+		return "http"
+	}
+	var first, sameHost string
+	for _, e := range *entrypoints {
+		if e.Scheme != "http" && e.Scheme != "https" {
+			continue
+		}
+		if first == "" {
+			first = e.Scheme
+		}
+		if !strings.EqualFold(e.Host, host) {
+			continue
+		}
+		if port == strconv.Itoa(int(e.Port)) || port == "" && e.Port == defaultPort(e.Scheme) {
+			return e.Scheme
+		}
+		if sameHost == "" {
+			sameHost = e.Scheme
+		}
+	}
+	switch {
+	case sameHost != "":
+		return sameHost
+	case first != "":
+		return first
+	default:
+		return "http"
+	}
+}
+
+// exactScheme is like scheme, but ok is false unless the host and port point to the entrypoints
+// of one scheme, e.g. the host is of none of them, or the port is omitted and both schemes have the default one.
+func (f *forwardedPort) exactScheme(host, port string) (scheme string, ok bool) {
+	entrypoints := f.entrypoints.Load()
+	if entrypoints == nil {
+		return "", false
+	}
+	for _, e := range *entrypoints {
+		if e.Scheme != "http" && e.Scheme != "https" || !strings.EqualFold(e.Host, host) {
+			continue
+		}
+		if port != strconv.Itoa(int(e.Port)) && (port != "" || e.Port != defaultPort(e.Scheme)) {
+			continue
+		}
+		if scheme != "" && scheme != e.Scheme {
+			return "", false
+		}
+		scheme = e.Scheme
+	}
+	return scheme, scheme != ""
+}
+
+// httpsHost returns the host of the https entrypoint of the host, with the port unless it's 443,
+// it's the host itself without such an entrypoint.
+func (f *forwardedPort) httpsHost(host string) string {
+	if entrypoints := f.entrypoints.Load(); entrypoints != nil {
+		for _, e := range *entrypoints {
+			if e.Scheme == "https" && strings.EqualFold(e.Host, host) && e.Port != defaultPort(e.Scheme) {
+				return net.JoinHostPort(host, strconv.Itoa(int(e.Port)))
+			}
+		}
+	}
+	return host
+}
+
+func defaultPort(scheme string) uint16 {
+	if scheme == "https" {
+		return 443
+	}
+	return 80
+}
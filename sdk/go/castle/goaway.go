@@ -0,0 +1,64 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+)
+
+// GoingAwayError is returned when the server ends the control stream for a planned shutdown,
+// e.g. the maintenance, the server keeps serving the existing connections for Grace.
+type GoingAwayError struct {
+	Grace time.Duration
+	Err   error
+}
+
+func (e *GoingAwayError) Error() string {
+	return fmt.Sprintf("server is going away in %s", e.Grace)
+}
+
+func (e *GoingAwayError) Unwrap() error {
+	return e.Err
+}
+
+// asGoingAway returns a GoingAwayError if the server ends the control stream
+// with the going away trailer, err is the error of receiving from the stream.
+func asGoingAway(stream proto.TunnelService_RegisterClient, err error) error {
+	values := stream.Trailer().Get(metadataGoingAway)
+	if len(values) == 0 {
+		return err
+	}
+	grace, parseErr := time.ParseDuration(values[0])
+	if parseErr != nil || grace < 0 {
+		grace = 0
+	}
+	return &GoingAwayError{Grace: grace, Err: err}
+}
+
+// broken handles the control stream of the tunnel broken by err, it's called before reconnecting.
+//
+// If the server is going away, EventGoingAway is emitted, and it waits for the grace period,
+// so the tunnel moves to another server instance after the old one finishes draining.
+func (c *Client) broken(ctx context.Context, tunnel *Tunnel, err error) {
+	var goingAway *GoingAwayError
+	if !errors.As(err, &goingAway) {
+		if c.reconnect != nil {
+			c.emit(tunnel, Event{Type: EventError, Err: err})
+		}
+		return
+	}
+
+	c.tunnelLogger(tunnel).Info("server is going away", slog.Duration("grace", goingAway.Grace))
+	c.emit(tunnel, Event{Type: EventGoingAway, Grace: goingAway.Grace, Err: err})
+	if c.reconnect == nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(goingAway.Grace):
+	}
+}
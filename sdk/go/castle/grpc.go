@@ -0,0 +1,68 @@
+package castle
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc/codes"
+)
+
+// grpcReflectionPrefix is the path prefix of the reflection services, v1 and v1alpha.
+const grpcReflectionPrefix = "/grpc.reflection."
+
+// grpcTransport proxies the requests to the local gRPC server in HTTP/2,
+// in cleartext(h2c) unless tlsConfig is set.
+func grpcTransport(dial func(ctx context.Context, network, addr string) (net.Conn, error), tlsConfig *tls.Config) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP:       tlsConfig == nil,
+		TLSClientConfig: tlsConfig,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil || tlsConfig == nil {
+				return conn, err
+			}
+			return dialLocalTLS(ctx, conn, tlsConfig, addr, http2.NextProtoTLS)
+		},
+	}
+}
+
+// grpcError responds the gRPC status in a trailers-only response,
+// so the gRPC clients get the code rather than a http error.
+func grpcError(w http.ResponseWriter, code codes.Code, msg string) {
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc")
+	h.Set("Grpc-Status", strconv.Itoa(int(code)))
+	h.Set("Grpc-Message", encodeGRPCMessage(msg))
+	w.WriteHeader(http.StatusOK)
+}
+
+// encodeGRPCMessage percent-encodes the message as the gRPC protocol requires.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// rejectGRPCReflection responds Unimplemented to the reflection requests,
+// the local server is never asked, see WithGRPCReflection.
+func rejectGRPCReflection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, grpcReflectionPrefix) {
+			grpcError(w, codes.Unimplemented, "reflection is disabled by the tunnel")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,152 @@
+package castle
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+)
+
+// startGRPCEcho starts a local gRPC server with the health and the reflection services.
+func startGRPCEcho(t *testing.T) (string, *health.Server) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthpb.RegisterHealthServer(server, healthServer)
+	reflection.Register(server)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	return lis.Addr().String(), healthServer
+}
+
+// dialGRPCTunnel returns a gRPC client of the users connecting to the nth tunnel of the fake server.
+func dialGRPCTunnel(t *testing.T, server *fakeServer, n int) *grpc.ClientConn {
+	t.Helper()
+
+	conn, err := grpc.NewClient("passthrough:///example.com",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return visitorConn{server.visit(t, n)}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCTunnel(t *testing.T) {
+	localAddr, healthServer := startGRPCEcho(t)
+	tunnel := NewGRPCTunnel("test", localAddr)
+	server := startHTTPTunnel(t, tunnel)
+	if md := server.md[0].Get(metadataGRPC); len(md) != 1 || tunnel.protocol() != "grpc" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+	conn := dialGRPCTunnel(t, server, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := healthpb.NewHealthClient(conn)
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	// the messages of the stream arrive one by one.
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []healthpb.HealthCheckResponse_ServingStatus{healthpb.HealthCheckResponse_SERVING, healthpb.HealthCheckResponse_NOT_SERVING} {
+		resp, err := watch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Status != want {
+			t.Fatalf("expected %s, got %s", want, resp.Status)
+		}
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+
+	// the status of the local server is carried in the trailers.
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound, got %v", err)
+	}
+
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&reflectionpb.ServerReflectionRequest{})
+	if _, err := stream.Recv(); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected the reflection to be disabled, got %v", err)
+	}
+}
+
+func TestGRPCTunnelReflection(t *testing.T) {
+	localAddr, _ := startGRPCEcho(t)
+	server := startHTTPTunnel(t, NewGRPCTunnel("test", localAddr, WithGRPCReflection(true)))
+	conn := dialGRPCTunnel(t, server, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// the bidirectional stream goes back and forth without closing the sending side.
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		services := resp.GetListServicesResponse().GetService()
+		if len(services) == 0 || services[0].Name != healthpb.Health_ServiceDesc.ServiceName {
+			t.Fatalf("unexpected services: %v", services)
+		}
+	}
+	stream.CloseSend()
+}
+
+func TestGRPCTunnelUnavailable(t *testing.T) {
+	// reserve a port which is not listened.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localAddr := lis.Addr().String()
+	lis.Close()
+
+	server := startHTTPTunnel(t, NewGRPCTunnel("test", localAddr))
+	conn := dialGRPCTunnel(t, server, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable, got %v", err)
+	}
+}
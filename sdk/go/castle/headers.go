@@ -0,0 +1,87 @@
+package castle
+
+import (
+	"net/http"
+)
+
+// traceHeaders are the W3C trace context headers,
+// they are preserved by default so the distributed tracing works across the tunnel.
+var traceHeaders = []string{"Traceparent", "Tracestate"}
+
+// headerRewrite sets and removes the headers, the names are case-insensitive.
+type headerRewrite struct {
+	set    map[string]string
+	remove []string
+	// preserve are the headers which are never rewritten.
+	preserve []string
+}
+
+func (h *headerRewrite) empty() bool {
+	return h == nil || (len(h.set) == 0 && len(h.remove) == 0)
+}
+
+func (h *headerRewrite) apply(header http.Header) {
+	for _, name := range h.remove {
+		if !h.preserved(name) {
+			header.Del(name)
+		}
+	}
+	for name, value := range h.set {
+		if !h.preserved(name) {
+			header.Set(name, value)
+		}
+	}
+}
+
+func (h *headerRewrite) preserved(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	for _, p := range h.preserve {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteHeaders rewrites the headers of the requests before proxying them to the local server,
+// and the headers of the responses before sending them to the users.
+func rewriteHeaders(request, response *headerRewrite) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !request.empty() {
+				request.apply(r.Header)
+			}
+			if !response.empty() {
+				w = &headerRewriter{ResponseWriter: w, rewrite: response}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headerRewriter rewrites the headers of the response once it's written.
+type headerRewriter struct {
+	http.ResponseWriter
+	rewrite     *headerRewrite
+	wroteHeader bool
+}
+
+func (w *headerRewriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		w.rewrite.apply(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRewriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap makes http.ResponseController work with the underlying ResponseWriter.
+func (w *headerRewriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,102 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// WithHealthServer serves the health of the client over http at addr, e.g. ":8086",
+// for the liveness and readiness probes of Kubernetes:
+//
+//   - /healthz responds 200 when the connection to the server is up, 503 otherwise.
+//   - /readyz responds 200 when all the tunnels are registered, 503 otherwise, the body lists
+//     the tunnels which aren't. The tunnels closed by Tunnel.Close or the ctx of StartTunnel are
+//     skipped, and the client isn't ready before any tunnel is started or after Shutdown is called.
+//
+// NewClient fails if it can't listen on addr, and the server is closed by Client.Shutdown.
+func WithHealthServer(addr string) Option {
+	return func(c *options) {
+		c.healthAddr = addr
+	}
+}
+
+// healthServer is the http server of WithHealthServer.
+type healthServer struct {
+	lis    net.Listener
+	server *http.Server
+}
+
+func (c *Client) startHealthServer(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the health server: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.serveHealthz)
+	mux.HandleFunc("/readyz", c.serveReadyz)
+	c.health = &healthServer{lis: lis, server: &http.Server{Handler: mux}}
+	go func() {
+		if err := c.health.server.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			c.logger.Error("health server quit", slog.Any("error", err))
+		}
+	}()
+	return nil
+}
+
+func (h *healthServer) shutdown(ctx context.Context) error {
+	if h == nil {
+		return nil
+	}
+	return h.server.Shutdown(ctx)
+}
+
+func (c *Client) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	state := c.conn.GetState()
+	if state == connectivity.Idle {
+		// the connection is lazy, e.g. no tunnel is started yet.
+		c.conn.Connect()
+	}
+	if state != connectivity.Ready {
+		http.Error(w, "the connection to the server is "+strings.ToLower(state.String()), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (c *Client) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	shutdown := c.shutdown
+	c.mu.Unlock()
+	if shutdown {
+		http.Error(w, "the client is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var notReady []string
+	registered := 0
+	for _, info := range c.Tunnels() {
+		status := info.Status
+		switch {
+		case status.State == StateConnected:
+			registered++
+		case status.State == StateClosed && (status.QuitReason == QuitNormal || status.QuitReason == QuitContextCanceled):
+		default:
+			notReady = append(notReady, fmt.Sprintf("tunnel %s is %s", info.Name, status.State))
+		}
+	}
+	if registered == 0 && len(notReady) == 0 {
+		notReady = append(notReady, "no tunnel is started")
+	}
+	if len(notReady) > 0 {
+		http.Error(w, strings.Join(notReady, "\n"), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
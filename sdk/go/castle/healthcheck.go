@@ -0,0 +1,120 @@
+package castle
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const defaultHealthCheckInterval = 10 * time.Second
+
+// healthCheck probes the upstreams of a http tunnel periodically.
+type healthCheck struct {
+	path               string
+	interval           time.Duration
+	timeout            time.Duration
+	healthyThreshold   int
+	unhealthyThreshold int
+}
+
+// UpstreamStatus is the health of an upstream of a http or tcp tunnel.
+type UpstreamStatus struct {
+	Addr string
+	// Healthy is the result of the health check for a http upstream,
+	// or whether the last dial succeeded for a tcp upstream.
+	Healthy bool
+	// ActiveConns and TotalConns are the number of the active and all the connections
+	// proxied to the tcp upstream.
+	ActiveConns int
+	TotalConns  int
+	// Weight is the effective weight of WithTCPWeightedUpstreams or WithHTTPWeightedUpstreams,
+	// 1 by default, it's 0 if the upstream is drained, or the http upstream fails the health check.
+	Weight int
+}
+
+// run probes all the upstreams of the pool until ctx is done.
+// The upstreams are probed over https if tlsConfig is set.
+func (hc *healthCheck) run(ctx context.Context, pool *upstreamPool, tlsConfig *tls.Config, logger *slog.Logger, emit func(Event)) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if unixAddr, ok := unixAddrOf(addr); ok {
+			addr = unixAddr
+		}
+		return (&localDialer{}).dial(ctx, network, addr, nil)
+	}
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		transport.TLSClientConfig = tlsConfig
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   hc.timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	for _, u := range pool.upstreams {
+		go hc.probe(ctx, client, scheme, u, logger, emit)
+	}
+}
+
+func (hc *healthCheck) probe(ctx context.Context, client *http.Client, scheme string, u *upstream, logger *slog.Logger, emit func(Event)) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	// successes and failures are the number of consecutive results.
+	var successes, failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := hc.do(ctx, client, scheme, u.addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			successes++
+			failures = 0
+		} else {
+			failures++
+			successes = 0
+		}
+
+		healthy := u.healthy.Load()
+		switch {
+		case !healthy && successes >= hc.healthyThreshold:
+			u.healthy.Store(true)
+			logger.Info("upstream becomes healthy", slog.String("upstream", u.addr))
+			emit(Event{Type: EventUpstreamHealth, Upstream: u.addr, Healthy: true})
+		case healthy && failures >= hc.unhealthyThreshold:
+			u.healthy.Store(false)
+			logger.Warn("upstream becomes unhealthy", slog.String("upstream", u.addr), slog.Any("error", err))
+			emit(Event{Type: EventUpstreamHealth, Upstream: u.addr, Healthy: false, Err: err})
+		}
+	}
+}
+
+// do sends a probe to the upstream, the upstream is healthy if it responds with 2xx or 3xx.
+func (hc *healthCheck) do(ctx context.Context, client *http.Client, scheme, addr string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, scheme+"://"+urlHost(addr)+hc.path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unhealthy status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package castle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// the modes of WithHTTPHostHeader.
+const (
+	// HostHeaderPreserve forwards the Host of the user, e.g. "app.example.com", it's the default.
+	HostHeaderPreserve = "preserve"
+	// HostHeaderRewrite sets the Host to the address dialed by the client, e.g. "127.0.0.1:8080".
+	HostHeaderRewrite = "rewrite"
+	// hostHeaderCustom is the prefix of the mode setting the Host to the value after it.
+	hostHeaderCustom = "custom:"
+)
+
+// hostHeader is the Host of the requests proxied to the local server, see WithHTTPHostHeader.
+type hostHeader struct {
+	mode string
+	// custom is the Host of the custom mode.
+	custom string
+}
+
+func parseHostHeader(mode string) (hostHeader, error) {
+	switch {
+	case mode == "" || mode == HostHeaderPreserve:
+		return hostHeader{mode: HostHeaderPreserve}, nil
+	case mode == HostHeaderRewrite:
+		return hostHeader{mode: HostHeaderRewrite}, nil
+	case strings.HasPrefix(mode, hostHeaderCustom):
+		custom := strings.TrimPrefix(mode, hostHeaderCustom)
+		if custom == "" || !httpguts.ValidHostHeader(custom) {
+			return hostHeader{}, fmt.Errorf("invalid host header %q", custom)
+		}
+		return hostHeader{mode: hostHeaderCustom, custom: custom}, nil
+	}
+	return hostHeader{}, fmt.Errorf("invalid host header mode %q, expected %q, %q or \"custom:<host>\"",
+		mode, HostHeaderPreserve, HostHeaderRewrite)
+}
+
+// String returns the mode as WithHTTPHostHeader takes it.
+func (h hostHeader) String() string {
+	if h.mode == hostHeaderCustom {
+		return hostHeaderCustom + h.custom
+	}
+	if h.mode == "" {
+		return HostHeaderPreserve
+	}
+	return h.mode
+}
+
+type publicHostKey struct{}
+
+// publicHost returns the Host of the user before it's changed by WithHTTPHostHeader.
+func publicHost(r *http.Request) string {
+	if host, ok := r.Context().Value(publicHostKey{}).(string); ok {
+		return host
+	}
+	return r.Host
+}
+
+// handler sets the Host of the requests, it's inside the upstream pool,
+// so the rewritten Host is of the upstream picked for the request.
+func (h hostHeader) handler(next http.Handler, localAddr func() string) http.Handler {
+	if h.mode == "" || h.mode == HostHeaderPreserve {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), publicHostKey{}, r.Host))
+		switch h.mode {
+		case HostHeaderRewrite:
+			r.Host = backendHost(upstreamAddr(r.Context(), localAddr()))
+		case hostHeaderCustom:
+			r.Host = h.custom
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// backendHost returns the Host of the local address, the unix sockets are "localhost".
+func backendHost(addr string) string {
+	if _, ok := unixSocketPath(addr); ok {
+		return "localhost"
+	}
+	return addr
+}
@@ -0,0 +1,507 @@
+package castle
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// middleware wraps the handler which proxies the request to the local server.
+type middleware func(http.Handler) http.Handler
+
+// httpProxy handles the http requests of a http tunnel inside the client,
+// before the requests are proxied to the local server.
+//
+// The server of castled sends each user request in a separate data stream,
+// the httpProxy serves the data streams with a http server, which runs
+// the middlewares of the tunnel and proxies the request to the local server.
+type httpProxy struct {
+	middlewares    []middleware
+	hostHeader     hostHeader
+	upgradeTimeout time.Duration
+	wsKeepAlive    time.Duration
+	// requestTimeout and responseIdleTimeout are of WithHTTPRequestTimeout and WithHTTPResponseIdleTimeout.
+	requestTimeout      time.Duration
+	responseIdleTimeout time.Duration
+	flushInterval       time.Duration
+	// http2 is true if the server forwards the HTTP/2 connections, see WithHTTPProtocols.
+	http2 bool
+	// grpc is true for the tunnels of NewGRPCTunnel, the local server speaks HTTP/2.
+	grpc bool
+	// localTLS is the config to connect to the local server over https, nil for plain http.
+	localTLS *tls.Config
+	// upstreams are the local addresses beside the local address of the tunnel.
+	upstreams []string
+	// weights are of WithHTTPWeightedUpstreams by the addrs.
+	weights      map[string]int
+	stickyCookie string
+	healthCheck  *healthCheck
+	dialer       *localDialer
+	cache        *httpCache
+	breaker      *circuitBreaker
+	// rejected is the number of the requests rejected by the proxy.
+	rejected *atomic.Int64
+	// connLimit paces the requests, it's nil without WithConnectionRateLimit.
+	connLimit *rateLimiter
+	accessLog *accessLog
+	inspector *inspector
+	resolver  localResolver
+	// rewrite rewrites the responses of the local server, it may be nil.
+	rewrite *responseRewrite
+	// mirror is of WithHTTPMirror, it may be nil.
+	mirror *httpMirror
+	// fallback is the handler of WithHTTPFallback, it may be nil.
+	fallback http.Handler
+	// forwarded is of WithHTTPForwardedPort and WithHTTPForceHTTPS, it may be nil.
+	forwarded *forwardedPort
+	// static serves the files of NewStaticTunnel instead of proxying to the local server, it may be nil.
+	static *staticHandler
+
+	mu       sync.Mutex
+	listener *connListener
+	server   *http.Server
+	pool     *upstreamPool
+	// stopHealthCheck stops probing the upstreams.
+	stopHealthCheck context.CancelFunc
+	stopAccessLog   context.CancelFunc
+}
+
+// newHTTPProxy returns nil if none of the options needs to handle the requests,
+// the traffic is forwarded to the local server as is in this case.
+func newHTTPProxy(opts *httpOptions) *httpProxy {
+	var middlewares []middleware
+	var accessLog *accessLog
+	if opts.accessLogWriter != nil || opts.accessLogFunc != nil {
+		accessLog = newAccessLog(opts.accessLogWriter, opts.accessLogFormat, opts.accessLogFunc)
+		middlewares = append(middlewares, accessLog.middleware)
+	}
+	var inspector *inspector
+	if opts.inspectMaxRequests > 0 {
+		inspector = newInspector(opts.inspectMaxRequests, opts.inspectMaxBodyBytes, opts.inspectRedact)
+		middlewares = append(middlewares, inspector.middleware)
+	}
+	if len(opts.errorPages) > 0 {
+		middlewares = append(middlewares, opts.errorPages.middleware)
+	}
+	rejected := new(atomic.Int64)
+	var connLimit *rateLimiter
+	if opts.connRate > 0 && opts.connBurst >= 0 {
+		connLimit = newRateLimiter(int64(opts.connRate), int64(opts.connBurst))
+		middlewares = append(middlewares, rateLimitRequests(connLimit, opts.grpc, rejected))
+	}
+	if len(opts.allowedMethods) > 0 {
+		middlewares = append(middlewares, allowMethods(opts.allowedMethods, rejected))
+	}
+	if opts.grpc && !opts.grpcReflection {
+		middlewares = append(middlewares, rejectGRPCReflection)
+	}
+	if opts.maxRequestBody > 0 {
+		middlewares = append(middlewares, maxRequestBody(opts.maxRequestBody, rejected))
+	}
+	if opts.connIDHeader != "" {
+		middlewares = append(middlewares, connIDHeader(opts.connIDHeader))
+	}
+	var forwarded *forwardedPort
+	forcesHTTPS := opts.forceHTTPS && opts.cert != nil
+	if opts.forwardedPort || forcesHTTPS {
+		// the entrypoints tell the schemes of the requests.
+		forwarded = &forwardedPort{}
+	}
+	if opts.forwardedPort {
+		// it's before forwardedFor, which defaults X-Forwarded-Proto to http.
+		middlewares = append(middlewares, forwarded.middleware)
+	}
+	if opts.forwardedFor {
+		middlewares = append(middlewares, forwardedFor(opts.trustedProxies))
+	}
+	if forcesHTTPS {
+		middlewares = append(middlewares, forceHTTPS(opts.forceHTTPSExcept, forwarded))
+	}
+	if opts.stripPrefix && opts.pathPrefix != "" {
+		middlewares = append(middlewares, stripPrefix(opts.pathPrefix))
+	}
+	if len(opts.credentials) > 0 {
+		middlewares = append(middlewares, basicAuth(opts.credentials))
+	}
+	if !opts.requestHeaders.empty() || !opts.responseHeaders.empty() {
+		if !opts.dropTraceHeaders {
+			for _, rewrite := range []*headerRewrite{opts.requestHeaders, opts.responseHeaders} {
+				if rewrite != nil {
+					rewrite.preserve = traceHeaders
+				}
+			}
+		}
+		middlewares = append(middlewares, rewriteHeaders(opts.requestHeaders, opts.responseHeaders))
+	}
+
+	if len(opts.compression) > 0 {
+		minSize := opts.compressionMinSize
+		if minSize <= 0 {
+			minSize = defaultCompressionMinSize
+		}
+		middlewares = append(middlewares, compress(opts.compression, minSize))
+	}
+	var mirror *httpMirror
+	if opts.mirrorAddr != "" {
+		// the mirror sees the request as the local server does, even if it's cached.
+		mirror = newHTTPMirror(opts)
+		middlewares = append(middlewares, mirror.middleware)
+	}
+	var cache *httpCache
+	if opts.cacheMaxSize > 0 {
+		// the cache is the innermost one, the cached responses still run through the others.
+		cache = newHTTPCache(opts.cacheMaxSize, opts.cacheTTL)
+		middlewares = append(middlewares, cache.middleware)
+	}
+
+	var breaker *circuitBreaker
+	if opts.breakerThreshold > 0 {
+		breaker = newCircuitBreaker(opts.breakerThreshold, opts.breakerOpenDuration)
+	}
+
+	var rewrite *responseRewrite
+	if opts.rewriteRedirects || len(opts.cookieDomains) > 0 {
+		rewrite = &responseRewrite{
+			redirects:     opts.rewriteRedirects,
+			scheme:        "http",
+			cookieDomains: opts.cookieDomains,
+		}
+		if opts.cert != nil {
+			rewrite.scheme = "https"
+		}
+		if opts.stripPrefix {
+			rewrite.prefix = strings.TrimSuffix(opts.pathPrefix, "/")
+		}
+	}
+
+	var static *staticHandler
+	if opts.staticRoot != "" {
+		static = newStaticHandler(opts)
+	}
+
+	localTLS := opts.localTLSConfig()
+	if static == nil && opts.fallback == nil && len(middlewares) == 0 && opts.upgradeTimeout == 0 && opts.wsKeepAlive == 0 && opts.requestTimeout == 0 && opts.responseIdleTimeout == 0 && len(opts.upstreams) == 0 && len(opts.weights) == 0 && opts.healthCheck == nil && breaker == nil &&
+		localTLS == nil && !hasHTTP2(opts.protocols) && !opts.grpc && opts.resolver == nil && rewrite == nil &&
+		opts.hostHeader.String() == HostHeaderPreserve {
+		return nil
+	}
+	return &httpProxy{
+		middlewares:         middlewares,
+		upgradeTimeout:      opts.upgradeTimeout,
+		wsKeepAlive:         opts.wsKeepAlive,
+		requestTimeout:      opts.requestTimeout,
+		responseIdleTimeout: opts.responseIdleTimeout,
+		flushInterval:       opts.flushInterval,
+		http2:               hasHTTP2(opts.protocols),
+		grpc:                opts.grpc,
+		localTLS:            localTLS,
+		upstreams:           opts.upstreams,
+		weights:             opts.weights,
+		stickyCookie:        opts.stickyCookie,
+		healthCheck:         opts.healthCheck,
+		dialer:              opts.localDialer(),
+		cache:               cache,
+		breaker:             breaker,
+		rejected:            rejected,
+		connLimit:           connLimit,
+		accessLog:           accessLog,
+		inspector:           inspector,
+		resolver:            opts.resolver,
+		rewrite:             rewrite,
+		mirror:              mirror,
+		static:              static,
+		fallback:            opts.fallback,
+		forwarded:           forwarded,
+		hostHeader:          opts.hostHeader,
+	}
+}
+
+// setEntrypoints sets the entrypoints of the tunnel once it's registered.
+func (p *httpProxy) setEntrypoints(entrypoints []Entrypoint) {
+	if p.forwarded != nil {
+		p.forwarded.entrypoints.Store(&entrypoints)
+	}
+}
+
+// start serves the requests, localAddr returns where the new requests are proxied to.
+func (p *httpProxy) start(localAddr func() string, logger *slog.Logger, emit func(Event)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server != nil {
+		return
+	}
+	if p.mirror != nil {
+		p.mirror.logger = logger
+	}
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if unixAddr, ok := unixAddrOf(addr); ok {
+			addr = unixAddr
+		}
+		conn, err := p.dialer.dial(ctx, network, addr, func(attempt int, err error) {
+			emit(Event{Type: EventLocalDialFailed, ConnectionID: connectionID(ctx), Attempt: attempt, Err: err})
+		})
+		if err != nil {
+			return nil, &localDialError{err: err}
+		}
+		return conn, nil
+	}
+	scheme := "http"
+	if p.localTLS != nil {
+		scheme = "https"
+	}
+	// the host is set by the director for each request.
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: scheme})
+	if p.grpc {
+		proxy.Transport = grpcTransport(dial, p.localTLS)
+		// the streaming rpcs are never buffered.
+		proxy.FlushInterval = -1
+	} else {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DialContext = dial
+		// the transport negotiates HTTP/2 with the https local server since ForceAttemptHTTP2 is kept.
+		transport.TLSClientConfig = p.localTLS
+		// the timeout starts once the request is written, so it doesn't limit the uploads.
+		transport.ResponseHeaderTimeout = p.requestTimeout
+		proxy.Transport = transport
+		proxy.FlushInterval = p.flushInterval
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if isBodyTooLarge(err) {
+			p.rejected.Add(1)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		logger.Error("failed to proxy the request to local server", slog.Any("error", err))
+		if p.fallback != nil && isLocalDialError(err) {
+			p.fallback.ServeHTTP(w, r)
+			return
+		}
+		if p.grpc {
+			grpcError(w, codes.Unavailable, "the local server is unavailable")
+			return
+		}
+		var netErr net.Error
+		if p.requestTimeout > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+			proxyError(w, r, http.StatusGatewayTimeout, "")
+			return
+		}
+		proxyError(w, r, http.StatusBadGateway, "")
+	}
+	if p.rewrite != nil {
+		proxy.ModifyResponse = p.rewrite.modifyResponse
+	}
+	if p.responseIdleTimeout > 0 {
+		modifyResponse := proxy.ModifyResponse
+		proxy.ModifyResponse = func(resp *http.Response) error {
+			if modifyResponse != nil {
+				if err := modifyResponse(resp); err != nil {
+					return err
+				}
+			}
+			resp.Body = newIdleBody(resp.Body, p.responseIdleTimeout)
+			return nil
+		}
+	}
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.URL.Host = urlHost(upstreamAddr(r.Context(), localAddr()))
+	}
+	var handler http.Handler = &upgradeHandler{
+		localAddr:   localAddr,
+		timeout:     p.upgradeTimeout,
+		wsKeepAlive: p.wsKeepAlive,
+		dial:        dial,
+		tlsConfig:   p.localTLS,
+		logger:      logger,
+		fallback:    p.fallback,
+		next:        proxy,
+	}
+	handler = p.hostHeader.handler(handler, localAddr)
+	if p.static != nil {
+		handler = p.static
+	}
+	if len(p.upstreams) > 0 || len(p.weights) > 0 || p.healthCheck != nil {
+		addrs := upstreamAddrs(localAddr(), p.upstreams, p.weights)
+		p.pool = newUpstreamPool(addrs, upstreamWeights(addrs, p.weights), p.stickyCookie)
+		handler = p.pool.handler(handler)
+		if p.healthCheck != nil {
+			var ctx context.Context
+			ctx, p.stopHealthCheck = context.WithCancel(context.Background())
+			p.healthCheck.run(ctx, p.pool, p.localTLS, logger, emit)
+		}
+	}
+	if p.resolver != nil {
+		handler = p.resolver.handler(handler, localAddr, p.grpc, func(r *http.Request, err error) {
+			logger.Info("request is rejected", slog.Any("error", err))
+			p.rejected.Add(1)
+			emit(Event{Type: EventConnRejected, ConnectionID: connectionID(r.Context()), Err: err})
+		})
+	}
+	if p.breaker != nil {
+		handler = p.breaker.handler(handler, emit)
+	}
+	if p.accessLog != nil {
+		var ctx context.Context
+		ctx, p.stopAccessLog = context.WithCancel(context.Background())
+		go p.accessLog.run(ctx)
+	}
+	for i := len(p.middlewares) - 1; i >= 0; i-- {
+		handler = p.middlewares[i](handler)
+	}
+	if p.http2 {
+		handler = serveH2C(handler)
+	}
+
+	p.listener = newConnListener()
+	p.server = &http.Server{
+		Handler:     handler,
+		ConnContext: visitorContext,
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			// each data stream carries only one request,
+			// close it once the response is sent.
+			switch state {
+			case http.StateIdle:
+				conn.Close()
+			case http.StateHijacked:
+				// the upgraded and the HTTP/2 conns end once the user closes writing.
+				if sc, ok := conn.(*streamConn); ok {
+					sc.holdEOF.Store(false)
+				}
+			}
+		},
+	}
+	go func() {
+		if err := p.server.Serve(p.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("http proxy quit", slog.Any("error", err))
+		}
+	}()
+}
+
+func (p *httpProxy) serve(conn *streamConn) {
+	conn.holdEOF.Store(true)
+	p.listener.push(conn)
+}
+
+func (p *httpProxy) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server != nil {
+		p.server.Close()
+		p.server = nil
+	}
+	if p.stopHealthCheck != nil {
+		p.stopHealthCheck()
+		p.stopHealthCheck = nil
+	}
+	if p.stopAccessLog != nil {
+		p.stopAccessLog()
+		p.stopAccessLog = nil
+	}
+	if p.mirror != nil {
+		p.mirror.close()
+	}
+}
+
+// upstreamStatus returns the health of the upstreams,
+// it returns nil if the requests are not balanced.
+func (p *httpProxy) upstreamStatus() []UpstreamStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pool == nil {
+		return nil
+	}
+	status := make([]UpstreamStatus, 0, len(p.pool.upstreams))
+	for _, u := range p.pool.upstreams {
+		weight := u.weight
+		if !u.healthy.Load() {
+			weight = 0
+		}
+		status = append(status, UpstreamStatus{Addr: u.addr, Healthy: u.healthy.Load(), Weight: weight})
+	}
+	return status
+}
+
+// connListener is a net.Listener accepting the conns pushed into it.
+type connListener struct {
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) push(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return streamAddr("listener")
+}
+
+type credential struct {
+	username string
+	password string
+}
+
+func basicAuth(credentials []credential) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if ok {
+				for _, c := range credentials {
+					userMatch := subtle.ConstantTimeCompare([]byte(username), []byte(c.username))
+					passMatch := subtle.ConstantTimeCompare([]byte(password), []byte(c.password))
+					if userMatch&passMatch == 1 {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+
+			w.Header().Set("WWW-Authenticate", `Basic realm="castle", charset="UTF-8"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package castle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	protocolHTTP2  = "h2"
+	protocolHTTP11 = "http/1.1"
+)
+
+func validateProtocols(protocols []string) error {
+	for _, p := range protocols {
+		if p != protocolHTTP2 && p != protocolHTTP11 {
+			return fmt.Errorf("unsupported http protocol %q, expected %q or %q", p, protocolHTTP2, protocolHTTP11)
+		}
+	}
+	return nil
+}
+
+func hasHTTP2(protocols []string) bool {
+	for _, p := range protocols {
+		if p == protocolHTTP2 {
+			return true
+		}
+	}
+	return false
+}
+
+// serveH2C serves the HTTP/2 connections which the server forwards in cleartext,
+// either with the prior knowledge or upgraded from HTTP/1.1, beside the HTTP/1.1 requests.
+//
+// Each stream of a connection is a separate request through the handler,
+// the flow control is done by the http2 server per stream and per connection,
+// so a large response only waits for the window of its own stream.
+func serveH2C(handler http.Handler) http.Handler {
+	h2 := h2c.NewHandler(handler, &http2.Server{})
+	// the http2 server inherits the ConnState of the server it's upgraded from,
+	// which closes the idle conns, so it's given a server without the hooks.
+	base := &http.Server{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h2.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), http.ServerContextKey, base)))
+	})
+}
@@ -0,0 +1,1619 @@
+package castle
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/openosaka/castled/sdk/go/proto"
+	"golang.org/x/net/http2"
+)
+
+// startHTTPTunnel starts the tunnel to the fake server and returns the fake server.
+func startHTTPTunnel(t *testing.T, tunnel *Tunnel) *fakeServer {
+	t.Helper()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+// roundTrip sends the request through the nth tunnel of the fake server,
+// and reads the response from the tunnel.
+func roundTrip(t *testing.T, server *fakeServer, n int, req *http.Request) *http.Response {
+	t.Helper()
+
+	var raw bytes.Buffer
+	if err := req.Write(&raw); err != nil {
+		t.Fatal(err)
+	}
+	visitor := server.visit(t, n)
+	visitor.send(raw.Bytes())
+	visitor.finish()
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(visitor.readAll())), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestHTTPBasicAuth(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer local.Close()
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPBasicAuth("alice", "a"),
+		WithHTTPBasicAuth("bob", "b"),
+	))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp := roundTrip(t, server, 0, req)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("expected to be challenged, got %d", resp.StatusCode)
+	}
+
+	req.SetBasicAuth("bob", "b")
+	resp = roundTrip(t, server, 0, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if body := readBody(t, resp); body != "hello" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	req.SetBasicAuth("bob", "a")
+	resp = roundTrip(t, server, 0, req)
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 with the wrong password, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPUpstreams(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"a", "b"} {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+		defer local.Close()
+		addrs = append(addrs, strings.TrimPrefix(local.URL, "http://"))
+	}
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("round-robin", addrs[0], WithHTTPUpstreams(addrs[1])))
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, readBody(t, roundTrip(t, server, 0, req)))
+	}
+	if strings.Join(got, "") != "abab" {
+		t.Fatalf("expected round-robin, got %v", got)
+	}
+
+	server = startHTTPTunnel(t, NewHTTPTunnel("sticky", addrs[0],
+		WithHTTPUpstreams(addrs[1]),
+		WithHTTPStickySession("castle-upstream"),
+	))
+	resp := roundTrip(t, server, 0, req)
+	first := readBody(t, resp)
+	cookies := resp.Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "castle-upstream" {
+		t.Fatalf("expected the sticky cookie, got %v", cookies)
+	}
+	req.AddCookie(cookies[0])
+	for i := 0; i < 3; i++ {
+		resp := roundTrip(t, server, 0, req)
+		if body := readBody(t, resp); body != first {
+			t.Fatalf("expected to stick to %s, got %s", first, body)
+		}
+		if len(resp.Cookies()) != 0 {
+			t.Fatalf("unexpected cookie reset: %v", resp.Cookies())
+		}
+	}
+}
+
+func TestUpstreamPoolSkipUnhealthy(t *testing.T) {
+	pool := newUpstreamPool([]string{"a", "b", "c"}, []int{1, 1, 1}, "")
+	pool.upstreams[1].healthy.Store(false)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	for i := 0; i < 6; i++ {
+		if u := pool.pick(req); u.addr == "b" {
+			t.Fatal("picked the unhealthy upstream")
+		}
+	}
+	for _, u := range pool.upstreams {
+		u.healthy.Store(false)
+	}
+	if u := pool.pick(req); u != nil {
+		t.Fatalf("expected no upstream, got %s", u.addr)
+	}
+}
+
+func TestUpstreamPoolWeights(t *testing.T) {
+	pool := newUpstreamPool([]string{"a", "b", "c"}, []int{3, 1, 0}, "")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	var got string
+	for i := 0; i < 8; i++ {
+		got += pool.pick(req).addr
+	}
+	if got != "aabaaaba" {
+		t.Fatalf("unexpected weighted order: %s", got)
+	}
+
+	// the unhealthy upstream is skipped whatever its weight is, and the drained one is never picked.
+	pool.upstreams[0].healthy.Store(false)
+	for i := 0; i < 4; i++ {
+		if u := pool.pick(req); u.addr != "b" {
+			t.Fatalf("expected b, got %s", u.addr)
+		}
+	}
+	pool.upstreams[1].healthy.Store(false)
+	if u := pool.pick(req); u != nil {
+		t.Fatalf("expected no upstream, got %s", u.addr)
+	}
+}
+
+func TestHTTPHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" && !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "a")
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "b")
+	}))
+	defer b.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(a.URL, "http://"),
+		WithHTTPUpstreams(strings.TrimPrefix(b.URL, "http://")),
+		WithHTTPHealthCheck("/healthz", 10*time.Millisecond, time.Second, 1, 2),
+	)
+	server := startHTTPTunnel(t, tunnel)
+	defer tunnel.Close(context.Background())
+
+	waitHealthy := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if upstreams := tunnel.Status().Upstreams; len(upstreams) == 2 && upstreams[0].Healthy == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("upstream never became healthy=%v: %+v", want, tunnel.Status().Upstreams)
+	}
+
+	healthy.Store(false)
+	waitHealthy(false)
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	for i := 0; i < 3; i++ {
+		if body := readBody(t, roundTrip(t, server, 0, req)); body != "b" {
+			t.Fatalf("routed to the unhealthy upstream: %s", body)
+		}
+	}
+
+	healthy.Store(true)
+	waitHealthy(true)
+}
+
+func TestHTTPMaxRequestBody(t *testing.T) {
+	var hits atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		io.WriteString(w, strconv.Itoa(len(body)))
+	}))
+	defer local.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"), WithHTTPMaxRequestBody(10))
+	server := startHTTPTunnel(t, tunnel)
+	post := func(body string, chunked bool) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.com/", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		return roundTrip(t, server, 0, req)
+	}
+
+	if resp := post("hello", true); resp.StatusCode != http.StatusOK || readBody(t, resp) != "5" {
+		t.Fatalf("expected the small body to pass, got %d", resp.StatusCode)
+	}
+	if resp := post(strings.Repeat("x", 11), false); resp.StatusCode != http.StatusRequestEntityTooLarge || hits.Load() != 1 {
+		t.Fatalf("expected the declared large body to be rejected before the local server, got %d", resp.StatusCode)
+	}
+	if resp := post(strings.Repeat("x", 1024), true); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected the streamed large body to be rejected, got %d", resp.StatusCode)
+	}
+	if rejected := tunnel.Status().RejectedRequests; rejected != 2 {
+		t.Fatalf("unexpected rejected requests: %d", rejected)
+	}
+}
+
+func TestHTTPAllowedMethods(t *testing.T) {
+	if err := NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPAllowedMethods("GET", "BAD METHOD")).Validate(); err == nil {
+		t.Fatal("expected the invalid method to fail")
+	}
+
+	var hits atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, r.Method)
+	}))
+	defer local.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPAllowedMethods("get"), WithHTTPAllowedMethods("HEAD", "Get"))
+	server := startHTTPTunnel(t, tunnel)
+	if got := server.md[0].Get(metadataHTTPAllowedMethods); !slices.Equal(got, []string{"GET", "HEAD"}) {
+		t.Fatalf("unexpected allowed methods metadata: %v", got)
+	}
+	do := func(method string) *http.Response {
+		req, _ := http.NewRequest(method, "http://example.com/", nil)
+		return roundTrip(t, server, 0, req)
+	}
+
+	if resp := do(http.MethodGet); resp.StatusCode != http.StatusOK || readBody(t, resp) != "GET" {
+		t.Fatalf("expected GET to pass, got %d", resp.StatusCode)
+	}
+	if resp := do(http.MethodHead); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected HEAD to pass, got %d", resp.StatusCode)
+	}
+	resp := do(http.MethodDelete)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" || hits.Load() != 2 {
+		t.Fatalf("expected DELETE to be rejected before the local server, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if rejected := tunnel.Status().RejectedRequests; rejected != 1 {
+		t.Fatalf("unexpected rejected requests: %d", rejected)
+	}
+}
+
+func TestHTTPHostHeader(t *testing.T) {
+	for _, mode := range []string{"keep", "custom:", "custom:bad host"} {
+		if err := NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPHostHeader(mode)).Validate(); err == nil {
+			t.Fatalf("expected the mode %q to fail", mode)
+		}
+	}
+
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.Redirect(w, r, "http://"+r.Host+"/home", http.StatusFound)
+			return
+		}
+		io.WriteString(w, r.Host)
+	}))
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	for _, c := range []struct {
+		mode    string
+		options []HTTPOption
+		want    string
+	}{
+		{mode: "preserve", want: "app.example.com"},
+		{mode: "preserve", options: []HTTPOption{WithHTTPHostHeader("preserve")}, want: "app.example.com"},
+		{mode: "rewrite", options: []HTTPOption{WithHTTPHostHeader("rewrite"), WithHTTPRewriteRedirects()}, want: localAddr},
+		{mode: "custom:app.internal", options: []HTTPOption{WithHTTPHostHeader("custom:app.internal")}, want: "app.internal"},
+	} {
+		tunnel := NewHTTPTunnel("test", localAddr, c.options...)
+		server := startHTTPTunnel(t, tunnel)
+		if got := tunnel.Status().HostHeader; got != c.mode {
+			t.Fatalf("unexpected host header mode: %q, expected %q", got, c.mode)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		if got := readBody(t, roundTrip(t, server, 0, req)); got != c.want {
+			t.Fatalf("%s: unexpected host %q, expected %q", c.mode, got, c.want)
+		}
+	}
+
+	// the rewritten redirects go to the host of the user.
+	tunnel := NewHTTPTunnel("test", localAddr, WithHTTPHostHeader("rewrite"), WithHTTPRewriteRedirects())
+	server := startHTTPTunnel(t, tunnel)
+	req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/login", nil)
+	if location := roundTrip(t, server, 0, req).Header.Get("Location"); location != "http://app.example.com/home" {
+		t.Fatalf("unexpected location: %q", location)
+	}
+	if status := NewTCPTunnel("test", localAddr).Status(); status.HostHeader != "" {
+		t.Fatalf("unexpected host header mode of the tcp tunnel: %q", status.HostHeader)
+	}
+}
+
+func TestHTTPConnectionRateLimit(t *testing.T) {
+	var hits atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"), WithConnectionRateLimit(1, 1))
+	server := startHTTPTunnel(t, tunnel)
+	get := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		return roundTrip(t, server, 0, req)
+	}
+
+	if resp := get(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the first request to pass, got %d", resp.StatusCode)
+	}
+	resp := get()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "1" || hits.Load() != 1 {
+		t.Fatalf("expected the second request to be rejected before the local server, got %d", resp.StatusCode)
+	}
+	if rejected := tunnel.Status().RejectedRequests; rejected != 1 {
+		t.Fatalf("unexpected rejected requests: %d", rejected)
+	}
+}
+
+func TestHTTPCircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	var hits atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"), WithHTTPCircuitBreaker(2, 100*time.Millisecond))
+	server := startHTTPTunnel(t, tunnel)
+	get := func() int {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		resp := roundTrip(t, server, 0, req)
+		readBody(t, resp)
+		return resp.StatusCode
+	}
+
+	failing.Store(true)
+	get()
+	if state := tunnel.Status().Breaker; state != BreakerClosed {
+		t.Fatalf("expected the breaker to be closed after one failure, got %s", state)
+	}
+	get()
+	if state := tunnel.Status().Breaker; state != BreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %s", state)
+	}
+	if code := get(); code != http.StatusServiceUnavailable || hits.Load() != 2 {
+		t.Fatalf("expected the open breaker to short-circuit, got %d after %d hits", code, hits.Load())
+	}
+
+	// the failed probe opens the breaker again.
+	time.Sleep(100 * time.Millisecond)
+	if code := get(); code != http.StatusInternalServerError || tunnel.Status().Breaker != BreakerOpen {
+		t.Fatalf("unexpected probe: %d %s", code, tunnel.Status().Breaker)
+	}
+
+	failing.Store(false)
+	time.Sleep(100 * time.Millisecond)
+	if code := get(); code != http.StatusOK || tunnel.Status().Breaker != BreakerClosed {
+		t.Fatalf("expected the breaker to be closed after the probe succeeds: %d %s", code, tunnel.Status().Breaker)
+	}
+}
+
+func TestHTTPRewriteHeaders(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Secret", "secret")
+		w.Header().Set("Server", "local")
+		io.WriteString(w, r.Header.Get("X-Tunnel-Id")+","+r.Header.Get("X-Forwarded-Host")+","+r.Header.Get("Cookie"))
+	}))
+	defer local.Close()
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPRequestHeaders(map[string]string{
+			"x-tunnel-id":      "test",
+			"X-Forwarded-Host": "example.com",
+		}, []string{"cookie"}),
+		WithHTTPResponseHeaders(map[string]string{"server": "castle"}, []string{"x-secret"}),
+	))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Tunnel-Id", "fake")
+	req.Header.Set("Cookie", "a=b")
+	resp := roundTrip(t, server, 0, req)
+	if body := readBody(t, resp); body != "test,example.com," {
+		t.Fatalf("unexpected request headers: %q", body)
+	}
+	if resp.Header.Get("X-Secret") != "" || resp.Header.Get("Server") != "castle" {
+		t.Fatalf("unexpected response headers: %v", resp.Header)
+	}
+}
+
+func TestHTTPPreserveTraceHeaders(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Traceparent")+","+r.Header.Get("Tracestate"))
+	}))
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+	rewrite := WithHTTPRequestHeaders(map[string]string{"tracestate": "fake"}, []string{"traceparent"})
+
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Traceparent", traceparent)
+	req.Header.Set("Tracestate", "congo=t61rcWkgMzE")
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("preserve", localAddr, rewrite))
+	if body := readBody(t, roundTrip(t, server, 0, req)); body != traceparent+",congo=t61rcWkgMzE" {
+		t.Fatalf("expected the trace headers to be preserved, got %q", body)
+	}
+
+	server = startHTTPTunnel(t, NewHTTPTunnel("drop", localAddr, rewrite, WithHTTPPreserveTraceHeaders(false)))
+	if body := readBody(t, roundTrip(t, server, 0, req)); body != ",fake" {
+		t.Fatalf("expected the trace headers to be rewritten, got %q", body)
+	}
+}
+
+func TestHTTPPathPrefix(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.RequestURI())
+	}))
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	api := NewHTTPTunnel("api", localAddr, WithHTTPSubDomain("foo"), WithHTTPPathPrefix("/api"), WithHTTPStripPrefix(true))
+	if _, _, err := client.StartTunnel(ctx, api); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataHTTPPathPrefix); len(got) != 1 || got[0] != "/api" {
+		t.Fatalf("unexpected path prefix metadata: %v", got)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("app", localAddr, WithHTTPSubDomain("foo"), WithHTTPPathPrefix("/app"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("conflict", localAddr, WithHTTPSubDomain("foo"), WithHTTPPathPrefix("/api/"))); err == nil {
+		t.Fatal("expected the conflicting prefix to fail")
+	}
+	if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("invalid", localAddr, WithHTTPPathPrefix("api"))); err == nil {
+		t.Fatal("expected the invalid prefix to fail")
+	}
+
+	for path, want := range map[string]string{
+		"/api":         "/",
+		"/api/users?a": "/users?a",
+		"/apix":        "/apix",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://foo.example.com"+path, nil)
+		if got := readBody(t, roundTrip(t, server, 0, req)); got != want {
+			t.Fatalf("%s is proxied as %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestHTTPMatch(t *testing.T) {
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	acme := NewHTTPTunnel("acme", "127.0.0.1:8080", WithHTTPSubDomain("foo"),
+		WithHTTPMatchHeader("x-tenant", "acme"), WithHTTPMatchQuery("region", "eu"))
+	if _, _, err := client.StartTunnel(ctx, acme); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataHTTPMatchHeader); len(got) != 1 || got[0] != "X-Tenant=acme" {
+		t.Fatalf("unexpected header metadata: %v", got)
+	}
+	if got := server.md[0].Get(metadataHTTPMatchQuery); len(got) != 1 || got[0] != "region=eu" {
+		t.Fatalf("unexpected query metadata: %v", got)
+	}
+
+	for name, opts := range map[string][]HTTPOption{
+		"other":    {WithHTTPMatchHeader("X-Tenant", "other")},
+		"fallback": nil,
+		"prefixed": {WithHTTPPathPrefix("/api"), WithHTTPMatchHeader("X-Tenant", "acme"), WithHTTPMatchQuery("region", "eu")},
+	} {
+		if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel(name, "127.0.0.1:8080", append(opts, WithHTTPSubDomain("foo"))...)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+	// the same predicates in another order.
+	conflict := NewHTTPTunnel("conflict", "127.0.0.1:8080", WithHTTPSubDomain("foo"),
+		WithHTTPMatchQuery("region", "eu"), WithHTTPMatchHeader("X-TENANT", "acme"))
+	if _, _, err := client.StartTunnel(ctx, conflict); err == nil || !strings.Contains(err.Error(), `"acme"`) {
+		t.Fatalf("expected the conflicting predicates to fail, got %v", err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("invalid", "127.0.0.1:8080", WithHTTPMatchHeader("X Tenant", "acme"))); err == nil {
+		t.Fatal("expected the invalid header name to fail")
+	}
+	if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("empty", "127.0.0.1:8080", WithHTTPMatchQuery("", "eu"))); err == nil {
+		t.Fatal("expected the empty query key to fail")
+	}
+}
+
+func TestHTTPLocalResolver(t *testing.T) {
+	backend := func(name string) string {
+		local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+r.URL.Path)
+		}))
+		t.Cleanup(local.Close)
+		return strings.TrimPrefix(local.URL, "http://")
+	}
+	a, b := backend("a"), backend("b")
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", a, WithLocalResolver(func(ctx context.Context, meta ConnMeta) (string, error) {
+		switch {
+		case meta.Host != "foo.example.com":
+			return "", errors.New("unknown host")
+		case strings.HasPrefix(meta.Path, "/b/"):
+			return b, nil
+		default:
+			return meta.LocalAddr, nil
+		}
+	})))
+
+	for path, want := range map[string]string{"/a/x": "a/a/x", "/b/y": "b/b/y"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://foo.example.com"+path, nil)
+		if got := readBody(t, roundTrip(t, server, 0, req)); got != want {
+			t.Fatalf("%s is proxied to %s, want %s", path, got, want)
+		}
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://bar.example.com/", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", resp.StatusCode)
+	}
+}
+
+func TestHTTPRewriteRedirects(t *testing.T) {
+	var localAddr string
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, port, _ := net.SplitHostPort(localAddr)
+		switch r.URL.Path {
+		case "/self":
+			http.Redirect(w, r, "http://"+localAddr+"/login?next=%2Fself", http.StatusFound)
+		case "/localhost":
+			http.Redirect(w, r, "http://localhost:"+port+"/home", http.StatusFound)
+		case "/other-port":
+			http.Redirect(w, r, "http://localhost:1/home", http.StatusFound)
+		case "/external":
+			http.Redirect(w, r, "https://accounts.example.org/oauth", http.StatusFound)
+		case "/relative":
+			http.Redirect(w, r, "/home", http.StatusFound)
+		case "/cookies":
+			w.Header().Add("Set-Cookie", "session=abc; Path=/; Domain=.App.internal; HttpOnly")
+			w.Header().Add("Set-Cookie", "theme=dark; Domain=other.internal")
+			w.Header().Add("Set-Cookie", "host=only; domain=drop.internal; Secure")
+		}
+	}))
+	defer local.Close()
+	localAddr = strings.TrimPrefix(local.URL, "http://")
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", localAddr,
+		WithHTTPPathPrefix("/api"), WithHTTPStripPrefix(true), WithHTTPRewriteRedirects(),
+		WithHTTPRewriteCookieDomain("app.internal", "foo.example.com"), WithHTTPRewriteCookieDomain("drop.internal", "")))
+	for path, want := range map[string]string{
+		"/api/self":       "http://foo.example.com/api/login?next=%2Fself",
+		"/api/localhost":  "https://foo.example.com/api/home",
+		"/api/other-port": "http://localhost:1/home",
+		"/api/external":   "https://accounts.example.org/oauth",
+		"/api/relative":   "/home",
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://foo.example.com"+path, nil)
+		if path == "/api/localhost" {
+			req.Header.Set("X-Forwarded-Proto", "https")
+		}
+		resp := roundTrip(t, server, 0, req)
+		resp.Body.Close()
+		if got := resp.Header.Get("Location"); got != want {
+			t.Errorf("%s redirects to %s, want %s", path, got, want)
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://foo.example.com/api/cookies", nil)
+	resp := roundTrip(t, server, 0, req)
+	resp.Body.Close()
+	want := []string{
+		"session=abc; Path=/; Domain=foo.example.com; HttpOnly",
+		"theme=dark; Domain=other.internal",
+		"host=only; Secure",
+	}
+	if got := resp.Header.Values("Set-Cookie"); !slices.Equal(got, want) {
+		t.Fatalf("unexpected cookies: %q", got)
+	}
+
+	if err := NewHTTPTunnel("test", localAddr, WithHTTPRewriteCookieDomain("", "foo.example.com")).Validate(); err == nil {
+		t.Fatal("expected the empty cookie domain to fail")
+	}
+}
+
+func TestHTTPCompression(t *testing.T) {
+	large := strings.Repeat(`{"hello":"world"}`, 100)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{}`)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, large)
+		}
+	}))
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", localAddr, WithHTTPCompression("gzip", "deflate")))
+	get := func(path, acceptEncoding string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		return roundTrip(t, server, 0, req)
+	}
+
+	resp := get("/", "br;q=1, gzip;q=0.8")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	gr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(gr); string(body) != large {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	if resp := get("/", "deflate"); resp.Header.Get("Content-Encoding") != "deflate" {
+		t.Fatalf("expected deflate, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	for _, tt := range []struct{ path, acceptEncoding string }{
+		{"/", "gzip;q=0"},
+		{"/small", "gzip"},
+		{"/image", "gzip"},
+	} {
+		resp := get(tt.path, tt.acceptEncoding)
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" {
+			t.Fatalf("%s with %q is compressed with %s", tt.path, tt.acceptEncoding, encoding)
+		}
+		readBody(t, resp)
+	}
+
+	br := startHTTPTunnel(t, NewHTTPTunnel("br", localAddr, WithHTTPCompression("br", "gzip")))
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	resp = roundTrip(t, br, 0, req)
+	if resp.Header.Get("Content-Encoding") != "br" {
+		t.Fatalf("expected br, got %q", resp.Header.Get("Content-Encoding"))
+	}
+	if body, _ := io.ReadAll(brotli.NewReader(resp.Body)); string(body) != large {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(context.Background(), NewHTTPTunnel("zstd", localAddr, WithHTTPCompression("zstd"))); err == nil {
+		t.Fatal("expected the unsupported compression to fail")
+	}
+}
+
+func TestHTTPCache(t *testing.T) {
+	var hits atomic.Int32
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		switch r.URL.Path {
+		case "/private":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/lang":
+			w.Header().Set("Vary", "Accept-Language")
+			io.WriteString(w, r.Header.Get("Accept-Language")+" ")
+		default:
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+		}
+		io.WriteString(w, strconv.Itoa(int(n)))
+	}))
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	tunnel := NewHTTPTunnel("test", localAddr, WithHTTPCache(1<<20, time.Minute))
+	server := startHTTPTunnel(t, tunnel)
+	get := func(path string, header ...string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp := roundTrip(t, server, 0, req)
+		return resp, readBody(t, resp)
+	}
+
+	if resp, body := get("/"); body != "1" || resp.Header.Get(cacheStatusHeader) != "MISS" {
+		t.Fatalf("unexpected response: %s %q", resp.Header.Get(cacheStatusHeader), body)
+	}
+	if resp, body := get("/"); body != "1" || resp.Header.Get(cacheStatusHeader) != "HIT" {
+		t.Fatalf("expected the cached response, got %s %q", resp.Header.Get(cacheStatusHeader), body)
+	}
+	if resp, _ := get("/", "If-None-Match", `"v1"`); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("expected 304, got %d", resp.StatusCode)
+	}
+	if _, body := get("/", CacheBypassHeader, "1"); body != "2" {
+		t.Fatalf("expected the bypass to reach the local server, got %q", body)
+	}
+
+	get("/private")
+	if _, body := get("/private"); body != "4" {
+		t.Fatalf("expected no-store not to be cached, got %q", body)
+	}
+
+	get("/lang", "Accept-Language", "en")
+	get("/lang", "Accept-Language", "ja")
+	if _, body := get("/lang", "Accept-Language", "en"); body != "en 5" {
+		t.Fatalf("unexpected variant: %q", body)
+	}
+	if _, body := get("/lang", "Accept-Language", "ja"); body != "ja 6" {
+		t.Fatalf("unexpected variant: %q", body)
+	}
+
+	tunnel.PurgeCache()
+	if _, body := get("/"); body != "7" {
+		t.Fatalf("expected the purged response to be fetched again, got %q", body)
+	}
+}
+
+func TestHTTPUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	local.Listener = lis
+	local.Start()
+	defer local.Close()
+
+	// the middleware makes the requests go through the http proxy of the client.
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", "unix://"+path, WithHTTPBasicAuth("user", "pass")))
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.SetBasicAuth("user", "pass")
+	if body := readBody(t, roundTrip(t, server, 0, req)); body != "hello from example.com" {
+		t.Fatalf("unexpected body: %q", body)
+	}
+
+	if err := NewHTTPTunnel("test", "unix://app.sock").Validate(); err == nil {
+		t.Fatal("expected the relative socket path to be invalid")
+	}
+}
+
+func TestHTTPWildcardDomain(t *testing.T) {
+	tunnel := NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPWildcardDomain("*.myapp.example.com"))
+	if tunnel.err != nil {
+		t.Fatal(tunnel.err)
+	}
+	if domain := tunnel.GetHttp().Domain; domain != "*.myapp.example.com" {
+		t.Fatalf("unexpected domain: %s", domain)
+	}
+
+	for _, pattern := range []string{"myapp.example.com", "tenant.*.example.com", "*.*.example.com", "*.com", "*"} {
+		if tunnel := NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPWildcardDomain(pattern)); tunnel.err == nil {
+			t.Fatalf("expected %q to be invalid", pattern)
+		}
+	}
+
+	certPEM, keyPEM := selfSignedCert(t, "*.myapp.example.com")
+	if tunnel := NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPWildcardDomain("*.myapp.example.com"), WithHTTPTLS(certPEM, keyPEM)); tunnel.err != nil {
+		t.Fatalf("expected the wildcard certificate to match: %v", tunnel.err)
+	}
+	if tunnel := NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPWildcardDomain("*.other.example.com"), WithHTTPTLS(certPEM, keyPEM)); tunnel.err == nil {
+		t.Fatal("expected the wildcard certificate not to match")
+	}
+}
+
+func TestHTTPForwardedFor(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For")+"|"+r.Header.Get("X-Real-IP")+"|"+r.Header.Get("X-Forwarded-Proto"))
+	}))
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	tests := []struct {
+		name    string
+		visitor string
+		options []HTTPOption
+		want    string
+	}{
+		{"untrusted", "10.0.0.1:5555", []HTTPOption{WithHTTPForwardedFor()}, "203.0.113.7, 10.0.0.2, 10.0.0.1|10.0.0.1|http"},
+		{"trusted", "10.0.0.1:5555", []HTTPOption{WithHTTPTrustedProxies("10.0.0.0/8")}, "203.0.113.7, 10.0.0.2, 10.0.0.1|203.0.113.7|http"},
+		// the forged X-Forwarded-For and X-Real-IP don't make the real ip without the direct peer.
+		{"unknown visitor", "", []HTTPOption{WithHTTPTrustedProxies("10.0.0.0/8")}, "203.0.113.7, 10.0.0.2||"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t)
+			server.remoteAddr = tt.visitor
+			client, err := NewClient(server.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if _, _, err := client.StartTunnel(ctx, NewHTTPTunnel("test", localAddr, tt.options...)); err != nil {
+				t.Fatal(err)
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+			req.Header.Set("X-Real-IP", "203.0.113.7")
+			if got := readBody(t, roundTrip(t, server, 0, req)); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if tunnel := NewHTTPTunnel("test", localAddr, WithHTTPTrustedProxies("10.0.0.0")); tunnel.err == nil {
+		t.Fatal("expected the invalid cidr to fail")
+	}
+}
+
+func TestHTTPForwardedPort(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Proto")+"|"+r.Header.Get("X-Forwarded-Port"))
+	}))
+	defer local.Close()
+
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "https://secure.example.com", "http://plain.example.com:8080"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"), WithHTTPForwardedPort(true), WithHTTPForwardedFor())
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		url   string
+		proto string
+		want  string
+	}{
+		{"https entrypoint", "http://secure.example.com/", "", "https|443"},
+		{"http entrypoint", "http://plain.example.com:8080/", "", "http|8080"},
+		{"forged proto", "http://plain.example.com:8080/", "https", "http|8080"},
+		{"port of the host", "http://secure.example.com:8443/", "", "https|8443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			req.Header.Set("X-Forwarded-Port", "1")
+			if got := readBody(t, roundTrip(t, server, 0, req)); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPAccessLog(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, "hello")
+	}))
+	defer local.Close()
+
+	var logs syncBuffer
+	entries := make(chan AccessLogEntry, 2)
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPAccessLog(&logs),
+		WithHTTPAccessLogFormat("$method ${path} $status $bytes"),
+		WithHTTPAccessLogFunc(func(entry AccessLogEntry) { entries <- entry }),
+	)
+	server := startHTTPTunnel(t, tunnel)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/hello?a=1", nil)
+	readBody(t, roundTrip(t, server, 0, req))
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com/missing", strings.NewReader("x"))
+	readBody(t, roundTrip(t, server, 0, req))
+
+	for _, want := range []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "/hello?a=1", http.StatusOK},
+		{http.MethodPost, "/missing", http.StatusNotFound},
+	} {
+		select {
+		case entry := <-entries:
+			if entry.Method != want.method || entry.Path != want.path || entry.Status != want.status || entry.Duration <= 0 {
+				t.Fatalf("unexpected entry: %+v", entry)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the entry is not logged")
+		}
+	}
+	// the line is written right after the entry is passed to the func.
+	deadline := time.Now().Add(time.Second)
+	expected := "GET /hello?a=1 200 5\nPOST /missing 404 19\n"
+	for logs.String() != expected && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if logs.String() != expected {
+		t.Fatalf("unexpected access log: %q", logs.String())
+	}
+}
+
+func TestHTTPConnIDHeader(t *testing.T) {
+	headers := make(chan string, 1)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("X-Conn-Id")
+	}))
+	defer local.Close()
+
+	server := newFakeServer(t)
+	opened := make(chan string, 1)
+	client, err := NewClient(server.addr, WithEventHandler(func(event Event) {
+		if event.Type == EventConnOpened {
+			opened <- event.ConnectionID
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var logs syncBuffer
+	entries := make(chan AccessLogEntry, 1)
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPConnIDHeader("x-conn-id"),
+		WithHTTPAccessLog(&logs),
+		WithHTTPAccessLogFormat("$connection_id $status"),
+		WithHTTPAccessLogFunc(func(entry AccessLogEntry) { entries <- entry }),
+	)
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	// the header of the user is replaced.
+	req.Header.Set("X-Conn-Id", "spoofed")
+	readBody(t, roundTrip(t, server, 0, req))
+
+	id := <-opened
+	if id == "" {
+		t.Fatal("expected the connection id of the event")
+	}
+	if header := <-headers; header != id {
+		t.Fatalf("expected the header %q, got %q", id, header)
+	}
+	select {
+	case entry := <-entries:
+		if entry.ConnectionID != id {
+			t.Fatalf("expected the connection id %q of the entry, got %q", id, entry.ConnectionID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the entry is not logged")
+	}
+	deadline := time.Now().Add(time.Second)
+	for logs.String() != id+" 200\n" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if logs.String() != id+" 200\n" {
+		t.Fatalf("unexpected access log: %q", logs.String())
+	}
+}
+
+func TestHTTPServerSentEvents(t *testing.T) {
+	next := make(chan struct{})
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 2; i++ {
+			io.WriteString(w, "data: "+strconv.Itoa(i)+"\n\n")
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}))
+	defer local.Close()
+
+	// the responses pass through the recorders of the cache and the header rewrite.
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPCache(1<<20, time.Minute),
+		WithHTTPResponseHeaders(map[string]string{"X-Tunnel": "castle"}, nil),
+	)
+	server := startHTTPTunnel(t, tunnel)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/events", nil)
+	var raw bytes.Buffer
+	req.Write(&raw)
+	visitor := server.visit(t, 0)
+	visitor.send(raw.Bytes())
+	visitor.finish()
+
+	resp, err := http.ReadResponse(bufio.NewReader(visitor), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	for i := 0; i < 2; i++ {
+		// the next event is only sent after the previous one arrives.
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != "data: "+strconv.Itoa(i)+"\n" {
+			t.Fatalf("unexpected event: %q", line)
+		}
+		events.ReadString('\n')
+		next <- struct{}{}
+	}
+}
+
+func TestHTTPInspect(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+		io.Copy(w, r.Body)
+	}))
+	defer local.Close()
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPInspect(2, 4),
+		WithHTTPInspectRedact("authorization", "Set-Cookie"),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"a", "bb", "hello world"} {
+		req, _ := http.NewRequest(http.MethodPost, "http://example.com/echo?n="+strconv.Itoa(len(body)), strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer token")
+		if got := readBody(t, roundTrip(t, server, 0, req)); got != body {
+			t.Fatalf("unexpected body: %q", got)
+		}
+	}
+
+	requests := client.RecentRequests("test")
+	if len(requests) != 2 {
+		t.Fatalf("expected the latest 2 requests, got %d", len(requests))
+	}
+	if requests[0].URL != "/echo?n=2" || string(requests[0].Body) != "bb" || requests[0].BodyTruncated {
+		t.Fatalf("unexpected request: %+v", requests[0])
+	}
+	last := requests[1]
+	if string(last.Body) != "hell" || !last.BodyTruncated || string(last.ResponseBody) != "hell" || !last.ResponseBodyTruncated {
+		t.Fatalf("expected the bodies to be truncated: %+v", last)
+	}
+	if last.Status != http.StatusOK || last.Header.Get("Authorization") != "[REDACTED]" || last.ResponseHeader.Get("Set-Cookie") != "[REDACTED]" {
+		t.Fatalf("expected the headers to be redacted: %+v", last)
+	}
+	if client.RecentRequests("unknown") != nil {
+		t.Fatal("expected no requests of the unknown tunnel")
+	}
+}
+
+func TestHTTPLocalTLS(t *testing.T) {
+	local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	local.EnableHTTP2 = true
+	local.StartTLS()
+	defer local.Close()
+	localAddr := strings.TrimPrefix(local.URL, "https://")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(local.Certificate())
+	for name, options := range map[string][]HTTPOption{
+		"insecure":    {WithHTTPLocalTLS(&tls.Config{InsecureSkipVerify: true})},
+		"server name": {WithHTTPLocalTLS(&tls.Config{RootCAs: roots, ServerName: "example.com"})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := startHTTPTunnel(t, NewHTTPTunnel("test", localAddr, options...))
+			req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+			resp := roundTrip(t, server, 0, req)
+			if body := readBody(t, resp); resp.StatusCode != http.StatusOK || body != "HTTP/2.0" {
+				t.Fatalf("expected to proxy over HTTP/2, got %d %q", resp.StatusCode, body)
+			}
+		})
+	}
+
+	// the self-signed certificate is not trusted by default.
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", localAddr, WithHTTPLocalScheme("https")))
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", resp.StatusCode)
+	}
+	if err := NewHTTPTunnel("test", localAddr, WithHTTPLocalScheme("ftp")).Validate(); err == nil {
+		t.Fatal("expected the scheme to be rejected")
+	}
+}
+
+func TestHTTPErrorPage(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "from local", http.StatusServiceUnavailable)
+	}))
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	tunnel := NewHTTPTunnel("test", localAddr,
+		WithHTTPErrorPage(http.StatusBadGateway, "text/html", []byte("<h1>down</h1>")),
+		WithHTTPErrorPage(0, "text/plain", []byte("oops")),
+		WithHTTPCircuitBreaker(3, time.Minute),
+	)
+	server := startHTTPTunnel(t, tunnel)
+
+	// the errors from the local server are proxied as is.
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusServiceUnavailable || readBody(t, resp) != "from local\n" {
+		t.Fatalf("expected the response of the local server, got %d", resp.StatusCode)
+	}
+
+	local.Close()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp := roundTrip(t, server, 0, req)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusBadGateway || body != "<h1>down</h1>" ||
+		resp.Header.Get("Content-Type") != "text/html" {
+		t.Fatalf("expected the error page, got %d %q", resp.StatusCode, body)
+	}
+
+	// the upgrade requests fail to dial the local server too.
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if resp := roundTrip(t, server, 0, req); readBody(t, resp) != "<h1>down</h1>" {
+		t.Fatalf("expected the error page of the upgrade, got %d", resp.StatusCode)
+	}
+	// the breaker is open after 3 failures, 503 falls back to the catch-all page.
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusServiceUnavailable || readBody(t, resp) != "oops" {
+		t.Fatalf("expected the catch-all error page, got %d", resp.StatusCode)
+	}
+
+	if err := NewHTTPTunnel("test", localAddr, WithHTTPErrorPage(http.StatusNotFound, "text/plain", nil)).Validate(); err == nil {
+		t.Fatal("expected the status to be rejected")
+	}
+}
+
+func TestHTTPFallback(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		http.Error(w, "from local", http.StatusInternalServerError)
+	}))
+	localAddr := strings.TrimPrefix(local.URL, "http://")
+
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "maintenance "+r.URL.Path)
+	})
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", localAddr,
+		WithHTTPFallback(fallback),
+		WithHTTPRequestTimeout(50*time.Millisecond),
+	))
+
+	// the errors of the local server and the timeouts aren't replaced.
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusInternalServerError || readBody(t, resp) != "from local\n" {
+		t.Fatalf("expected the response of the local server, got %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/slow", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 of the timeout, got %d", resp.StatusCode)
+	}
+
+	local.Close()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/a", nil)
+	resp := roundTrip(t, server, 0, req)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusServiceUnavailable || body != "maintenance /a" ||
+		resp.Header.Get("Retry-After") != "60" {
+		t.Fatalf("expected the fallback, got %d %q", resp.StatusCode, body)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	if resp := roundTrip(t, server, 0, req); readBody(t, resp) != "maintenance /ws" {
+		t.Fatalf("expected the fallback of the upgrade, got %d", resp.StatusCode)
+	}
+}
+
+// visitorConn is the net.Conn of the user over the fake visitor.
+type visitorConn struct {
+	*fakeVisitor
+}
+
+func (c visitorConn) Write(b []byte) (int, error) {
+	if err := c.stream.Send(&proto.TrafficToClient{Data: append([]byte(nil), b...)}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c visitorConn) Close() error                       { return c.stream.Send(&proto.TrafficToClient{}) }
+func (c visitorConn) LocalAddr() net.Addr                { return streamAddr("visitor") }
+func (c visitorConn) RemoteAddr() net.Addr               { return streamAddr("client") }
+func (c visitorConn) SetDeadline(t time.Time) error      { return nil }
+func (c visitorConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c visitorConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestHTTP2(t *testing.T) {
+	large := strings.Repeat("x", 1<<20)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large" {
+			io.WriteString(w, large)
+			return
+		}
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer local.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"), WithHTTPProtocols("h2", "http/1.1"))
+	server := startHTTPTunnel(t, tunnel)
+	if md := server.md[0].Get(metadataHTTPProtocols); len(md) != 1 || md[0] != "h2,http/1.1" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+
+	// all the requests are multiplexed on a single connection in h2c.
+	conn := visitorConn{server.visit(t, 0)}
+	var dials atomic.Int32
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			if dials.Add(1) > 1 {
+				return nil, errors.New("unexpected dial")
+			}
+			return conn, nil
+		},
+	}}
+	defer client.CloseIdleConnections()
+
+	paths := []string{"/large", "/a", "/b", "/c"}
+	bodies := make([]string, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://example.com" + path)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			if resp.ProtoMajor != 2 {
+				t.Errorf("unexpected proto: %s", resp.Proto)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(body)
+		}()
+	}
+	wg.Wait()
+	if bodies[0] != large {
+		t.Fatalf("unexpected size of the large body: %d", len(bodies[0]))
+	}
+	for i, path := range paths[1:] {
+		if bodies[i+1] != path {
+			t.Fatalf("unexpected body of %s: %q", path, bodies[i+1])
+		}
+	}
+
+	if err := NewHTTPTunnel("test", "127.0.0.1:80", WithHTTPProtocols("h3")).Validate(); err == nil {
+		t.Fatal("expected the protocol to be rejected")
+	}
+}
+
+func TestHTTPRequestTimeout(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		case "/stream":
+			// the events keep the response alive longer than the timeouts.
+			for i := 0; i < 5; i++ {
+				io.WriteString(w, "data: "+strconv.Itoa(i)+"\n\n")
+				w.(http.Flusher).Flush()
+				time.Sleep(50 * time.Millisecond)
+			}
+			return
+		case "/stall":
+			io.WriteString(w, "partial")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer local.Close()
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPRequestTimeout(100*time.Millisecond),
+		WithHTTPResponseIdleTimeout(150*time.Millisecond),
+	))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusOK || readBody(t, resp) != "ok" {
+		t.Fatalf("unexpected response: %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/slow", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 for the slow response, got %d", resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/stream", nil)
+	resp := roundTrip(t, server, 0, req)
+	if body := readBody(t, resp); resp.StatusCode != http.StatusOK || strings.Count(body, "data:") != 5 {
+		t.Fatalf("expected the whole stream, got %d %q", resp.StatusCode, body)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/stall", nil)
+	resp = roundTrip(t, server, 0, req)
+	body, err := io.ReadAll(resp.Body)
+	if err == nil || string(body) != "partial" {
+		t.Fatalf("expected the stalled response to be aborted after %q, got %q, %v", "partial", body, err)
+	}
+}
+
+func TestHTTPMirror(t *testing.T) {
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "primary:"+string(body))
+	}))
+	defer local.Close()
+	type mirrored struct {
+		host, path, body string
+	}
+	requests := make(chan mirrored, 10)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- mirrored{host: r.Host, path: r.URL.RequestURI(), body: string(body)}
+		// the error of the mirror is never seen by the user.
+		http.Error(w, "mirror is broken", http.StatusInternalServerError)
+	}))
+	defer mirror.Close()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPMirror(strings.TrimPrefix(mirror.URL, "http://"), 1),
+		WithHTTPMirrorMaxBody(8),
+	)
+	server := startHTTPTunnel(t, tunnel)
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/a?q=1", strings.NewReader("hello"))
+	if resp := roundTrip(t, server, 0, req); readBody(t, resp) != "primary:hello" {
+		t.Fatalf("unexpected response: %d", resp.StatusCode)
+	}
+	select {
+	case got := <-requests:
+		if got != (mirrored{host: "example.com", path: "/a?q=1", body: "hello"}) {
+			t.Fatalf("unexpected mirrored request: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to be mirrored")
+	}
+
+	// the body larger than the cap isn't mirrored, the request is still served.
+	req, _ = http.NewRequest(http.MethodPost, "http://example.com/big", strings.NewReader("0123456789"))
+	if resp := roundTrip(t, server, 0, req); readBody(t, resp) != "primary:0123456789" {
+		t.Fatalf("unexpected response: %d", resp.StatusCode)
+	}
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/b", nil)
+	roundTrip(t, server, 0, req).Body.Close()
+	select {
+	case got := <-requests:
+		if got.path != "/b" {
+			t.Fatalf("expected the large body to be skipped, got %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the request to be mirrored")
+	}
+	if status := tunnel.Status(); status.MirroredRequests != 2 || status.MirrorErrors != 0 {
+		t.Fatalf("unexpected mirror status: %d mirrored, %d errors", status.MirroredRequests, status.MirrorErrors)
+	}
+
+	// the unavailable mirror doesn't affect the response either.
+	mirror.Close()
+	req, _ = http.NewRequest(http.MethodGet, "http://example.com/c", nil)
+	if resp := roundTrip(t, server, 0, req); readBody(t, resp) != "primary:" {
+		t.Fatalf("unexpected response: %d", resp.StatusCode)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for tunnel.Status().MirrorErrors != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the failed mirror to be counted, got %+v", tunnel.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := NewHTTPTunnel("test", "127.0.0.1:8080", WithHTTPMirror("127.0.0.1:8081", 1.5)).Validate(); err == nil {
+		t.Fatal("expected the invalid fraction to be rejected")
+	}
+}
+
+func TestHTTPMirrorSampling(t *testing.T) {
+	sample := func(m *httpMirror, key string) []bool {
+		var got []bool
+		for i := 0; i < 100; i++ {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if key != "" {
+				r.Header.Set("X-User", key+strconv.Itoa(i%10))
+			}
+			got = append(got, m.sampled(r))
+		}
+		return got
+	}
+	seeded := func(seed uint64) *httpMirror {
+		return newHTTPMirror(&httpOptions{mirrorAddr: "127.0.0.1:1", mirrorFraction: 0.5, mirrorSeed: seed, mirrorSeeded: true})
+	}
+	if !slices.Equal(sample(seeded(1), ""), sample(seeded(1), "")) {
+		t.Fatal("expected the same seed to sample the same requests")
+	}
+	if slices.Equal(sample(seeded(1), ""), sample(seeded(2), "")) {
+		t.Fatal("expected another seed to sample other requests")
+	}
+
+	keyed := newHTTPMirror(&httpOptions{mirrorAddr: "127.0.0.1:1", mirrorFraction: 0.5, mirrorSampleKey: "x-user"})
+	got := sample(keyed, "user")
+	var mirrored int
+	for i, ok := range got {
+		if ok != got[i%10] {
+			t.Fatalf("expected the same key to be sampled in the same way, the %dth differs", i)
+		}
+		if ok {
+			mirrored++
+		}
+	}
+	if mirrored == 0 || mirrored == len(got) {
+		t.Fatalf("expected a fraction of the keys to be mirrored, got %d of %d", mirrored, len(got))
+	}
+}
+
+func TestStaticTunnel(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"index.html":      "<h1>home</h1>",
+		"app.js":          "console.log(1)",
+		"docs/readme.txt": "hello",
+		"data":            "\x89PNG\r\n\x1a\n",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tunnel := NewStaticTunnel("test", root, WithStaticSPAFallback("index.html"))
+	if err := tunnel.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	server := startHTTPTunnel(t, tunnel)
+
+	get := func(n int, target string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+target, nil)
+		return roundTrip(t, server, n, req)
+	}
+	for _, tc := range []struct {
+		target, contentType, body string
+		status                    int
+	}{
+		{"/", "text/html; charset=utf-8", "<h1>home</h1>", http.StatusOK},
+		{"/app.js", "text/javascript; charset=utf-8", "console.log(1)", http.StatusOK},
+		{"/docs/readme.txt", "text/plain; charset=utf-8", "hello", http.StatusOK},
+		// the content type is sniffed without an extension.
+		{"/data", "image/png", "\x89PNG\r\n\x1a\n", http.StatusOK},
+		// the client-side routes fall back to the index, the missing assets don't.
+		{"/users/1", "text/html; charset=utf-8", "<h1>home</h1>", http.StatusOK},
+		{"/missing.js", "", "", http.StatusNotFound},
+		// the listing is disabled by default.
+		{"/docs/", "", "", http.StatusForbidden},
+		// the paths never escape the root.
+		{"/../../etc/passwd", "text/html; charset=utf-8", "<h1>home</h1>", http.StatusOK},
+		{"/../app.js", "text/javascript; charset=utf-8", "console.log(1)", http.StatusOK},
+	} {
+		resp := get(0, tc.target)
+		body := readBody(t, resp)
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.target, tc.status, resp.StatusCode)
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != tc.contentType || body != tc.body {
+			t.Fatalf("%s: unexpected response %q %q", tc.target, ct, body)
+		}
+	}
+	if resp := get(0, "/docs?x=1"); resp.StatusCode != http.StatusMovedPermanently || resp.Header.Get("Location") != "docs/?x=1" {
+		t.Fatalf("expected the directory to be redirected, got %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com/app.js", nil)
+	if resp := roundTrip(t, server, 0, req); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405, got %d", resp.StatusCode)
+	}
+
+	server = startHTTPTunnel(t, NewStaticTunnel("test", root, WithStaticDirectoryListing(true), WithStaticIndexFiles()))
+	if resp := get(0, "/"); !strings.Contains(readBody(t, resp), `<a href="docs/">docs/</a>`) {
+		t.Fatalf("expected the directory to be listed")
+	}
+
+	if err := NewStaticTunnel("test", filepath.Join(root, "missing")).Validate(); err == nil {
+		t.Fatal("expected the missing root to be rejected")
+	}
+	if err := NewStaticTunnel("test", root, WithHTTPUpstreams("127.0.0.1:8080")).Validate(); err == nil {
+		t.Fatal("expected the upstreams to be rejected")
+	}
+	if err := NewHTTPTunnel("test", "127.0.0.1:8080", WithStaticDirectoryListing(true)).Validate(); err == nil {
+		t.Fatal("expected the static options to be rejected without NewStaticTunnel")
+	}
+}
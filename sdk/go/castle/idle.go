@@ -0,0 +1,74 @@
+package castle
+
+import (
+	"io"
+	"time"
+)
+
+// idleTimer calls onIdle once there is no activity for the timeout.
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, onIdle func()) *idleTimer {
+	return &idleTimer{
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, onIdle),
+	}
+}
+
+// touch postpones the timer, it's a no-op on a nil timer.
+func (t *idleTimer) touch() {
+	if t != nil {
+		t.timer.Reset(t.timeout)
+	}
+}
+
+func (t *idleTimer) stop() {
+	if t != nil {
+		t.timer.Stop()
+	}
+}
+
+// idleBody closes the body of a response once it reads nothing for the timeout,
+// which aborts streaming the response.
+type idleBody struct {
+	io.ReadCloser
+	timer *idleTimer
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration) *idleBody {
+	b := &idleBody{ReadCloser: body}
+	b.timer = newIdleTimer(timeout, func() {
+		body.Close()
+	})
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.touch()
+	}
+	return n, err
+}
+
+func (b *idleBody) Close() error {
+	b.timer.stop()
+	return b.ReadCloser.Close()
+}
+
+// idleReader touches the timer whenever it reads something.
+type idleReader struct {
+	io.Reader
+	timer *idleTimer
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.timer.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,183 @@
+package castle
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// redacted replaces the values of the headers of WithHTTPInspectRedact.
+const redacted = "[REDACTED]"
+
+// InspectedRequest is a request and its response retained by WithHTTPInspect.
+type InspectedRequest struct {
+	// Time is when the request is received.
+	Time   time.Time
+	Method string
+	// URL is the path and the query of the request as the user sent.
+	URL    string
+	Proto  string
+	Host   string
+	Header http.Header
+	// Body is up to the maxBodyBytes of WithHTTPInspect of the request body,
+	// BodyTruncated is true if the body is longer.
+	Body          []byte
+	BodyTruncated bool
+
+	// Status is 0 if nothing is responded.
+	Status         int
+	ResponseHeader http.Header
+	// ResponseBody is the body sent to the user, it's compressed if WithHTTPCompression applies.
+	ResponseBody          []byte
+	ResponseBodyTruncated bool
+
+	Duration time.Duration
+	ClientIP string
+	// ConnectionID is the id of the connection assigned by the server.
+	ConnectionID string
+}
+
+// inspector retains the latest requests in a ring.
+type inspector struct {
+	maxRequests  int
+	maxBodyBytes int
+	// redact is the canonical names of the headers to redact.
+	redact []string
+
+	mu       sync.Mutex
+	requests []InspectedRequest
+	// next is where the next request is put once the ring is full.
+	next int
+}
+
+func newInspector(maxRequests, maxBodyBytes int, redact []string) *inspector {
+	canonical := make([]string, 0, len(redact))
+	for _, name := range redact {
+		canonical = append(canonical, http.CanonicalHeaderKey(name))
+	}
+	return &inspector{
+		maxRequests:  maxRequests,
+		maxBodyBytes: maxBodyBytes,
+		redact:       canonical,
+	}
+}
+
+func (i *inspector) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		req := InspectedRequest{
+			Time:         start,
+			Method:       r.Method,
+			URL:          r.URL.RequestURI(),
+			Proto:        r.Proto,
+			Host:         r.Host,
+			Header:       i.redacted(r.Header),
+			ClientIP:     clientIP(r),
+			ConnectionID: connectionID(r.Context()),
+		}
+		body := &limitedBuffer{limit: i.maxBodyBytes}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &teeBody{ReadCloser: r.Body, w: body}
+		}
+		rec := &inspectRecorder{ResponseWriter: w, body: limitedBuffer{limit: i.maxBodyBytes}}
+		next.ServeHTTP(rec, r)
+
+		req.Body, req.BodyTruncated = body.Bytes(), body.truncated
+		req.Status = rec.status
+		if rec.header != nil {
+			req.ResponseHeader = i.redacted(rec.header)
+		}
+		req.ResponseBody, req.ResponseBodyTruncated = rec.body.Bytes(), rec.body.truncated
+		req.Duration = time.Since(start)
+		i.add(req)
+	})
+}
+
+func (i *inspector) redacted(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range i.redact {
+		if _, ok := h[name]; ok {
+			h[name] = []string{redacted}
+		}
+	}
+	return h
+}
+
+func (i *inspector) add(req InspectedRequest) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if len(i.requests) < i.maxRequests {
+		i.requests = append(i.requests, req)
+		return
+	}
+	i.requests[i.next] = req
+	i.next = (i.next + 1) % i.maxRequests
+}
+
+// recent returns the retained requests, the oldest first.
+func (i *inspector) recent() []InspectedRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	requests := make([]InspectedRequest, 0, len(i.requests))
+	requests = append(requests, i.requests[i.next:]...)
+	return append(requests, i.requests[:i.next]...)
+}
+
+// limitedBuffer keeps up to limit bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.truncated = true
+		p = p[:max(room, 0)]
+	}
+	b.Buffer.Write(p)
+	return len(p), nil
+}
+
+// teeBody copies the request body to w while it's read by the proxy.
+type teeBody struct {
+	io.ReadCloser
+	w io.Writer
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.w.Write(p[:n])
+	return n, err
+}
+
+// inspectRecorder tees the response to the user and the body.
+type inspectRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   limitedBuffer
+}
+
+func (w *inspectRecorder) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+		w.header = w.Header().Clone()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *inspectRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap makes http.ResponseController work with the underlying ResponseWriter.
+func (w *inspectRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,45 @@
+package castle
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// tcpKeepAlive is the keepalive of the forwarded tcp connections, see WithTCPKeepAlive.
+type tcpKeepAlive struct {
+	enabled  bool
+	idle     time.Duration
+	interval time.Duration
+	count    int
+}
+
+// apply sets the keepalive of conn, the conns which are not tcp are left as is.
+func (k *tcpKeepAlive) apply(conn net.Conn) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if !k.enabled {
+		return tc.SetKeepAlive(false)
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		return err
+	}
+	if k.idle > 0 {
+		// it sets the interval to the idle as well on most platforms.
+		if err := tc.SetKeepAlivePeriod(k.idle); err != nil {
+			return err
+		}
+	}
+	return setKeepAliveProbes(tc, k.interval, k.count)
+}
+
+// metadata is the value of metadataTCPKeepAlive, "off" or "idle,interval,count",
+// zero means the default of the OS.
+func (k *tcpKeepAlive) metadata() string {
+	if !k.enabled {
+		return "off"
+	}
+	return k.idle.String() + "," + k.interval.String() + "," + strconv.Itoa(k.count)
+}
@@ -0,0 +1,35 @@
+package castle
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// setKeepAliveProbes sets the interval between the keepalive probes and the number of
+// the unacknowledged probes before the connection is dropped, zero keeps the current value.
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	if interval <= 0 && count <= 0 {
+		return nil
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if interval > 0 {
+			secs := max(int(interval/time.Second), 1)
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); sockErr != nil {
+				return
+			}
+		}
+		if count > 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
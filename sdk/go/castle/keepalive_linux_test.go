@@ -0,0 +1,79 @@
+package castle
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLocalDialKeepAlive(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	dialer := &localDialer{keepAlive: &tcpKeepAlive{enabled: true, idle: 30 * time.Second, interval: 10 * time.Second, count: 5}}
+	conn, err := dialer.dial(context.Background(), "tcp", local.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[int]int{}
+	raw.Control(func(fd uintptr) {
+		for _, opt := range []int{syscall.TCP_KEEPIDLE, syscall.TCP_KEEPINTVL, syscall.TCP_KEEPCNT} {
+			got[opt], _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, opt)
+		}
+	})
+	if got[syscall.TCP_KEEPIDLE] != 30 || got[syscall.TCP_KEEPINTVL] != 10 || got[syscall.TCP_KEEPCNT] != 5 {
+		t.Fatalf("unexpected keepalive: %v", got)
+	}
+
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithTCPKeepAlive(false, 0, 0, 0))
+	if md := tunnel.md.Get(metadataTCPKeepAlive); len(md) != 1 || md[0] != "off" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+}
+
+func TestLocalDialNoDelay(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	noDelay := func(tunnel *Tunnel) int {
+		conn, err := tunnel.dialer.dial(context.Background(), "tcp", local.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int
+		raw.Control(func(fd uintptr) {
+			got, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+		})
+		return got
+	}
+	// the Go runtime sets TCP_NODELAY by default.
+	if got := noDelay(NewTCPTunnel("test", local.Addr().String())); got == 0 {
+		t.Fatal("expected the default of the Go runtime")
+	}
+	tunnel := NewTCPTunnel("test", local.Addr().String(), WithTCPNoDelay(false))
+	if got := noDelay(tunnel); got != 0 {
+		t.Fatal("expected Nagle's algorithm to be enabled")
+	}
+	if md := tunnel.md.Get(metadataTCPNoDelay); len(md) != 1 || md[0] != "false" {
+		t.Fatalf("unexpected metadata: %v", md)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package castle
+
+import (
+	"net"
+	"time"
+)
+
+// setKeepAliveProbes is a no-op except on linux, the interval is the same as the idle time
+// and the count is the default of the OS.
+func setKeepAliveProbes(conn *net.TCPConn, interval time.Duration, count int) error {
+	return nil
+}
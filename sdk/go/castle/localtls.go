@@ -0,0 +1,37 @@
+package castle
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// localTLSConfig returns the config to connect to the local server over https,
+// it returns nil if the local server speaks plain http.
+func (opts *httpOptions) localTLSConfig() *tls.Config {
+	if opts.localTLS != nil {
+		return opts.localTLS.Clone()
+	}
+	if opts.localScheme == "https" {
+		return &tls.Config{}
+	}
+	return nil
+}
+
+// dialLocalTLS starts TLS on the conn to the local server at addr,
+// the ServerName defaults to the host of addr, and only the nextProto is negotiated.
+func dialLocalTLS(ctx context.Context, conn net.Conn, config *tls.Config, addr, nextProto string) (net.Conn, error) {
+	config = config.Clone()
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			config.ServerName = host
+		}
+	}
+	config.NextProtos = []string{nextProto}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
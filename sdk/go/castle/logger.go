@@ -1,8 +1,19 @@
 package castle
 
-type Logger interface {
-	Debug(msg string, args ...any)
-	Info(msg string, args ...any)
-	Warn(msg string, args ...any)
-	Error(msg string, args ...any)
+import (
+	"context"
+	"log/slog"
+)
+
+// discardHandler drops all the records, the client is silent unless WithLogger is used.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// tunnelLogger returns the logger which adds the name of the tunnel to each record.
+func (c *Client) tunnelLogger(tunnel *Tunnel) *slog.Logger {
+	return c.logger.With(slog.String("tunnel", tunnel.Name))
 }
@@ -0,0 +1,74 @@
+package castle
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// routeMatch is a predicate of the requests routed to the http tunnel,
+// see WithHTTPMatchHeader and WithHTTPMatchQuery.
+type routeMatch struct {
+	// header is true for a header, otherwise it's a query parameter.
+	header bool
+	name   string
+	value  string
+}
+
+func (m routeMatch) validate() error {
+	if m.header {
+		if !httpguts.ValidHeaderFieldName(m.name) {
+			return fmt.Errorf("invalid header name %q to match", m.name)
+		}
+		if !httpguts.ValidHeaderFieldValue(m.value) {
+			return fmt.Errorf("invalid value %q of header %s to match", m.value, m.name)
+		}
+		return nil
+	}
+	if m.name == "" {
+		return errors.New("the query parameter to match is required")
+	}
+	return nil
+}
+
+// String is the metadata value of the predicate, name=value.
+func (m routeMatch) String() string {
+	return m.name + "=" + m.value
+}
+
+// normalizeMatches canonicalizes the header names and sorts the predicates,
+// so the same predicates in any order compare equal.
+func normalizeMatches(matches []routeMatch) []routeMatch {
+	normalized := make([]routeMatch, 0, len(matches))
+	for _, m := range matches {
+		if m.header {
+			m.name = http.CanonicalHeaderKey(m.name)
+		}
+		if !slices.Contains(normalized, m) {
+			normalized = append(normalized, m)
+		}
+	}
+	slices.SortFunc(normalized, func(a, b routeMatch) int {
+		switch {
+		case a.header != b.header:
+			if a.header {
+				return -1
+			}
+			return 1
+		case a.name != b.name:
+			if a.name < b.name {
+				return -1
+			}
+			return 1
+		case a.value < b.value:
+			return -1
+		case a.value > b.value:
+			return 1
+		}
+		return 0
+	})
+	return normalized
+}
@@ -0,0 +1,177 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+// The control protocol doesn't carry all the options of a tunnel,
+// the client sends them as the metadata of the Register request,
+// the servers which don't know the metadata just ignore them, castled does so,
+// the options only applied by the server warn then, see serverMetadata.
+const (
+	// metadataAllowCIDR is the CIDRs allowed to connect to the tunnel.
+	metadataAllowCIDR = "castle-allow-cidr"
+	// metadataDenyCIDR is the CIDRs denied to connect to the tunnel.
+	metadataDenyCIDR = "castle-deny-cidr"
+	// metadataTLSCert and metadataTLSKey are the PEM encoded certificate and key
+	// to terminate the TLS of the http tunnel.
+	metadataTLSCert = "castle-tls-cert-bin"
+	metadataTLSKey  = "castle-tls-key-bin"
+	// metadataTLSUpdates is set by the server in the header of the control stream if it accepts
+	// the certificates pushed by Tunnel.UpdateTLS, the value is "true".
+	metadataTLSUpdates = "castle-tls-updates"
+	// metadataHTTPPathPrefix is the path prefix routed to the http tunnel.
+	metadataHTTPPathPrefix = "castle-http-path-prefix"
+	// metadataHTTPMatchHeader and metadataHTTPMatchQuery are the predicates of the requests
+	// routed to the http tunnel, each value is name=value.
+	metadataHTTPMatchHeader = "castle-http-match-header"
+	metadataHTTPMatchQuery  = "castle-http-match-query"
+	// metadataHTTPForceHTTPS asks the server to redirect the plaintext requests to https,
+	// the values are the excluded path prefixes, or empty.
+	metadataHTTPForceHTTPS = "castle-http-force-https"
+	// metadataHTTPMaxRequestBody is the max bytes of the request body of the http tunnel.
+	metadataHTTPMaxRequestBody = "castle-http-max-request-body"
+	// metadataHTTPAllowedMethods are the methods of the requests proxied by the http tunnel,
+	// the server responds 405 to the others.
+	metadataHTTPAllowedMethods = "castle-http-allowed-methods"
+	// metadataGRPC marks the http tunnel as a gRPC tunnel, the server terminates HTTP/2
+	// and forwards the trailers, the value is "true".
+	metadataGRPC = "castle-grpc"
+	// metadataHTTPProtocols is the protocols negotiated with the users by ALPN, e.g. "h2,http/1.1",
+	// the server forwards the HTTP/2 connections to the client in h2c.
+	metadataHTTPProtocols = "castle-http-protocols"
+	// metadataTag is the metadata of WithMetadata, each value is key=value, the server also sets it
+	// in the header of the control stream to the accepted metadata.
+	metadataTag = "castle-tag"
+	// metadataMaxConnections is the max number of concurrent connections of the tunnel.
+	metadataMaxConnections = "castle-max-connections"
+	// metadataConnectionRate is the rate limit of the new connections of the tunnel,
+	// "perSecond,burst", e.g. "10,20".
+	metadataConnectionRate = "castle-connection-rate"
+	// metadataTTL is the lifetime of the tunnel of WithTTL, e.g. "1h0m0s".
+	metadataTTL = "castle-ttl"
+	// metadataRegion is the preferred region of the edge which terminates the traffic of the tunnel,
+	// the server also sets it in the header of the control stream to the region actually chosen.
+	metadataRegion = "castle-region"
+	// metadataTCPPortRange is the range of the remote ports to allocate the port of the tcp tunnel from,
+	// e.g. "20000-20100".
+	metadataTCPPortRange = "castle-tcp-port-range"
+	// metadataTCPBindAddr is the server address which the listener of the tcp tunnel is bound to.
+	metadataTCPBindAddr = "castle-tcp-bind-addr"
+	// metadataTCPSNIRouting tells the server the tcp tunnel carries TLS and is routed by the server name,
+	// the server must forward the ClientHello untouched, the value is "true".
+	metadataTCPSNIRouting = "castle-tcp-sni-routing"
+	// metadataDataCompression is the compression of the data streams offered by the tcp tunnel, e.g. "deflate",
+	// the server also sets it in the header of the control stream if it accepts, see dataCodec.
+	metadataDataCompression = "castle-data-compression"
+	// metadataTCPKeepAlive is the keepalive of the connections accepted by the server for the tcp tunnel,
+	// "off" or "idle,interval,count", e.g. "30s,10s,5", zero means the default of the OS.
+	metadataTCPKeepAlive = "castle-tcp-keepalive"
+	// metadataTCPNoDelay is TCP_NODELAY of the connections accepted by the server for the tcp tunnel, "true" or "false".
+	metadataTCPNoDelay = "castle-tcp-nodelay"
+	// metadataUDPSessionTimeout is how long the server keeps an inactive udp session, e.g. "30s".
+	metadataUDPSessionTimeout = "castle-udp-session-timeout"
+	// metadataUDPMaxSessions is the max number of concurrent udp sessions.
+	metadataUDPMaxSessions = "castle-udp-max-sessions"
+	// metadataUDPMaxDatagramSize is the max size of the udp datagrams of WithUdpMaxDatagramSize.
+	metadataUDPMaxDatagramSize = "castle-udp-max-datagram-size"
+)
+
+// metadataConfigUpdates tells the server the client applies the config updates of configUpdatePrefix,
+// it's sent with each Register request, the value is "true".
+const metadataConfigUpdates = "castle-config-updates"
+
+// metadataAccepted is the header metadata of the control stream, the server sets it to the keys
+// of the metadata of the tunnel which it applies, e.g. castle-tcp-bind-addr.
+const metadataAccepted = "castle-accepted-metadata"
+
+// serverMetadata are the metadata of the options which take effect only if the server supports them,
+// mapped to the warnings of the options being ignored.
+var serverMetadata = map[string]string{
+	metadataTCPBindAddr:       "the tcp bind addr is ignored, the server doesn't support it",
+	metadataRegion:            "the region is ignored, the server doesn't support it",
+	metadataTCPPortRange:      "the tcp port range is ignored, the server doesn't support it",
+	metadataTCPKeepAlive:      "the tcp keepalive only applies to the local connections, the server doesn't support it",
+	metadataHTTPProtocols:     "the http protocols are ignored, the server doesn't support them and serves http/1.1 only",
+	metadataTTL:               "the ttl is only enforced by the client, the server doesn't support it",
+	metadataTCPNoDelay:        "the tcp nodelay only applies to the local connections, the server doesn't support it",
+	metadataUDPSessionTimeout: "the udp session timeout is only enforced by the client, the server doesn't support it",
+	metadataUDPMaxSessions:    "the udp max sessions is only enforced by the client, the server doesn't support it",
+}
+
+// unconfirmedMetadata returns the warnings of serverMetadata in md which the server doesn't confirm
+// in the header, by metadataAccepted or by setting the metadata itself, e.g. metadataRegion.
+func unconfirmedMetadata(md, header metadata.MD) []error {
+	accepted := header.Get(metadataAccepted)
+	var keys []string
+	for key := range md {
+		if _, ok := serverMetadata[key]; ok && !slices.Contains(accepted, key) && len(header.Get(key)) == 0 {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	warnings := make([]error, 0, len(keys))
+	for _, key := range keys {
+		warnings = append(warnings, errors.New(serverMetadata[key]))
+	}
+	return warnings
+}
+
+// metadataAuthorization carries the auth token of the client in the Register request.
+const metadataAuthorization = "authorization"
+
+// metadataGoingAway is the trailer metadata of the control stream, the server sets it
+// to the grace period, e.g. "30s", when it ends the stream for a planned shutdown.
+const metadataGoingAway = "castle-going-away"
+
+// metadataAllowedBindAddrs is the trailer metadata of the Register stream, the server sets it
+// to the allowed bind addresses when it refuses the one of metadataTCPBindAddr.
+const metadataAllowedBindAddrs = "castle-allowed-bind-addrs"
+
+// metadataRemoteAddr is the header metadata of a data stream,
+// the server may set it to the address of the user who connects to the tunnel.
+const metadataRemoteAddr = "castle-remote-addr"
+
+// withTunnelMetadata attaches the metadata of the tunnel to the outgoing ctx.
+func withTunnelMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if len(md) == 0 {
+		return ctx
+	}
+	if outgoing, ok := metadata.FromOutgoingContext(ctx); ok {
+		md = metadata.Join(outgoing, md)
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// remoteAddr returns the address of the user who connects to the tunnel,
+// it's unknown if the server doesn't tell.
+func remoteAddr(stream proto.TunnelService_DataClient) (netip.Addr, bool) {
+	addrPort, ok := remoteAddrPort(stream)
+	return addrPort.Addr(), ok
+}
+
+// remoteAddrPort is like remoteAddr, but also returns the port of the user,
+// the port is 0 if the server only tells the address.
+func remoteAddrPort(stream proto.TunnelService_DataClient) (netip.AddrPort, bool) {
+	md, err := stream.Header()
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	values := md.Get(metadataRemoteAddr)
+	if len(values) == 0 {
+		return netip.AddrPort{}, false
+	}
+	if addrPort, err := netip.ParseAddrPort(values[0]); err == nil {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), true
+	}
+	if addr, err := netip.ParseAddr(values[0]); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), 0), true
+	}
+	return netip.AddrPort{}, false
+}
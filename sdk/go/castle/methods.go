@@ -0,0 +1,47 @@
+package castle
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// normalizeMethods uppercases the methods, sorts them and removes the duplicates.
+func normalizeMethods(methods []string) []string {
+	normalized := make([]string, 0, len(methods))
+	for _, method := range methods {
+		normalized = append(normalized, strings.ToUpper(strings.TrimSpace(method)))
+	}
+	slices.Sort(normalized)
+	return slices.Compact(normalized)
+}
+
+func validateMethods(methods []string) error {
+	for _, method := range methods {
+		// a method is a token like a header name.
+		if !httpguts.ValidHeaderFieldName(method) {
+			return fmt.Errorf("invalid http method %q", method)
+		}
+	}
+	return nil
+}
+
+// allowMethods responds 405 with the Allow header to the requests of the other methods.
+func allowMethods(methods []string, rejected *atomic.Int64) middleware {
+	allow := strings.Join(methods, ", ")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !slices.Contains(methods, r.Method) {
+				rejected.Add(1)
+				w.Header().Set("Allow", allow)
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
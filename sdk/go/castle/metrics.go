@@ -0,0 +1,93 @@
+package castle
+
+import "time"
+
+// Metrics is a snapshot of the counters of a client, see Client.Metrics.
+type Metrics struct {
+	// Time is when the snapshot is taken.
+	Time time.Time
+	// Uptime is how long the client has been created.
+	Uptime time.Duration
+	// Totals is the sum of Tunnels, its Name, Protocol, State and Uptime are not set.
+	Totals TunnelMetrics
+	// Tunnels are the metrics of all the tunnels started by the client, including the closed ones,
+	// in the order they were started.
+	Tunnels []TunnelMetrics
+}
+
+// TunnelMetrics is the counters of a tunnel, the counters only increase since the tunnel
+// was started, except ActiveConns.
+type TunnelMetrics struct {
+	Name     string
+	Protocol string
+	State    State
+	// ActiveConns is the number of the connections which are being proxied.
+	ActiveConns int64
+	// TotalConns is the number of the connections which have been proxied, including the active ones.
+	TotalConns    int64
+	RejectedConns int64
+	BytesIn       int64
+	BytesOut      int64
+	// Errors is the number of the connections which failed to be proxied, e.g. the local server is down.
+	Errors         int64
+	Reconnects     int64
+	RegisterErrors int64
+	// Uptime is how long the tunnel has been connected since the last registration,
+	// it's zero unless State is StateConnected.
+	Uptime time.Duration
+}
+
+// Metrics returns a snapshot of the counters of the client and its tunnels,
+// it's a plain struct to be encoded as json or pushed to any metrics system.
+//
+// The Totals is computed from the same snapshot as the Tunnels, so they are always consistent.
+// The closed tunnels are kept in the snapshot, so the totals never decrease.
+func (c *Client) Metrics() Metrics {
+	c.mu.Lock()
+	tunnels := append([]*Tunnel(nil), c.tunnels...)
+	c.mu.Unlock()
+
+	now := time.Now()
+	metrics := Metrics{
+		Time:    now,
+		Uptime:  now.Sub(c.created),
+		Tunnels: make([]TunnelMetrics, 0, len(tunnels)),
+	}
+	for _, tunnel := range tunnels {
+		m := tunnel.status.metrics(now)
+		m.Name = tunnel.Name
+		m.Protocol = tunnel.protocol()
+		metrics.Tunnels = append(metrics.Tunnels, m)
+
+		totals := &metrics.Totals
+		totals.ActiveConns += m.ActiveConns
+		totals.TotalConns += m.TotalConns
+		totals.RejectedConns += m.RejectedConns
+		totals.BytesIn += m.BytesIn
+		totals.BytesOut += m.BytesOut
+		totals.Errors += m.Errors
+		totals.Reconnects += m.Reconnects
+		totals.RegisterErrors += m.RegisterErrors
+	}
+	return metrics
+}
+
+func (s *tunnelStatus) metrics(now time.Time) TunnelMetrics {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m := TunnelMetrics{
+		State:          s.state,
+		ActiveConns:    int64(s.conns.count()),
+		TotalConns:     s.totalConns.Load(),
+		RejectedConns:  s.rejectedConns.Load(),
+		BytesIn:        s.bytesIn.Load(),
+		BytesOut:       s.bytesOut.Load(),
+		Errors:         s.connErrors.Load(),
+		Reconnects:     s.reconnects.Load(),
+		RegisterErrors: s.registerErrors.Load(),
+	}
+	if s.state == StateConnected {
+		m.Uptime = now.Sub(s.connectedSince)
+	}
+	return m
+}
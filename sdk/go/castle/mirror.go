@@ -0,0 +1,233 @@
+package castle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultMirrorMaxBody is the size cap of the mirrored bodies without WithHTTPMirrorMaxBody.
+	defaultMirrorMaxBody = 1 << 20
+	// maxMirrorsInFlight is the number of the mirrored requests in flight,
+	// the requests beyond it aren't mirrored, so a slow mirror never piles up.
+	maxMirrorsInFlight = 64
+	// mirrorTimeout is the timeout of each mirrored request, including reading the response.
+	mirrorTimeout = 30 * time.Second
+)
+
+// hopHeaders are the hop-by-hop headers which aren't copied to the mirrored requests.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// httpMirror copies a fraction of the requests to the mirror address of WithHTTPMirror,
+// the responses of the mirror are discarded.
+type httpMirror struct {
+	addr     string
+	fraction float64
+	// sampleKey is the header of WithHTTPMirrorSampleKey, the requests are sampled by random without it.
+	sampleKey string
+	seed      uint64
+	maxBody   int64
+	transport *http.Transport
+	// logger is set once the proxy starts.
+	logger *slog.Logger
+
+	mu     sync.Mutex
+	random *rand.Rand
+
+	inFlight chan struct{}
+	// mirrored and failed are of TunnelStatus.MirroredRequests and TunnelStatus.MirrorErrors.
+	mirrored atomic.Int64
+	failed   atomic.Int64
+}
+
+func newHTTPMirror(opts *httpOptions) *httpMirror {
+	maxBody := opts.mirrorMaxBody
+	if maxBody == 0 {
+		maxBody = defaultMirrorMaxBody
+	}
+	m := &httpMirror{
+		addr:      opts.mirrorAddr,
+		fraction:  opts.mirrorFraction,
+		sampleKey: http.CanonicalHeaderKey(opts.mirrorSampleKey),
+		seed:      opts.mirrorSeed,
+		maxBody:   maxBody,
+		inFlight:  make(chan struct{}, maxMirrorsInFlight),
+	}
+	if opts.mirrorSeeded {
+		m.random = rand.New(rand.NewPCG(opts.mirrorSeed, opts.mirrorSeed))
+	}
+	dialer := &localDialer{timeout: opts.dialTimeout}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.dial(ctx, network, m.addr, nil)
+	}
+	transport.MaxIdleConnsPerHost = maxMirrorsInFlight
+	m.transport = transport
+	return m
+}
+
+// validateMirror checks the options of WithHTTPMirror.
+func validateMirror(opts *httpOptions) error {
+	if err := validateLocalAddr(opts.mirrorAddr); err != nil {
+		return fmt.Errorf("invalid mirror address: %w", err)
+	}
+	if opts.mirrorFraction < 0 || opts.mirrorFraction > 1 {
+		return fmt.Errorf("invalid mirror fraction %v, it should be 0 to 1", opts.mirrorFraction)
+	}
+	if opts.mirrorMaxBody < 0 {
+		return fmt.Errorf("invalid mirror max body %d", opts.mirrorMaxBody)
+	}
+	return nil
+}
+
+// sampled reports whether the request is mirrored.
+func (m *httpMirror) sampled(r *http.Request) bool {
+	if m.fraction <= 0 {
+		return false
+	}
+	if m.fraction >= 1 {
+		return true
+	}
+	if m.sampleKey != "" {
+		if value := r.Header.Get(m.sampleKey); value != "" {
+			// the same key, e.g. a user id, is always sampled in the same way.
+			h := fnv.New64a()
+			var seed [8]byte
+			for i := range seed {
+				seed[i] = byte(m.seed >> (8 * i))
+			}
+			h.Write(seed[:])
+			h.Write([]byte(value))
+			return float64(mix64(h.Sum64())>>11)/(1<<53) < m.fraction
+		}
+	}
+	if m.random == nil {
+		return rand.Float64() < m.fraction
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.random.Float64() < m.fraction
+}
+
+// mix64 is the finalizer of splitmix64, it spreads the close hashes of the similar keys like "user1" and "user2".
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	return x ^ x>>31
+}
+
+func (m *httpMirror) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the upgrades can't be replayed, and the bodies larger than the cap aren't mirrored either.
+		if r.Header.Get("Upgrade") != "" || r.ContentLength > m.maxBody || !m.sampled(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		req := r.Clone(context.WithoutCancel(r.Context()))
+		var body *mirrorBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &mirrorBody{ReadCloser: r.Body, buf: limitedBuffer{limit: int(m.maxBody)}}
+			r.Body = body
+		}
+		next.ServeHTTP(w, r)
+
+		var content []byte
+		if body != nil {
+			var ok bool
+			// the body is only mirrored if the local server read it to the end.
+			if content, ok = body.content(); !ok {
+				return
+			}
+		}
+		select {
+		case m.inFlight <- struct{}{}:
+		default:
+			m.logger.Debug("mirror is busy, the request isn't mirrored", slog.String("mirror", m.addr))
+			return
+		}
+		go func() {
+			defer func() { <-m.inFlight }()
+			m.send(req, content, body != nil)
+		}()
+	})
+}
+
+// mirrorBody keeps the request body while it's read by the proxy.
+type mirrorBody struct {
+	io.ReadCloser
+
+	// mu guards the buf, the body may be still read by the transport after the response.
+	mu  sync.Mutex
+	buf limitedBuffer
+	eof bool
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Write(p[:n])
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+// content returns the body, ok is false if the body isn't read to the end or it's larger than the cap.
+func (b *mirrorBody) content() (content []byte, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.eof || b.buf.truncated {
+		return nil, false
+	}
+	return bytes.Clone(b.buf.Bytes()), true
+}
+
+// send sends the copy of the request to the mirror and discards the response.
+func (m *httpMirror) send(req *http.Request, body []byte, hasBody bool) {
+	ctx, cancel := context.WithTimeout(req.Context(), mirrorTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.RequestURI = ""
+	req.URL.Scheme = "http"
+	req.URL.Host = urlHost(m.addr)
+	for _, name := range hopHeaders {
+		req.Header.Del(name)
+	}
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	if hasBody {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	req.GetBody = nil
+
+	m.mirrored.Add(1)
+	resp, err := m.transport.RoundTrip(req)
+	if err != nil {
+		m.failed.Add(1)
+		m.logger.Debug("failed to mirror the request", slog.String("mirror", m.addr), slog.Any("error", err))
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+}
+
+func (m *httpMirror) close() {
+	m.transport.CloseIdleConnections()
+}
@@ -0,0 +1,70 @@
+package castle
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// routeConflicts reports whether the http tunnels route the same host, path prefix and predicates,
+// the server can't tell which one a request belongs to in this case.
+func routeConflicts(a, b *Tunnel) bool {
+	ah, bh := a.GetHttp(), b.GetHttp()
+	if ah == nil || bh == nil {
+		return false
+	}
+	// the server refuses the same host without any routing itself.
+	if (a.pathPrefix == "" && len(a.matches) == 0) || (b.pathPrefix == "" && len(b.matches) == 0) {
+		return false
+	}
+	if ah.Domain != bh.Domain || ah.Subdomain != bh.Subdomain || (ah.Domain == "" && ah.Subdomain == "") {
+		return false
+	}
+	return strings.TrimSuffix(a.pathPrefix, "/") == strings.TrimSuffix(b.pathPrefix, "/") &&
+		slices.Equal(a.matches, b.matches)
+}
+
+func validatePathPrefix(prefix string) error {
+	if !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("path prefix %q should start with /", prefix)
+	}
+	return nil
+}
+
+// stripPrefix removes the path prefix of the tunnel from the requests,
+// the request of the prefix itself becomes /.
+func stripPrefix(prefix string) middleware {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = trimPathPrefix(r.URL.Path, prefix)
+			if r.URL.RawPath != "" {
+				r2.URL.RawPath = trimPathPrefix(r.URL.RawPath, prefix)
+			}
+			r2.RequestURI = r2.URL.RequestURI()
+			next.ServeHTTP(w, r2)
+		})
+	}
+}
+
+// trimPathPrefix trims the prefix only if it matches whole segments of the path.
+func trimPathPrefix(path, prefix string) string {
+	if path == prefix {
+		return "/"
+	}
+	if strings.HasPrefix(path, prefix+"/") {
+		return path[len(prefix):]
+	}
+	return path
+}
+
+// validateWildcardDomain checks the wildcard only appears as the leftmost label.
+func validateWildcardDomain(pattern string) error {
+	rest, ok := strings.CutPrefix(pattern, "*.")
+	if !ok || rest == "" || strings.Contains(rest, "*") || !strings.Contains(rest, ".") {
+		return fmt.Errorf("invalid wildcard domain %q, the wildcard should be the leftmost label, e.g. *.example.com", pattern)
+	}
+	return nil
+}
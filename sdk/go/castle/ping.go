@@ -0,0 +1,46 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ping measures the round-trip time of the control channel to the server on demand,
+// e.g. for the readiness checks, it's unrelated to the keepalive of WithKeepAlive.
+//
+// The first Ping of the client includes the time of connecting to the server.
+// If the server doesn't respond before the ctx is done, a TimeoutError is returned.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	start := time.Now()
+	// castled rejects the registration without a tunnel immediately, the rejection
+	// is the response of the ping.
+	stream, err := c.grpcClient.Register(ctx, &proto.RegisterReq{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	rtt := time.Since(start)
+
+	switch status.Code(err) {
+	case codes.InvalidArgument, codes.Unauthenticated, codes.PermissionDenied:
+		return rtt, nil
+	case codes.DeadlineExceeded:
+		return 0, &TimeoutError{Op: "ping", Err: err}
+	case codes.Canceled:
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return 0, &TimeoutError{Op: "ping", Err: err}
+		}
+	case codes.OK:
+		// a server which accepts the empty registration is not castled.
+		return 0, errors.New("unexpected response to ping")
+	}
+	return 0, fmt.Errorf("failed to ping: %w", c.registerError(err, nil))
+}
@@ -0,0 +1,61 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// ErrNoPortAvailable is returned by StartTunnel if all the ports of WithTCPPortRange are taken.
+var ErrNoPortAvailable = errors.New("castle: no port available")
+
+// portRange is the range of the remote ports of a tcp tunnel, both ends are inclusive.
+type portRange struct {
+	min, max uint16
+}
+
+func (r *portRange) validate() error {
+	if r.min == 0 || r.min > r.max {
+		return fmt.Errorf("invalid port range %d-%d", r.min, r.max)
+	}
+	return nil
+}
+
+func (r *portRange) String() string {
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// registerTunnel registers the tunnel for the first time, it requests the first available port
+// of the port range of the tunnel if there is one.
+//
+// The range is sent to the server along with the registration, the servers which allocate
+// the port from the range respond the port directly, for the other servers, the ports
+// are requested one by one until one of them is not in use.
+func (c *Client) registerTunnel(ctx context.Context, tunnel *Tunnel) (proto.TunnelService_RegisterClient, []string, error) {
+	r := tunnel.portRange
+	if r == nil {
+		return c.register(ctx, tunnel, &tunnel.Tunnel)
+	}
+	for port := r.min; ; port++ {
+		config := pb.Clone(&tunnel.Tunnel).(*proto.Tunnel)
+		config.GetTcp().RemotePort = int32(port)
+		rest := &portRange{min: port, max: r.max}
+		stream, entrypoint, err := c.register(metadata.AppendToOutgoingContext(ctx, metadataTCPPortRange, rest.String()), tunnel, config)
+		switch {
+		case err == nil:
+			return stream, entrypoint, nil
+		case status.Code(err) == codes.ResourceExhausted:
+			return nil, nil, fmt.Errorf("%w in %s: %w", ErrNoPortAvailable, r, err)
+		case !errors.Is(err, ErrAddressInUse):
+			return nil, nil, err
+		case port == r.max:
+			return nil, nil, fmt.Errorf("%w in %s", ErrNoPortAvailable, r)
+		}
+	}
+}
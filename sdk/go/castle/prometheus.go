@@ -0,0 +1,82 @@
+package castle
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// prometheusCollector exports the counters of Client.Metrics, see NewPrometheusCollector.
+type prometheusCollector struct {
+	client *Client
+
+	activeConns    *prometheus.Desc
+	bytesIn        *prometheus.Desc
+	bytesOut       *prometheus.Desc
+	reconnects     *prometheus.Desc
+	registerErrors *prometheus.Desc
+}
+
+// NewPrometheusCollector returns a prometheus.Collector of the tunnels of the client,
+// register it with a prometheus.Registerer to export them:
+//
+//	castle_tunnel_active_connections         gauge of TunnelStatus.ActiveConns
+//	castle_tunnel_bytes_in_total             counter of TunnelStatus.BytesIn
+//	castle_tunnel_bytes_out_total            counter of TunnelStatus.BytesOut
+//	castle_tunnel_reconnects_total           counter of TunnelStatus.Reconnects
+//	castle_tunnel_registration_errors_total  counter of TunnelStatus.RegisterErrors
+//
+// The metrics are labeled by tunnel and protocol, and read from the same counters as TunnelStatus
+// when collected, so nothing is counted twice. A tunnel which is started again after it's closed
+// adds to the series of the same name, so the counters never decrease.
+func NewPrometheusCollector(client *Client) prometheus.Collector {
+	labels := []string{"tunnel", "protocol"}
+	return &prometheusCollector{
+		client: client,
+		activeConns: prometheus.NewDesc("castle_tunnel_active_connections",
+			"Number of the connections being proxied by the tunnel.", labels, nil),
+		bytesIn: prometheus.NewDesc("castle_tunnel_bytes_in_total",
+			"Total bytes from the users of the tunnel.", labels, nil),
+		bytesOut: prometheus.NewDesc("castle_tunnel_bytes_out_total",
+			"Total bytes to the users of the tunnel.", labels, nil),
+		reconnects: prometheus.NewDesc("castle_tunnel_reconnects_total",
+			"Number of times the tunnel re-registered successfully.", labels, nil),
+		registerErrors: prometheus.NewDesc("castle_tunnel_registration_errors_total",
+			"Number of the failed registrations of the tunnel, including the failed reconnect attempts.", labels, nil),
+	}
+}
+
+func (c *prometheusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.activeConns
+	ch <- c.bytesIn
+	ch <- c.bytesOut
+	ch <- c.reconnects
+	ch <- c.registerErrors
+}
+
+func (c *prometheusCollector) Collect(ch chan<- prometheus.Metric) {
+	type series struct{ name, protocol string }
+	// the closed tunnels are kept by the client, merge them with the later ones of the same name,
+	// since a series can't be collected twice.
+	var order []series
+	merged := make(map[series]*TunnelMetrics)
+	for _, m := range c.client.Metrics().Tunnels {
+		key := series{m.Name, m.Protocol}
+		total, ok := merged[key]
+		if !ok {
+			total = &TunnelMetrics{}
+			merged[key] = total
+			order = append(order, key)
+		}
+		total.ActiveConns += m.ActiveConns
+		total.BytesIn += m.BytesIn
+		total.BytesOut += m.BytesOut
+		total.Reconnects += m.Reconnects
+		total.RegisterErrors += m.RegisterErrors
+	}
+
+	for _, key := range order {
+		m := merged[key]
+		ch <- prometheus.MustNewConstMetric(c.activeConns, prometheus.GaugeValue, float64(m.ActiveConns), key.name, key.protocol)
+		ch <- prometheus.MustNewConstMetric(c.bytesIn, prometheus.CounterValue, float64(m.BytesIn), key.name, key.protocol)
+		ch <- prometheus.MustNewConstMetric(c.bytesOut, prometheus.CounterValue, float64(m.BytesOut), key.name, key.protocol)
+		ch <- prometheus.MustNewConstMetric(c.reconnects, prometheus.CounterValue, float64(m.Reconnects), key.name, key.protocol)
+		ch <- prometheus.MustNewConstMetric(c.registerErrors, prometheus.CounterValue, float64(m.RegisterErrors), key.name, key.protocol)
+	}
+}
@@ -0,0 +1,122 @@
+package castle
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestPrometheusCollector(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := newFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if req.Tunnel.Name == "bad" {
+			return status.Error(codes.PermissionDenied, "not allowed")
+		}
+		if err := sendInit(stream, "tcp://127.0.0.1:20000"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the closed tunnel and the later one of the same name are one series.
+	first := NewTCPTunnel("echo", local.Addr().String())
+	if _, _, err := client.StartTunnel(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	visitor.finish()
+	visitor.readAll()
+	if err := first.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("echo", local.Addr().String())); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("bad", local.Addr().String())); err == nil {
+		t.Fatal("expected the registration to fail")
+	}
+	visitor = server.visit(t, 1)
+	visitor.send([]byte("hello"))
+	// the connection is kept open, so it's active.
+	if _, err := io.ReadFull(visitor, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := NewPrometheusCollector(client)
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(collector); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP castle_tunnel_active_connections Number of the connections being proxied by the tunnel.
+# TYPE castle_tunnel_active_connections gauge
+castle_tunnel_active_connections{protocol="tcp",tunnel="bad"} 0
+castle_tunnel_active_connections{protocol="tcp",tunnel="echo"} 1
+# HELP castle_tunnel_bytes_in_total Total bytes from the users of the tunnel.
+# TYPE castle_tunnel_bytes_in_total counter
+castle_tunnel_bytes_in_total{protocol="tcp",tunnel="bad"} 0
+castle_tunnel_bytes_in_total{protocol="tcp",tunnel="echo"} 9
+# HELP castle_tunnel_bytes_out_total Total bytes to the users of the tunnel.
+# TYPE castle_tunnel_bytes_out_total counter
+castle_tunnel_bytes_out_total{protocol="tcp",tunnel="bad"} 0
+castle_tunnel_bytes_out_total{protocol="tcp",tunnel="echo"} 9
+# HELP castle_tunnel_reconnects_total Number of times the tunnel re-registered successfully.
+# TYPE castle_tunnel_reconnects_total counter
+castle_tunnel_reconnects_total{protocol="tcp",tunnel="bad"} 0
+castle_tunnel_reconnects_total{protocol="tcp",tunnel="echo"} 0
+# HELP castle_tunnel_registration_errors_total Number of the failed registrations of the tunnel, including the failed reconnect attempts.
+# TYPE castle_tunnel_registration_errors_total counter
+castle_tunnel_registration_errors_total{protocol="tcp",tunnel="bad"} 1
+castle_tunnel_registration_errors_total{protocol="tcp",tunnel="echo"} 0
+`
+	deadline := time.Now().Add(time.Second)
+	for {
+		// the bytes out of the echo are counted once they're sent to the server.
+		err = testutil.GatherAndCompare(registry, strings.NewReader(expected))
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems, err := testutil.CollectAndLint(collector); err != nil || len(problems) > 0 {
+		t.Fatalf("unexpected lint problems %v: %v", problems, err)
+	}
+}
@@ -0,0 +1,80 @@
+package castle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// proxyProtocolSignature is the signature of the PROXY protocol v2 header.
+var proxyProtocolSignature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader returns the PROXY protocol header carrying the address of the user,
+// see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+//
+// If the address of the user is unknown, the header tells the local server
+// to use the real address of the connection. The serverName is the TLS server name of the
+// connection, it's sent as the PP2_TYPE_AUTHORITY TLV in v2, v1 can't carry it.
+func proxyHeader(version int, src, dst netip.AddrPort, serverName string) []byte {
+	known := src.IsValid() && dst.IsValid()
+	v4 := src.Addr().Is4() && dst.Addr().Is4()
+	if known && !v4 {
+		// the addresses must be in the same family.
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	if version == 1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
+			family, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	header := append([]byte(nil), proxyProtocolSignature...)
+	var addrs []byte
+	if !known {
+		// LOCAL command, AF_UNSPEC, no addresses.
+		header = append(header, 0x20, 0x00)
+	} else if v4 {
+		// PROXY command, TCP over IPv4.
+		header = append(header, 0x21, 0x11)
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		addrs = append(s[:], d[:]...)
+	} else {
+		// PROXY command, TCP over IPv6.
+		header = append(header, 0x21, 0x21)
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		addrs = append(s[:], d[:]...)
+	}
+	if known {
+		addrs = binary.BigEndian.AppendUint16(addrs, src.Port())
+		addrs = binary.BigEndian.AppendUint16(addrs, dst.Port())
+	}
+	if serverName != "" && len(serverName) <= 0xffff {
+		// PP2_TYPE_AUTHORITY.
+		addrs = append(addrs, 0x02)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(len(serverName)))
+		addrs = append(addrs, serverName...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+// writeProxyHeader writes the PROXY protocol header to the local connection,
+// the destination is the address of the local server.
+func writeProxyHeader(localConn net.Conn, version int, src netip.AddrPort, serverName string) error {
+	var dst netip.AddrPort
+	if addr, ok := localConn.RemoteAddr().(*net.TCPAddr); ok {
+		dst = addr.AddrPort()
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	}
+	_, err := localConn.Write(proxyHeader(version, src, dst, serverName))
+	return err
+}
@@ -0,0 +1,193 @@
+package castle
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v4src := netip.MustParseAddrPort("192.168.1.2:5555")
+	v4dst := netip.MustParseAddrPort("127.0.0.1:8080")
+	v6src := netip.MustParseAddrPort("[2001:db8::1]:5555")
+	signature := string(proxyProtocolSignature)
+
+	tests := []struct {
+		name       string
+		version    int
+		src, dst   netip.AddrPort
+		serverName string
+		want       string
+	}{
+		{"v1 ipv4", 1, v4src, v4dst, "", "PROXY TCP4 192.168.1.2 127.0.0.1 5555 8080\r\n"},
+		{"v1 ipv6", 1, v6src, v4dst, "", "PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 5555 8080\r\n"},
+		{"v1 unknown", 1, netip.AddrPort{}, v4dst, "", "PROXY UNKNOWN\r\n"},
+		{"v2 ipv4", 2, v4src, v4dst, "", signature + "\x21\x11\x00\x0c" +
+			"\xc0\xa8\x01\x02" + "\x7f\x00\x00\x01" + "\x15\xb3" + "\x1f\x90"},
+		{"v2 ipv6", 2, v6src, v4dst, "", signature + "\x21\x21\x00\x24" +
+			"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x7f\x00\x00\x01" +
+			"\x15\xb3" + "\x1f\x90"},
+		{"v2 unknown", 2, netip.AddrPort{}, v4dst, "", signature + "\x20\x00\x00\x00"},
+		{"v1 server name", 1, v4src, v4dst, "a.example.com", "PROXY TCP4 192.168.1.2 127.0.0.1 5555 8080\r\n"},
+		{"v2 server name", 2, v4src, v4dst, "a.example.com", signature + "\x21\x11\x00\x1c" +
+			"\xc0\xa8\x01\x02" + "\x7f\x00\x00\x01" + "\x15\xb3" + "\x1f\x90" +
+			"\x02\x00\x0d" + "a.example.com"},
+		{"v2 unknown server name", 2, netip.AddrPort{}, v4dst, "a.example.com", signature + "\x20\x00\x00\x10" +
+			"\x02\x00\x0d" + "a.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxyHeader(tt.version, tt.src, tt.dst, tt.serverName); !bytes.Equal(got, []byte(tt.want)) {
+				t.Fatalf("proxyHeader() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTCPTunnelProxyProtocol(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	go func() {
+		conn, err := local.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	server := newFakeServer(t)
+	server.remoteAddr = "[2001:db8::1]:5555"
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", local.Addr().String(), WithTCPProxyProtocol(1))); err != nil {
+		t.Fatal(err)
+	}
+
+	visitor := server.visit(t, 0)
+	visitor.send([]byte("ping"))
+	visitor.finish()
+	want := "PROXY TCP6 2001:db8::1 ::ffff:127.0.0.1 5555 " + strconv.Itoa(local.Addr().(*net.TCPAddr).Port) + "\r\nping"
+	if got := string(visitor.readAll()); got != want {
+		t.Fatalf("unexpected echo: %q, want %q", got, want)
+	}
+
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", local.Addr().String(), WithTCPProxyProtocol(3))); err == nil {
+		t.Fatal("expected the unsupported version to fail")
+	}
+}
+
+// clientHello returns the ClientHello record which crypto/tls sends for the server name.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		defer c1.Close()
+		tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c2, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(c2, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestParseServerName(t *testing.T) {
+	if got := parseServerName(clientHello(t, "a.example.com")[5:]); got != "a.example.com" {
+		t.Fatalf("parseServerName() = %q", got)
+	}
+	// crypto/tls doesn't send the server name of an IP.
+	if got := parseServerName(clientHello(t, "127.0.0.1")[5:]); got != "" {
+		t.Fatalf("expected no server name, got %q", got)
+	}
+	hello := clientHello(t, "a.example.com")[5:]
+	for i := 0; i < len(hello); i += 7 {
+		// a truncated ClientHello doesn't panic.
+		parseServerName(hello[:i])
+	}
+}
+
+func TestTCPSNIRouting(t *testing.T) {
+	for _, opt := range []TCPOption{
+		WithTCPSNIRoute("*.com", "127.0.0.1:8081"),
+		WithTCPSNIRoute("a.*.example.com", "127.0.0.1:8081"),
+		WithTCPSNIRoute("", "127.0.0.1:8081"),
+		WithTCPSNIRoute("a.example.com", "localhost"),
+	} {
+		if err := NewTCPTunnel("test", "127.0.0.1:8080", opt).Validate(); err == nil {
+			t.Fatal("expected the invalid route to fail")
+		}
+	}
+
+	a, b, c := tcpNamed(t, "a"), tcpNamed(t, "b"), tcpNamed(t, "c")
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("test", a.Addr().String(),
+		WithTCPSNIRoute("B.example.com", b.Addr().String()),
+		WithTCPSNIRoute("*.c.example.com", c.Addr().String()))); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataTCPSNIRouting); len(got) != 1 || got[0] != "true" {
+		t.Fatalf("unexpected metadata: %v", got)
+	}
+
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{clientHello(t, "b.example.com"), "b"},
+		{clientHello(t, "x.c.example.com"), "c"},
+		{clientHello(t, "x.y.c.example.com"), "a"},
+		{clientHello(t, "other.example.com"), "a"},
+		{[]byte("ping"), "a"},
+	}
+	for _, tt := range tests {
+		visitor := server.visit(t, 0)
+		visitor.send(tt.data)
+		visitor.finish()
+		// the backend gets the whole ClientHello.
+		if got := visitor.readAll(); string(got) != tt.want+string(tt.data) {
+			t.Fatalf("unexpected echo %q, want %s and the data", got[:1], tt.want)
+		}
+	}
+
+	// the server name goes to the local server in the PROXY protocol header.
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("proxy", a.Addr().String(),
+		WithTCPSNIRouting(), WithTCPProxyProtocol(2))); err != nil {
+		t.Fatal(err)
+	}
+	hello := clientHello(t, "b.example.com")
+	visitor := server.visit(t, 1)
+	visitor.send(hello[:3])
+	visitor.send(hello[3:])
+	visitor.finish()
+	got := visitor.readAll()
+	if !bytes.HasPrefix(got, []byte("a"+string(proxyProtocolSignature))) ||
+		!bytes.HasSuffix(got, append([]byte("\x02\x00\x0db.example.com"), hello...)) {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+}
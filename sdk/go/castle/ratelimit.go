@@ -0,0 +1,150 @@
+package castle
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+// rateLimiter is a token bucket limiting the bytes per second,
+// or the connections per second of WithConnectionRateLimit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns nil if the rate is not positive, which means no limit.
+func newRateLimiter(bytesPerSecond, burst int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// set changes the rate and the burst, the burst defaults to the rate if it's not positive,
+// and a rate which is not positive disables the limit.
+func (l *rateLimiter) set(rate, burst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+	if burst <= 0 {
+		burst = rate
+	}
+	l.rate = float64(max(rate, 0))
+	l.burst = float64(max(burst, 0))
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// reserve takes n tokens from the bucket, and returns how long to wait
+// until the tokens are available.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill()
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow takes a token if there is one without waiting, otherwise it returns
+// how long until the next token is available.
+func (l *rateLimiter) allow() (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0, true
+	}
+	l.refill()
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second)), false
+}
+
+// chunk returns the bytes of n which can be reserved at once, at most the burst.
+func (l *rateLimiter) chunk(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return n
+	}
+	return min(n, int(l.burst))
+}
+
+func (l *rateLimiter) refill() {
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// wait blocks until n bytes are allowed to be transferred,
+// a nil limiter never blocks.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		chunk := l.chunk(n)
+		n -= chunk
+		delay := l.reserve(chunk)
+		if delay <= 0 {
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// rateLimitRequests responds 429 with Retry-After to the requests exceeding the rate of the limiter,
+// or RESOURCE_EXHAUSTED for the gRPC tunnels.
+func rateLimitRequests(limiter *rateLimiter, grpc bool, rejected *atomic.Int64) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			retryAfter, ok := limiter.allow()
+			if ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			rejected.Add(1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			if grpc {
+				grpcError(w, codes.ResourceExhausted, "too many requests")
+				return
+			}
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package castle
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if l := newRateLimiter(0, 0); l != nil {
+		t.Fatal("expected no limiter without rate")
+	}
+
+	l := newRateLimiter(1000, 100)
+	if d := l.reserve(100); d != 0 {
+		t.Fatalf("expected the burst to pass without waiting, got %v", d)
+	}
+	if d := l.reserve(100); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatalf("expected to wait about 100ms, got %v", d)
+	}
+
+	l = newRateLimiter(10000, 1000)
+	start := time.Now()
+	if err := l.wait(context.Background(), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected to be slowed down, took %v", elapsed)
+	}
+}
@@ -0,0 +1,155 @@
+package castle
+
+import (
+	"context"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "google.golang.org/protobuf/proto"
+)
+
+type reconnectOptions struct {
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	// jitter is the fraction of the delay which is randomized, see WithReconnectJitter.
+	jitter float64
+	// random returns a number in [0, 1), see WithReconnectRand.
+	random func() float64
+}
+
+// delay returns how long to wait before the given attempt, attempt starts from 1.
+//
+// the backoff is randomly reduced by up to the jitter fraction of it,
+// so the clients dropped together don't retry in lockstep.
+func (r *reconnectOptions) delay(attempt int) time.Duration {
+	d := r.backoff(attempt)
+	if r.jitter <= 0 {
+		return d
+	}
+	random := r.random
+	if random == nil {
+		random = rand.Float64
+	}
+	return d - time.Duration(float64(d)*r.jitter*random())
+}
+
+// backoff doubles after each attempt, and it never exceeds the maxDelay,
+// a zero baseDelay retries right away.
+func (r *reconnectOptions) backoff(attempt int) time.Duration {
+	d := r.baseDelay
+	if d <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt; i++ {
+		// doubling would exceed the maxDelay, or overflow.
+		if d > r.maxDelay/2 {
+			return r.maxDelay
+		}
+		d *= 2
+	}
+	return min(d, r.maxDelay)
+}
+
+// sleepContext is the default SleepFunc, it waits d unless ctx is done before.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ReconnectHandler is called after each re-registration attempt,
+// err is nil if the attempt succeeded.
+type ReconnectHandler func(attempt int, err error)
+
+// pinTunnel returns a copy of the tunnel which requests exactly the entrypoint
+// assigned by the server at the first registration,
+// so the entrypoint stays the same after reconnecting.
+func pinTunnel(tunnel *proto.Tunnel, entrypoints []string) *proto.Tunnel {
+	pinned := pb.Clone(tunnel).(*proto.Tunnel)
+	if len(entrypoints) == 0 {
+		return pinned
+	}
+	u, err := url.Parse(entrypoints[0])
+	if err != nil {
+		return pinned
+	}
+	port, _ := strconv.Atoi(u.Port())
+
+	switch config := pinned.Config.(type) {
+	case *proto.Tunnel_Tcp:
+		if config.Tcp.RemotePort == 0 {
+			config.Tcp.RemotePort = int32(port)
+		}
+	case *proto.Tunnel_Udp:
+		if config.Udp.RemotePort == 0 {
+			config.Udp.RemotePort = int32(port)
+		}
+	case *proto.Tunnel_Http:
+		http := config.Http
+		switch {
+		case http.Domain != "" || http.Subdomain != "":
+		case http.RandomSubdomain:
+			if subdomain, _, ok := strings.Cut(u.Hostname(), "."); ok {
+				http.Subdomain = subdomain
+				http.RandomSubdomain = false
+			}
+		case http.RemotePort == 0:
+			http.RemotePort = int32(port)
+		}
+	}
+	return pinned
+}
+
+// RetryPolicy is how to retry the registration of StartTunnel on transient errors,
+// e.g. the server is not up yet.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of registration attempts including the first one,
+	// zero means retrying until the ctx is done.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, it doubles after each retry,
+	// it defaults to 1 second.
+	Backoff time.Duration
+	// MaxBackoff is the max delay between retries, it defaults to 30 seconds.
+	MaxBackoff time.Duration
+}
+
+// the defaults of RetryPolicy.
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	backoff := p.Backoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxDelay := p.MaxBackoff
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxBackoff
+	}
+	r := reconnectOptions{baseDelay: backoff, maxDelay: maxDelay}
+	return r.delay(retry)
+}
+
+// isTransient reports whether the registration may succeed by retrying after err.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,47 @@
+package castle
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forceHTTPS redirects the plaintext requests to https, except the paths under the excluded prefixes.
+//
+// The server of castled terminates the TLS, so the scheme of a request is of the entrypoint
+// which its host and port point to. If it's ambiguous, e.g. the port is omitted and the host has
+// both http and https entrypoints of the default ports, the request is plaintext unless
+// X-Forwarded-Proto tells https.
+func forceHTTPS(except []string, entrypoints *forwardedPort) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, port, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host, port = r.Host, ""
+			}
+			scheme, ok := entrypoints.exactScheme(host, port)
+			if !ok {
+				proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+				scheme = strings.ToLower(strings.TrimSpace(proto))
+			}
+			if scheme == "https" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, prefix := range except {
+				if underPath(r.URL.Path, prefix) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			http.Redirect(w, r, "https://"+entrypoints.httpsHost(host)+r.URL.RequestURI(), http.StatusPermanentRedirect)
+		})
+	}
+}
+
+// underPath reports whether the path is the prefix or under it,
+// e.g. /a/b is under /a, but /ab isn't.
+func underPath(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
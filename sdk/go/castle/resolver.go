@@ -0,0 +1,65 @@
+package castle
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"google.golang.org/grpc/codes"
+)
+
+// ConnMeta describes a connection of a tunnel to a local resolver, see WithLocalResolver.
+type ConnMeta struct {
+	ConnectionID string
+	// RemoteAddr is the address of the user, it's invalid if the server doesn't tell,
+	// and the port is 0 for the http tunnels.
+	RemoteAddr netip.AddrPort
+	// LocalAddr is the local address of the tunnel, the resolver may fall back to it.
+	LocalAddr string
+	// Host and Path are of the request, they're only set for the http tunnels.
+	Host string
+	Path string
+}
+
+// localResolver returns the local address which a connection is dialed to.
+type localResolver func(ctx context.Context, meta ConnMeta) (string, error)
+
+// resolve calls the resolver and checks the returned address.
+func (fn localResolver) resolve(ctx context.Context, meta ConnMeta) (string, error) {
+	addr, err := fn(ctx, meta)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the local address: %w", err)
+	}
+	if err := validateLocalAddr(addr); err != nil {
+		return "", fmt.Errorf("the local resolver returns an invalid address: %w", err)
+	}
+	return addr, nil
+}
+
+// handler resolves the local address of each request, the requests which fail
+// to resolve are answered with 503 and never reach any local server.
+func (fn localResolver) handler(next http.Handler, localAddr func() string, grpc bool, onReject func(*http.Request, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		meta := ConnMeta{
+			ConnectionID: connectionID(r.Context()),
+			LocalAddr:    localAddr(),
+			Host:         r.Host,
+			Path:         r.URL.Path,
+		}
+		if visitor, ok := r.Context().Value(visitorKey{}).(netip.Addr); ok {
+			meta.RemoteAddr = netip.AddrPortFrom(visitor, 0)
+		}
+		addr, err := fn.resolve(r.Context(), meta)
+		if err != nil {
+			onReject(r, err)
+			if grpc {
+				grpcError(w, codes.Unavailable, "no local server is resolved")
+				return
+			}
+			proxyError(w, r, http.StatusServiceUnavailable, "")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, addr)))
+	})
+}
@@ -0,0 +1,112 @@
+package castle
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// responseRewrite rewrites the responses of the local server, which refer to the local server itself,
+// to the public entrypoint, see WithHTTPRewriteRedirects and WithHTTPRewriteCookieDomain.
+type responseRewrite struct {
+	redirects bool
+	// scheme is the scheme of the public entrypoint if the request doesn't tell by X-Forwarded-Proto.
+	scheme string
+	// prefix is the path prefix stripped from the requests, it's added back to the redirects.
+	prefix string
+	// cookieDomains maps the lowercase domains of the cookies to the rewritten ones,
+	// empty means dropping the Domain attribute.
+	cookieDomains map[string]string
+}
+
+func (rw *responseRewrite) modifyResponse(resp *http.Response) error {
+	if rw.redirects {
+		if location := resp.Header.Get("Location"); location != "" {
+			if rewritten, ok := rw.rewriteLocation(location, resp.Request); ok {
+				resp.Header.Set("Location", rewritten)
+			}
+		}
+	}
+	if len(rw.cookieDomains) > 0 {
+		cookies := resp.Header.Values("Set-Cookie")
+		for i, cookie := range cookies {
+			cookies[i] = rw.rewriteCookie(cookie)
+		}
+	}
+	return nil
+}
+
+// rewriteLocation rewrites the absolute location to the local server, the relative locations
+// and the locations to the other hosts are kept as is.
+func (rw *responseRewrite) rewriteLocation(location string, r *http.Request) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+	if !isBackendHost(u, r.URL.Host) {
+		return "", false
+	}
+	u.Scheme = rw.scheme
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		u.Scheme = proto
+	}
+	u.Host = publicHost(r)
+	if rw.prefix != "" {
+		u.Path = rw.prefix + u.Path
+		if u.RawPath != "" {
+			u.RawPath = rw.prefix + u.RawPath
+		}
+	}
+	return u.String(), true
+}
+
+// isBackendHost reports whether the url refers to the backend, the loopback hosts
+// are the same if they have the same port.
+func isBackendHost(u *url.URL, backend string) bool {
+	if strings.EqualFold(u.Host, backend) {
+		return true
+	}
+	backendHost, backendPort, err := net.SplitHostPort(backend)
+	if err != nil || !isLoopbackHost(backendHost) || !isLoopbackHost(u.Hostname()) {
+		return false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return port == backendPort
+}
+
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.IsLoopback()
+}
+
+// rewriteCookie rewrites the Domain attribute of the Set-Cookie value, the other attributes are kept.
+func (rw *responseRewrite) rewriteCookie(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	kept := parts[:1]
+	for _, part := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if !strings.EqualFold(name, "Domain") {
+			kept = append(kept, part)
+			continue
+		}
+		to, ok := rw.cookieDomains[strings.ToLower(strings.TrimPrefix(value, "."))]
+		switch {
+		case !ok:
+			kept = append(kept, part)
+		case to != "":
+			kept = append(kept, " Domain="+to)
+		}
+	}
+	return strings.Join(kept, ";")
+}
@@ -0,0 +1,191 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
+type serveOptions struct {
+	clientOptions   []Option
+	logger          *slog.Logger
+	shutdownTimeout time.Duration
+	restart         bool
+	restartDelay    time.Duration
+	onReady         func([][]Entrypoint)
+}
+
+// ServeOption configures Serve.
+type ServeOption func(*serveOptions)
+
+// WithServeClientOptions sets the options of the client created by Serve.
+func WithServeClientOptions(options ...Option) ServeOption {
+	return func(opts *serveOptions) {
+		opts.clientOptions = append(opts.clientOptions, options...)
+	}
+}
+
+// WithServeLogger sets the logger which Serve logs the entrypoints and the restarts to,
+// it defaults to slog.Default. It's not the logger of the client, see WithLogger.
+func WithServeLogger(logger *slog.Logger) ServeOption {
+	return func(opts *serveOptions) {
+		opts.logger = logger
+	}
+}
+
+// WithServeShutdownTimeout sets how long to drain the connections after the signal,
+// it defaults to 10 seconds.
+func WithServeShutdownTimeout(timeout time.Duration) ServeOption {
+	return func(opts *serveOptions) {
+		opts.shutdownTimeout = timeout
+	}
+}
+
+// WithServeRestart starts the tunnel again after the delay if it quits unexpectedly,
+// it keeps retrying with the delay until the tunnel starts.
+// Without the option, Serve returns once any tunnel quits unexpectedly.
+func WithServeRestart(delay time.Duration) ServeOption {
+	return func(opts *serveOptions) {
+		opts.restart = true
+		opts.restartDelay = delay
+	}
+}
+
+// WithServeReady sets the callback which is called once all the tunnels are started,
+// entrypoints[i] is the entrypoints of tunnels[i].
+func WithServeReady(fn func(entrypoints [][]Entrypoint)) ServeOption {
+	return func(opts *serveOptions) {
+		opts.onReady = fn
+	}
+}
+
+// tunnelExit is the result of a started tunnel.
+type tunnelExit struct {
+	tunnel *Tunnel
+	err    error
+}
+
+// Serve connects to the server, starts all the tunnels and blocks until the ctx is done
+// or the process receives SIGINT or SIGTERM, then it closes the tunnels gracefully.
+//
+// The entrypoints of the tunnels are logged once they are started. Serve fails if any tunnel
+// fails to start. It also fails if any tunnel quits unexpectedly, unless WithServeRestart is used.
+// It returns nil once all the tunnels are closed, e.g. by Tunnel.Close.
+//
+// Serve is the shortcut of NewClient, Client.StartTunnels and Client.Shutdown for the most cases.
+func Serve(ctx context.Context, serverAddr string, tunnels []*Tunnel, options ...ServeOption) error {
+	opts := &serveOptions{
+		logger:          slog.Default(),
+		shutdownTimeout: defaultShutdownTimeout,
+	}
+	for _, option := range options {
+		option(opts)
+	}
+
+	var errs []error
+	for _, tunnel := range tunnels {
+		if err := tunnel.Validate(); err != nil {
+			errs = append(errs, &TunnelError{Name: tunnel.Name, Err: err})
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// loopCtx stops the restarts once Serve returns.
+	loopCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	client, err := NewClient(serverAddr, opts.clientOptions...)
+	if err != nil {
+		return err
+	}
+	shutdown := func() error {
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), opts.shutdownTimeout)
+		defer cancel()
+		return client.Shutdown(shutdownCtx)
+	}
+
+	exits := make(chan tunnelExit)
+	start := func(tunnel *Tunnel) ([]Entrypoint, error) {
+		// the tunnels outlive the signal, they are shut down gracefully.
+		entrypoints, quit, err := client.StartTunnel(context.WithoutCancel(ctx), tunnel)
+		if err != nil {
+			return nil, err
+		}
+		opts.logger.Info("tunnel started", slog.String("tunnel", tunnel.Name), slog.Any("entrypoints", entrypoints))
+		go func() {
+			exit := tunnelExit{tunnel: tunnel, err: <-quit}
+			select {
+			case exits <- exit:
+			case <-loopCtx.Done():
+			}
+		}()
+		return entrypoints, nil
+	}
+	restart := func(tunnel *Tunnel) {
+		for {
+			select {
+			case <-loopCtx.Done():
+				return
+			case <-time.After(opts.restartDelay):
+			}
+			_, err := start(tunnel)
+			if err == nil {
+				return
+			}
+			if errors.Is(err, ErrClientClosed) {
+				return
+			}
+			opts.logger.Warn("failed to restart tunnel", slog.String("tunnel", tunnel.Name), slog.Any("error", err))
+		}
+	}
+
+	entrypoints := make([][]Entrypoint, len(tunnels))
+	errs = make([]error, len(tunnels))
+	var wg sync.WaitGroup
+	for i, tunnel := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if entrypoints[i], errs[i] = start(tunnel); errs[i] != nil {
+				errs[i] = &TunnelError{Name: tunnel.Name, Err: errs[i]}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return errors.Join(err, shutdown())
+	}
+	if opts.onReady != nil {
+		opts.onReady(entrypoints)
+	}
+
+	for running := len(tunnels); running > 0; {
+		select {
+		case <-ctx.Done():
+			return shutdown()
+		case exit := <-exits:
+			if exit.err == nil {
+				running--
+				continue
+			}
+			err := &TunnelError{Name: exit.tunnel.Name, Err: exit.err}
+			if !opts.restart {
+				return errors.Join(err, shutdown())
+			}
+			opts.logger.Warn("tunnel quit, restarting", slog.String("tunnel", exit.tunnel.Name), slog.Any("error", exit.err))
+			go restart(exit.tunnel)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package castle
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// serverSchemes are the supported schemes of the server address, by whether it uses tls.
+var serverSchemes = map[string]bool{
+	"castle":  false,
+	"grpc":    false,
+	"castles": true,
+	"grpcs":   true,
+	"tls":     true,
+	"https":   true,
+}
+
+// parseServerAddr strips the scheme of addr, and reports whether the scheme indicates tls,
+// the bare host:port is plaintext.
+func parseServerAddr(addr string) (string, bool, error) {
+	scheme, hostport, ok := strings.Cut(addr, "://")
+	if !ok {
+		return addr, false, nil
+	}
+	useTLS, ok := serverSchemes[strings.ToLower(scheme)]
+	if !ok {
+		return "", false, fmt.Errorf("unsupported scheme %q of the server address, expected castle, castles, grpc or grpcs", scheme)
+	}
+	if hostport == "" || strings.Contains(hostport, "/") {
+		return "", false, fmt.Errorf("invalid server address %q, expected scheme://host:port", addr)
+	}
+	return hostport, useTLS, nil
+}
+
+// serverCredentials is the tls credentials of the control channel,
+// it remembers the last handshake error, which is hidden by grpc behind an Unavailable status.
+type serverCredentials struct {
+	credentials.TransportCredentials
+
+	mu      sync.Mutex
+	lastErr error
+}
+
+func newServerCredentials(config *tls.Config) *serverCredentials {
+	return &serverCredentials{
+		TransportCredentials: credentials.NewTLS(config),
+	}
+}
+
+func (c *serverCredentials) ClientHandshake(ctx context.Context, authority string, rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	conn, info, err := c.TransportCredentials.ClientHandshake(ctx, authority, rawConn)
+	c.setErr(err)
+	if err != nil {
+		return nil, nil, err
+	}
+	// in tls 1.3, the server verifies the client certificate after the client finishes the handshake,
+	// the rejection is an alert on the first read.
+	return &alertConn{Conn: conn, creds: c}, info, nil
+}
+
+func (c *serverCredentials) setErr(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+func (c *serverCredentials) Clone() credentials.TransportCredentials {
+	return &serverCredentials{
+		TransportCredentials: c.TransportCredentials.Clone(),
+	}
+}
+
+// handshakeErr returns the error of the last handshake, nil if it succeeded.
+func (c *serverCredentials) handshakeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastErr
+}
+
+// alertConn records the tls alert from the server as the handshake error.
+type alertConn struct {
+	net.Conn
+	creds *serverCredentials
+}
+
+func (c *alertConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		c.creds.setErr(err)
+	}
+	return n, err
+}
+
+// the tls alerts which mean the server rejects the client certificate.
+var clientCertAlerts = []tls.AlertError{
+	42,  // bad_certificate
+	43,  // unsupported_certificate
+	44,  // certificate_revoked
+	45,  // certificate_expired
+	46,  // certificate_unknown
+	48,  // unknown_ca
+	49,  // access_denied
+	116, // certificate_required
+}
+
+// newTLSError returns a TLSError of the handshake error err.
+func newTLSError(err error) *TLSError {
+	return &TLSError{
+		ClientCert: isClientCertAlert(err),
+		Err:        err,
+	}
+}
+
+// isClientCertAlert reports whether err is a tls alert from the server of rejecting the client certificate.
+func isClientCertAlert(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" || opErr.Err == nil {
+		return false
+	}
+	// crypto/tls doesn't export the type of the received alerts, but they have the same messages
+	// as tls.AlertError.
+	for _, alert := range clientCertAlerts {
+		if opErr.Err.Error() == alert.Error() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package castle
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// session is the running state of a started tunnel.
+type session struct {
+	// stopControl cancels the control stream, then the server stops sending new connections.
+	stopControl context.CancelFunc
+	// stopData cancels the data streams, all the connections are closed.
+	stopData context.CancelFunc
+	// client is the client which started the tunnel.
+	client *Client
+
+	closing atomic.Bool
+	// expired is set if the tunnel is closed by WithTTL or WithMaxRequests.
+	expired   atomic.Bool
+	closeOnce sync.Once
+	closeErr  error
+	// done is closed after the tunnel quits.
+	done chan struct{}
+}
+
+func newSession(ctx context.Context) (s *session, controlCtx, dataCtx context.Context) {
+	controlCtx, stopControl := context.WithCancel(ctx)
+	dataCtx, stopData := context.WithCancel(ctx)
+	return &session{
+		stopControl: stopControl,
+		stopData:    stopData,
+		done:        make(chan struct{}),
+	}, controlCtx, dataCtx
+}
+
+// Close deregisters the tunnel gracefully, it doesn't affect the other tunnels.
+//
+// The tunnel stops accepting new connections, and waits for the in-flight connections
+// to finish until the ctx is done, then the remaining connections are closed forcibly,
+// and ctx.Err() is returned in this case.
+// The quit channel of the tunnel receives nil after closing.
+//
+// Calling Close more than once, or on a tunnel which is not started, is a no-op.
+func (t *Tunnel) Close(ctx context.Context) error {
+	t.mu.Lock()
+	s := t.session
+	t.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	s.closeOnce.Do(func() {
+		s.closing.Store(true)
+		s.stopControl()
+		s.closeErr = t.status.conns.wait(ctx)
+		if t.http != nil {
+			t.http.close()
+		}
+		s.stopData()
+		<-s.done
+	})
+	return s.closeErr
+}
+
+// expire closes the tunnel of WithTTL or WithMaxRequests, the connections are closed once ctx is done.
+func (t *Tunnel) expire(ctx context.Context, logger *slog.Logger) {
+	t.mu.Lock()
+	s := t.session
+	t.mu.Unlock()
+	if s == nil || s.closing.Load() {
+		return
+	}
+	if s.expired.CompareAndSwap(false, true) {
+		logger.Info("tunnel expired")
+		go t.Close(ctx)
+	}
+}
+
+// takeRequest counts a new connection of WithMaxRequests, it reports whether the connection is accepted,
+// and whether it's the last one.
+func (t *Tunnel) takeRequest() (accepted, last bool) {
+	if t.maxRequests <= 0 {
+		return true, false
+	}
+	n := t.requests.Add(1)
+	return n <= t.maxRequests, n == t.maxRequests
+}
+
+// connTracker counts the active connections.
+type connTracker struct {
+	mu sync.Mutex
+	n  int
+	// idle is closed when there is no active connection.
+	idle chan struct{}
+}
+
+func (t *connTracker) add() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.n++
+}
+
+// tryAdd adds a connection unless there are max connections already.
+func (t *connTracker) tryAdd(max int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.n >= max {
+		return false
+	}
+	if t.n == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.n++
+	return true
+}
+
+func (t *connTracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 {
+		close(t.idle)
+	}
+}
+
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.n
+}
+
+// wait blocks until there is no active connection or the ctx is done.
+func (t *connTracker) wait(ctx context.Context) error {
+	t.mu.Lock()
+	if t.n == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
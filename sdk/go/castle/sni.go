@@ -0,0 +1,224 @@
+package castle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// sniPeekTimeout is how long to wait for the ClientHello of a connection of a tcp tunnel with
+// WithTCPSNIRouting, the connection goes to the local address without the server name after it.
+const sniPeekTimeout = 10 * time.Second
+
+// maxTLSRecordSize is the max length of a TLS plaintext record, a bigger one isn't a ClientHello.
+const maxTLSRecordSize = 16384
+
+// sniRoute routes the connections of the server name to the addr, the name may be a wildcard.
+type sniRoute struct {
+	name string
+	addr string
+}
+
+// sniRouter picks the local address of a connection of a tcp tunnel by the TLS server name.
+type sniRouter struct {
+	exact map[string]string
+	// wildcard is keyed by the domain of the wildcard without "*.".
+	wildcard map[string]string
+}
+
+func newSNIRouter(routes []sniRoute) (*sniRouter, error) {
+	r := &sniRouter{exact: map[string]string{}, wildcard: map[string]string{}}
+	for _, route := range routes {
+		if err := validateLocalAddr(route.addr); err != nil {
+			return nil, fmt.Errorf("invalid sni route of %q: %w", route.name, err)
+		}
+		name := strings.ToLower(strings.TrimSuffix(route.name, "."))
+		if strings.Contains(name, "*") {
+			if err := validateWildcardDomain(name); err != nil {
+				return nil, fmt.Errorf("invalid sni route: %w", err)
+			}
+			r.wildcard[strings.TrimPrefix(name, "*.")] = route.addr
+			continue
+		}
+		if name == "" || strings.ContainsAny(name, ":/ ") {
+			return nil, fmt.Errorf("invalid sni route: invalid server name %q", route.name)
+		}
+		r.exact[name] = route.addr
+	}
+	return r, nil
+}
+
+// route returns the address of the server name, the exact names take precedence over the wildcards,
+// and a wildcard only matches a single label.
+func (r *sniRouter) route(serverName string) (string, bool) {
+	if serverName == "" {
+		return "", false
+	}
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if addr, ok := r.exact[name]; ok {
+		return addr, true
+	}
+	if _, domain, ok := strings.Cut(name, "."); ok {
+		if addr, ok := r.wildcard[domain]; ok {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// peekServerName reads the ClientHello from the conn and returns its server name,
+// the bytes read are put back to the conn, so the local server still gets the whole handshake.
+//
+// It returns empty if the traffic isn't TLS, there is no server name, or the ClientHello
+// doesn't come within the timeout, e.g. the protocol where the server speaks first.
+func (c *streamConn) peekServerName(timeout time.Duration) string {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	var peeked []byte
+	defer func() {
+		c.unread(peeked)
+	}()
+
+	header := make([]byte, 5)
+	n, err := io.ReadFull(c, header)
+	peeked = header[:n]
+	// a handshake record.
+	if err != nil || header[0] != 0x16 {
+		return ""
+	}
+	length := int(binary.BigEndian.Uint16(header[3:]))
+	if length > maxTLSRecordSize {
+		return ""
+	}
+	record := make([]byte, length)
+	n, err = io.ReadFull(c, record)
+	peeked = append(peeked, record[:n]...)
+	if err != nil {
+		return ""
+	}
+	return parseServerName(record)
+}
+
+// unread puts the bytes back in front of the unread traffic.
+func (c *streamConn) unread(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	c.pending = append(append([]byte(nil), b...), c.pending...)
+}
+
+// parseServerName returns the host name of the server_name extension of the ClientHello in the
+// handshake record, see RFC 8446 section 4.1.2 and RFC 6066 section 3.
+// It returns empty if the ClientHello is malformed or spans multiple records.
+func parseServerName(record []byte) string {
+	s := tlsReader(record)
+	// a ClientHello.
+	if typ, ok := s.uint8(); !ok || typ != 0x01 {
+		return ""
+	}
+	body, ok := s.bytes(24)
+	if !ok {
+		return ""
+	}
+	s = tlsReader(body)
+	// the legacy version and the random.
+	if _, ok := s.skip(2 + 32); !ok {
+		return ""
+	}
+	// the legacy session id, the cipher suites and the legacy compression methods.
+	if _, ok := s.bytes(8); !ok {
+		return ""
+	}
+	if _, ok := s.bytes(16); !ok {
+		return ""
+	}
+	if _, ok := s.bytes(8); !ok {
+		return ""
+	}
+	extensions, ok := s.bytes(16)
+	if !ok {
+		return ""
+	}
+	s = tlsReader(extensions)
+	for len(s) > 0 {
+		typ, ok := s.uint16()
+		if !ok {
+			return ""
+		}
+		data, ok := s.bytes(16)
+		if !ok {
+			return ""
+		}
+		if typ != 0x0000 {
+			continue
+		}
+		ext := tlsReader(data)
+		names, ok := ext.bytes(16)
+		if !ok {
+			return ""
+		}
+		ext = tlsReader(names)
+		for len(ext) > 0 {
+			nameType, ok := ext.uint8()
+			if !ok {
+				return ""
+			}
+			name, ok := ext.bytes(16)
+			if !ok {
+				return ""
+			}
+			// host_name.
+			if nameType == 0 {
+				return string(name)
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// tlsReader reads the vectors of the TLS presentation language.
+type tlsReader []byte
+
+func (s *tlsReader) skip(n int) ([]byte, bool) {
+	if len(*s) < n {
+		return nil, false
+	}
+	b := (*s)[:n]
+	*s = (*s)[n:]
+	return b, true
+}
+
+func (s *tlsReader) uint8() (uint8, bool) {
+	b, ok := s.skip(1)
+	if !ok {
+		return 0, false
+	}
+	return b[0], true
+}
+
+func (s *tlsReader) uint16() (uint16, bool) {
+	b, ok := s.skip(2)
+	if !ok {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(b), true
+}
+
+// bytes reads a vector prefixed by its length of the bits, 8, 16 or 24.
+func (s *tlsReader) bytes(bits int) ([]byte, bool) {
+	prefix, ok := s.skip(bits / 8)
+	if !ok {
+		return nil, false
+	}
+	var n int
+	for _, b := range prefix {
+		n = n<<8 | int(b)
+	}
+	return s.skip(n)
+}
@@ -0,0 +1,181 @@
+package castle
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// defaultIndexFiles are the index files of the directories without WithStaticIndexFiles.
+var defaultIndexFiles = []string{"index.html"}
+
+// staticHandler serves the files of the directory of NewStaticTunnel.
+type staticHandler struct {
+	root http.Dir
+	// listing lists the directories without index files, see WithStaticDirectoryListing.
+	listing bool
+	index   []string
+	// fallback is the file of WithStaticSPAFallback, empty without it.
+	fallback string
+}
+
+func newStaticHandler(opts *httpOptions) *staticHandler {
+	index := opts.staticIndex
+	if index == nil {
+		index = defaultIndexFiles
+	}
+	h := &staticHandler{
+		root:    http.Dir(opts.staticRoot),
+		listing: opts.staticListing,
+		index:   index,
+	}
+	if opts.staticFallback != "" {
+		h.fallback = path.Clean("/" + opts.staticFallback)
+	}
+	return h
+}
+
+// validateStatic checks the root directory and the options of NewStaticTunnel.
+func validateStatic(opts *httpOptions) error {
+	var err error
+	if info, statErr := os.Stat(opts.staticRoot); statErr != nil {
+		err = fmt.Errorf("invalid static root: %w", statErr)
+	} else if !info.IsDir() {
+		err = fmt.Errorf("invalid static root %q: not a directory", opts.staticRoot)
+	}
+	for _, name := range opts.staticIndex {
+		if name == "" || strings.Contains(name, "/") {
+			err = errors.Join(err, fmt.Errorf("invalid index file %q, it should be a file name", name))
+		}
+	}
+	if len(opts.upstreams) > 0 || len(opts.weights) > 0 || opts.healthCheck != nil || opts.localScheme != "" || opts.localTLS != nil {
+		err = errors.Join(err, errors.New("the static tunnel has no local server, the upstreams and the local tls can't be used"))
+	}
+	return err
+}
+
+func (h *staticHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		proxyError(w, r, http.StatusMethodNotAllowed, "")
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	f, err := h.root.Open(name)
+	if errors.Is(err, fs.ErrNotExist) && h.fallback != "" && path.Ext(name) == "" {
+		// the routes of the single-page apps are resolved by the index, the missing assets are still 404.
+		name = h.fallback
+		f, err = h.root.Open(name)
+	}
+	if err != nil {
+		h.error(w, r, err)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		h.error(w, r, err)
+		return
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			localRedirect(w, r, path.Base(name)+"/")
+			return
+		}
+		for _, index := range h.index {
+			if h.serveFile(w, r, path.Join(name, index)) {
+				return
+			}
+		}
+		if !h.listing {
+			proxyError(w, r, http.StatusForbidden, "")
+			return
+		}
+		h.list(w, r, f)
+		return
+	}
+	// a trailing slash of a file is redirected away like http.FileServer does.
+	if strings.HasSuffix(r.URL.Path, "/") && name != "/" {
+		localRedirect(w, r, "../"+path.Base(name))
+		return
+	}
+	// the content type is told by the extension, or sniffed from the content.
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// serveFile serves the file of the name if it's a regular file, it reports whether it's served.
+func (h *staticHandler) serveFile(w http.ResponseWriter, r *http.Request, name string) bool {
+	f, err := h.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return true
+}
+
+// list responds the entries of the directory, the directories first, both sorted by name.
+func (h *staticHandler) list(w http.ResponseWriter, r *http.Request, dir http.File) {
+	entries, err := dir.Readdir(-1)
+	if err != nil {
+		h.error(w, r, err)
+		return
+	}
+	slices.SortFunc(entries, func(a, b fs.FileInfo) int {
+		if a.IsDir() != b.IsDir() {
+			if a.IsDir() {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name(), b.Name())
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("<!doctype html>\n<meta name=\"viewport\" content=\"width=device-width\">\n<pre>\n")
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := url.URL{Path: name}
+		fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(href.String()), html.EscapeString(name))
+	}
+	b.WriteString("</pre>\n")
+	w.Write([]byte(b.String()))
+}
+
+func (h *staticHandler) error(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		proxyError(w, r, http.StatusNotFound, "")
+	case errors.Is(err, fs.ErrPermission):
+		proxyError(w, r, http.StatusForbidden, "")
+	default:
+		proxyError(w, r, http.StatusInternalServerError, "")
+	}
+}
+
+// localRedirect redirects to the target relative to the request path, so it works behind WithHTTPStripPrefix.
+func localRedirect(w http.ResponseWriter, r *http.Request, target string) {
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
@@ -0,0 +1,423 @@
+package castle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State is the state of the tunnel.
+type State int
+
+const (
+	// StateIdle means the tunnel hasn't been started.
+	StateIdle State = iota
+	// StateConnecting means the tunnel is registering to the server.
+	StateConnecting
+	// StateConnected means the tunnel is registered and serving the connections.
+	StateConnected
+	// StateReconnecting means the control stream is broken and the tunnel is registering again.
+	StateReconnecting
+	// StateClosed means the tunnel has quit.
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// QuitReason is why a tunnel quits.
+type QuitReason int
+
+const (
+	// QuitNormal means the tunnel is closed by Tunnel.Close or Client.Shutdown.
+	QuitNormal QuitReason = iota
+	// QuitContextCanceled means the ctx of StartTunnel is done.
+	QuitContextCanceled
+	// QuitServerClosed means the server ended the control stream or the connection is lost,
+	// the error of the quit channel matches ErrServerClosed.
+	QuitServerClosed
+	// QuitFatalError means the tunnel failed for any other error, e.g. the registration is rejected.
+	QuitFatalError
+	// QuitExpired means the tunnel reached WithTTL or WithMaxRequests, the quit channel receives nil.
+	QuitExpired
+)
+
+func (r QuitReason) String() string {
+	switch r {
+	case QuitNormal:
+		return "normal"
+	case QuitContextCanceled:
+		return "context_canceled"
+	case QuitServerClosed:
+		return "server_closed"
+	case QuitFatalError:
+		return "fatal_error"
+	case QuitExpired:
+		return "expired"
+	default:
+		return "unknown"
+	}
+}
+
+// quitReason returns the reason of the tunnel which quits with err by itself.
+func quitReason(err error) QuitReason {
+	switch {
+	case err == nil:
+		return QuitNormal
+	case errors.Is(err, ErrServerClosed):
+		return QuitServerClosed
+	default:
+		return QuitFatalError
+	}
+}
+
+// TunnelStatus is the status of a tunnel at the moment of calling Tunnel.Status.
+type TunnelStatus struct {
+	State State
+	// ActiveConns is the number of connections which are being proxied.
+	ActiveConns int
+	// TotalConns is the number of connections accepted since the tunnel started.
+	TotalConns int
+	// RejectedConns is the number of connections rejected by the client,
+	// including the UDP sessions dropped by WithUdpMaxSessions.
+	RejectedConns int
+	// LastError is the last error which broke the tunnel, it's kept after reconnecting.
+	LastError error
+	// QuitReason is why the tunnel quit, it's only meaningful if State is StateClosed.
+	// The quit channel receives nil for QuitNormal and QuitContextCanceled.
+	QuitReason QuitReason
+	// ConnectedSince is the time when the tunnel was registered or re-registered last time.
+	ConnectedSince time.Time
+	// BytesIn is the total bytes from the users, BytesOut is the total bytes to the users,
+	// including the connections which are being proxied.
+	BytesIn  int64
+	BytesOut int64
+	// Reconnects is the number of times the tunnel re-registered successfully.
+	Reconnects int
+	// RegisterErrors is the number of failed registrations, including the failed reconnect attempts.
+	RegisterErrors int
+	// Upstreams is the health of the upstreams of a http tunnel,
+	// it's empty unless WithHTTPUpstreams or WithHTTPHealthCheck is used.
+	Upstreams []UpstreamStatus
+	// RejectedRequests is the number of the http requests rejected by the client,
+	// e.g. the request body exceeds WithHTTPMaxRequestBody.
+	RejectedRequests int
+	// MirroredRequests is the number of the requests copied to the mirror of WithHTTPMirror,
+	// MirrorErrors is the number of them failed to be sent, the responses of the mirror aren't checked.
+	MirroredRequests int
+	MirrorErrors     int
+	// Breaker is the state of the circuit breaker of a http tunnel,
+	// it's always closed unless WithHTTPCircuitBreaker is used.
+	Breaker BreakerState
+	// DroppedDatagrams is the number of the datagrams of an udp tunnel which exceed WithUdpMaxDatagramSize.
+	DroppedDatagrams int
+	// WireBytesIn and WireBytesOut are BytesIn and BytesOut as sent on the data streams,
+	// they are smaller with WithDataCompression.
+	WireBytesIn  int64
+	WireBytesOut int64
+	// DataCompression is the compression of WithDataCompression accepted by the server when the tunnel
+	// was registered, it's empty if the traffic isn't compressed.
+	DataCompression string
+	// HostHeader is the Host mode of WithHTTPHostHeader of a http tunnel, "preserve" by default,
+	// it's empty for the other tunnels.
+	HostHeader string
+}
+
+// tunnelStatus is the live status of a tunnel, it's safe for concurrent use.
+type tunnelStatus struct {
+	mu    sync.RWMutex
+	state State
+	// stateChanged is closed and renewed once the state changes, nil before any change.
+	stateChanged   chan struct{}
+	lastErr        error
+	connectedSince time.Time
+	entrypoints    []string
+	region         string
+	tags           map[string]string
+	compression    string
+	// tunnelID is the id assigned by the server when the tunnel was registered last time.
+	tunnelID string
+	// tlsUpdates is true if the server accepts Tunnel.UpdateTLS.
+	tlsUpdates bool
+	// unconfirmed are the warnings of the metadata which the server doesn't confirm, see unconfirmedMetadata.
+	unconfirmed []error
+	quitReason  QuitReason
+
+	conns         connTracker
+	totalConns    atomic.Int64
+	rejectedConns atomic.Int64
+	// droppedDatagrams is of TunnelStatus.DroppedDatagrams.
+	droppedDatagrams atomic.Int64
+	connErrors       atomic.Int64
+	bytesIn          atomic.Int64
+	bytesOut         atomic.Int64
+	wireBytesIn      atomic.Int64
+	wireBytesOut     atomic.Int64
+	reconnects       atomic.Int64
+	registerErrors   atomic.Int64
+
+	activeMu sync.Mutex
+	// active are the connections which are being proxied, by connection id.
+	active map[string]*streamConn
+}
+
+// ConnStats is the transfer stats of a connection which is being proxied.
+type ConnStats struct {
+	// Tunnel is the name of the tunnel.
+	Tunnel       string
+	ConnectionID string
+	// RemoteAddr is the address of the user, it's invalid if the server doesn't tell.
+	RemoteAddr netip.AddrPort
+	// BytesIn is the bytes from the user, BytesOut is the bytes to the user.
+	BytesIn  int64
+	BytesOut int64
+	// Opened is the time when the connection was opened, Duration is how long it has been open.
+	Opened   time.Time
+	Duration time.Duration
+}
+
+func (s *tunnelStatus) addActive(conn *streamConn) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	if s.active == nil {
+		s.active = make(map[string]*streamConn)
+	}
+	s.active[conn.connectionID] = conn
+}
+
+func (s *tunnelStatus) removeActive(conn *streamConn) {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	delete(s.active, conn.connectionID)
+}
+
+// activeConns returns the stats of the active connections.
+func (s *tunnelStatus) activeConns(tunnel string) []ConnStats {
+	s.activeMu.Lock()
+	defer s.activeMu.Unlock()
+	now := time.Now()
+	stats := make([]ConnStats, 0, len(s.active))
+	for _, conn := range s.active {
+		stats = append(stats, ConnStats{
+			Tunnel:       tunnel,
+			ConnectionID: conn.connectionID,
+			RemoteAddr:   conn.visitorAddr(),
+			BytesIn:      conn.bytesIn.Load(),
+			BytesOut:     conn.bytesOut.Load(),
+			Opened:       conn.opened,
+			Duration:     now.Sub(conn.opened),
+		})
+	}
+	return stats
+}
+
+func (s *tunnelStatus) setState(state State, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = state
+	if s.stateChanged != nil {
+		close(s.stateChanged)
+		s.stateChanged = nil
+	}
+	if err != nil {
+		s.lastErr = err
+	}
+	if state == StateConnected {
+		s.connectedSince = time.Now()
+	}
+}
+
+func (s *tunnelStatus) setQuitReason(reason QuitReason) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quitReason = reason
+}
+
+func (s *tunnelStatus) setEntrypoints(entrypoints []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entrypoints = entrypoints
+}
+
+func (s *tunnelStatus) registeredEntrypoints() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]string(nil), s.entrypoints...)
+}
+
+func (s *tunnelStatus) setRegion(region string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.region = region
+}
+
+func (s *tunnelStatus) registeredRegion() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.region
+}
+
+func (s *tunnelStatus) setDataCompression(algo string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compression = algo
+}
+
+func (s *tunnelStatus) setTunnelID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnelID = id
+}
+
+func (s *tunnelStatus) setTLSUpdates(accepted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tlsUpdates = accepted
+}
+
+func (s *tunnelStatus) setUnconfirmed(warnings []error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unconfirmed = warnings
+}
+
+func (s *tunnelStatus) unconfirmedWarnings() []error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.unconfirmed
+}
+
+// tlsUpdate returns the registered tunnel id, and whether the server accepts Tunnel.UpdateTLS.
+func (s *tunnelStatus) tlsUpdate() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.tunnelID, s.tlsUpdates
+}
+
+func (s *tunnelStatus) dataCompression() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.compression
+}
+
+func (s *tunnelStatus) setTags(tags map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tags = tags
+}
+
+func (s *tunnelStatus) acceptedTags() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.tags == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(s.tags))
+	for key, value := range s.tags {
+		tags[key] = value
+	}
+	return tags
+}
+
+func (s *tunnelStatus) snapshot() TunnelStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return TunnelStatus{
+		State:            s.state,
+		ActiveConns:      s.conns.count(),
+		TotalConns:       int(s.totalConns.Load()),
+		RejectedConns:    int(s.rejectedConns.Load()),
+		DroppedDatagrams: int(s.droppedDatagrams.Load()),
+		BytesIn:          s.bytesIn.Load(),
+		BytesOut:         s.bytesOut.Load(),
+		WireBytesIn:      s.wireBytesIn.Load(),
+		WireBytesOut:     s.wireBytesOut.Load(),
+		DataCompression:  s.compression,
+		Reconnects:       int(s.reconnects.Load()),
+		RegisterErrors:   int(s.registerErrors.Load()),
+		LastError:        s.lastErr,
+		QuitReason:       s.quitReason,
+		ConnectedSince:   s.connectedSince,
+	}
+}
+
+// waitState returns the current state, the error if the tunnel quits for it,
+// and the channel which is closed once the state changes.
+func (s *tunnelStatus) waitState() (State, error, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stateChanged == nil {
+		s.stateChanged = make(chan struct{})
+	}
+	var err error
+	if s.state == StateClosed && (s.quitReason == QuitServerClosed || s.quitReason == QuitFatalError) {
+		err = s.lastErr
+	}
+	return s.state, err, s.stateChanged
+}
+
+// WaitReady blocks until the tunnel is registered, it returns at once if the tunnel is connected already.
+// The server of castled assigns the entrypoints after it starts listening on them, so the entrypoints
+// are reachable once it returns. It waits while the tunnel isn't started yet or it's reconnecting,
+// and it returns the error of the tunnel if the tunnel quits, or the error of the ctx once it's done.
+func (t *Tunnel) WaitReady(ctx context.Context) error {
+	for {
+		state, err, changed := t.status.waitState()
+		switch state {
+		case StateConnected:
+			return nil
+		case StateClosed:
+			if err != nil {
+				return fmt.Errorf("tunnel is closed: %w", err)
+			}
+			return errors.New("tunnel is closed")
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Status returns the current status of the tunnel, it's safe to call concurrently.
+func (t *Tunnel) Status() TunnelStatus {
+	status := t.status.snapshot()
+	if t.GetHttp() != nil {
+		status.HostHeader = HostHeaderPreserve
+	}
+	if t.http != nil {
+		status.HostHeader = t.http.hostHeader.String()
+		status.Upstreams = t.http.upstreamStatus()
+		status.RejectedRequests = int(t.http.rejected.Load())
+		if t.http.mirror != nil {
+			status.MirroredRequests = int(t.http.mirror.mirrored.Load())
+			status.MirrorErrors = int(t.http.mirror.failed.Load())
+		}
+		if t.http.breaker != nil {
+			status.Breaker = t.http.breaker.current()
+		}
+	}
+	if t.balancer != nil {
+		status.Upstreams = t.balancer.status()
+	}
+	return status
+}
@@ -0,0 +1,79 @@
+package castle
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// The limits of WithMetadata, the larger metadata makes StartTunnel fail.
+const (
+	maxTags        = 32
+	maxTagKeyLen   = 64
+	maxTagValueLen = 256
+	maxTagsSize    = 4096
+)
+
+// validateTags checks the metadata of WithMetadata, the keys are like the tunnel names,
+// and the values are printable ASCII, as the values of the grpc metadata.
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTags {
+		return fmt.Errorf("the metadata has %d keys, more than the limit %d", len(tags), maxTags)
+	}
+	size := 0
+	for key, value := range tags {
+		if key == "" || len(key) > maxTagKeyLen {
+			return fmt.Errorf("the metadata key %q should be 1 to %d characters", key, maxTagKeyLen)
+		}
+		for _, r := range key {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return fmt.Errorf("the metadata key %q has invalid character %q", key, r)
+			}
+		}
+		if len(value) > maxTagValueLen {
+			return fmt.Errorf("the metadata value of %q is %d bytes, larger than the limit %d", key, len(value), maxTagValueLen)
+		}
+		for _, r := range value {
+			if r < 0x20 || r > 0x7e {
+				return fmt.Errorf("the metadata value of %q has invalid character %q", key, r)
+			}
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxTagsSize {
+		return fmt.Errorf("the metadata is %d bytes, larger than the limit %d", size, maxTagsSize)
+	}
+	return nil
+}
+
+// encodeTags returns the tags as the values of metadataTag, key=value in the order of the keys.
+func encodeTags(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	values := make([]string, 0, len(tags))
+	for _, key := range keys {
+		values = append(values, key+"="+tags[key])
+	}
+	return values
+}
+
+// decodeTags returns the tags echoed by the server in the header,
+// it returns nil if the server doesn't echo any.
+func decodeTags(md metadata.MD) map[string]string {
+	values := md.Get(metadataTag)
+	if len(values) == 0 {
+		return nil
+	}
+	tags := make(map[string]string, len(values))
+	for _, value := range values {
+		if key, value, ok := strings.Cut(value, "="); ok {
+			tags[key] = value
+		}
+	}
+	return tags
+}
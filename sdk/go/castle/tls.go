@@ -0,0 +1,198 @@
+package castle
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+// tunnelCert is the certificate which the server uses to terminate the TLS of a http tunnel.
+type tunnelCert struct {
+	certPEM []byte
+	keyPEM  []byte
+	leaf    *x509.Certificate
+}
+
+func newTunnelCert(certPEM, keyPEM []byte) (*tunnelCert, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid tls certificate: %w", err)
+	}
+	return &tunnelCert{
+		certPEM: certPEM,
+		keyPEM:  keyPEM,
+		leaf:    leaf,
+	}, nil
+}
+
+func loadTunnelCert(certPath, keyPath string) (*tunnelCert, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tls key: %w", err)
+	}
+	return newTunnelCert(certPEM, keyPEM)
+}
+
+func (c *tunnelCert) verify(host string) error {
+	// a wildcard certificate matches any name of the leftmost label.
+	name := strings.Replace(host, "*", "wildcard", 1)
+	if err := c.leaf.VerifyHostname(name); err != nil {
+		return fmt.Errorf("tls certificate doesn't match the domain %s: %w", host, err)
+	}
+	return nil
+}
+
+// verifyEntrypoints checks the certificate matches the entrypoints assigned by the server.
+func (c *tunnelCert) verifyEntrypoints(entrypoints []string) error {
+	for _, entrypoint := range entrypoints {
+		u, err := url.Parse(entrypoint)
+		if err != nil {
+			return fmt.Errorf("invalid entrypoint %q: %w", entrypoint, err)
+		}
+		if err := c.verify(u.Hostname()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyEntrypoint checks the certificate of the tunnel matches the entrypoints assigned by the server.
+func (t *Tunnel) verifyEntrypoint(entrypoints []string) error {
+	t.mu.Lock()
+	cert := t.cert
+	t.mu.Unlock()
+	if cert == nil {
+		return nil
+	}
+	return cert.verifyEntrypoints(entrypoints)
+}
+
+// tlsUpdatePrefix is the connection id of the data stream which pushes the certificate of a running tunnel
+// by Tunnel.UpdateTLS, it's followed by the tunnel id, the certificate and key are in metadataTLSCert and
+// metadataTLSKey of the stream. The server ends the stream once the new handshakes use the certificate,
+// or fails it with the reason if it refuses the certificate.
+const tlsUpdatePrefix = "castle-tls-update/"
+
+// tlsUpdateTimeout is how long Tunnel.UpdateTLS waits for the server.
+const tlsUpdateTimeout = 10 * time.Second
+
+// UpdateTLS replaces the certificate of WithHTTPTLS without re-registering the tunnel, e.g. it's renewed
+// by ACME. The server swaps it atomically, so the new handshakes use the new certificate and the existing
+// connections keep going, and the tunnel is re-registered with it after reconnecting.
+//
+// It fails and keeps the old certificate if the new one is invalid, it doesn't match the domain or
+// the entrypoints of the tunnel, or the server refuses it, including the servers which don't support it.
+// Like StartTunnel, it fails if the client doesn't connect to the server over TLS.
+// If the tunnel isn't connected, e.g. it's reconnecting, the certificate is only used by the next registration.
+func (t *Tunnel) UpdateTLS(certPEM, keyPEM []byte) error {
+	t.mu.Lock()
+	hasCert, s := t.cert != nil, t.session
+	t.mu.Unlock()
+	if !hasCert {
+		return errors.New("the tunnel isn't created with the tls certificate")
+	}
+	if s != nil {
+		if err := s.client.checkTLSKey(t); err != nil {
+			return err
+		}
+	}
+	cert, err := newTunnelCert(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if domain := t.GetHttp().Domain; domain != "" {
+		if err := cert.verify(domain); err != nil {
+			return err
+		}
+	}
+	if err := cert.verifyEntrypoints(t.status.registeredEntrypoints()); err != nil {
+		return err
+	}
+
+	if s != nil && t.status.snapshot().State == StateConnected {
+		if err := s.client.pushTLS(t, cert); err != nil {
+			return err
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cert = cert
+	md := t.md.Copy()
+	md.Set(metadataTLSCert, string(cert.certPEM))
+	md.Set(metadataTLSKey, string(cert.keyPEM))
+	t.md = md
+	return nil
+}
+
+// errPlaintextTLSKey is returned if the private key of WithHTTPTLS would be sent over the plaintext connection.
+var errPlaintextTLSKey = errors.New("the private key of WithHTTPTLS can't be sent to the server over the plaintext connection, " +
+	"connect to the server over tls by WithServerTLS or the castles:// address")
+
+// checkTLSKey fails if the tunnel has the certificate of WithHTTPTLS but the client doesn't connect
+// to the server over tls, since the private key is sent along with the registration.
+func (c *Client) checkTLSKey(tunnel *Tunnel) error {
+	tunnel.mu.Lock()
+	hasCert := tunnel.cert != nil
+	tunnel.mu.Unlock()
+	if hasCert && c.serverTLS == nil {
+		return errPlaintextTLSKey
+	}
+	return nil
+}
+
+// registerMetadata returns the metadata sent along with the registration.
+func (t *Tunnel) registerMetadata() metadata.MD {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.md
+}
+
+// pushTLS sends the certificate of the tunnel to the server, see tlsUpdatePrefix.
+func (c *Client) pushTLS(tunnel *Tunnel, cert *tunnelCert) error {
+	tunnelID, accepted := tunnel.status.tlsUpdate()
+	if !accepted {
+		return errors.New("the server doesn't support updating the tls certificate of a running tunnel")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), tlsUpdateTimeout)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, metadataTLSCert, string(cert.certPEM), metadataTLSKey, string(cert.keyPEM))
+	stream, err := c.grpcClient.Data(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create data stream: %w", err)
+	}
+	if err := stream.Send(&proto.TrafficToServer{
+		ConnectionId: tlsUpdatePrefix + tunnelID,
+		Action:       proto.TrafficToServer_Start,
+	}); err != nil {
+		return fmt.Errorf("failed to push the tls certificate: %w", err)
+	}
+	stream.CloseSend()
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if errors.Is(err, io.EOF) {
+				c.tunnelLogger(tunnel).Info("tls certificate is updated", slog.Time("not_after", cert.leaf.NotAfter))
+				return nil
+			}
+			return fmt.Errorf("the server refused the tls certificate: %w", err)
+		}
+	}
+}
@@ -0,0 +1,487 @@
+package castle
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// selfSignedCert generates a PEM encoded certificate and key for the given domains.
+func selfSignedCert(t *testing.T, domains ...string) ([]byte, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domains[0]},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+// newTLSFakeServer starts the fake server over tls, the option makes the client trust it.
+func newTLSFakeServer(t *testing.T) (*fakeServer, Option) {
+	t.Helper()
+
+	certPEM, keyPEM := selfSignedCert(t, "castled.test")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	server := newFakeServer(t, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	return server, WithServerTLS(&tls.Config{RootCAs: roots, ServerName: "castled.test"})
+}
+
+func TestHTTPTunnelTLS(t *testing.T) {
+	certPEM, keyPEM := selfSignedCert(t, "*.example.com")
+
+	server, serverTLS := newTLSFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		entrypoint := "https://foo.example.com"
+		if req.Tunnel.Name == "mismatch" {
+			entrypoint = "https://foo.example.org"
+		}
+		if err := sendInit(stream, entrypoint); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr, serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel := NewHTTPTunnel("match", "127.0.0.1:0", WithHTTPSubDomain("foo"), WithHTTPTLS(certPEM, keyPEM))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	md := server.md[0]
+	if got := md.Get(metadataTLSCert); len(got) != 1 || !bytes.Equal([]byte(got[0]), certPEM) {
+		t.Fatalf("unexpected certificate metadata: %v", got)
+	}
+	if got := md.Get(metadataTLSKey); len(got) != 1 || !bytes.Equal([]byte(got[0]), keyPEM) {
+		t.Fatalf("unexpected key metadata: %v", got)
+	}
+
+	tunnel = NewHTTPTunnel("mismatch", "127.0.0.1:0", WithHTTPSubDomain("foo"), WithHTTPTLS(certPEM, keyPEM))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err == nil {
+		t.Fatal("expected the mismatched certificate to fail the tunnel")
+	}
+	if state := tunnel.Status().State; state != StateClosed {
+		t.Fatalf("expected closed state, got %v", state)
+	}
+
+	// the domain is verified before registering.
+	tunnel = NewHTTPTunnel("domain", "127.0.0.1:0", WithHTTPDomain("example.org"), WithHTTPTLS(certPEM, keyPEM))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err == nil {
+		t.Fatal("expected the mismatched domain to fail the tunnel")
+	}
+	if n := len(server.registrations()); n != 2 {
+		t.Fatalf("expected 2 registrations, got %d", n)
+	}
+
+	tunnel = NewHTTPTunnel("invalid", "127.0.0.1:0", WithHTTPTLS(certPEM, []byte("invalid")))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err == nil {
+		t.Fatal("expected the invalid key to fail the tunnel")
+	}
+}
+
+func TestHTTPTunnelTLSPlaintext(t *testing.T) {
+	certPEM, keyPEM := selfSignedCert(t, "*.example.com")
+
+	server := newFakeServer(t)
+	client, err := NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the private key never goes over the plaintext connection.
+	tunnel := NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPSubDomain("foo"), WithHTTPTLS(certPEM, keyPEM))
+	if _, _, err := client.StartTunnel(ctx, tunnel); !errors.Is(err, errPlaintextTLSKey) {
+		t.Fatalf("expected the plaintext connection to be refused, got %v", err)
+	}
+	if n := len(server.registrations()); n != 0 {
+		t.Fatalf("expected no registration, got %d", n)
+	}
+
+	// the tunnel without the certificate is running, but it can't be updated either.
+	tunnel = NewHTTPTunnel("plain", "127.0.0.1:0", WithHTTPSubDomain("foo"))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	tunnel.cert, _ = newTunnelCert(certPEM, keyPEM)
+	if err := tunnel.UpdateTLS(certPEM, keyPEM); !errors.Is(err, errPlaintextTLSKey) {
+		t.Fatalf("expected the update over the plaintext connection to be refused, got %v", err)
+	}
+}
+
+func TestHTTPTunnelUpdateTLS(t *testing.T) {
+	certPEM, keyPEM := selfSignedCert(t, "*.example.com")
+	renewedPEM, renewedKeyPEM := selfSignedCert(t, "*.example.com")
+	otherPEM, otherKeyPEM := selfSignedCert(t, "*.example.org")
+
+	server, serverTLS := newTLSFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		// the second tunnel is registered by a server which doesn't accept the updates.
+		if n == 0 {
+			if err := stream.SendHeader(metadata.Pairs(metadataTLSUpdates, "true")); err != nil {
+				return err
+			}
+		}
+		if err := sendInit(stream, "https://foo.example.com"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	client, err := NewClient(server.addr, serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel := NewHTTPTunnel("test", "127.0.0.1:0", WithHTTPSubDomain("foo"), WithHTTPTLS(certPEM, keyPEM))
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if err := tunnel.UpdateTLS(otherPEM, otherKeyPEM); err == nil {
+		t.Fatal("expected the certificate of another domain to fail")
+	}
+	if err := tunnel.UpdateTLS(renewedPEM, keyPEM); err == nil {
+		t.Fatal("expected the mismatched key to fail")
+	}
+	if err := tunnel.UpdateTLS(renewedPEM, renewedKeyPEM); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	certs := server.certs
+	server.mu.Unlock()
+	if len(certs) != 1 || certs[0] != string(renewedPEM) {
+		t.Fatalf("expected only the renewed certificate to be pushed, got %d", len(certs))
+	}
+	// the tunnel is re-registered with the renewed certificate.
+	if got := tunnel.registerMetadata().Get(metadataTLSCert); len(got) != 1 || got[0] != string(renewedPEM) {
+		t.Fatal("expected the renewed certificate in the registration")
+	}
+
+	unsupported := NewHTTPTunnel("unsupported", "127.0.0.1:0", WithHTTPSubDomain("foo"), WithHTTPTLS(certPEM, keyPEM))
+	if _, _, err := client.StartTunnel(ctx, unsupported); err != nil {
+		t.Fatal(err)
+	}
+	if err := unsupported.UpdateTLS(renewedPEM, renewedKeyPEM); err == nil {
+		t.Fatal("expected the server without the support to fail the update")
+	}
+	if got := unsupported.registerMetadata().Get(metadataTLSCert); got[0] != string(certPEM) {
+		t.Fatal("expected the certificate to be kept")
+	}
+	if err := NewHTTPTunnel("plain", "127.0.0.1:0").UpdateTLS(renewedPEM, renewedKeyPEM); err == nil {
+		t.Fatal("expected the tunnel without tls to fail")
+	}
+}
+
+func TestHTTPForceHTTPS(t *testing.T) {
+	certPEM, keyPEM := selfSignedCert(t, "foo.example.com")
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer local.Close()
+
+	server, serverTLS := newTLSFakeServer(t)
+	server.onRegister = func(n int, req *proto.RegisterReq, stream proto.TunnelService_RegisterServer) error {
+		if err := sendInit(stream, "https://foo.example.com", "http://foo.example.com:8080"); err != nil {
+			return err
+		}
+		<-stream.Context().Done()
+		return nil
+	}
+	events := make(chan Event, 10)
+	client, err := NewClient(server.addr, serverTLS, WithEventHandler(func(event Event) {
+		events <- event
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnel := NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPSubDomain("foo"),
+		WithHTTPTLS(certPEM, keyPEM),
+		WithHTTPForceHTTPSExcept("/.well-known/acme-challenge"),
+	)
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	if got := server.md[0].Get(metadataHTTPForceHTTPS); len(got) != 1 || got[0] != "/.well-known/acme-challenge" {
+		t.Fatalf("unexpected force https metadata: %v", got)
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		proto    string
+		location string
+	}{
+		{"http entrypoint", "http://foo.example.com:8080/a?b=c", "", "https://foo.example.com/a?b=c"},
+		// the entrypoint tells the scheme, the header of the user doesn't.
+		{"forged proto", "http://foo.example.com:8080/a", "https", "https://foo.example.com/a"},
+		{"https entrypoint", "http://foo.example.com/a", "http", ""},
+		{"excluded path", "http://foo.example.com:8080/.well-known/acme-challenge/token", "", ""},
+		{"excluded prefix", "http://foo.example.com:8080/.well-known/acme-challenge", "", ""},
+		{"not a segment", "http://foo.example.com:8080/.well-known/acme-challenges", "", "https://foo.example.com/.well-known/acme-challenges"},
+		// the entrypoints can't tell, so the header does, and it's plaintext without the header.
+		{"unknown host", "http://bar.example.com/a", "", "https://bar.example.com/a"},
+		{"unknown host over https", "http://bar.example.com/a", "https", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			resp := roundTrip(t, server, 0, req)
+			if tt.location == "" {
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("expected the request to be served, got %d", resp.StatusCode)
+				}
+				return
+			}
+			if resp.StatusCode != http.StatusPermanentRedirect || resp.Header.Get("Location") != tt.location {
+				t.Fatalf("expected to be redirected to %s, got %d %s", tt.location, resp.StatusCode, resp.Header.Get("Location"))
+			}
+		})
+	}
+
+	// without tls, the option is ignored with a warning.
+	tunnel = NewHTTPTunnel("no-tls", strings.TrimPrefix(local.URL, "http://"), WithHTTPSubDomain("bar"), WithHTTPForceHTTPS())
+	if _, _, err := client.StartTunnel(ctx, tunnel); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case event := <-events:
+			if event.Type == EventWarning {
+				if event.Tunnel != "no-tls" {
+					t.Fatalf("unexpected warning of tunnel %s", event.Tunnel)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no warning event")
+		}
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	certPEM, keyPEM := selfSignedCert(t, "castled.test")
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeServer(t, grpc.Creds(credentials.NewServerTLSFromCert(&cert)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	client, err := NewClient(server.addr, WithServerTLS(&tls.Config{RootCAs: roots, ServerName: "castled.test"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("verified", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err = NewClient(server.addr, WithServerTLSInsecureSkipVerify())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("insecure", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate isn't signed by the system roots.
+	client, err = NewClient("castles://"+server.addr, WithRegisterRetry(RetryPolicy{Backoff: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.StartTunnel(ctx, NewTCPTunnel("unverified", "127.0.0.1:0"))
+	var tlsErr *TLSError
+	if !errors.As(err, &tlsErr) {
+		t.Fatalf("expected a TLSError, got %v", err)
+	}
+	var serverErr *ServerError
+	if !errors.Is(err, ErrTLS) || !errors.As(err, &serverErr) || serverErr.Tunnel != "unverified" {
+		t.Fatalf("expected the ServerError matching ErrTLS, got %v", err)
+	}
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("expected a certificate verification error, got %v", err)
+	}
+
+	// the plaintext client can't talk to the tls server.
+	client, err = NewClient(server.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("plaintext", "127.0.0.1:0")); err == nil {
+		t.Fatal("expected the plaintext registration to fail")
+	}
+}
+
+// testCA is a tiny certificate authority for testing mTLS.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "castle test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue issues a leaf certificate of the name for the usage.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	server := newFakeServer(t, grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "castled.test", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    ca.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serverTLS := &tls.Config{RootCAs: ca.pool, ServerName: "castled.test"}
+
+	client, err := NewClient(server.addr,
+		WithServerTLS(serverTLS),
+		WithClientCertificate(ca.issue(t, "client", x509.ExtKeyUsageClientAuth)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.StartTunnel(ctx, NewTCPTunnel("mtls", "127.0.0.1:0")); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, opts := range map[string][]Option{
+		"no client cert": {WithServerTLS(serverTLS)},
+		"untrusted client cert": {
+			WithServerTLS(serverTLS),
+			WithClientCertificate(newTestCA(t).issue(t, "client", x509.ExtKeyUsageClientAuth)),
+		},
+	} {
+		client, err := NewClient(server.addr, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = client.StartTunnel(ctx, NewTCPTunnel("mtls", "127.0.0.1:0"))
+		var tlsErr *TLSError
+		if !errors.As(err, &tlsErr) || !tlsErr.ClientCert {
+			t.Fatalf("%s: expected a TLSError of the client cert, got %v", name, err)
+		}
+	}
+
+	// the server certificate isn't signed by the trusted roots.
+	client, err = NewClient(server.addr,
+		WithServerTLS(&tls.Config{RootCAs: newTestCA(t).pool, ServerName: "castled.test"}),
+		WithClientCertificate(ca.issue(t, "client", x509.ExtKeyUsageClientAuth)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.StartTunnel(ctx, NewTCPTunnel("mtls", "127.0.0.1:0"))
+	var tlsErr *TLSError
+	if !errors.As(err, &tlsErr) || tlsErr.ClientCert {
+		t.Fatalf("expected a TLSError of the server cert, got %v", err)
+	}
+}
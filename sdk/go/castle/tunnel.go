@@ -1,38 +1,733 @@
 package castle
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/openosaka/castled/sdk/go/proto"
+	"google.golang.org/grpc/metadata"
 )
 
 type Tunnel struct {
 	proto.Tunnel
 
-	Name      string
+	Name string
+	// LocalAddr is the local address which the tunnel is created with,
+	// it's kept as is after UpdateLocalAddr, see TunnelInfo.LocalAddr for the current one.
 	LocalAddr string
+	// updatedAddr is the local address set by UpdateLocalAddr.
+	updatedAddr atomic.Pointer[string]
+
+	status tunnelStatus
+
+	mu      sync.Mutex
+	session *session
+	// http is not nil if the http requests need to be handled by the client.
+	http *httpProxy
+
+	// limitsMu guards ingress, egress, connLimit, maxConns and limits,
+	// the server may update them while the tunnel is running, see ConfigUpdate.
+	limitsMu sync.RWMutex
+	limits   limitConfig
+	ingress  *rateLimiter
+	egress   *rateLimiter
+	filter   *addrFilter
+	dialer   *localDialer
+	// dnsCache is of WithLocalDNSCache, it may be nil.
+	dnsCache *dnsCache
+	// balancer balances the connections of a tcp tunnel across the upstreams, it may be nil.
+	balancer *tcpBalancer
+	// resolver picks the local address of each connection, it may be nil,
+	// the http proxy resolves each request itself.
+	resolver localResolver
+	// proxyProtocol is the version of the PROXY protocol header
+	// sent to the local server, 0 means no header.
+	proxyProtocol int
+	// idleTimeout closes the connections idle for the duration, 0 means no timeout.
+	idleTimeout time.Duration
+	// portRange is the range of the remote port of a tcp tunnel, it may be nil.
+	portRange *portRange
+	// bindAddr is the server address which the listener of a tcp tunnel is bound to, it may be empty.
+	bindAddr string
+	// sni routes the connections of a tcp tunnel by the TLS server name, it's nil without WithTCPSNIRouting.
+	sni *sniRouter
+	// maxConns is the max number of concurrent connections, 0 means no limit.
+	maxConns int
+	// connLimit paces the new connections, it's nil without WithConnectionRateLimit,
+	// the http proxy paces the requests itself.
+	connLimit *rateLimiter
+	// ttl closes the tunnel once it has been started for the duration, 0 means no limit.
+	ttl time.Duration
+	// maxRequests closes the tunnel once it has accepted the connections, 0 means no limit,
+	// requests counts the accepted ones.
+	maxRequests int64
+	requests    atomic.Int64
+	// fanout are the udp backends beside the local address which the datagrams are mirrored to.
+	fanout           []string
+	fanoutAllReplies bool
+	// maxDatagramSize is of WithUdpMaxDatagramSize, 0 means the max payload of udp.
+	maxDatagramSize int
+	// pathPrefix is the path prefix routed to the http tunnel, empty means all the paths.
+	pathPrefix string
+	// matches are the normalized predicates of the requests routed to the http tunnel.
+	matches []routeMatch
+	// cert is the certificate to terminate the TLS of the http tunnel.
+	cert *tunnelCert
+	// warnings are the problems of the options which don't make StartTunnel fail,
+	// they are emitted as EventWarning after registering.
+	warnings []error
+	// md is sent along with the registration.
+	md metadata.MD
+	// err is the error of the options, StartTunnel fails with it.
+	err error
+}
+
+// tunnelOptions are the options shared by all kinds of tunnels.
+type tunnelOptions struct {
+	ingressRate int64
+	egressRate  int64
+	rateBurst   int64
+
+	allowCIDRs []string
+	denyCIDRs  []string
+
+	dialTimeout    time.Duration
+	dialRetries    int
+	dialRetryDelay time.Duration
+	// dnsTTL and dnsRefresh are of WithLocalDNSCache and WithLocalDNSRefresh,
+	// dnsCache is shared by the dialers of the tunnel.
+	dnsTTL     time.Duration
+	dnsRefresh bool
+	dnsCache   *dnsCache
+	// dialSource is the source address of WithLocalDialSourceAddr.
+	dialSource string
+
+	maxConns int
+	// connRate and connBurst are of WithConnectionRateLimit.
+	connRate  int
+	connBurst int
+	// ttl and maxRequests are of WithTTL and WithMaxRequests.
+	ttl         time.Duration
+	maxRequests int
+
+	region string
+	tags   map[string]string
+
+	resolver localResolver
+}
+
+func (opts *tunnelOptions) localDialer() *localDialer {
+	if opts.dnsTTL > 0 && opts.dnsCache == nil {
+		opts.dnsCache = newDNSCache(opts.dnsTTL)
+		opts.dnsCache.refresh = opts.dnsRefresh
+	}
+	// the invalid source address is rejected by apply.
+	source, _ := netip.ParseAddr(opts.dialSource)
+	return &localDialer{
+		timeout:  opts.dialTimeout,
+		retries:  opts.dialRetries,
+		delay:    opts.dialRetryDelay,
+		dnsCache: opts.dnsCache,
+		source:   source.Unmap(),
+	}
+}
+
+func (opts *tunnelOptions) apply(tunnel *Tunnel) {
+	tunnel.ingress = newRateLimiter(opts.ingressRate, opts.rateBurst)
+	tunnel.egress = newRateLimiter(opts.egressRate, opts.rateBurst)
+	tunnel.dialer = opts.localDialer()
+	tunnel.dnsCache = opts.dnsCache
+
+	tunnel.md = metadata.MD{}
+	tunnel.filter, tunnel.err = newAddrFilter(opts.allowCIDRs, opts.denyCIDRs)
+	if opts.dialSource != "" {
+		if _, err := netip.ParseAddr(opts.dialSource); err != nil {
+			tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid local dial source address: %w", err))
+		}
+	}
+	if opts.dnsTTL < 0 {
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid local dns cache ttl %s", opts.dnsTTL))
+	} else if opts.dnsRefresh && opts.dnsTTL == 0 {
+		tunnel.warnings = append(tunnel.warnings, errors.New("local dns refresh is ignored without the local dns cache"))
+	}
+	if len(opts.allowCIDRs) > 0 {
+		tunnel.md.Append(metadataAllowCIDR, opts.allowCIDRs...)
+	}
+	if len(opts.denyCIDRs) > 0 {
+		tunnel.md.Append(metadataDenyCIDR, opts.denyCIDRs...)
+	}
+	if opts.maxConns > 0 {
+		if tunnel.maxConns == 0 || opts.maxConns < tunnel.maxConns {
+			tunnel.maxConns = opts.maxConns
+		}
+		tunnel.md.Append(metadataMaxConnections, strconv.Itoa(opts.maxConns))
+	}
+	if opts.connRate < 0 || opts.connBurst < 0 {
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid connection rate limit %d/s with burst %d", opts.connRate, opts.connBurst))
+	} else if opts.connRate > 0 {
+		tunnel.connLimit = newRateLimiter(int64(opts.connRate), int64(opts.connBurst))
+		tunnel.md.Append(metadataConnectionRate, fmt.Sprintf("%d,%d", opts.connRate, int(tunnel.connLimit.burst)))
+	}
+	if opts.ttl < 0 || opts.maxRequests < 0 {
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid ttl %s or max requests %d", opts.ttl, opts.maxRequests))
+	}
+	tunnel.ttl = opts.ttl
+	tunnel.maxRequests = int64(opts.maxRequests)
+	if opts.ttl > 0 {
+		tunnel.md.Append(metadataTTL, opts.ttl.String())
+	}
+	if opts.region != "" {
+		tunnel.md.Append(metadataRegion, opts.region)
+	}
+	if len(opts.tags) > 0 {
+		if err := validateTags(opts.tags); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		} else {
+			tunnel.md.Append(metadataTag, encodeTags(opts.tags)...)
+		}
+	}
+	tunnel.resolver = opts.resolver
+	tunnel.limits = limitConfig{
+		ingressRate: opts.ingressRate,
+		egressRate:  opts.egressRate,
+		rateBurst:   opts.rateBurst,
+		maxConns:    tunnel.maxConns,
+		connRate:    opts.connRate,
+		connBurst:   opts.connBurst,
+	}
+}
+
+// TunnelOption configures any kind of tunnel,
+// it can be used as TCPOption, UDPOption and HTTPOption.
+type TunnelOption func(*tunnelOptions)
+
+func (f TunnelOption) applyTCP(opts *tcpOptions)   { f(&opts.tunnelOptions) }
+func (f TunnelOption) applyUDP(opts *udpOptions)   { f(&opts.tunnelOptions) }
+func (f TunnelOption) applyHTTP(opts *httpOptions) { f(&opts.tunnelOptions) }
+func (f TunnelOption) applyGRPC(opts *grpcOptions) { opts.http = append(opts.http, f) }
+
+// WithRateLimit limits the throughput of the tunnel in both directions,
+// the limit is shared by all the connections of the tunnel.
+//
+// The connections exceeding the limit are slowed down, not dropped.
+func WithRateLimit(bytesPerSecond int64) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.ingressRate = bytesPerSecond
+		opts.egressRate = bytesPerSecond
+	}
+}
+
+// WithIngressRateLimit limits the throughput from the users to the local server.
+func WithIngressRateLimit(bytesPerSecond int64) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.ingressRate = bytesPerSecond
+	}
+}
+
+// WithEgressRateLimit limits the throughput from the local server to the users.
+func WithEgressRateLimit(bytesPerSecond int64) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.egressRate = bytesPerSecond
+	}
+}
+
+// WithRateLimitBurst sets the max bytes can be transferred at once by the rate limits,
+// it defaults to one second of the rate.
+func WithRateLimitBurst(bytes int64) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.rateBurst = bytes
+	}
+}
+
+// WithAllowCIDR only allows the users from the given CIDRs to connect to the tunnel.
+//
+// The CIDRs are sent to the server along with the registration, also the client
+// rejects the connections itself by the address of the user told by the server,
+// the connections are rejected if the server doesn't tell it, since they can't be checked.
+// Invalid CIDRs make StartTunnel fail.
+func WithAllowCIDR(cidrs ...string) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.allowCIDRs = append(opts.allowCIDRs, cidrs...)
+	}
+}
+
+// WithDenyCIDR denies the users from the given CIDRs to connect to the tunnel,
+// it takes precedence over WithAllowCIDR. Unlike WithAllowCIDR, the connections of the unknown
+// addresses are let through by the client, it's up to the server.
+func WithDenyCIDR(cidrs ...string) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.denyCIDRs = append(opts.denyCIDRs, cidrs...)
+	}
+}
+
+// WithMaxConnections caps the number of concurrent connections of the tunnel,
+// the new connections are refused once n connections are active, and the slot is released
+// when a connection closes.
+//
+// The limit is sent to the server along with the registration, also the client refuses
+// the connections itself, each refused connection is counted in TunnelStatus.RejectedConns
+// and emitted as EventConnRejected.
+// For udp tunnels, it's the same as WithUdpMaxSessions, the smaller one takes effect.
+func WithMaxConnections(n int) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.maxConns = n
+	}
+}
+
+// WithConnectionRateLimit paces the new connections of the tunnel to perSecond with bursts
+// of up to burst, e.g. to protect a fragile local server from a storm of reconnecting users.
+// The burst defaults to perSecond if it's 0, and perSecond 0 means no limit.
+//
+// The limit is sent to the server along with the registration, also the client refuses the
+// connections exceeding it itself: the tcp connections and the udp sessions are closed at once,
+// counted in TunnelStatus.RejectedConns and emitted as EventConnRejected. The http tunnels limit
+// the requests instead, they're answered with 429 and Retry-After before reaching the local server,
+// and counted in TunnelStatus.RejectedRequests.
+func WithConnectionRateLimit(perSecond, burst int) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.connRate = perSecond
+		opts.connBurst = burst
+	}
+}
+
+// WithTTL closes the tunnel once it has been started for d, whatever the traffic is, e.g. a time-boxed share link.
+// The connections being proxied are closed too, the quit channel receives nil and the QuitReason is QuitExpired.
+// The TTL isn't reset by reconnecting, and it's sent to the server along with the registration,
+// so the server expires the tunnel too if it supports it, castled ignores it, only the client
+// closes the tunnel then, with an EventWarning.
+func WithTTL(d time.Duration) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.ttl = d
+	}
+}
+
+// WithMaxRequests closes the tunnel once it has accepted n connections, or n requests of a http tunnel,
+// e.g. n 1 for a one-time share link. The tunnel stops accepting at once, the connections being proxied
+// keep going until they end, then the quit channel receives nil and the QuitReason is QuitExpired.
+// A HTTP/2 connection of WithHTTPProtocols is counted once however many requests it carries.
+func WithMaxRequests(n int) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.maxRequests = n
+	}
+}
+
+// WithRegion asks a multi-region server to terminate the traffic of the tunnel at the edge
+// in the region, e.g. "eu-west".
+//
+// The server falls back to another region if the region is unavailable,
+// TunnelInfo.Region is the region actually chosen by the server, it's empty if the server
+// doesn't tell, e.g. it runs in a single region.
+//
+// It needs the support of the server, castled ignores it, the tunnel still starts then,
+// with an EventWarning.
+func WithRegion(region string) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.region = region
+	}
+}
+
+// WithMetadata tags the tunnel with the key/value metadata, e.g. the team, the environment or the commit,
+// so the tunnel can be told apart in the listings and the logs of the server. The calls are merged.
+//
+// The keys have letters, digits, '-', '_' and '.', the values are printable ASCII, there are at most
+// 32 keys of 64 bytes and values of 256 bytes, 4KB in total, StartTunnel fails otherwise.
+// TunnelInfo.Metadata is the metadata accepted by the server.
+func WithMetadata(metadata map[string]string) TunnelOption {
+	return func(opts *tunnelOptions) {
+		if opts.tags == nil {
+			opts.tags = make(map[string]string, len(metadata))
+		}
+		for key, value := range metadata {
+			opts.tags[key] = value
+		}
+	}
+}
+
+// WithLocalDialTimeout sets the timeout of dialing the local address for each forwarded connection.
+func WithLocalDialTimeout(d time.Duration) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.dialTimeout = d
+	}
+}
+
+// WithLocalDialRetries retries dialing the local address n times with the delay
+// before dropping the forwarded connection, it smooths over the restarts of the local server.
+// EventLocalDialFailed is emitted on each failed dial.
+func WithLocalDialRetries(n int, delay time.Duration) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.dialRetries = n
+		opts.dialRetryDelay = delay
+	}
+}
+
+// WithLocalDialSourceAddr binds the local side of the connections to the local server to the ip addr,
+// e.g. for the policy routing or the firewall rules by the source address on a host with several interfaces.
+// The addr should be assigned to an interface of the host, StartTunnel fails otherwise,
+// and the local server should be reachable from it, e.g. an IPv4 addr can't dial an IPv6 local server.
+// The unix domain sockets aren't affected.
+func WithLocalDialSourceAddr(addr string) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.dialSource = addr
+	}
+}
+
+// WithLocalDNSCache caches the addresses of the hostname of the local address for the ttl,
+// e.g. "backend:8080" of a container whose address changes, the hostname is resolved again on the first
+// dial after the ttl. Without it, the hostname is resolved on each dial. The addresses are dialed in order,
+// and the dial fails if the hostname resolves to no addresses. See Tunnel.RefreshLocalDNS to drop the cache.
+func WithLocalDNSCache(ttl time.Duration) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.dnsTTL = ttl
+	}
+}
+
+// WithLocalDNSRefresh drops the cached addresses of WithLocalDNSCache once the dial to all of them fails,
+// so the retries of WithLocalDialRetries and the following connections resolve the hostname again
+// rather than waiting for the ttl.
+func WithLocalDNSRefresh() TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.dnsRefresh = true
+	}
+}
+
+// WithLocalResolver picks the local address of each connection with fn instead of the static
+// local address, e.g. from the service discovery. fn is called with the metadata of the connection
+// before dialing the local server, for the http tunnels, it's called for each request.
+//
+// The connection is rejected if fn returns an error or an invalid address, it's emitted as
+// EventConnRejected and counted in TunnelStatus.RejectedConns, the rejected http requests are
+// answered with 503 and counted in TunnelStatus.RejectedRequests. It can't be used with the upstreams of WithTCPUpstreams, WithHTTPUpstreams,
+// WithHTTPHealthCheck and WithUdpFanout.
+func WithLocalResolver(fn func(ctx context.Context, meta ConnMeta) (string, error)) TunnelOption {
+	return func(opts *tunnelOptions) {
+		opts.resolver = fn
+	}
+}
+
+// Validate checks the options of the tunnel locally, without contacting the server,
+// e.g. the conflicting options, invalid CIDRs, or the tls certificate doesn't match the domain.
+// StartTunnel fails with the same error.
+func (t *Tunnel) Validate() error {
+	err := t.err
+	if nameErr := validateName(t.Name); nameErr != nil {
+		err = errors.Join(err, nameErr)
+	}
+	if t.isStatic() {
+		// the files are served by the tunnel, there's no local address.
+	} else if addrErr := validateLocalAddr(t.LocalAddr); addrErr != nil {
+		err = errors.Join(err, addrErr)
+	}
+	if t.dialer != nil && t.dialer.source.IsValid() {
+		if sourceErr := validateSourceAddr(t.dialer.source); sourceErr != nil {
+			err = errors.Join(err, sourceErr)
+		}
+	}
+	if t.resolver != nil && t.hasUpstreams() {
+		err = errors.Join(err, errors.New("the local resolver can't be used with upstreams"))
+	}
+	return err
+}
+
+// UpdateLocalAddr switches the local address which the new connections are dialed to,
+// e.g. the local server is restarted on another port, the tunnel stays registered,
+// so the entrypoints are kept. The connections which are being proxied keep going to
+// the old address until they end.
+//
+// It fails if the addr is invalid, or the tunnel balances the connections across upstreams,
+// i.e. WithTCPUpstreams, WithHTTPUpstreams, WithHTTPHealthCheck or WithUdpFanout.
+func (t *Tunnel) UpdateLocalAddr(addr string) error {
+	if err := validateLocalAddr(addr); err != nil {
+		return err
+	}
+	if t.hasUpstreams() {
+		return errors.New("can't update the local address of the tunnel with upstreams")
+	}
+	if t.isStatic() {
+		return errors.New("can't update the local address of the static tunnel")
+	}
+	t.updatedAddr.Store(&addr)
+	return nil
+}
+
+// RefreshLocalDNS drops the addresses cached by WithLocalDNSCache, the next dials resolve the local hostnames again.
+// It does nothing without WithLocalDNSCache.
+func (t *Tunnel) RefreshLocalDNS() {
+	if t.dnsCache != nil {
+		t.dnsCache.forget("")
+	}
+}
+
+// hasUpstreams reports whether the tunnel balances the connections across several local addresses.
+func (t *Tunnel) hasUpstreams() bool {
+	return t.balancer != nil || len(t.fanout) > 0 || (t.http != nil && (len(t.http.upstreams) > 0 || len(t.http.weights) > 0 || t.http.healthCheck != nil))
+}
+
+// isStatic reports whether the tunnel serves the files of NewStaticTunnel.
+func (t *Tunnel) isStatic() bool {
+	return t.http != nil && t.http.static != nil
+}
+
+// localAddr returns the local address which the new connections are dialed to.
+func (t *Tunnel) localAddr() string {
+	if addr := t.updatedAddr.Load(); addr != nil {
+		return *addr
+	}
+	return t.LocalAddr
+}
+
+// maxNameLength is the max length of the name of a tunnel.
+const maxNameLength = 64
+
+// validateName checks the name of a tunnel only has letters, digits, '-', '_' and '.',
+// the name is sent to the server, which may reject the duplicate names.
+func validateName(name string) error {
+	if name == "" {
+		return errors.New("the tunnel name is empty")
+	}
+	if len(name) > maxNameLength {
+		return fmt.Errorf("the tunnel name %q is longer than %d", name, maxNameLength)
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("the tunnel name %q has invalid character %q", name, r)
+		}
+	}
+	return nil
+}
+
+// protocol returns "tcp", "udp" or "http" by the config of the tunnel.
+func (t *Tunnel) protocol() string {
+	switch {
+	case t.GetUdp() != nil:
+		return "udp"
+	case t.http != nil && t.http.grpc:
+		return "grpc"
+	case t.GetHttp() != nil:
+		return "http"
+	default:
+		return "tcp"
+	}
+}
+
+func (t *Tunnel) newConn(stream proto.TunnelService_DataClient, connectionID string) *streamConn {
+	conn := newStreamConn(stream, connectionID)
+	t.limitsMu.RLock()
+	conn.ingress = t.ingress
+	conn.egress = t.egress
+	t.limitsMu.RUnlock()
+	conn.status = &t.status
+	if t.status.dataCompression() != "" {
+		conn.codec = newDataCodec()
+	}
+	go conn.recv()
+	return conn
 }
 
 type tcpOptions struct {
-	port uint16
+	tunnelOptions
+
+	port          uint16
+	portRange     *portRange
+	proxyProtocol int
+	idleTimeout   time.Duration
+	upstreams     []string
+	weights       map[string]int
+	balancer      string
+	keepAlive     *tcpKeepAlive
+	noDelay       *bool
+	bindAddr      string
+	sniRouting    bool
+	sniRoutes     []sniRoute
+	compression   string
+}
+
+// TCPOption configures a TCP tunnel.
+type TCPOption interface {
+	applyTCP(*tcpOptions)
 }
 
-type TCPOption func(*tcpOptions)
+type tcpOptionFunc func(*tcpOptions)
+
+func (f tcpOptionFunc) applyTCP(opts *tcpOptions) { f(opts) }
 
 func WithTCPPort(port uint16) TCPOption {
-	return func(opts *tcpOptions) {
+	return tcpOptionFunc(func(opts *tcpOptions) {
 		opts.port = port
-	}
+	})
+}
+
+// WithTCPPortRange requests the first available remote port between min and max, inclusive,
+// e.g. the firewall only permits a band of ports. The port is in the returned entrypoint,
+// and StartTunnel fails with ErrNoPortAvailable if all the ports are taken.
+// It can't be used with WithTCPPort.
+//
+// It needs the support of the server, castled ignores it and assigns any free port,
+// the tunnel still starts then, with an EventWarning.
+func WithTCPPortRange(min, max uint16) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.portRange = &portRange{min: min, max: max}
+	})
+}
+
+// WithTCPProxyProtocol prepends a PROXY protocol header of the given version(1 or 2)
+// to each connection to the local server, so the local server knows the address of the user.
+//
+// The address is only known if the server tells it, otherwise the header falls back to
+// UNKNOWN in v1 and LOCAL in v2, the local server uses the address of the connection then.
+func WithTCPProxyProtocol(version int) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.proxyProtocol = version
+	})
+}
+
+// WithTCPIdleTimeout closes the connections which transfer no bytes in either direction
+// for the duration, any traffic resets the timeout. It defaults to no timeout.
+func WithTCPIdleTimeout(timeout time.Duration) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.idleTimeout = timeout
+	})
+}
+
+// WithTCPUpstreams balances the connections across the addrs beside the local address,
+// e.g. several instances of a service on different local ports.
+// The strategy is round-robin unless WithTCPBalancer is used, a failed dial to an upstream
+// falls through to the next one, the connection fails only if all the upstreams fail.
+// The connection counts of the upstreams are in TunnelStatus.Upstreams.
+func WithTCPUpstreams(addrs ...string) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.upstreams = append(opts.upstreams, addrs...)
+	})
+}
+
+// WithTCPWeightedUpstreams is like WithTCPUpstreams, but the connections are balanced in proportion
+// to the weights by the addrs, e.g. the upstreams of different capacities. The local address of the tunnel
+// may be in the weights too, the addrs without a weight are 1, and the weight 0 drains the upstream,
+// it takes no new connection while the existing ones keep going. The calls are merged.
+//
+// The weights apply to all the strategies of WithTCPBalancer, e.g. BalanceLeastConnections picks
+// the fewest connections per weight. The weights are in TunnelStatus.Upstreams.
+func WithTCPWeightedUpstreams(weights map[string]int) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.weights = mergeWeights(opts.weights, weights)
+	})
+}
+
+// WithTCPBalancer sets the strategy of WithTCPUpstreams, one of BalanceRoundRobin,
+// BalanceLeastConnections and BalanceRandom, the others make StartTunnel fail.
+func WithTCPBalancer(strategy string) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.balancer = strategy
+	})
+}
+
+// WithTCPKeepAlive sets the tcp keepalive of the forwarded connections, both the connections
+// to the local server and the connections of the users accepted by the server, e.g. to keep
+// the long-lived connections across NAT. It has nothing to do with the keepalive of the
+// control channel, see WithKeepAlive.
+//
+// The idle is the time before the first probe, the interval is the time between the probes,
+// and the count is the number of the unacknowledged probes before the connection is dropped,
+// zero means the default of the OS. The interval and the count are only applied on linux
+// to the local connections, the interval is the same as the idle on the other platforms.
+// Without the option, the local connections use the keepalive of the Go runtime.
+//
+// The connections of the users need the support of the server, castled ignores it,
+// only the local connections use it then, with an EventWarning.
+func WithTCPKeepAlive(enabled bool, idle, interval time.Duration, count int) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.keepAlive = &tcpKeepAlive{enabled: enabled, idle: idle, interval: interval, count: count}
+	})
+}
+
+// WithTCPNoDelay sets TCP_NODELAY of the forwarded connections, both the connections to the local server
+// and the connections of the users accepted by the server. With true, Nagle's algorithm is disabled and
+// the small writes are sent at once, it lowers the latency of the interactive protocols like SSH or games,
+// at the cost of more packets and overhead for the bulk transfers. With false, the small writes are coalesced
+// into fewer packets, it favors the throughput over the latency.
+//
+// Without the option, the sockets are left as is, the Go runtime disables Nagle's algorithm of
+// the local connections by default, and the server keeps the default of its OS.
+//
+// The connections of the users need the support of the server, castled ignores it,
+// only the local connections use it then, with an EventWarning.
+func WithTCPNoDelay(enabled bool) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.noDelay = &enabled
+	})
+}
+
+// WithTCPBindAddr asks the server to bind the listener of the tunnel to the addr, an IP of the server,
+// instead of all the interfaces, e.g. to expose the tunnel only on the internal network of a multi-homed server.
+// StartTunnel fails with a BindAddrError if the server doesn't allow the addr.
+//
+// It needs the support of the server, castled ignores it and binds all the interfaces,
+// the tunnel still starts then, with an EventWarning.
+func WithTCPBindAddr(addr string) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.bindAddr = addr
+	})
+}
+
+// WithDataCompression offers the server to compress the traffic of the data streams of the tcp tunnel
+// by the algo, only DataCompressionDeflate is supported. It helps the compressible traffic over the slow links,
+// e.g. the plain text protocols, at the cost of the cpu on both sides.
+//
+// The traffic is only compressed if the server accepts it when the tunnel is registered, it's plain otherwise,
+// and TunnelStatus.DataCompression tells the result. The writes which don't shrink are sent as is,
+// and the connections which look already compressed or encrypted, e.g. TLS, aren't compressed at all.
+// TunnelStatus.BytesIn and BytesOut are the bytes before the compression, WireBytesIn and WireBytesOut after it.
+func WithDataCompression(algo string) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.compression = algo
+	})
+}
+
+// WithTCPSNIRouting peeks the TLS ClientHello of each connection for the server name,
+// e.g. the local server terminates TLS and serves several hostnames. The server name is sent to
+// the local server as the PP2_TYPE_AUTHORITY TLV of WithTCPProxyProtocol(2), and it picks the
+// local address by WithTCPSNIRoute. The ClientHello is still forwarded to the local server as is.
+//
+// The connections which aren't TLS or don't send the server name within 10 seconds
+// go to the local address, so it's only for the protocols where the user speaks first.
+func WithTCPSNIRouting() TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.sniRouting = true
+	})
+}
+
+// WithTCPSNIRoute dials the addr instead of the local address for the connections of the
+// TLS server name, which may be a wildcard like *.example.com matching a single label.
+// It implies WithTCPSNIRouting, and takes precedence over WithTCPUpstreams and WithLocalResolver,
+// the connections of the other names still go to them.
+func WithTCPSNIRoute(serverName, addr string) TCPOption {
+	return tcpOptionFunc(func(opts *tcpOptions) {
+		opts.sniRouting = true
+		opts.sniRoutes = append(opts.sniRoutes, sniRoute{name: serverName, addr: addr})
+	})
 }
 
 // NewTCPTunnel creates a new TCP tunnel.
 //
 // Without any option, the default behavior is to create a tunnel with a random port.
+// The localAddr is host:port, or the path of a unix domain socket like "unix:///run/app.sock".
 func NewTCPTunnel(name, localAddr string, options ...TCPOption) *Tunnel {
 	opts := &tcpOptions{}
 	for _, option := range options {
-		option(opts)
+		option.applyTCP(opts)
 	}
 
-	return &Tunnel{
+	tunnel := &Tunnel{
 		Tunnel: proto.Tunnel{
 			Name: name,
 			Config: &proto.Tunnel_Tcp{
@@ -41,20 +736,158 @@ func NewTCPTunnel(name, localAddr string, options ...TCPOption) *Tunnel {
 				},
 			},
 		},
-		LocalAddr: localAddr,
+		Name:          name,
+		LocalAddr:     localAddr,
+		proxyProtocol: opts.proxyProtocol,
+		idleTimeout:   opts.idleTimeout,
 	}
+	opts.tunnelOptions.apply(tunnel)
+	if opts.keepAlive != nil {
+		tunnel.dialer.keepAlive = opts.keepAlive
+		tunnel.md.Append(metadataTCPKeepAlive, opts.keepAlive.metadata())
+	}
+	if opts.noDelay != nil {
+		tunnel.dialer.noDelay = opts.noDelay
+		tunnel.md.Append(metadataTCPNoDelay, strconv.FormatBool(*opts.noDelay))
+	}
+
+	if opts.bindAddr != "" {
+		if addr, err := netip.ParseAddr(opts.bindAddr); err != nil {
+			tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid bind address %q: %w", opts.bindAddr, err))
+		} else {
+			tunnel.bindAddr = addr.String()
+			tunnel.md.Append(metadataTCPBindAddr, tunnel.bindAddr)
+		}
+	}
+
+	if opts.sniRouting {
+		router, err := newSNIRouter(opts.sniRoutes)
+		if err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+		tunnel.sni = router
+		tunnel.md.Append(metadataTCPSNIRouting, "true")
+	}
+	if opts.compression != "" {
+		if err := validateDataCompression(opts.compression); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+		tunnel.md.Append(metadataDataCompression, opts.compression)
+	}
+
+	if opts.portRange != nil {
+		if opts.port != 0 {
+			tunnel.err = errors.Join(tunnel.err, errors.New("only one of port and port range options is allowed"))
+		} else if err := opts.portRange.validate(); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		} else {
+			tunnel.portRange = opts.portRange
+		}
+	}
+
+	if opts.proxyProtocol != 0 && opts.proxyProtocol != 1 && opts.proxyProtocol != 2 {
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("unsupported proxy protocol version %d", opts.proxyProtocol))
+	}
+	if err := validateWeights(opts.weights); err != nil {
+		tunnel.err = errors.Join(tunnel.err, err)
+	}
+	if len(opts.upstreams) > 0 || len(opts.weights) > 0 || opts.balancer != "" {
+		addrs := upstreamAddrs(localAddr, opts.upstreams, opts.weights)
+		balancer, err := newTCPBalancer(addrs, upstreamWeights(addrs, opts.weights), opts.balancer)
+		if err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+		tunnel.balancer = balancer
+	}
+	return tunnel
 }
 
 type udpOptions struct {
-	port uint16
+	tunnelOptions
+
+	port           uint16
+	sessionTimeout time.Duration
+	maxSessions    int
+
+	fanout           []string
+	fanoutAllReplies bool
+
+	maxDatagramSize int
+}
+
+// UDPOption configures a UDP tunnel.
+type UDPOption interface {
+	applyUDP(*udpOptions)
 }
 
-type UDPOption func(*udpOptions)
+type udpOptionFunc func(*udpOptions)
+
+func (f udpOptionFunc) applyUDP(opts *udpOptions) { f(opts) }
 
 func WithUdpPort(port uint16) UDPOption {
-	return func(opts *udpOptions) {
+	return udpOptionFunc(func(opts *udpOptions) {
 		opts.port = port
-	}
+	})
+}
+
+// WithUdpSessionTimeout expires the udp sessions which transfer no datagrams for the duration,
+// a session is the traffic from the same source address. It defaults to no timeout.
+//
+// The client expires the sessions itself, the server only does too if it supports it,
+// castled ignores it and keeps the sessions, with an EventWarning.
+func WithUdpSessionTimeout(timeout time.Duration) UDPOption {
+	return udpOptionFunc(func(opts *udpOptions) {
+		opts.sessionTimeout = timeout
+	})
+}
+
+// WithUdpMaxSessions caps the number of concurrent udp sessions,
+// the datagrams from new sources are dropped once the cap is reached,
+// and an EventConnRejected is emitted for each dropped session.
+//
+// The client caps the sessions itself, the server only does too if it supports it,
+// castled ignores it and still forwards the datagrams of new sources, with an EventWarning.
+func WithUdpMaxSessions(n int) UDPOption {
+	return udpOptionFunc(func(opts *udpOptions) {
+		opts.maxSessions = n
+	})
+}
+
+// WithUdpFanout mirrors each datagram from the users to the addrs beside the local address,
+// e.g. for testing the services rely on the LAN broadcast.
+//
+// Each udp session, which is the datagrams from one source, has its own sockets to all the backends,
+// so the replies are always sent back to the source of the session.
+// Only the replies of the first responder of the session are sent back,
+// see WithUdpFanoutAllReplies for sending back all of them.
+// A datagram is mirrored to at most 16 backends including the local address,
+// more backends make StartTunnel fail.
+func WithUdpFanout(addrs ...string) UDPOption {
+	return udpOptionFunc(func(opts *udpOptions) {
+		opts.fanout = append(opts.fanout, addrs...)
+	})
+}
+
+// WithUdpFanoutAllReplies sends back the replies of all the backends of WithUdpFanout.
+func WithUdpFanoutAllReplies() UDPOption {
+	return udpOptionFunc(func(opts *udpOptions) {
+		opts.fanoutAllReplies = true
+	})
+}
+
+// WithUdpMaxDatagramSize sets the max size of the datagrams in both directions, it defaults to
+// 65535 bytes, the max payload of udp. The buffers are sized by it, and the bigger datagrams are dropped
+// rather than truncated, each of them is counted in TunnelStatus.DroppedDatagrams and emitted as
+// EventDatagramDropped. The size is sent to the server along with the registration.
+//
+// Each datagram travels between the server and the client in one message of the data stream,
+// so the stream adds no limit, but the practical max is of the sockets of the users: 65507 bytes over IPv4,
+// and the datagrams bigger than the path MTU, e.g. 1472 bytes over 1500 bytes Ethernet, are fragmented by IP,
+// of which losing any fragment loses the datagram.
+func WithUdpMaxDatagramSize(bytes int) UDPOption {
+	return udpOptionFunc(func(opts *udpOptions) {
+		opts.maxDatagramSize = bytes
+	})
 }
 
 // NewUDPTunnel creates a new UDP tunnel.
@@ -63,10 +896,10 @@ func WithUdpPort(port uint16) UDPOption {
 func NewUDPTunnel(name, localAddr string, options ...UDPOption) *Tunnel {
 	opts := &udpOptions{}
 	for _, option := range options {
-		option(opts)
+		option.applyUDP(opts)
 	}
 
-	return &Tunnel{
+	tunnel := &Tunnel{
 		Tunnel: proto.Tunnel{
 			Name: name,
 			Config: &proto.Tunnel_Udp{
@@ -75,80 +908,1015 @@ func NewUDPTunnel(name, localAddr string, options ...UDPOption) *Tunnel {
 				},
 			},
 		},
-		LocalAddr: localAddr,
+		Name:             name,
+		LocalAddr:        localAddr,
+		idleTimeout:      opts.sessionTimeout,
+		maxConns:         opts.maxSessions,
+		fanout:           opts.fanout,
+		fanoutAllReplies: opts.fanoutAllReplies,
+		maxDatagramSize:  opts.maxDatagramSize,
+	}
+	opts.tunnelOptions.apply(tunnel)
+
+	if len(opts.fanout)+1 > maxUDPFanout {
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("too many fanout backends, at most %d including the local address", maxUDPFanout))
+	}
+	for _, addr := range opts.fanout {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid fanout address %q: %w", addr, err))
+		}
 	}
+
+	if opts.sessionTimeout > 0 {
+		tunnel.md.Append(metadataUDPSessionTimeout, opts.sessionTimeout.String())
+	}
+	if opts.maxSessions > 0 {
+		tunnel.md.Append(metadataUDPMaxSessions, strconv.Itoa(opts.maxSessions))
+	}
+	if opts.maxDatagramSize < 0 || opts.maxDatagramSize > maxUDPDatagramSize {
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("invalid max datagram size %d, it should be 1 to %d", opts.maxDatagramSize, maxUDPDatagramSize))
+	} else if opts.maxDatagramSize > 0 {
+		tunnel.md.Append(metadataUDPMaxDatagramSize, strconv.Itoa(opts.maxDatagramSize))
+	}
+	return tunnel
 }
 
 type httpOptions struct {
+	tunnelOptions
+
 	pbFn func() *proto.HTTPConfig
+	// entrypoints is the number of options which decide the entrypoint,
+	// they are exclusive.
+	entrypoints int
+
+	wildcardErr error
+
+	credentials    []credential
+	upgradeTimeout time.Duration
+	wsKeepAlive    time.Duration
+	// requestTimeout and responseIdleTimeout are of WithHTTPRequestTimeout and WithHTTPResponseIdleTimeout.
+	requestTimeout      time.Duration
+	responseIdleTimeout time.Duration
+	flushInterval       time.Duration
+	protocols           []string
+	grpc                bool
+	grpcReflection      bool
+	errorPages          errorPages
+	errorPagesErr       error
+	fallback            http.Handler
+
+	localScheme string
+	localTLS    *tls.Config
+
+	cert    *tunnelCert
+	certErr error
+
+	upstreams    []string
+	weights      map[string]int
+	stickyCookie string
+	healthCheck  *healthCheck
+
+	pathPrefix  string
+	stripPrefix bool
+	matches     []routeMatch
+
+	rewriteRedirects bool
+	cookieDomains    map[string]string
+
+	connIDHeader string
+
+	forwardedFor   bool
+	trustedProxies []netip.Prefix
+	trustedErr     error
+	forwardedPort  bool
+
+	forceHTTPS       bool
+	forceHTTPSExcept []string
+
+	compression        []string
+	compressionMinSize int
+
+	cacheMaxSize int64
+	cacheTTL     time.Duration
+
+	breakerThreshold    int
+	breakerOpenDuration time.Duration
+
+	maxRequestBody int64
+	allowedMethods []string
+	hostHeader     hostHeader
+	hostHeaderErr  error
+
+	accessLogWriter io.Writer
+	accessLogFormat string
+	accessLogFunc   func(AccessLogEntry)
+
+	inspectMaxRequests  int
+	inspectMaxBodyBytes int
+	inspectRedact       []string
+
+	// mirrorAddr and the others are of WithHTTPMirror, empty if the requests aren't mirrored.
+	mirrorAddr      string
+	mirrorFraction  float64
+	mirrorSampleKey string
+	mirrorSeed      uint64
+	mirrorSeeded    bool
+	mirrorMaxBody   int64
+
+	// staticRoot and the others are of NewStaticTunnel, empty for the tunnels to a local server.
+	staticRoot     string
+	staticListing  bool
+	staticIndex    []string
+	staticFallback string
+	// staticOptions is true if any of the static options is used.
+	staticOptions bool
+
+	requestHeaders   *headerRewrite
+	responseHeaders  *headerRewrite
+	dropTraceHeaders bool
 }
 
 func WithHTTPPort(port uint16) HTTPOption {
-	return func(opts *httpOptions) {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.entrypoints++
 		opts.pbFn = func() *proto.HTTPConfig {
 			return &proto.HTTPConfig{
 				RemotePort: int32(port),
 			}
 		}
-	}
+	})
 }
 
 func WithHTTPDomain(domain string) HTTPOption {
-	return func(opts *httpOptions) {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.entrypoints++
 		opts.pbFn = func() *proto.HTTPConfig {
 			return &proto.HTTPConfig{
 				Domain: domain,
 			}
 		}
-	}
+	})
+}
+
+// WithHTTPWildcardDomain routes all the subdomains matching the pattern to the tunnel,
+// e.g. "*.myapp.example.com" matches tenant.myapp.example.com, the original Host header is forwarded.
+// The wildcard is only allowed as the leftmost label.
+//
+// The server prefers the more specific registrations, e.g. a tunnel of api.myapp.example.com
+// takes the requests of api.myapp.example.com over the wildcard one.
+func WithHTTPWildcardDomain(pattern string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.entrypoints++
+		opts.wildcardErr = validateWildcardDomain(pattern)
+		opts.pbFn = func() *proto.HTTPConfig {
+			return &proto.HTTPConfig{
+				Domain: pattern,
+			}
+		}
+	})
 }
 
 func WithHTTPSubDomain(subDomain string) HTTPOption {
-	return func(opts *httpOptions) {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.entrypoints++
 		opts.pbFn = func() *proto.HTTPConfig {
 			return &proto.HTTPConfig{
 				Subdomain: subDomain,
 			}
 		}
-	}
+	})
 }
 
 func WithHTTPRandomSubdomain() HTTPOption {
-	return func(opts *httpOptions) {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.entrypoints++
 		opts.pbFn = func() *proto.HTTPConfig {
 			return &proto.HTTPConfig{
 				RandomSubdomain: true,
 			}
 		}
-	}
+	})
+}
+
+// WithHTTPPathPrefix only routes the requests under the path prefix to the tunnel,
+// so multiple tunnels can share the same domain or subdomain, the server routes
+// a request to the tunnel with the longest matching prefix.
+//
+// StartTunnel fails if another tunnel of the same domain has the same prefix.
+func WithHTTPPathPrefix(prefix string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.pathPrefix = prefix
+	})
+}
+
+// WithHTTPMatchHeader only routes the requests with the header of the value to the tunnel,
+// e.g. X-Tenant: acme, so multiple tunnels can share the same domain or subdomain and path prefix.
+// The name is case-insensitive, the value is matched exactly.
+//
+// Among the tunnels of the longest matching path prefix, the server routes a request to the tunnel
+// with the most matching predicates, a header predicate goes before a query one when they tie,
+// and the tunnel without any predicate takes the rest. All the predicates of a tunnel must match.
+//
+// StartTunnel fails if another tunnel of the same domain has the same path prefix and predicates.
+func WithHTTPMatchHeader(name, value string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.matches = append(opts.matches, routeMatch{header: true, name: name, value: value})
+	})
+}
+
+// WithHTTPMatchQuery only routes the requests with the query parameter of the value to the tunnel,
+// e.g. ?tenant=acme. The key and the value are matched exactly, see WithHTTPMatchHeader for the precedence.
+func WithHTTPMatchQuery(key, value string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.matches = append(opts.matches, routeMatch{name: key, value: value})
+	})
+}
+
+// WithHTTPStripPrefix removes the prefix of WithHTTPPathPrefix from the requests
+// before proxying them to the local server, e.g. /api/users becomes /users.
+func WithHTTPStripPrefix(strip bool) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.stripPrefix = strip
+	})
+}
+
+// WithHTTPRewriteRedirects rewrites the Location of the redirects to the local server,
+// e.g. http://localhost:8080/login, to the host of the request, so the users stay on the entrypoint.
+// The locations to the other hosts and the relative locations are kept as is.
+//
+// The location matches the local server if it has the host and port dialed by the client,
+// or any loopback host with the same port. The scheme is of X-Forwarded-Proto if the server tells,
+// or https if the tunnel terminates the tls with WithHTTPTLS, http otherwise.
+// The prefix of WithHTTPStripPrefix is added back to the path.
+func WithHTTPRewriteRedirects() HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.rewriteRedirects = true
+	})
+}
+
+// WithHTTPRewriteCookieDomain rewrites the Domain attribute of the cookies set by the local server
+// from the domain to another, e.g. from the internal domain of the local server to the domain of the tunnel.
+// The domains are case-insensitive, an empty to drops the attribute, so the cookie belongs to the host
+// of the request. The calls are merged.
+func WithHTTPRewriteCookieDomain(from, to string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		if opts.cookieDomains == nil {
+			opts.cookieDomains = make(map[string]string)
+		}
+		opts.cookieDomains[strings.ToLower(strings.TrimPrefix(from, "."))] = to
+	})
+}
+
+// WithHTTPBasicAuth protects the tunnel with the http basic authentication,
+// the requests without the correct credentials are challenged with 401 by the client,
+// they never reach the local server.
+//
+// Use the option multiple times to accept multiple credentials.
+func WithHTTPBasicAuth(username, password string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.credentials = append(opts.credentials, credential{
+			username: username,
+			password: password,
+		})
+	})
+}
+
+// WithHTTPTLS makes the server terminate the TLS of the tunnel with the given certificate,
+// instead of the server's default one, the server picks the certificate by SNI.
+//
+// The certificate and key are sent to the server along with the registration,
+// so StartTunnel fails unless the client connects to the server over TLS, e.g. by WithServerTLS.
+// StartTunnel fails if the certificate doesn't match the domain of the tunnel.
+func WithHTTPTLS(certPEM, keyPEM []byte) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.cert, opts.certErr = newTunnelCert(certPEM, keyPEM)
+	})
 }
 
-type HTTPOption func(*httpOptions)
+// WithHTTPTLSFromFiles is like WithHTTPTLS, but reads the PEM encoded certificate and key from files.
+func WithHTTPTLSFromFiles(certPath, keyPath string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.cert, opts.certErr = loadTunnelCert(certPath, keyPath)
+	})
+}
+
+// WithHTTPUpstreams balances the requests of the tunnel across the local address
+// of the tunnel and the given addresses, in round-robin by default.
+func WithHTTPUpstreams(addrs ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.upstreams = append(opts.upstreams, addrs...)
+	})
+}
+
+// WithHTTPWeightedUpstreams is like WithHTTPUpstreams, but the requests are routed in the weighted round-robin
+// by the weights of the addrs, the local address of the tunnel may be in the weights too, the addrs without
+// a weight are 1, and the weight 0 drains the upstream, it takes no new user, only the users of
+// WithHTTPStickySession bound to it. The unhealthy upstreams of WithHTTPHealthCheck are skipped whatever
+// their weights are. The calls are merged, and the effective weights are in TunnelStatus.Upstreams.
+func WithHTTPWeightedUpstreams(weights map[string]int) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.weights = mergeWeights(opts.weights, weights)
+	})
+}
+
+// WithHTTPStickySession routes the requests of a user to the same upstream,
+// the upstream is remembered by the cookie with the given name.
+// If the upstream becomes unhealthy, the user is moved to another one.
+//
+// It only works with WithHTTPUpstreams.
+func WithHTTPStickySession(cookieName string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.stickyCookie = cookieName
+	})
+}
+
+// WithHTTPHealthCheck probes each upstream of the tunnel with a GET request to the path every interval,
+// the upstream responding 2xx or 3xx within the timeout passes the probe.
+//
+// An upstream becomes unhealthy after unhealthyThreshold consecutive failed probes,
+// and healthy again after healthyThreshold consecutive passed probes,
+// the requests are not routed to the unhealthy upstreams.
+// The upstreams are healthy at the beginning, the interval defaults to 10 seconds,
+// the timeout defaults to the interval, and the thresholds default to 1.
+func WithHTTPHealthCheck(path string, interval, timeout time.Duration, healthyThreshold, unhealthyThreshold int) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		if interval <= 0 {
+			interval = defaultHealthCheckInterval
+		}
+		if timeout <= 0 {
+			timeout = interval
+		}
+		opts.healthCheck = &healthCheck{
+			path:               path,
+			interval:           interval,
+			timeout:            timeout,
+			healthyThreshold:   max(healthyThreshold, 1),
+			unhealthyThreshold: max(unhealthyThreshold, 1),
+		}
+	})
+}
+
+// WithHTTPRequestHeaders sets and removes the headers of the requests
+// before they are proxied to the local server, the names are case-insensitive.
+//
+// The headers in set overwrite the existing ones, the headers in remove are removed before setting.
+func WithHTTPRequestHeaders(set map[string]string, remove []string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.requestHeaders = &headerRewrite{set: set, remove: remove}
+	})
+}
+
+// WithHTTPResponseHeaders is like WithHTTPRequestHeaders, but rewrites the headers of the responses
+// from the local server.
+func WithHTTPResponseHeaders(set map[string]string, remove []string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.responseHeaders = &headerRewrite{set: set, remove: remove}
+	})
+}
+
+// WithHTTPPreserveTraceHeaders keeps the W3C trace context headers, traceparent and tracestate,
+// from being removed or overwritten by WithHTTPRequestHeaders and WithHTTPResponseHeaders,
+// so the trace context flows across the tunnel. It's enabled by default.
+//
+// The tunnel itself never strips the trace context headers.
+func WithHTTPPreserveTraceHeaders(preserve bool) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.dropTraceHeaders = !preserve
+	})
+}
+
+// WithHTTPConnIDHeader sets the header of the name, e.g. "X-Castle-Connection-Id", of the requests to the
+// id of the user connection assigned by the server, so the logs of the local server can be lined up with
+// Event.ConnectionID, AccessLogEntry.ConnectionID and the connection_id of the logs of the client.
+// The header sent by the user is replaced. The requests of a HTTP/2 connection share its id.
+func WithHTTPConnIDHeader(name string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.connIDHeader = name
+	})
+}
+
+// WithHTTPForwardedFor tells the local server who the users are by the request headers,
+// the address of the user is appended to X-Forwarded-For, X-Real-IP is set to the real ip of the user,
+// and X-Forwarded-Proto is set to http if it's absent.
+//
+// The address of the user is only known if the server tells it, otherwise the headers are
+// passed as they are, except X-Real-IP is removed, since the user could forge X-Forwarded-For.
+func WithHTTPForwardedFor() HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.forwardedFor = true
+	})
+}
+
+// WithHTTPTrustedProxies is like WithHTTPForwardedFor, but trusts the X-Forwarded-For set by
+// the proxies in the CIDRs, e.g. a load balancer in front of the server,
+// the real ip is the rightmost address of X-Forwarded-For which is not a trusted proxy.
+// Invalid CIDRs make StartTunnel fail.
+func WithHTTPTrustedProxies(cidrs ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.forwardedFor = true
+		prefixes, err := parseCIDRs(cidrs)
+		opts.trustedProxies = append(opts.trustedProxies, prefixes...)
+		opts.trustedErr = errors.Join(opts.trustedErr, err)
+	})
+}
+
+// WithHTTPForwardedPort tells the local server where the users reach the tunnel, so it builds
+// the absolute urls of the entrypoint instead of the local server: X-Forwarded-Port is set to the port
+// of the entrypoint, and X-Forwarded-Proto to https if the server terminates the tls, http otherwise.
+//
+// The port is of the Host header, or the default port of the scheme if the header has none.
+// The scheme is of the entrypoint of the host, the X-Forwarded-Proto sent by the user is replaced.
+func WithHTTPForwardedPort(enabled bool) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.forwardedPort = enabled
+	})
+}
+
+// WithHTTPForceHTTPS redirects the plaintext requests to https with 308, the path and query are kept.
+//
+// A request is plaintext if its host and port point to an http entrypoint of the tunnel,
+// X-Forwarded-Proto is only read if the entrypoints can't tell, and the request is plaintext
+// without it. It only works with WithHTTPTLS, otherwise it's ignored with an EventWarning.
+func WithHTTPForceHTTPS() HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.forceHTTPS = true
+	})
+}
+
+// WithHTTPForceHTTPSExcept is like WithHTTPForceHTTPS, but the requests under the path prefixes
+// are served in plaintext, e.g. /.well-known/acme-challenge, the prefixes match whole path segments,
+// so /.well-known/acme-challenge/token is under it but /.well-known/acme-challenges isn't.
+func WithHTTPForceHTTPSExcept(paths ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.forceHTTPS = true
+		opts.forceHTTPSExcept = append(opts.forceHTTPSExcept, paths...)
+	})
+}
+
+// WithHTTPCompression compresses the responses of the local server with the first algorithm
+// of algos accepted by the user, "gzip", "br" (brotli) and "deflate" are supported,
+// e.g. WithHTTPCompression("br", "gzip") prefers brotli for the users accepting both.
+//
+// The responses which are encoded already, e.g. images, or streamed, e.g. text/event-stream,
+// are not compressed, neither are the upgraded connections, e.g. websocket.
+// Unsupported algorithms make StartTunnel fail.
+func WithHTTPCompression(algos ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.compression = algos
+	})
+}
+
+// WithHTTPCompressionMinSize only compresses the responses of at least the bytes,
+// it defaults to 1024, the responses of unknown size are always compressed.
+func WithHTTPCompressionMinSize(bytes int) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.compressionMinSize = bytes
+	})
+}
+
+// WithHTTPCache caches the GET responses of the local server in the client up to maxSize bytes,
+// the least recently used responses are evicted first.
+//
+// The Cache-Control of the responses is respected, the responses without max-age are cached
+// for defaultTTL, or not cached if it's zero. The responses which vary by the headers
+// of the requests are cached per the values of the Vary headers.
+// The requests with the CacheBypassHeader always reach the local server, and Tunnel.PurgeCache
+// drops all the cached responses, e.g. after a deployment.
+func WithHTTPCache(maxSize int64, defaultTTL time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.cacheMaxSize = maxSize
+		opts.cacheTTL = defaultTTL
+	})
+}
+
+// WithHTTPMaxRequestBody rejects the requests with the body larger than the bytes with 413.
+//
+// The requests are rejected before reaching the local server if the Content-Length is larger,
+// otherwise the body is streamed to the local server and cut off once it exceeds the bytes,
+// the body is never buffered. The rejected requests are counted in TunnelStatus.RejectedRequests.
+func WithHTTPMaxRequestBody(bytes int64) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.maxRequestBody = bytes
+	})
+}
+
+// WithHTTPAllowedMethods only proxies the requests of the methods to the local server, e.g. GET and HEAD
+// for a read-only mirror, the requests of the other methods are responded with 405 and the Allow header.
+// The methods are case-insensitive, the calls are merged, and no method means all of them are allowed.
+// Note the CORS preflight requests are OPTIONS. The rejected requests are counted in TunnelStatus.RejectedRequests.
+func WithHTTPAllowedMethods(methods ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.allowedMethods = normalizeMethods(append(opts.allowedMethods, methods...))
+	})
+}
+
+// WithHTTPHostHeader sets the Host of the requests proxied to the local server, e.g. for the local servers
+// routing by the virtual hosts:
+//
+//   - "preserve" forwards the Host of the user, e.g. "app.example.com", it's the default.
+//   - "rewrite" sets it to the local address, or the upstream of WithHTTPUpstreams picked for the request,
+//     e.g. "127.0.0.1:8080", the unix sockets are "localhost".
+//   - "custom:<host>" sets it to the host, e.g. "custom:app.internal".
+//
+// The redirects of WithHTTPRewriteRedirects still go to the Host of the user. The mode is in TunnelStatus.HostHeader.
+func WithHTTPHostHeader(mode string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.hostHeader, opts.hostHeaderErr = parseHostHeader(mode)
+	})
+}
+
+// WithHTTPAccessLog writes a line to w for each proxied request once the response is sent,
+// the format is DefaultAccessLogFormat unless WithHTTPAccessLogFormat is used.
+//
+// The lines are written in a separate goroutine, so a slow w never blocks the requests,
+// the lines are dropped if w can't keep up.
+func WithHTTPAccessLog(w io.Writer) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.accessLogWriter = w
+	})
+}
+
+// WithHTTPAccessLogFormat sets the format of the lines of WithHTTPAccessLog,
+// the variables are $time, $method, $path, $proto, $host, $status, $bytes, $duration,
+// $duration_ms, $client_ip, $user_agent and $connection_id, they can also be written as ${method}.
+func WithHTTPAccessLogFormat(format string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.accessLogFormat = format
+	})
+}
+
+// WithHTTPAccessLogFunc calls fn with the entry of each proxied request once the response is sent,
+// it can be used with or without WithHTTPAccessLog. Like the lines, fn is called in a separate goroutine.
+func WithHTTPAccessLogFunc(fn func(AccessLogEntry)) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.accessLogFunc = fn
+	})
+}
+
+// WithHTTPInspect retains the latest maxRequests requests and their responses for debugging,
+// see Client.RecentRequests. The bodies are truncated to maxBodyBytes, and the truncation
+// is flagged in the InspectedRequest. The headers are retained as is unless WithHTTPInspectRedact is used.
+func WithHTTPInspect(maxRequests int, maxBodyBytes int) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.inspectMaxRequests = maxRequests
+		opts.inspectMaxBodyBytes = maxBodyBytes
+	})
+}
+
+// WithHTTPInspectRedact replaces the values of the headers with "[REDACTED]" in the requests
+// and the responses retained by WithHTTPInspect, e.g. Authorization and Cookie.
+// The headers proxied to the local server and the user are never changed.
+func WithHTTPInspectRedact(headers ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.inspectRedact = append(opts.inspectRedact, headers...)
+	})
+}
+
+// WithHTTPMirror copies the fraction of the requests, 0 to 1, to the mirror at addr, e.g. a new version
+// of the local server, and discards the responses of it, the user is always served by the local server.
+// The addr is host:port or a unix domain socket like the local address.
+//
+// The copy is sent once the local server responds, and the failures of the mirror never affect the response,
+// they're counted in TunnelStatus.MirrorErrors. The requests are sampled at random unless
+// WithHTTPMirrorSampleKey or WithHTTPMirrorSeed is used, and the bodies larger than WithHTTPMirrorMaxBody
+// aren't mirrored, neither are the upgrade requests like websocket.
+func WithHTTPMirror(addr string, fraction float64) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.mirrorAddr = addr
+		opts.mirrorFraction = fraction
+	})
+}
+
+// WithHTTPMirrorSampleKey samples the requests of WithHTTPMirror by the value of the header,
+// e.g. a user id, the requests with the same value are either all mirrored or none of them.
+// The requests without the header are sampled at random.
+func WithHTTPMirrorSampleKey(header string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.mirrorSampleKey = header
+	})
+}
+
+// WithHTTPMirrorSeed makes the sampling of WithHTTPMirror reproducible, the random sampling follows the same
+// sequence for the same seed, and the seed is mixed into the hash of WithHTTPMirrorSampleKey,
+// so a different seed samples another set of the keys.
+func WithHTTPMirrorSeed(seed uint64) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.mirrorSeed = seed
+		opts.mirrorSeeded = true
+	})
+}
+
+// WithHTTPMirrorMaxBody caps the bodies buffered for WithHTTPMirror, it defaults to 1 MiB.
+// The requests with the larger bodies are served as usual but not mirrored, the bodies are never truncated.
+func WithHTTPMirrorMaxBody(bytes int64) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.mirrorMaxBody = bytes
+	})
+}
+
+// WithHTTPCircuitBreaker stops proxying the requests to the local server after failureThreshold
+// consecutive failures, the failures are the 5xx responses and the failed connections to the local server.
+//
+// Once the breaker is open, the requests are responded with 503 immediately for openDuration,
+// then a single request is proxied to probe the local server, the breaker is closed if it succeeds,
+// or open again if it fails. The openDuration defaults to 30 seconds.
+// EventBreakerState is emitted on each transition, and TunnelStatus.Breaker is the current state.
+func WithHTTPCircuitBreaker(failureThreshold int, openDuration time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		if openDuration <= 0 {
+			openDuration = defaultBreakerOpenDuration
+		}
+		opts.breakerThreshold = max(failureThreshold, 1)
+		opts.breakerOpenDuration = openDuration
+	})
+}
+
+// WithHTTPUpgradeTimeout sets how long to wait for the local server to finish
+// the upgrade handshake, e.g. websocket, it defaults to 10 seconds.
+//
+// Once the protocol is switched, the bytes are streamed in both directions as is.
+func WithHTTPUpgradeTimeout(timeout time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.upgradeTimeout = timeout
+	})
+}
+
+// WithHTTPRequestTimeout responds 504 if the local server doesn't respond the headers within the timeout
+// after the request is sent, it covers the time to the first byte rather than the whole response,
+// so the large downloads and the streaming responses like SSE aren't limited once they start,
+// see WithHTTPResponseIdleTimeout for them. It defaults to no timeout.
+//
+// The upgrade requests like websocket have WithHTTPUpgradeTimeout instead.
+func WithHTTPRequestTimeout(timeout time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.requestTimeout = timeout
+	})
+}
+
+// WithHTTPResponseIdleTimeout aborts the response of which the local server sends nothing for the timeout,
+// e.g. a stalled download or SSE stream, the response sent so far is kept and the rest is dropped.
+// It defaults to no timeout, the SSE streams sending no heartbeats need a long timeout.
+func WithHTTPResponseIdleTimeout(timeout time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.responseIdleTimeout = timeout
+	})
+}
+
+// WithHTTPWebSocketKeepAlive pings the users of the websocket connections once they're idle for the interval,
+// e.g. behind the proxies which drop the idle connections quickly, and closes the connections of which the users
+// don't respond within the interval. The pongs of the pings aren't forwarded to the local server.
+//
+// The other frames are proxied as is, and so is the handshake, including Sec-WebSocket-Protocol and
+// Sec-WebSocket-Extensions, the pings are only sent between the frames of the local server.
+func WithHTTPWebSocketKeepAlive(interval time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.wsKeepAlive = interval
+	})
+}
+
+// WithHTTPProtocols sets the protocols which the server negotiates with the users by ALPN,
+// "h2" and "http/1.1" in the order of preference, it defaults to "http/1.1" only.
+//
+// With "h2", the server terminates HTTP/2, with tls or in cleartext(h2c), and forwards
+// the connection in h2c, each stream of the connection is proxied as a separate request
+// to the local server, which still speaks HTTP/1.1 unless WithHTTPLocalTLS negotiates HTTP/2.
+//
+// It needs the support of the server, castled ignores it and serves HTTP/1.1 only,
+// the tunnel still starts then, with an EventWarning.
+func WithHTTPProtocols(protocols ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.protocols = protocols
+	})
+}
+
+// WithHTTPErrorPage responds the content instead of the bare error for the statusCode,
+// e.g. 502 if the local server is down, 503 if the circuit breaker is open, or 504 if it times out.
+// The statusCode 0 is the catch-all page of the errors without their own pages.
+//
+// Only the errors generated by the tunnel are replaced, the responses from the local server are proxied as is.
+func WithHTTPErrorPage(statusCode int, contentType string, body []byte) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		if err := validateErrorPage(statusCode); err != nil {
+			opts.errorPagesErr = errors.Join(opts.errorPagesErr, err)
+			return
+		}
+		if opts.errorPages == nil {
+			opts.errorPages = make(errorPages)
+		}
+		opts.errorPages[statusCode] = errorPage{contentType: contentType, body: body}
+	})
+}
+
+// WithHTTPFallback serves the requests by the handler in the client if the local server can't be connected,
+// e.g. a maintenance page while it's down, rather than 502. The responses of the local server, including
+// the 5xx ones, and the other failures once it's connected, e.g. WithHTTPRequestTimeout, are never replaced.
+//
+// The handler runs after the dial retries of WithLocalDialRetries run out, each failed dial is still
+// emitted as EventLocalDialFailed, and the requests see the other middlewares like WithHTTPBasicAuth.
+func WithHTTPFallback(handler http.Handler) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.fallback = handler
+	})
+}
+
+// WithHTTPLocalScheme sets the scheme of the local server, "http" or "https", it defaults to "http".
+// With "https", the certificate of the local server is verified with the system roots,
+// use WithHTTPLocalTLS to trust a self-signed certificate or override the ServerName.
+func WithHTTPLocalScheme(scheme string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.localScheme = scheme
+	})
+}
+
+// WithHTTPLocalTLS connects to the local server over https with the config, it implies
+// WithHTTPLocalScheme("https"). The ServerName defaults to the host of the local address,
+// and HTTP/2 is negotiated if the local server supports it.
+func WithHTTPLocalTLS(config *tls.Config) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.localTLS = config
+	})
+}
+
+// WithHTTPFlushInterval flushes the responses to the user periodically by the interval
+// while they are streamed, a negative interval flushes after each write.
+//
+// The responses of text/event-stream and the responses without Content-Length
+// are always flushed after each write, so the events are never buffered.
+// Without the other http options, the traffic is forwarded as is and it's never buffered either.
+func WithHTTPFlushInterval(interval time.Duration) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.flushInterval = interval
+	})
+}
+
+// WithStaticDirectoryListing lists the entries of the directories without index files of NewStaticTunnel,
+// they're responded 403 by default.
+func WithStaticDirectoryListing(enabled bool) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.staticListing = enabled
+		opts.staticOptions = true
+	})
+}
+
+// WithStaticIndexFiles sets the files served for the directories of NewStaticTunnel, the first one found is served,
+// it defaults to "index.html". No index files, i.e. WithStaticIndexFiles(), always lists the directories
+// if WithStaticDirectoryListing is enabled.
+func WithStaticIndexFiles(names ...string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.staticIndex = append([]string{}, names...)
+		opts.staticOptions = true
+	})
+}
+
+// WithStaticSPAFallback serves the file at indexPath, relative to the root directory of NewStaticTunnel,
+// for the missing paths without an extension, e.g. the client-side routes like /users/1 of a single-page app,
+// the missing paths with an extension like /app.js are still 404.
+func WithStaticSPAFallback(indexPath string) HTTPOption {
+	return httpOptionFunc(func(opts *httpOptions) {
+		opts.staticFallback = indexPath
+		opts.staticOptions = true
+	})
+}
+
+// HTTPOption configures a HTTP tunnel.
+type HTTPOption interface {
+	applyHTTP(*httpOptions)
+}
+
+type httpOptionFunc func(*httpOptions)
+
+func (f httpOptionFunc) applyHTTP(opts *httpOptions) { f(opts) }
+
+// NewStaticTunnel creates a http tunnel which serves the files of the rootDir rather than a local server,
+// the other http options like WithHTTPSubDomain, WithHTTPBasicAuth or WithHTTPCompression apply as usual.
+//
+// Only GET and HEAD are allowed, the content types are told by the extensions, or sniffed from the contents,
+// and the ranges and the conditional requests are supported. The directories are served by the index files of
+// WithStaticIndexFiles, see WithStaticDirectoryListing and WithStaticSPAFallback for the others.
+// The upstreams and the options of the local server can't be used.
+func NewStaticTunnel(name, rootDir string, options ...HTTPOption) *Tunnel {
+	return NewHTTPTunnel(name, "", append(options, httpOptionFunc(func(opts *httpOptions) {
+		opts.staticRoot = rootDir
+	}))...)
+}
 
 // NewHTTPTunnel creates a new HTTP tunnel.
 //
 // Without any option, the default behavior is to create a tunnel with a random port.
+// The localAddr is host:port, or the path of a unix domain socket like "unix:///run/app.sock".
 func NewHTTPTunnel(name, localAddr string, options ...HTTPOption) *Tunnel {
-	if len(options) > 1 {
-		panic("only one option is allowed")
-	}
-
 	opts := &httpOptions{
 		pbFn: func() *proto.HTTPConfig {
 			return &proto.HTTPConfig{}
 		},
 	}
 	for _, option := range options {
-		option(opts)
+		option.applyHTTP(opts)
 	}
 
-	return &Tunnel{
+	tunnel := &Tunnel{
 		Tunnel: proto.Tunnel{
 			Name: name,
 			Config: &proto.Tunnel_Http{
 				Http: opts.pbFn(),
 			},
 		},
-		LocalAddr: localAddr,
+		Name:       name,
+		LocalAddr:  localAddr,
+		http:       newHTTPProxy(opts),
+		cert:       opts.cert,
+		pathPrefix: opts.pathPrefix,
+		matches:    normalizeMatches(opts.matches),
+	}
+	opts.tunnelOptions.apply(tunnel)
+	if tunnel.http != nil {
+		// the requests are paced by the proxy, share its limiter for the config updates.
+		tunnel.connLimit = tunnel.http.connLimit
+	}
+
+	if opts.entrypoints > 1 {
+		tunnel.err = errors.Join(tunnel.err, errors.New("only one of port, domain, wildcard domain, subdomain and random subdomain options is allowed"))
+	}
+	if opts.trustedErr != nil {
+		tunnel.err = errors.Join(tunnel.err, opts.trustedErr)
+	}
+	if opts.wildcardErr != nil {
+		tunnel.err = errors.Join(tunnel.err, opts.wildcardErr)
+	}
+	if opts.hostHeaderErr != nil {
+		tunnel.err = errors.Join(tunnel.err, opts.hostHeaderErr)
+	}
+	if err := validateWeights(opts.weights); err != nil {
+		tunnel.err = errors.Join(tunnel.err, err)
+	}
+	if err := validateCompression(opts.compression); err != nil {
+		tunnel.err = errors.Join(tunnel.err, err)
+	}
+	if opts.mirrorAddr != "" {
+		if err := validateMirror(opts); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+	}
+	if opts.staticRoot != "" {
+		if err := validateStatic(opts); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+	} else if opts.staticOptions {
+		tunnel.err = errors.Join(tunnel.err, errors.New("the static options are only for NewStaticTunnel"))
+	}
+	if opts.forceHTTPS {
+		if opts.cert == nil {
+			tunnel.warnings = append(tunnel.warnings, errors.New("force https is ignored without tls"))
+		} else {
+			md := opts.forceHTTPSExcept
+			if len(md) == 0 {
+				md = []string{""}
+			}
+			tunnel.md.Append(metadataHTTPForceHTTPS, md...)
+		}
+	}
+	if len(opts.protocols) > 0 {
+		if err := validateProtocols(opts.protocols); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+		tunnel.md.Append(metadataHTTPProtocols, strings.Join(opts.protocols, ","))
+	}
+	if opts.grpc {
+		tunnel.md.Append(metadataGRPC, "true")
+	}
+	if opts.errorPagesErr != nil {
+		tunnel.err = errors.Join(tunnel.err, opts.errorPagesErr)
+	}
+	switch opts.localScheme {
+	case "", "http", "https":
+	default:
+		tunnel.err = errors.Join(tunnel.err, fmt.Errorf("unsupported local scheme %q", opts.localScheme))
+	}
+	if opts.maxRequestBody > 0 {
+		tunnel.md.Append(metadataHTTPMaxRequestBody, strconv.FormatInt(opts.maxRequestBody, 10))
+	}
+	if len(opts.allowedMethods) > 0 {
+		if err := validateMethods(opts.allowedMethods); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+		tunnel.md.Append(metadataHTTPAllowedMethods, opts.allowedMethods...)
+	}
+	if opts.pathPrefix != "" {
+		if err := validatePathPrefix(opts.pathPrefix); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+		}
+		tunnel.md.Append(metadataHTTPPathPrefix, opts.pathPrefix)
+	}
+	if _, ok := opts.cookieDomains[""]; ok {
+		tunnel.err = errors.Join(tunnel.err, errors.New("the cookie domain to rewrite is empty"))
+	}
+	for _, m := range tunnel.matches {
+		if err := m.validate(); err != nil {
+			tunnel.err = errors.Join(tunnel.err, err)
+			continue
+		}
+		if m.header {
+			tunnel.md.Append(metadataHTTPMatchHeader, m.String())
+		} else {
+			tunnel.md.Append(metadataHTTPMatchQuery, m.String())
+		}
+	}
+
+	if opts.certErr != nil {
+		tunnel.err = errors.Join(tunnel.err, opts.certErr)
+	}
+	if opts.cert != nil {
+		if domain := tunnel.GetHttp().Domain; domain != "" {
+			if err := opts.cert.verify(domain); err != nil {
+				tunnel.err = errors.Join(tunnel.err, err)
+			}
+		}
+		tunnel.md.Append(metadataTLSCert, string(opts.cert.certPEM))
+		tunnel.md.Append(metadataTLSKey, string(opts.cert.keyPEM))
+	}
+	return tunnel
+}
+
+type grpcOptions struct {
+	// http are the options of the underlying http tunnel.
+	http       []HTTPOption
+	reflection bool
+}
+
+// GRPCOption configures a gRPC tunnel.
+type GRPCOption interface {
+	applyGRPC(*grpcOptions)
+}
+
+type grpcOptionFunc func(*grpcOptions)
+
+func (f grpcOptionFunc) applyGRPC(opts *grpcOptions) { f(opts) }
+
+// withGRPCHTTP applies the http options to the gRPC tunnel.
+func withGRPCHTTP(options ...HTTPOption) GRPCOption {
+	return grpcOptionFunc(func(opts *grpcOptions) {
+		opts.http = append(opts.http, options...)
+	})
+}
+
+// WithGRPCPort is WithHTTPPort of the gRPC tunnel.
+func WithGRPCPort(port uint16) GRPCOption {
+	return withGRPCHTTP(WithHTTPPort(port))
+}
+
+// WithGRPCDomain is WithHTTPDomain of the gRPC tunnel.
+func WithGRPCDomain(domain string) GRPCOption {
+	return withGRPCHTTP(WithHTTPDomain(domain))
+}
+
+// WithGRPCSubdomain is WithHTTPSubDomain of the gRPC tunnel.
+func WithGRPCSubdomain(subdomain string) GRPCOption {
+	return withGRPCHTTP(WithHTTPSubDomain(subdomain))
+}
+
+// WithGRPCRandomSubdomain is WithHTTPRandomSubdomain of the gRPC tunnel.
+func WithGRPCRandomSubdomain() GRPCOption {
+	return withGRPCHTTP(WithHTTPRandomSubdomain())
+}
+
+// WithGRPCTLS is WithHTTPTLS of the gRPC tunnel, the server terminates the TLS with the certificate.
+func WithGRPCTLS(certPEM, keyPEM []byte) GRPCOption {
+	return withGRPCHTTP(WithHTTPTLS(certPEM, keyPEM))
+}
+
+// WithGRPCLocalTLS is WithHTTPLocalTLS of the gRPC tunnel, the local server speaks gRPC over TLS.
+func WithGRPCLocalTLS(config *tls.Config) GRPCOption {
+	return withGRPCHTTP(WithHTTPLocalTLS(config))
+}
+
+// WithGRPCReflection passes the requests of the reflection service through to the local server,
+// e.g. for grpcurl. Without it, they are responded with Unimplemented by the tunnel.
+func WithGRPCReflection(enabled bool) GRPCOption {
+	return grpcOptionFunc(func(opts *grpcOptions) {
+		opts.reflection = enabled
+	})
+}
+
+// NewGRPCTunnel creates a tunnel to the local gRPC server, it's a http tunnel which
+// the server terminates HTTP/2 for and forwards the trailers of.
+//
+// The local server is proxied in h2c unless WithGRPCLocalTLS is used, each rpc is
+// a separate request, and the streaming rpcs are flushed in both directions as the
+// messages arrive, so the bidirectional streaming works end to end. If the local server
+// is unavailable, the rpcs fail with the gRPC status Unavailable rather than a http error.
+func NewGRPCTunnel(name, localAddr string, options ...GRPCOption) *Tunnel {
+	opts := &grpcOptions{}
+	for _, option := range options {
+		option.applyGRPC(opts)
 	}
+	return NewHTTPTunnel(name, localAddr, append(opts.http,
+		WithHTTPProtocols(protocolHTTP2),
+		httpOptionFunc(func(httpOpts *httpOptions) {
+			httpOpts.grpc = true
+			httpOpts.grpcReflection = opts.reflection
+		}),
+	)...)
 }
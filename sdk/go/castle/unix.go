@@ -0,0 +1,74 @@
+package castle
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// unixScheme is the prefix of the local addresses of unix domain sockets, e.g. "unix:///run/app.sock".
+const unixScheme = "unix://"
+
+// unixHostSuffix is the suffix of the placeholder hosts of the unix sockets in the proxied http requests.
+const unixHostSuffix = ".unix.castle"
+
+// unixSocketPath returns the path of the socket if addr is a unix domain socket address.
+func unixSocketPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, unixScheme)
+}
+
+// validateLocalAddr checks the local address is either host:port or an absolute unix socket path,
+// the socket itself is checked when it's dialed.
+func validateLocalAddr(addr string) error {
+	if path, ok := unixSocketPath(addr); ok {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("invalid local address %q: the unix socket path should be absolute", addr)
+		}
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return fmt.Errorf("invalid local address %q: %w", addr, err)
+	}
+	return nil
+}
+
+// unixNetwork returns the network and the address to dial the unix socket for the network of the tunnel.
+func unixNetwork(network, path string) (string, string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", "", fmt.Errorf("local unix socket is not available: %w", err)
+	}
+	if strings.HasPrefix(network, "udp") {
+		return "unixgram", path, nil
+	}
+	return "unix", path, nil
+}
+
+// urlHost returns the host of the local address in the URL of a proxied http request,
+// a unix socket is replaced with a placeholder host, which is mapped back by unixAddrOf when dialing.
+func urlHost(addr string) string {
+	path, ok := unixSocketPath(addr)
+	if !ok {
+		return addr
+	}
+	return hex.EncodeToString([]byte(path)) + unixHostSuffix
+}
+
+// unixAddrOf returns the unix socket address of the placeholder hostport made by urlHost.
+func unixAddrOf(hostport string) (string, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	encoded, ok := strings.CutSuffix(host, unixHostSuffix)
+	if !ok {
+		return "", false
+	}
+	path, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return unixScheme + string(path), true
+}
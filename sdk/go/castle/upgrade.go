@@ -0,0 +1,171 @@
+package castle
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultUpgradeTimeout is the default timeout of the upgrade handshake with the local server.
+const defaultUpgradeTimeout = 10 * time.Second
+
+// upgradeHandler proxies the upgrade requests like websocket to the local server,
+// once the local server switches the protocol, it streams the raw bytes in both directions.
+//
+// Unlike httputil.ReverseProxy, which closes the connection once either direction ends,
+// the upgradeHandler propagates the half-close to the other side,
+// and closes the connection after both directions end.
+type upgradeHandler struct {
+	localAddr func() string
+	timeout   time.Duration
+	dial      func(ctx context.Context, network, addr string) (net.Conn, error)
+	// tlsConfig is set if the local server speaks https.
+	tlsConfig *tls.Config
+	logger    *slog.Logger
+	// wsKeepAlive is the interval of WithHTTPWebSocketKeepAlive.
+	wsKeepAlive time.Duration
+	// fallback serves the requests if the local server can't be connected, see WithHTTPFallback.
+	fallback http.Handler
+	// next handles the requests which are not upgrade requests.
+	next http.Handler
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *upgradeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isUpgradeRequest(r) {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	timeout := h.timeout
+	if timeout <= 0 {
+		timeout = defaultUpgradeTimeout
+	}
+	dialCtx, cancel := context.WithTimeout(r.Context(), timeout)
+	addr := upstreamAddr(r.Context(), h.localAddr())
+	backend, err := h.dial(dialCtx, "tcp", addr)
+	if err == nil && h.tlsConfig != nil {
+		// the upgrade requests are written on the conn in http/1.1 as is.
+		backend, err = dialLocalTLS(dialCtx, backend, h.tlsConfig, addr, "http/1.1")
+	}
+	cancel()
+	if err != nil {
+		h.logger.Error("failed to dial local server for upgrade", slog.Any("error", err))
+		if h.fallback != nil && isLocalDialError(err) {
+			h.fallback.ServeHTTP(w, r)
+			return
+		}
+		proxyError(w, r, http.StatusBadGateway, "")
+		return
+	}
+	defer backend.Close()
+
+	backend.SetDeadline(time.Now().Add(timeout))
+	if _, ok := r.Header["User-Agent"]; !ok {
+		// prevent Request.Write from adding the default user agent
+		r.Header.Set("User-Agent", "")
+	}
+	if err := r.Write(backend); err != nil {
+		h.logger.Error("failed to send upgrade request to local server", slog.Any("error", err))
+		proxyError(w, r, http.StatusBadGateway, "")
+		return
+	}
+	backendReader := bufio.NewReader(backend)
+	resp, err := http.ReadResponse(backendReader, r)
+	if err != nil {
+		h.logger.Error("failed to read upgrade response from local server", slog.Any("error", err))
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			proxyError(w, r, http.StatusGatewayTimeout, "")
+		} else {
+			proxyError(w, r, http.StatusBadGateway, "")
+		}
+		return
+	}
+	backend.SetDeadline(time.Time{})
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// the local server refuses to switch the protocol, respond as usual.
+		defer resp.Body.Close()
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		h.logger.Error("failed to hijack the upgrade connection", slog.Any("error", err))
+		proxyError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	defer conn.Close()
+	if sc, ok := conn.(*streamConn); ok {
+		// the end of the traffic means the user closes writing from now on.
+		sc.holdEOF.Store(false)
+	}
+
+	if err := resp.Write(brw); err != nil {
+		h.logger.Error("failed to send upgrade response", slog.Any("error", err))
+		return
+	}
+	if err := brw.Flush(); err != nil {
+		h.logger.Error("failed to send upgrade response", slog.Any("error", err))
+		return
+	}
+
+	toBackend := func() { io.Copy(backend, brw) }
+	toUser := func() { io.Copy(conn, backendReader) }
+	if h.wsKeepAlive > 0 && isWebSocket(resp) {
+		keepAlive := newWSKeepAlive(h.wsKeepAlive, conn)
+		done := make(chan struct{})
+		defer close(done)
+		go keepAlive.run(backend, done)
+		toBackend = func() { keepAlive.copyFromUser(backend, brw.Reader) }
+		toUser = func() { keepAlive.copyToUser(backendReader) }
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		toBackend()
+		closeWrite(backend)
+	}()
+	go func() {
+		defer wg.Done()
+		toUser()
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+// closeWrite shuts down the writing side of the conn if it supports half-close.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+}
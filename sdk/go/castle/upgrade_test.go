@@ -0,0 +1,186 @@
+package castle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// writeClientFrame writes a masked websocket text frame.
+func writeClientFrame(v *fakeVisitor, payload string) {
+	writeClientFrameOp(v, 0x1, payload)
+}
+
+// writeClientFrameOp writes a masked websocket frame of the opcode.
+func writeClientFrameOp(v *fakeVisitor, opcode byte, payload string) {
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i := 0; i < len(payload); i++ {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+	v.send(frame)
+}
+
+// readServerFrame reads an unmasked websocket frame and returns the payload.
+func readServerFrame(t *testing.T, r io.Reader) string {
+	t.Helper()
+	_, payload := readServerFrameOp(t, r)
+	return payload
+}
+
+// readServerFrameOp reads an unmasked websocket frame and returns the opcode and the payload.
+func readServerFrameOp(t *testing.T, r io.Reader) (byte, string) {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			t.Fatal(err)
+		}
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, string(payload)
+}
+
+func TestHTTPWebSocketUpgrade(t *testing.T) {
+	local := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		io.Copy(ws, ws)
+	}))
+	defer local.Close()
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPBasicAuth("user", "pass"),
+	))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.SetBasicAuth("user", "pass")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	var raw bytes.Buffer
+	req.Write(&raw)
+
+	visitor := server.visit(t, 0)
+	visitor.send(raw.Bytes())
+
+	reader := bufio.NewReader(visitor)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+
+	writeClientFrame(visitor, "hello")
+	if got := readServerFrame(t, reader); got != "hello" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+	writeClientFrame(visitor, "world")
+	if got := readServerFrame(t, reader); got != "world" {
+		t.Fatalf("unexpected echo: %q", got)
+	}
+
+	// half-close the user side, the local server quits the echo loop and closes the connection.
+	visitor.finish()
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPWebSocketKeepAlive(t *testing.T) {
+	protocols := make(chan string, 1)
+	local := httptest.NewServer(websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			protocols <- r.Header.Get("Sec-WebSocket-Protocol")
+			config.Protocol = []string{"chat"}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			io.Copy(ws, ws)
+		},
+	})
+	defer local.Close()
+
+	server := startHTTPTunnel(t, NewHTTPTunnel("test", strings.TrimPrefix(local.URL, "http://"),
+		WithHTTPWebSocketKeepAlive(100*time.Millisecond),
+	))
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat, superchat")
+	var raw bytes.Buffer
+	req.Write(&raw)
+
+	visitor := server.visit(t, 0)
+	visitor.send(raw.Bytes())
+	reader := bufio.NewReader(visitor)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	if got := <-protocols; got != "chat, superchat" {
+		t.Fatalf("unexpected subprotocols sent to the local server: %q", got)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat" {
+		t.Fatalf("unexpected negotiated subprotocol: %q", got)
+	}
+
+	// the idle connection is pinged, and kept after the pong.
+	if opcode, payload := readServerFrameOp(t, reader); opcode != wsOpPing || payload != string(wsPingPayload) {
+		t.Fatalf("expected a ping, got the opcode %d of %q", opcode, payload)
+	}
+	writeClientFrameOp(visitor, wsOpPong, string(wsPingPayload))
+	writeClientFrame(visitor, "hello")
+	for {
+		opcode, payload := readServerFrameOp(t, reader)
+		if opcode == wsOpPing {
+			continue
+		}
+		if payload != "hello" {
+			t.Fatalf("unexpected echo: %q", payload)
+		}
+		break
+	}
+
+	// the connection is closed once the pings aren't answered.
+	closed := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(reader)
+		closed <- err
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection without pongs to be closed")
+	}
+}
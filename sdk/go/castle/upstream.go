@@ -0,0 +1,97 @@
+package castle
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// upstream is a local address which serves the requests of a http tunnel.
+type upstream struct {
+	addr string
+	// id identifies the upstream in the sticky session cookie.
+	id string
+	// weight is of WithHTTPWeightedUpstreams, 0 means no new user.
+	weight  int
+	healthy atomic.Bool
+}
+
+// upstreamPool balances the requests of a http tunnel across the upstreams,
+// the requests are routed in the weighted round-robin, the unhealthy upstreams are skipped.
+type upstreamPool struct {
+	upstreams []*upstream
+	wrr       *weightedRoundRobin
+	// stickyCookie is the name of the cookie which binds a user to an upstream,
+	// empty means no sticky session.
+	stickyCookie string
+}
+
+func newUpstreamPool(addrs []string, weights []int, stickyCookie string) *upstreamPool {
+	p := &upstreamPool{stickyCookie: stickyCookie, wrr: newWeightedRoundRobin(weights)}
+	for i, addr := range addrs {
+		h := fnv.New64a()
+		h.Write([]byte(addr))
+		u := &upstream{
+			addr:   addr,
+			id:     strconv.FormatUint(h.Sum64(), 36),
+			weight: weights[i],
+		}
+		u.healthy.Store(true)
+		p.upstreams = append(p.upstreams, u)
+	}
+	return p
+}
+
+// pick returns the upstream for the request, it returns nil if all the upstreams are unhealthy or drained.
+// The users of the sticky session stay on a drained upstream until it becomes unhealthy.
+func (p *upstreamPool) pick(r *http.Request) *upstream {
+	if p.stickyCookie != "" {
+		if cookie, err := r.Cookie(p.stickyCookie); err == nil {
+			for _, u := range p.upstreams {
+				if u.id == cookie.Value && u.healthy.Load() {
+					return u
+				}
+			}
+		}
+	}
+
+	i := p.wrr.next(func(i int) bool { return p.upstreams[i].healthy.Load() })
+	if i < 0 {
+		return nil
+	}
+	return p.upstreams[i]
+}
+
+func (p *upstreamPool) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := p.pick(r)
+		if u == nil {
+			proxyError(w, r, http.StatusServiceUnavailable, "no healthy upstream")
+			return
+		}
+		if p.stickyCookie != "" {
+			if cookie, err := r.Cookie(p.stickyCookie); err != nil || cookie.Value != u.id {
+				http.SetCookie(w, &http.Cookie{
+					Name:     p.stickyCookie,
+					Value:    u.id,
+					Path:     "/",
+					HttpOnly: true,
+				})
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamKey{}, u.addr)))
+	})
+}
+
+type upstreamKey struct{}
+
+// upstreamAddr returns the address of the upstream picked for the request,
+// or the fallback if the tunnel has only one upstream.
+func upstreamAddr(ctx context.Context, fallback string) string {
+	if addr, ok := ctx.Value(upstreamKey{}).(string); ok {
+		return addr
+	}
+	return fallback
+}
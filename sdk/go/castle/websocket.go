@@ -0,0 +1,193 @@
+package castle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	wsOpPing byte = 0x9
+	wsOpPong byte = 0xa
+)
+
+// wsPingPayload is the payload of the pings of WithHTTPWebSocketKeepAlive,
+// the pongs of it are answered to the client rather than the local server, so they're not forwarded.
+var wsPingPayload = []byte("castle-keepalive")
+
+func isWebSocket(resp *http.Response) bool {
+	return strings.EqualFold(resp.Header.Get("Upgrade"), "websocket")
+}
+
+// wsFrameHeader is the header of a websocket frame as is, with the length of the payload.
+type wsFrameHeader struct {
+	raw    []byte
+	opcode byte
+	mask   []byte
+	length int64
+}
+
+func readWSFrameHeader(r *bufio.Reader) (*wsFrameHeader, error) {
+	raw := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return nil, err
+	}
+	header := &wsFrameHeader{opcode: raw[0] & 0x0f, length: int64(raw[1] & 0x7f)}
+	var ext int
+	switch header.length {
+	case 126:
+		ext = 2
+	case 127:
+		ext = 8
+	}
+	masked := raw[1]&0x80 != 0
+	if masked {
+		ext += 4
+	}
+	if ext > 0 {
+		raw = raw[:2+ext]
+		if _, err := io.ReadFull(r, raw[2:]); err != nil {
+			return nil, err
+		}
+	}
+	switch header.length {
+	case 126:
+		header.length = int64(binary.BigEndian.Uint16(raw[2:4]))
+	case 127:
+		header.length = int64(binary.BigEndian.Uint64(raw[2:10]) & (1<<63 - 1))
+	}
+	if masked {
+		header.mask = raw[len(raw)-4:]
+	}
+	header.raw = raw
+	return header, nil
+}
+
+// wsKeepAlive pings the user of a websocket connection once it's idle for the interval,
+// and closes the connection if the user doesn't respond within the interval.
+//
+// The frames of both directions are parsed to ping between them, and to drop the pongs of the pings,
+// the payloads are streamed as is, including the compressed ones of permessage-deflate.
+type wsKeepAlive struct {
+	interval time.Duration
+	user     net.Conn
+	// mu serializes the frames written to the user.
+	mu sync.Mutex
+	// lastActive is the time of the last frame in either direction, lastUser is of the last frame from the user.
+	lastActive atomic.Int64
+	lastUser   atomic.Int64
+}
+
+func newWSKeepAlive(interval time.Duration, user net.Conn) *wsKeepAlive {
+	k := &wsKeepAlive{interval: interval, user: user}
+	now := time.Now().UnixNano()
+	k.lastActive.Store(now)
+	k.lastUser.Store(now)
+	return k
+}
+
+// run pings the user until done is closed, it closes the user and the backend if the user doesn't respond.
+func (k *wsKeepAlive) run(backend net.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(k.interval / 2)
+	defer ticker.Stop()
+	var pingAt time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if !pingAt.IsZero() {
+				if k.lastUser.Load() >= pingAt.UnixNano() {
+					pingAt = time.Time{}
+				} else if now.Sub(pingAt) >= k.interval {
+					k.user.Close()
+					backend.Close()
+					return
+				}
+			}
+			if pingAt.IsZero() && now.Sub(time.Unix(0, k.lastActive.Load())) >= k.interval {
+				if err := k.ping(); err != nil {
+					return
+				}
+				pingAt = now
+			}
+		}
+	}
+}
+
+func (k *wsKeepAlive) ping() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	frame := append([]byte{0x80 | wsOpPing, byte(len(wsPingPayload))}, wsPingPayload...)
+	_, err := k.user.Write(frame)
+	return err
+}
+
+// copyToUser copies the frames from the local server to the user.
+func (k *wsKeepAlive) copyToUser(backend *bufio.Reader) error {
+	for {
+		header, err := readWSFrameHeader(backend)
+		if err != nil {
+			return err
+		}
+		k.lastActive.Store(time.Now().UnixNano())
+		if err := k.writeFrame(header, backend); err != nil {
+			return err
+		}
+	}
+}
+
+func (k *wsKeepAlive) writeFrame(header *wsFrameHeader, payload io.Reader) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, err := k.user.Write(header.raw); err != nil {
+		return err
+	}
+	_, err := io.CopyN(k.user, payload, header.length)
+	return err
+}
+
+// copyFromUser copies the frames from the user to the local server, except the pongs of the pings.
+func (k *wsKeepAlive) copyFromUser(backend io.Writer, user *bufio.Reader) error {
+	for {
+		header, err := readWSFrameHeader(user)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UnixNano()
+		k.lastActive.Store(now)
+		k.lastUser.Store(now)
+		if header.opcode == wsOpPong && header.length == int64(len(wsPingPayload)) {
+			payload := make([]byte, header.length)
+			if _, err := io.ReadFull(user, payload); err != nil {
+				return err
+			}
+			unmasked := bytes.Clone(payload)
+			for i := range unmasked {
+				if header.mask != nil {
+					unmasked[i] ^= header.mask[i%4]
+				}
+			}
+			if bytes.Equal(unmasked, wsPingPayload) {
+				continue
+			}
+			if _, err := backend.Write(append(header.raw, payload...)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := backend.Write(header.raw); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(backend, user, header.length); err != nil {
+			return err
+		}
+	}
+}
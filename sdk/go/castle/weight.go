@@ -0,0 +1,91 @@
+package castle
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// upstreamAddrs returns the local address and the upstreams, followed by the addrs of the weights
+// which aren't among them, in the sorted order.
+func upstreamAddrs(localAddr string, upstreams []string, weights map[string]int) []string {
+	addrs := append([]string{localAddr}, upstreams...)
+	var extra []string
+	for addr := range weights {
+		if !slices.Contains(addrs, addr) {
+			extra = append(extra, addr)
+		}
+	}
+	slices.Sort(extra)
+	return append(addrs, extra...)
+}
+
+// upstreamWeights returns the weights of the addrs, the addrs without a weight are 1.
+func upstreamWeights(addrs []string, weights map[string]int) []int {
+	result := make([]int, len(addrs))
+	for i, addr := range addrs {
+		result[i] = 1
+		if weight, ok := weights[addr]; ok {
+			result[i] = weight
+		}
+	}
+	return result
+}
+
+// mergeWeights adds the weights to dst, the later weights of the same addr take precedence.
+func mergeWeights(dst, weights map[string]int) map[string]int {
+	if dst == nil {
+		dst = make(map[string]int, len(weights))
+	}
+	for addr, weight := range weights {
+		dst[addr] = weight
+	}
+	return dst
+}
+
+func validateWeights(weights map[string]int) error {
+	for addr, weight := range weights {
+		if err := validateLocalAddr(addr); err != nil {
+			return fmt.Errorf("invalid weighted upstream: %w", err)
+		}
+		if weight < 0 {
+			return fmt.Errorf("invalid weight %d of the upstream %s", weight, addr)
+		}
+	}
+	return nil
+}
+
+// weightedRoundRobin picks the upstreams in the smooth weighted round-robin of nginx,
+// e.g. the weights 5, 1 and 1 are picked as a, a, b, a, c, a, a instead of a burst of a.
+// The equal weights are the plain round-robin, and the upstreams of weight 0 are never picked.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	weights []int
+	current []int
+}
+
+func newWeightedRoundRobin(weights []int) *weightedRoundRobin {
+	return &weightedRoundRobin{weights: weights, current: make([]int, len(weights))}
+}
+
+// next returns the index of the next upstream among the eligible ones, -1 if there is none.
+func (w *weightedRoundRobin) next(eligible func(i int) bool) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	best, total := -1, 0
+	for i, weight := range w.weights {
+		if weight <= 0 || !eligible(i) {
+			continue
+		}
+		w.current[i] += weight
+		total += weight
+		if best < 0 || w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	if best >= 0 {
+		w.current[best] -= total
+	}
+	return best
+}
@@ -34,14 +34,17 @@ var httpCmd = &cobra.Command{
 		}
 
 		var options []castle.HTTPOption
+		// the conflicting flags are reported by tunnel.Validate.
 		if domain, _ := cmd.Flags().GetString("domain"); domain != "" {
-			println(domain)
 			options = append(options, castle.WithHTTPDomain(domain))
-		} else if subdomain, _ := cmd.Flags().GetString("subdomain"); subdomain != "" {
+		}
+		if subdomain, _ := cmd.Flags().GetString("subdomain"); subdomain != "" {
 			options = append(options, castle.WithHTTPSubDomain(subdomain))
-		} else if randomSubdomain, _ := cmd.Flags().GetBool("random-subdomain"); randomSubdomain {
+		}
+		if randomSubdomain, _ := cmd.Flags().GetBool("random-subdomain"); randomSubdomain {
 			options = append(options, castle.WithHTTPRandomSubdomain())
-		} else if remotePort, _ := cmd.Flags().GetUint16("remote-port"); remotePort != 0 {
+		}
+		if remotePort, _ := cmd.Flags().GetUint16("remote-port"); remotePort != 0 {
 			options = append(options, castle.WithHTTPPort(remotePort))
 		}
 
@@ -103,16 +106,7 @@ func getLocalAddr(fs *pflag.FlagSet, port int) string {
 }
 
 func run(ctx context.Context, serverAddr string, tunnel *castle.Tunnel) error {
-	client, err := castle.NewClient(serverAddr)
-	if err != nil {
-		return err
-	}
-	entrypoint, quit, err := client.StartTunnel(ctx, tunnel)
-	if err != nil {
-		return err
-	}
-	log.Printf("Entrypoint: %v", entrypoint)
-	return <-quit
+	return castle.Serve(ctx, serverAddr, []*castle.Tunnel{tunnel})
 }
 
 func init() {